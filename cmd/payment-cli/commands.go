@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/export"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// listAccounts writes wallets of holders to w. It returns exit code of the command.
+func listAccounts(ctx context.Context, client service.Service, args []string, format string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("accounts", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	holder := fs.String("holder", "", "list wallets of holder only")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	holders, err := client.Account(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitCode(err)
+	}
+	listed := make([]*repository.Holder, 0, len(holders))
+	t := &table{header: []string{"HOLDER", "ACCOUNT", "CURRENCY", "BALANCE", "CREDIT LIMIT", "AVAILABLE", "FREEZE"}}
+	for _, h := range holders {
+		if *holder != "" && h.ID != *holder {
+			continue
+		}
+		listed = append(listed, h)
+		for _, account := range h.Wallets {
+			t.append(h.ID, account.UserID, account.Currency,
+				export.FormatAmount(account.Balance, account.Currency),
+				export.FormatAmount(account.CreditLimit, account.Currency),
+				export.FormatAmount(account.Available(), account.Currency),
+				account.Freeze)
+		}
+	}
+	t.value = listed
+	return writeTable(t, format, w, stderr)
+}
+
+// showHistory writes transaction history matching flags of args to w. It
+// returns exit code of the command.
+func showHistory(ctx context.Context, client service.Service, args []string, format string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		account   = fs.String("account", "", "payer or payee account")
+		from      = fs.String("from", "", "start of date range (inclusive), YYYY-MM-DD or RFC 3339")
+		to        = fs.String("to", "", "end of date range (exclusive), YYYY-MM-DD or RFC 3339")
+		direction = fs.String("direction", "", "direction of transactions: outgoing, incoming and so on")
+		failed    = fs.Bool("failed", false, "show failed transactions only")
+		limit     = fs.Int("limit", 0, "show at most limit transactions, all if 0")
+	)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	filter := &repository.TransactionFilter{Account: *account}
+	var err error
+	if filter.From, err = export.ParseDate(*from); err != nil {
+		fmt.Fprintf(stderr, "invalid -from: %v\n", err)
+		return exitUsage
+	}
+	if filter.To, err = export.ParseDate(*to); err != nil {
+		fmt.Fprintf(stderr, "invalid -to: %v\n", err)
+		return exitUsage
+	}
+	if *limit < 0 {
+		fmt.Fprintf(stderr, "-limit must not be negative\n")
+		return exitUsage
+	}
+
+	cursor, err := client.ExportTransactions(ctx, filter)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitCode(err)
+	}
+	defer cursor.Close()
+	records := make([]export.Record, 0)
+	t := &table{header: []string{"ID", "DATE", "DIRECTION", "PAYER", "PAYEE", "AMOUNT", "FEE", "CURRENCY", "ERROR"}}
+	for *limit == 0 || len(records) < *limit {
+		txn, err := cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return exitCode(err)
+		}
+		if (*direction != "" && txn.Direction != *direction) || (*failed && txn.Error == "") {
+			continue
+		}
+		record := export.Record{
+			ID:        txn.TxnID,
+			Date:      txn.Date.UTC(),
+			Direction: txn.Direction,
+			Payer:     txn.Payer,
+			Payee:     txn.Payee,
+			Amount:    json.Number(export.FormatAmount(txn.Amount, txn.Currency)),
+			Fee:       json.Number(export.FormatAmount(txn.Fee, txn.Currency)),
+			Currency:  txn.Currency,
+			Error:     txn.Error,
+		}
+		records = append(records, record)
+		t.append(strconv.Itoa(record.ID), record.Date.Format(time.RFC3339), record.Direction, record.Payer,
+			record.Payee, record.Amount.String(), record.Fee.String(), record.Currency, record.Error)
+	}
+	t.value = records
+	return writeTable(t, format, w, stderr)
+}
+
+// transfer makes transfer described by flags of args and writes its history
+// record to w. It returns exit code of the command.
+func transfer(ctx context.Context, client service.Service, args []string, format string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("transfer", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		from     = fs.String("from", "", "payer account, required")
+		to       = fs.String("to", "", "payee account, required")
+		amount   = fs.Float64("amount", 0, "amount in currency of payer, required")
+		currency = fs.String("currency", "", "currency of payer's wallet to pay from")
+	)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *from == "" || *to == "" || *amount <= 0 {
+		fmt.Fprintf(stderr, "-from, -to and positive -amount are required\n")
+		return exitUsage
+	}
+
+	txn, err := client.Transfer(ctx, *from, *to, *amount, *currency)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitCode(err)
+	}
+	code := txn.Currency
+	if code == "" {
+		code = *currency
+	}
+	t := &table{header: []string{"DIRECTION", "PAYER", "PAYEE", "AMOUNT", "FEE"}, value: txn}
+	t.append(txn.Direction, txn.Payer, txn.Payee, export.FormatAmount(txn.Amount, code), export.FormatAmount(txn.Fee, code))
+	return writeTable(t, format, w, stderr)
+}
+
+// health writes health of payment system to w. It returns exit code of the
+// command, which is exitUnavailable if payment system is not healthy.
+func health(ctx context.Context, client service.Service, args []string, format string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	healthy, err := client.HealthCheck(ctx)
+	status := "ok"
+	if err != nil || !healthy {
+		status = "unavailable"
+	}
+	result := struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}{Status: status}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	t := &table{header: []string{"STATUS", "ERROR"}, value: result}
+	t.append(result.Status, result.Error)
+	if code := writeTable(t, format, w, stderr); code != exitOK {
+		return code
+	}
+	if err != nil {
+		return exitCode(err)
+	}
+	if !healthy {
+		return exitUnavailable
+	}
+	return exitOK
+}
+
+func writeTable(t *table, format string, w, stderr io.Writer) int {
+	if err := t.write(w, format); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// Exit codes of commands, scripts may tell failures apart by them.
+const (
+	exitOK = 0
+	// exitError is any other error, internal errors of payment system included
+	exitError = 1
+	// exitUsage is an error of command line or profile
+	exitUsage = 2
+	// exitInvalid is a request rejected as invalid: bad argument, insufficient funds and so on
+	exitInvalid = 3
+	// exitNotFound is a request of missing account or payment
+	exitNotFound = 4
+	// exitDenied is a request which principal may not make: limits, frozen accounts
+	exitDenied = 5
+	// exitConflict is a request conflicting with state of account
+	exitConflict = 6
+	// exitUnavailable is a failure which may pass if retried later, including
+	// unreachable and unhealthy payment system
+	exitUnavailable = 7
+)
+
+// exitCode returns exit code of command failed with err. Domain errors are
+// mapped by their status, errors which are not domain ones are transport
+// failures then.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var e *errs.Error
+	if !errors.As(err, &e) {
+		return exitUnavailable
+	}
+	switch {
+	case e.Retryable || e.Status == http.StatusServiceUnavailable:
+		return exitUnavailable
+	case e.Status == http.StatusNotFound:
+		return exitNotFound
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden || e.Status == http.StatusLocked:
+		return exitDenied
+	case e.Status == http.StatusConflict:
+		return exitConflict
+	case e.Status >= 400 && e.Status < 500:
+		return exitInvalid
+	}
+	return exitError
+}
@@ -0,0 +1,119 @@
+// Command payment-cli is a command line client of HTTP API of payment system.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/service"
+	"github.com/khaliullov/payment-system/pkg/transport"
+)
+
+// command runs subcommand with its args against client.
+type command func(ctx context.Context, client service.Service, args []string, format string, w, stderr io.Writer) int
+
+var commands = map[string]command{
+	"accounts": listAccounts,
+	"history":  showHistory,
+	"transfer": transfer,
+	"health":   health,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
+
+// run runs command line args and returns exit code.
+func run(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("payment-cli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		file      = fs.String("config", getenv("PAYMENT_CLI_CONFIG"), "profiles file, ~/.payment-cli.yml if empty (PAYMENT_CLI_CONFIG)")
+		name      = fs.String("profile", getenv("PAYMENT_CLI_PROFILE"), "profile of environment, \"default\" if empty (PAYMENT_CLI_PROFILE)")
+		url       = fs.String("url", "", "address of HTTP API, overrides profile")
+		principal = fs.String("principal", "", "principal of requests, overrides profile")
+		format    = fs.String("o", FormatTable, "output format: table or json")
+	)
+	fs.Usage = usageFor(fs, stderr, "payment-cli [flags] accounts [-holder id] | history [history flags] | transfer -from id -to id -amount n [-currency code] | health")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return exitUsage
+	}
+	if *format != FormatTable && *format != FormatJSON {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *format)
+		return exitUsage
+	}
+
+	defaultFile := *file == ""
+	if defaultFile {
+		*file = defaultProfilesFile()
+	}
+	if *name == "" {
+		*name = DefaultProfile
+	}
+	profile, err := loadProfile(*file, *name, defaultFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitUsage
+	}
+	if *url != "" {
+		profile.URL = *url
+	}
+	if *principal != "" {
+		profile.Principal = *principal
+	}
+	client, err := newClient(profile)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), profile.Timeout)
+	defer cancel()
+	if profile.Principal != "" {
+		ctx = service.ContextWithPrincipal(ctx, profile.Principal)
+	}
+	return cmd(ctx, client, fs.Args()[1:], *format, stdout, stderr)
+}
+
+// newClient returns client of HTTP API of profile.
+func newClient(profile *Profile) (service.Service, error) {
+	var opts []transport.ClientOption
+	if profile.TLS() {
+		tlsConfig, err := transport.ClientTLSConfig(profile.TLSCert, profile.TLSKey, profile.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, transport.WithTLS(tlsConfig))
+	}
+	if profile.Retries > 0 {
+		opts = append(opts, transport.WithRetry(profile.Retries, 100*time.Millisecond))
+	}
+	return transport.NewHTTPClient(profile.URL, log.NewNopLogger(), opts...)
+}
+
+func usageFor(fs *flag.FlagSet, w io.Writer, short string) func() {
+	return func() {
+		fmt.Fprintf(w, "USAGE\n")
+		fmt.Fprintf(w, "  %s\n", short)
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "FLAGS\n")
+		tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(tw, "\t-%s %s\t%s\n", f.Name, f.DefValue, f.Usage)
+		})
+		tw.Flush()
+		fmt.Fprintf(w, "\n")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+	"github.com/khaliullov/payment-system/pkg/transport"
+)
+
+func TestRun(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Holder: "alice", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Holder: "bob", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	readiness := &service.Readiness{}
+	endpoints := endpoint.New(service.ReadinessMiddleware(readiness)(svc), endpoint.Limits{}, logger)
+	server := httptest.NewServer(transport.NewHTTPHandler(endpoints, nil, logger))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "payment-cli-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString("# profiles\ntest:\n  url: " + server.URL + "\n  principal: alice\n  retries: 1\n")
+	file.Close()
+	env := map[string]string{"PAYMENT_CLI_CONFIG": file.Name(), "PAYMENT_CLI_PROFILE": "test"}
+	getenv := func(key string) string { return env[key] }
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(args, getenv, &stdout, &stderr)
+		return code, stdout.String() + stderr.String()
+	}
+
+	// test commands succeed against profile
+	if code, out := run("transfer", "-from", "alice456", "-to", "bob123", "-amount", "30"); code != exitOK ||
+		!strings.Contains(out, "30.00") {
+		t.Errorf("Transfer should succeed, got %d %s", code, out)
+	}
+	code, out := run("-o", "json", "accounts", "-holder", "bob")
+	var holders []*repository.Holder
+	if err = json.Unmarshal([]byte(out), &holders); code != exitOK || err != nil || len(holders) != 1 ||
+		holders[0].Wallets[0].Balance != 130 {
+		t.Errorf("Accounts of bob should be listed, got %d %s", code, out)
+	}
+	if code, out = run("history", "-account", "alice456", "-direction", "outgoing"); code != exitOK ||
+		strings.Count(out, "\n") != 2 || !strings.Contains(out, "alice456  bob123") {
+		t.Errorf("Outgoing transfer should be listed, got %d %s", code, out)
+	}
+	if code, out = run("-o", "json", "health"); code != exitOK || !strings.Contains(out, `"status": "ok"`) {
+		t.Errorf("Health should be ok, got %d %s", code, out)
+	}
+
+	// test domain errors are mapped to exit codes
+	_ = svc.Freeze(service.ContextWithPrincipal(context.Background(), "ops"), "bob123", repository.FreezeDebit, "SANCTIONS", "")
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"transfer", "-from", "alice456", "-to", "bob123", "-amount", "1000"}, exitInvalid},
+		{[]string{"transfer", "-from", "bob123", "-to", "alice456", "-amount", "1"}, exitDenied},
+		{[]string{"transfer", "-from", "alice456"}, exitUsage},
+		{[]string{"history", "-from", "yesterday"}, exitUsage},
+		{[]string{"-profile", "production", "health"}, exitUsage},
+		{[]string{"-url", "127.0.0.1:1", "health"}, exitUnavailable},
+		{[]string{"-o", "xml", "health"}, exitUsage},
+		{[]string{"pay"}, exitUsage},
+	} {
+		if code, out = run(c.args...); code != c.code {
+			t.Errorf("%v should exit with %d, got %d %s", c.args, c.code, code, out)
+		}
+	}
+
+	// test draining server is reported unhealthy
+	readiness.Drain()
+	if code, out = run("health"); code != exitUnavailable || !strings.Contains(out, "unavailable") {
+		t.Errorf("Health should be unavailable, got %d %s", code, out)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for err, code := range map[error]int{
+		nil:                           exitOK,
+		repository.ErrAccountNotFound: exitNotFound,
+		service.ErrLimitExceeded:      exitDenied,
+		repository.ErrAccountExists:   exitConflict,
+		repository.ErrVersionConflict: exitUnavailable,
+		service.ErrTransactionFailed:  exitUnavailable,
+		service.ErrFeeMisconfigured:   exitError,
+	} {
+		if actual := exitCode(err); actual != code {
+			t.Errorf("Exit code of %v should be %d, got %d", err, code, actual)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// table is an output of command, which is written as aligned columns or as
+// JSON of its value.
+type table struct {
+	header []string
+	rows   [][]string
+	// value is written instead of rows in JSON format
+	value interface{}
+}
+
+func (t *table) append(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+// write writes table to w in format.
+func (t *table) write(w io.Writer, format string) error {
+	if format == FormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(t.value)
+	}
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+	for _, row := range t.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/config"
+)
+
+// DefaultProfile is a profile used unless another one is selected.
+const DefaultProfile = "default"
+
+// Profile is a set of connection settings of one environment of payment system.
+type Profile struct {
+	Name string
+	// URL is an address of HTTP API, "host:port" or URL with scheme
+	URL string
+	// Principal is sent as X-Principal header of requests
+	Principal string
+	// TLSCert and TLSKey are client certificate and key for mutual TLS
+	TLSCert string
+	TLSKey  string
+	// TLSCA is a CA bundle trusted instead of system roots
+	TLSCA string
+	// Retries is a number of retries of failed requests, transfers are retried
+	// only if rejected without processing
+	Retries int
+	// Timeout limits duration of command
+	Timeout time.Duration
+}
+
+// TLS reports whether profile connects with TLS settings of its own.
+func (p *Profile) TLS() bool {
+	return p.TLSCert != "" || p.TLSKey != "" || p.TLSCA != ""
+}
+
+// defaultProfilesFile returns path of profiles file in home directory, empty if it is unknown.
+func defaultProfilesFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".payment-cli.yml")
+}
+
+// loadProfile returns profile of name read from file, which has a section of
+// settings per profile in format of config file of payment-system:
+//
+//	staging:
+//	  url: https://payments.staging.example.com
+//	  principal: ops
+//	  tls_ca: /etc/payment-cli/staging-ca.pem
+//
+// Default profile connects to localhost:8080 if it is not in file or file of
+// default location is missing.
+func loadProfile(file, name string, defaultFile bool) (*Profile, error) {
+	profile := &Profile{Name: name, URL: "localhost:8080", Timeout: 30 * time.Second}
+	values := make(map[string]string)
+	if file != "" {
+		f, err := os.Open(file)
+		switch {
+		case err == nil:
+			values, err = config.Parse(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+		case !(os.IsNotExist(err) && defaultFile):
+			return nil, err
+		}
+	}
+
+	found := false
+	unknown := make([]string, 0)
+	for key, v := range values {
+		if !strings.HasPrefix(key, name+".") {
+			continue
+		}
+		found = true
+		var err error
+		switch setting := strings.TrimPrefix(key, name+"."); setting {
+		case "url":
+			profile.URL = v
+		case "principal":
+			profile.Principal = v
+		case "tls_cert":
+			profile.TLSCert = v
+		case "tls_key":
+			profile.TLSKey = v
+		case "tls_ca":
+			profile.TLSCA = v
+		case "retries":
+			profile.Retries, err = strconv.Atoi(v)
+		case "timeout":
+			profile.Timeout, err = time.ParseDuration(v)
+		default:
+			unknown = append(unknown, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", file, key, err)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown settings: %s", file, strings.Join(unknown, ", "))
+	}
+	if !found && name != DefaultProfile {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	if profile.Retries < 0 || profile.Timeout <= 0 {
+		return nil, fmt.Errorf("profile %q: retries must not be negative and timeout must be positive", name)
+	}
+	return profile, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// auditPageSize is a number of audit log records fetched at once by auditVerify.
+const auditPageSize = 1000
+
+// auditVerify walks through the whole audit log and checks its hash chain.
+// It reports the first broken record and returns exit code of the command.
+func auditVerify(repo repository.Repository, w io.Writer) int {
+	var (
+		lastID   int64
+		lastHash string
+		total    int
+	)
+	for {
+		records, err := repo.GetAuditLog(lastID, auditPageSize)
+		if err != nil {
+			fmt.Fprintf(w, "audit log read failed: %v\n", err)
+			return 2
+		}
+		for _, record := range records {
+			if !record.Valid(lastHash) {
+				fmt.Fprintf(w, "audit log broken at record %d (after record %d)\n", record.ID, lastID)
+				return 1
+			}
+			lastID, lastHash = record.ID, record.Hash
+			total++
+		}
+		if len(records) < auditPageSize {
+			break
+		}
+	}
+	fmt.Fprintf(w, "audit log OK: %d records verified\n", total)
+	return 0
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/khaliullov/payment-system/pkg/config"
+)
+
+// configCheck validates configuration and prints it with secrets masked.
+// It returns exit status.
+func configCheck(cfg *config.Config, command string, stdout, stderr io.Writer) int {
+	if command != "check" {
+		fmt.Fprintf(stderr, "unknown config command %q, expected: config check\n", command)
+		return 1
+	}
+	if err := cfg.Print(stdout); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "configuration is valid\n")
+	return 0
+}
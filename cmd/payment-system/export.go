@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/khaliullov/payment-system/pkg/export"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// exportTransactions streams transaction history matching flags of args to w.
+// It returns exit code of the command.
+func exportTransactions(repo repository.Repository, args []string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		format  = fs.String("format", export.FormatCSV, "export format: csv, jsonl or ofx")
+		account = fs.String("account", "", "payer or payee account, required for ofx")
+		from    = fs.String("from", "", "start of date range (inclusive), YYYY-MM-DD or RFC 3339")
+		to      = fs.String("to", "", "end of date range (exclusive), YYYY-MM-DD or RFC 3339")
+		output  = fs.String("o", "", "output file, standard output if empty")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	filter := &repository.TransactionFilter{Account: *account}
+	var err error
+	if filter.From, err = export.ParseDate(*from); err != nil {
+		fmt.Fprintf(stderr, "-from: %v\n", err)
+		return 1
+	}
+	if filter.To, err = export.ParseDate(*to); err != nil {
+		fmt.Fprintf(stderr, "-to: %v\n", err)
+		return 1
+	}
+	if err = export.Validate(*format, filter); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	svc := service.NewPaymentService(repo)
+	cursor, err := svc.ExportTransactions(context.Background(), filter)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	defer cursor.Close()
+	writer, _ := export.NewWriter(*format, w, filter)
+	n, err := export.Copy(writer, cursor)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "%d transactions exported\n", n)
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/importer"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// importAccounts imports accounts with opening balances from file of args (standard
+// input if it is "-" or missing) and writes per-row report as CSV to w. Import is
+// recorded into audit log on behalf of -actor. It returns exit code of the command.
+func importAccounts(repo repository.Repository, logger log.Logger, args []string, stdin io.Reader, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		format = fs.String("format", "", "import format: csv or jsonl, taken from file extension if empty")
+		chunk  = fs.Int("chunk", 0, "number of rows committed at once, all rows are committed together if 0")
+		resume = fs.String("resume", "", "resume token reported by interrupted chunked import")
+		actor  = fs.String("actor", os.Getenv("USER"), "operator recorded into audit log")
+		output = fs.String("o", "", "report file, standard output if empty")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	name := fs.Arg(0)
+	if *format == "" {
+		*format = importer.FormatCSV
+		if strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".ndjson") {
+			*format = importer.FormatJSONL
+		}
+	}
+	r := stdin
+	if name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	rows, err := importer.Read(*format, r)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	svc := service.AuditMiddleware(repo, logger)(service.NewPaymentService(repo))
+	ctx := service.ContextWithPrincipal(context.Background(), *actor)
+	report, err := svc.ImportAccounts(ctx, rows, &repository.ImportOptions{ChunkSize: *chunk, Resume: *resume})
+	if report == nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if reportErr := importer.WriteReport(w, report); reportErr != nil {
+		fmt.Fprintf(stderr, "%v\n", reportErr)
+		return 1
+	}
+	fmt.Fprintf(stderr, "%d of %d accounts imported, %d failed, %d skipped\n", report.Created, report.Total,
+		report.Failed, report.Skipped)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		if report.Resume != "" {
+			fmt.Fprintf(stderr, "continue with: import -resume %s\n", report.Resume)
+		}
+		return 1
+	}
+	return 0
+}
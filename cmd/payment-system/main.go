@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -9,39 +11,55 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	_ "github.com/lib/pq"
 	"github.com/oklog/oklog/pkg/group"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/config"
 	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/eventsource"
+	"github.com/khaliullov/payment-system/pkg/outbox"
+	"github.com/khaliullov/payment-system/pkg/payout"
+	"github.com/khaliullov/payment-system/pkg/reconcile"
 	"github.com/khaliullov/payment-system/pkg/repository"
 	"github.com/khaliullov/payment-system/pkg/service"
+	"github.com/khaliullov/payment-system/pkg/tracing"
 	"github.com/khaliullov/payment-system/pkg/transport"
 )
 
 func main() {
 	fs := flag.NewFlagSet("payment-system", flag.ExitOnError)
-	var (
-		httpAddr   = fs.String("http-addr", ":"+strconv.Itoa(envInt("HTTP_PORT", 8000)), "HTTP listen address")
-		dbHost     = fs.String("db-host", envString("DB_HOST", "localhost"), "postgresql host")
-		dbPort     = fs.Int("db-port", envInt("DB_PORT", 5432), "postgresql port")
-		dbName     = fs.String("db-name", envString("DB_NAME", "psdb"), "postgresql database name")
-		dbUser     = fs.String("db-user", envString("DB_USER", "postgres"), "postgresql user")
-		dbPassword = fs.String("db-password", envString("DB_PASSWORD", "postgres"), "postgresql password")
-	)
-	fs.Usage = usageFor(fs, os.Args[0]+" [flags]")
+	cfg := config.New()
+	cfg.RegisterFlags(fs)
+	fs.Usage = usageFor(fs, os.Args[0]+" [flags] [audit-verify | config check | export [export flags] | import [import flags] [file] | rebuild [rebuild flags] | reconcile [reconcile flags]]")
 	_ = fs.Parse(os.Args[1:])
+	if err := cfg.Load(os.Getenv); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if fs.Arg(0) == "config" {
+		os.Exit(configCheck(cfg, fs.Arg(1), os.Stdout, os.Stderr))
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
 	// Logging domain.
 	var logger log.Logger
 	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = level.NewFilter(logger, level.AllowDebug())
+		if cfg.Log.Format == config.LogFormatJSON {
+			logger = log.NewJSONLogger(os.Stderr)
+		} else {
+			logger = log.NewLogfmtLogger(os.Stderr)
+		}
+		logger = level.NewFilter(logger, logLevel(cfg.Log.Level))
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
@@ -54,18 +72,14 @@ func main() {
 	{
 		var err error
 		// Connect to the "payment-system" database
-		DSN := &url.URL{
-			Scheme:   "postgresql",
-			RawQuery: "sslmode=disable",
-			Host:     *dbHost + ":" + strconv.Itoa(*dbPort),
-			Path:     *dbName,
-			User:     url.UserPassword(*dbUser, *dbPassword),
-		}
-		db, err = sql.Open("postgres", DSN.String())
+		db, err = sql.Open("postgres", cfg.DB.DSN())
 		if err != nil {
 			_ = level.Error(logger).Log("db", err)
 			os.Exit(1)
 		}
+		db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+		db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+		db.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
 	}
 	// Build the layers of the service "onion" from the inside out. First, the
 	// business logic service; then, the set of endpoints that wrap the service;
@@ -73,11 +87,67 @@ func main() {
 	// the HTTP handler or the gRPC server, are the bridge between Go kit and
 	// the interfaces that the transports expect. Note that we're not binding
 	// them to ports or anything yet; we'll do that next.
+	replicas := openReplicas(cfg.DB, logger)
+	broker := activity.NewBroker()
+	sharded, shardDBs := openShards(cfg.DB, db, replicas, broker, logger)
+	repository := repository.New(db, replicas, broker, logger)
+	if sharded != nil {
+		repository = sharded
+	}
+	var eventSourced *eventsource.Repository
+	if cfg.Events.Sourcing {
+		// Changes of accounts are appended as events, tables are their projections.
+		eventSourced = openEventSourced(repository, cfg.Events, logger)
+		repository = eventSourced
+	}
+	loadCurrencies(repository, logger)
+
+	// Maintenance commands run against the database and exit.
+	switch fs.Arg(0) {
+	case "":
+	case "audit-verify":
+		os.Exit(auditVerify(repository, os.Stdout))
+	case "export":
+		os.Exit(exportTransactions(repository, fs.Args()[1:], os.Stdout, os.Stderr))
+	case "import":
+		os.Exit(importAccounts(repository, logger, fs.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "rebuild":
+		os.Exit(rebuildProjections(eventSourced, fs.Args()[1:], os.Stdout, os.Stderr))
+	case "reconcile":
+		os.Exit(reconcileAccounts(repository, logger, fs.Args()[1:], os.Stdout, os.Stderr))
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var tracer *tracing.Tracer
+	if cfg.Trace.Exporter != "" {
+		exporter, err := tracing.NewExporter(cfg.Trace.Exporter, os.Stdout, "payment-system", logger)
+		if err != nil {
+			_ = level.Error(logger).Log("tracing", err)
+			os.Exit(1)
+		}
+		tracer = tracing.NewTracer("payment-system", exporter)
+		defer tracer.Close()
+	}
+
+	limits := endpoint.Limits{
+		PrincipalRate:          cfg.Rate.Principal,
+		IPRate:                 cfg.Rate.IP,
+		Burst:                  cfg.Rate.Burst,
+		MaxConcurrentTransfers: cfg.Rate.MaxConcurrentTransfers,
+	}
+	trustedProxies, _ := cfg.HTTP.TrustedProxyNets() // checked by Validate
+	handlerOptions := []transport.HandlerOption{transport.WithTrustedProxies(trustedProxies)}
+	if cfg.TLS.ClientCA != "" {
+		// principal of mutual TLS comes from client certificate only
+		handlerOptions = append(handlerOptions, transport.WithClientAuth())
+	}
+	readiness := &service.Readiness{}
 	var (
-		repository  = repository.New(db, logger)
-		service     = service.New(repository, logger)
-		endpoints   = endpoint.New(service, logger)
-		httpHandler = transport.NewHTTPHandler(endpoints, logger)
+		service     = service.ReadinessMiddleware(readiness)(service.New(repository, logger))
+		endpoints   = endpoint.New(service, limits, logger, cfg.HTTP.AdminPrincipals()...)
+		httpHandler = transport.NewHTTPHandler(endpoints, tracer, logger, handlerOptions...)
 	)
 
 	// Now we're to the part of the func main where we want to start actually
@@ -93,18 +163,185 @@ func main() {
 	// Putting each component into its own block is mostly for aesthetics: it
 	// clearly demarcates the scope in which each listener/socket may be used.
 	var g group.Group
+	var serverTLS *transport.ServerTLS
 	{
 		// The HTTP listener mounts the Go kit HTTP handler we created.
-		httpListener, err := net.Listen("tcp", *httpAddr)
+		httpServer := &http.Server{
+			Handler:      httpHandler,
+			ReadTimeout:  cfg.HTTP.ReadTimeout,
+			WriteTimeout: cfg.HTTP.WriteTimeout,
+			IdleTimeout:  cfg.HTTP.IdleTimeout,
+		}
+		httpListener, err := net.Listen("tcp", cfg.HTTP.Addr)
 		if err != nil {
 			_ = level.Error(logger).Log("transport", "HTTP", "during", "Listen", "err", err)
 			os.Exit(1)
 		}
+		if cfg.TLS.Enabled() {
+			serverTLS, err = transport.NewServerTLS(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA, cfg.TLS.ClientAuth == "require")
+			if err != nil {
+				_ = level.Error(logger).Log("transport", "HTTPS", "during", "LoadCertificate", "err", err)
+				os.Exit(1)
+			}
+			httpListener = tls.NewListener(httpListener, serverTLS.Config())
+		}
+		drained := make(chan struct{})
+		g.Add(func() error {
+			_ = level.Info(logger).Log("transport", "HTTP", "addr", cfg.HTTP.Addr, "tls", cfg.TLS.Enabled())
+			err := httpServer.Serve(httpListener)
+			if err == http.ErrServerClosed {
+				// Serve returns at once, wait for in-flight requests
+				<-drained
+			}
+			return err
+		}, func(error) {
+			defer close(drained)
+			// Fail health check first, so load balancer stops sending new
+			// requests, then stop accepting them and wait for in-flight ones.
+			readiness.Drain()
+			_ = level.Info(logger).Log("transport", "HTTP", "msg", "draining", "delay", cfg.HTTP.DrainDelay)
+			time.Sleep(cfg.HTTP.DrainDelay)
+			// activity streams are not waited for, they are closed, so clients
+			// reconnect to other instances
+			broker.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+			defer cancel()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				_ = level.Error(logger).Log("transport", "HTTP", "during", "Shutdown", "err", err)
+				httpServer.Close()
+			}
+		})
+	}
+	if cfg.HTTP.MetricsAddr != "" {
+		// Metrics are served by internal listener, as they expose command line.
+		metricsServer := &http.Server{
+			Handler:      transport.NewMetricsHandler(),
+			ReadTimeout:  cfg.HTTP.ReadTimeout,
+			WriteTimeout: cfg.HTTP.WriteTimeout,
+		}
+		metricsListener, err := net.Listen("tcp", cfg.HTTP.MetricsAddr)
+		if err != nil {
+			_ = level.Error(logger).Log("transport", "metrics", "during", "Listen", "err", err)
+			os.Exit(1)
+		}
+		g.Add(func() error {
+			_ = level.Info(logger).Log("transport", "metrics", "addr", cfg.HTTP.MetricsAddr)
+			return metricsServer.Serve(metricsListener)
+		}, func(error) {
+			metricsServer.Close()
+		})
+	}
+	{
+		// Certificates and currencies are reloaded on SIGHUP, so they are changed without restart.
+		cancelReload := make(chan struct{})
+		g.Add(func() error {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGHUP)
+			defer signal.Stop(c)
+			for {
+				select {
+				case <-c:
+					loadCurrencies(repository, logger)
+					if serverTLS == nil {
+						continue
+					}
+					if err := serverTLS.Reload(); err != nil {
+						_ = level.Error(logger).Log("transport", "HTTPS", "during", "Reload", "err", err)
+					} else {
+						_ = level.Info(logger).Log("transport", "HTTPS", "msg", "certificates reloaded")
+					}
+				case <-cancelReload:
+					return nil
+				}
+			}
+		}, func(error) {
+			close(cancelReload)
+		})
+	}
+	{
+		// Balance changes and payments are notified by database, so activity
+		// streams of every instance get events of all of them.
+		for _, dsn := range append([]string{cfg.DB.DSN()}, cfg.DB.ShardDSNs()...) {
+			listener := activity.NewListener(dsn, broker, logger)
+			g.Add(listener.Run, func(error) {
+				listener.Close()
+			})
+		}
+	}
+	if sharded != nil {
+		// Sagas left pending by crashed instances are driven forward or compensated.
+		cancelRecovery := make(chan struct{})
+		g.Add(func() error {
+			_ = level.Info(logger).Log("shards", len(shardDBs)+1, "saga_recovery", cfg.DB.SagaRecoveryInterval)
+			sharded.RunRecovery(cfg.DB.SagaRecoveryInterval, cfg.DB.SagaTimeout, cancelRecovery)
+			return nil
+		}, func(error) {
+			close(cancelRecovery)
+		})
+	}
+	if cfg.Outbox.Enabled() {
+		// Events committed to outbox along with balances are published by relay.
+		publisher, err := outbox.NewPublisher(cfg.Outbox.Publisher, cfg.Outbox.Target, cfg.Outbox.Topic)
+		if err != nil {
+			_ = level.Error(logger).Log("outbox", err)
+			os.Exit(1)
+		}
+		relay := outbox.NewRelay(cfg.Outbox.Relay, repository, publisher, logger)
 		g.Add(func() error {
-			_ = level.Info(logger).Log("transport", "HTTP", "addr", *httpAddr)
-			return http.Serve(httpListener, httpHandler)
+			defer publisher.Close()
+			_ = level.Info(logger).Log("outbox", cfg.Outbox.Publisher, "relay", cfg.Outbox.Relay, "interval", cfg.Outbox.Interval)
+			return relay.Run(cfg.Outbox.Interval)
 		}, func(error) {
-			httpListener.Close()
+			relay.Close()
+		})
+	}
+	if cfg.Payout.Enabled() {
+		// Payouts booked by service are sent to bank and settled or refunded.
+		connector, err := payout.NewConnector(cfg.Payout.Connector)
+		if err != nil {
+			_ = level.Error(logger).Log("payout", err)
+			os.Exit(1)
+		}
+		processor := payout.NewProcessor(repository, connector, cfg.Payout.Interval, cfg.Payout.MaxAttempts, logger)
+		g.Add(func() error {
+			_ = level.Info(logger).Log("payout", cfg.Payout.Connector, "interval", cfg.Payout.Interval)
+			return processor.Run()
+		}, func(error) {
+			processor.Close()
+		})
+	}
+	if replicas != nil {
+		// Replicas lagging behind primary are not used until they catch up.
+		cancelReplicas := make(chan struct{})
+		g.Add(func() error {
+			replicas.Run(cfg.DB.ReplicaCheckInterval, cancelReplicas)
+			return nil
+		}, func(error) {
+			close(cancelReplicas)
+		})
+	}
+	reconciler := reconcile.New(repository, reconcile.NewExpvarMetrics(), logger)
+	if cfg.Reconcile.Enabled() {
+		// Accounts are reconciled daily, outcome is logged and published as metrics.
+		cancelReconcile := make(chan struct{})
+		g.Add(func() error {
+			_ = level.Info(logger).Log("reconcile", "daily", "at", cfg.Reconcile.At, "snapshot", cfg.Reconcile.Snapshot)
+			reconciler.Schedule(cfg.Reconcile.TimeOfDay(), cfg.Reconcile.Snapshot, cancelReconcile)
+			return nil
+		}, func(error) {
+			close(cancelReconcile)
+		})
+	}
+	if cfg.Snapshot.Interval > 0 {
+		// Balances are saved periodically, so point-in-time balances are computed
+		// from the latest snapshot instead of the whole payment history.
+		cancelSnapshot := make(chan struct{})
+		g.Add(func() error {
+			_ = level.Info(logger).Log("snapshot", "periodic", "interval", cfg.Snapshot.Interval)
+			reconciler.ScheduleSnapshots(cfg.Snapshot.Interval, cancelSnapshot)
+			return nil
+		}, func(error) {
+			close(cancelSnapshot)
 		})
 	}
 	{
@@ -125,6 +362,97 @@ func main() {
 	}
 	// Run!
 	_ = level.Error(logger).Log("exit", g.Run())
+
+	// All requests are completed, so database connections may be released.
+	if err := db.Close(); err != nil {
+		_ = level.Error(logger).Log("db", err)
+	}
+	if replicas != nil {
+		if err := replicas.Close(); err != nil {
+			_ = level.Error(logger).Log("replicas", err)
+		}
+	}
+	for _, shardDB := range shardDBs {
+		if err := shardDB.Close(); err != nil {
+			_ = level.Error(logger).Log("shards", err)
+		}
+	}
+}
+
+// openShards returns repository spreading accounts over database and its shards
+// along with connections of shards, nil if there are no shards. Replicas serve
+// the first shard only.
+func openShards(cfg config.DBConfig, db *sql.DB, replicas *repository.ReplicaPool, broker *activity.Broker,
+	logger log.Logger) (*repository.ShardedRepository, []*sql.DB) {
+	dsns := cfg.ShardDSNs()
+	if len(dsns) == 0 {
+		return nil, nil
+	}
+	shards := []repository.Shard{repository.NewShard(db, replicas, broker, logger)}
+	dbs := make([]*sql.DB, 0, len(dsns))
+	for _, dsn := range dsns {
+		shardDB, err := sql.Open("postgres", dsn)
+		if err != nil {
+			_ = level.Error(logger).Log("shards", err)
+			os.Exit(1)
+		}
+		shardDB.SetMaxOpenConns(cfg.MaxOpenConns)
+		shardDB.SetMaxIdleConns(cfg.MaxIdleConns)
+		shardDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+		shards = append(shards, repository.NewShard(shardDB, nil, broker, logger))
+		dbs = append(dbs, shardDB)
+	}
+	return repository.NewSharded(shards, logger), dbs
+}
+
+// openEventSourced returns event-sourced repository keeping events in repo.
+func openEventSourced(repo repository.Repository, cfg config.EventsConfig, logger log.Logger) *eventsource.Repository {
+	store, ok := repo.(repository.EventRepository)
+	if !ok {
+		_ = level.Error(logger).Log("events", "repository does not keep events")
+		os.Exit(1)
+	}
+	return eventsource.New(store, cfg.SnapshotEvery, logger)
+}
+
+// openReplicas returns pool of replicas of database with checked lag, nil if
+// there are none.
+func openReplicas(cfg config.DBConfig, logger log.Logger) *repository.ReplicaPool {
+	dsns := cfg.ReplicaDSNs()
+	if len(dsns) == 0 {
+		return nil
+	}
+	replicas := repository.NewReplicaPool(cfg.ReplicaMaxLag, logger)
+	for i, dsn := range dsns {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			_ = level.Error(logger).Log("replicas", err)
+			os.Exit(1)
+		}
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+		name := fmt.Sprintf("replica%d", i+1)
+		if u, err := url.Parse(dsn); err == nil {
+			name = u.Host // DSN itself carries password
+		}
+		replicas.Add(name, db)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ReplicaCheckInterval)
+	defer cancel()
+	replicas.Check(ctx)
+	return replicas
+}
+
+// loadCurrencies loads overrides of ISO 4217 currencies from database, ISO 4217
+// currencies (or previously loaded ones) are used if it fails.
+func loadCurrencies(repo repository.Repository, logger log.Logger) {
+	registry, err := service.LoadCurrencies(repo)
+	if err != nil {
+		_ = level.Warn(logger).Log("currencies", "ISO 4217", "during", "LoadCurrencies", "err", err)
+		return
+	}
+	_ = level.Info(logger).Log("currencies", len(registry.Currencies()), "msg", "currencies loaded")
 }
 
 func usageFor(fs *flag.FlagSet, short string) func() {
@@ -142,22 +470,14 @@ func usageFor(fs *flag.FlagSet, short string) func() {
 	}
 }
 
-func envString(env, fallback string) string {
-	e := os.Getenv(env)
-	if e == "" {
-		return fallback
-	}
-	return e
-}
-
-func envInt(env string, fallback int) int {
-	e := os.Getenv(env)
-	if e == "" {
-		return fallback
-	}
-	v, err := strconv.Atoi(e)
-	if err != nil {
-		return fallback
+func logLevel(name string) level.Option {
+	switch name {
+	case "info":
+		return level.AllowInfo()
+	case "warn":
+		return level.AllowWarn()
+	case "error":
+		return level.AllowError()
 	}
-	return v
+	return level.AllowDebug()
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/khaliullov/payment-system/pkg/eventsource"
+)
+
+// rebuildProjections rebuilds account table and payment history from events of
+// accounts, it returns exit code of command.
+func rebuildProjections(repo *eventsource.Repository, args []string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	pageSize := fs.Int("page-size", eventsource.DefaultPageSize, "events read at once")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if repo == nil {
+		fmt.Fprintf(stderr, "event sourcing is disabled, see -event-sourcing\n")
+		return 2
+	}
+	if *pageSize <= 0 {
+		fmt.Fprintf(stderr, "page size must be positive\n")
+		return 2
+	}
+	report, err := repo.Rebuild(context.Background(), *pageSize)
+	if err != nil {
+		fmt.Fprintf(stderr, "rebuild failed after %d events: %v\n", report.Events, err)
+		return 1
+	}
+	fmt.Fprintf(w, "projections rebuilt: %d events replayed, %d accounts and %d history records written\n",
+		report.Events, report.Accounts, report.Records)
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/reconcile"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// reconcileAccounts reconciles accounts once and writes report to w. It returns
+// exit code of the command: 1 if discrepancies are found, 2 if reconciliation failed.
+func reconcileAccounts(repo repository.Repository, logger log.Logger, args []string, w, stderr io.Writer) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		snapshot = fs.Bool("snapshot", false, "save balances as daily snapshot")
+		format   = fs.String("format", reconcile.FormatText, "report format: text or json")
+		output   = fs.String("o", "", "report file, standard output if empty")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != reconcile.FormatText && *format != reconcile.FormatJSON {
+		fmt.Fprintf(stderr, "unknown report format %q\n", *format)
+		return 2
+	}
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	report, err := reconcile.New(repo, nil, logger).Run(context.Background(), *snapshot)
+	if err != nil {
+		fmt.Fprintf(stderr, "reconciliation failed: %v\n", err)
+		return 2
+	}
+	if err = reconcile.WriteReport(w, *format, report); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
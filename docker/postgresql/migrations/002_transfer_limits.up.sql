@@ -0,0 +1,21 @@
+-- Transfer limits. Zero value of any limit means "no limit".
+
+CREATE TABLE public.account_limit
+(
+  user_id        VARCHAR(40) PRIMARY KEY REFERENCES account (user_id) ON DELETE CASCADE,
+  max_amount     NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  daily_amount   NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  monthly_amount NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  hourly_count   INTEGER        NOT NULL DEFAULT 0
+);
+
+CREATE TABLE public.currency_limit
+(
+  currency       VARCHAR(3) PRIMARY KEY,
+  max_amount     NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  daily_amount   NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  monthly_amount NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  hourly_count   INTEGER        NOT NULL DEFAULT 0
+);
+
+CREATE INDEX payment_payer_date_idx ON public.payment (payer, date) WHERE direction = 'outgoing' AND error = '';
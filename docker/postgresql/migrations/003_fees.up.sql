@@ -0,0 +1,23 @@
+-- Transfer fees. Fee of transfer is booked to revenue account of currency
+-- as a separate "fee" record of payment history.
+
+CREATE TABLE public.fee_schedule
+(
+  currency        VARCHAR(3) PRIMARY KEY,
+  revenue_account VARCHAR(40)    NOT NULL REFERENCES account (user_id),
+  fixed           NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  percent         NUMERIC(7, 4)  NOT NULL DEFAULT 0,
+  min_fee         NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  max_fee         NUMERIC(15, 2) NOT NULL DEFAULT 0
+);
+
+CREATE TABLE public.fee_tier
+(
+  currency   VARCHAR(3)     NOT NULL REFERENCES fee_schedule (currency) ON DELETE CASCADE,
+  min_amount NUMERIC(15, 2) NOT NULL,
+  fixed      NUMERIC(15, 2) NOT NULL DEFAULT 0,
+  percent    NUMERIC(7, 4)  NOT NULL DEFAULT 0,
+  PRIMARY KEY (currency, min_amount)
+);
+
+ALTER TABLE public.payment ADD COLUMN fee NUMERIC(15, 2) NOT NULL DEFAULT 0;
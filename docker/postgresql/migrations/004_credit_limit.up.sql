@@ -0,0 +1,10 @@
+-- Overdraft: balance of account may go negative down to its credit limit.
+
+ALTER TABLE public.account
+  ADD COLUMN credit_limit NUMERIC(15, 2) NOT NULL DEFAULT 0
+    CONSTRAINT positive_credit_limit CHECK (credit_limit >= 0);
+
+ALTER TABLE public.account DROP CONSTRAINT positive_balance;
+
+ALTER TABLE public.account
+  ADD CONSTRAINT balance_within_credit_limit CHECK (balance >= -credit_limit);
@@ -0,0 +1,26 @@
+-- Compliance holds: account may be frozen for debit, credit or both.
+
+ALTER TABLE public.account
+  ADD COLUMN freeze        VARCHAR(6)  NOT NULL DEFAULT 'none'
+    CONSTRAINT valid_freeze CHECK (freeze IN ('none', 'debit', 'credit', 'both')),
+  ADD COLUMN freeze_reason VARCHAR(40) NOT NULL DEFAULT '';
+
+CREATE TABLE public.account_freeze
+(
+  id      BIGSERIAL PRIMARY KEY,
+  user_id VARCHAR(40)  NOT NULL REFERENCES account (user_id) ON DELETE RESTRICT,
+  state   VARCHAR(6)   NOT NULL,
+  reason  VARCHAR(40)  NOT NULL DEFAULT '',
+  comment VARCHAR(200) NOT NULL DEFAULT '',
+  actor   VARCHAR(100) NOT NULL,
+  date    TIMESTAMP             DEFAULT current_timestamp
+);
+
+CREATE INDEX account_freeze_user_id_idx ON public.account_freeze (user_id);
+
+-- accounts must be frozen instead of deleted, so payment history must never be wiped
+ALTER TABLE public.payment
+  DROP CONSTRAINT payment_payer_fkey,
+  DROP CONSTRAINT payment_payee_fkey,
+  ADD CONSTRAINT payment_payer_fkey FOREIGN KEY (payer) REFERENCES account (user_id) ON DELETE RESTRICT,
+  ADD CONSTRAINT payment_payee_fkey FOREIGN KEY (payee) REFERENCES account (user_id) ON DELETE RESTRICT;
@@ -0,0 +1,31 @@
+-- Append-only audit log of administrative and money-moving actions.
+-- Every record contains hash of the previous one (hash chain).
+
+CREATE TABLE public.audit_log
+(
+  id         BIGINT PRIMARY KEY,
+  date       TIMESTAMPTZ  NOT NULL,
+  actor      VARCHAR(100) NOT NULL,
+  action     VARCHAR(40)  NOT NULL,
+  target     VARCHAR(100) NOT NULL,
+  before     TEXT         NOT NULL,
+  after      TEXT         NOT NULL,
+  error      VARCHAR(200) NOT NULL DEFAULT '',
+  request_id VARCHAR(64)  NOT NULL DEFAULT '',
+  client_ip  VARCHAR(45)  NOT NULL DEFAULT '',
+  prev_hash  VARCHAR(64)  NOT NULL,
+  hash       VARCHAR(64)  NOT NULL UNIQUE
+);
+
+CREATE FUNCTION public.audit_log_immutable() RETURNS TRIGGER AS
+$$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_immutable
+  BEFORE UPDATE OR DELETE OR TRUNCATE
+  ON public.audit_log
+  FOR EACH STATEMENT
+EXECUTE PROCEDURE public.audit_log_immutable();
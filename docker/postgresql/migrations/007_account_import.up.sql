@@ -0,0 +1,10 @@
+-- Bulk import: opening balances are booked against equity account of currency,
+-- which balance is not limited by credit limit.
+
+ALTER TABLE public.account
+  ADD COLUMN equity BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE public.account DROP CONSTRAINT balance_within_credit_limit;
+
+ALTER TABLE public.account
+  ADD CONSTRAINT balance_within_credit_limit CHECK (equity OR balance >= -credit_limit);
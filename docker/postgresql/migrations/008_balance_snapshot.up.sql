@@ -0,0 +1,13 @@
+-- Daily balance snapshots taken by reconciliation: stored balance of every
+-- account along with balance recomputed from payment history.
+
+CREATE TABLE public.balance_snapshot
+(
+  date           DATE           NOT NULL,
+  user_id        VARCHAR(40)    NOT NULL REFERENCES account (user_id) ON DELETE CASCADE,
+  currency       VARCHAR(3)     NOT NULL,
+  balance        NUMERIC(15, 2) NOT NULL,
+  ledger_balance NUMERIC(15, 2) NOT NULL,
+  taken_at       TIMESTAMPTZ    NOT NULL,
+  PRIMARY KEY (date, user_id)
+);
@@ -0,0 +1,14 @@
+-- Point-in-time balances: balance of account at any moment is computed from
+-- the latest balance snapshot before it plus transactions following snapshot.
+
+-- Dates of payments were written by current_timestamp in time zone of database,
+-- which is UTC, so they are converted as UTC whatever time zone session running
+-- migration has.
+ALTER TABLE public.payment ALTER COLUMN date TYPE TIMESTAMPTZ USING date AT TIME ZONE 'UTC';
+
+-- Snapshots are taken periodically, not only daily by reconciliation.
+ALTER TABLE public.balance_snapshot DROP CONSTRAINT balance_snapshot_pkey;
+ALTER TABLE public.balance_snapshot DROP COLUMN date;
+ALTER TABLE public.balance_snapshot ADD PRIMARY KEY (user_id, taken_at);
+
+CREATE INDEX payment_payee_date_idx ON public.payment (payee, date) WHERE error = '';
@@ -0,0 +1,26 @@
+-- Multi-currency wallets: account holder owns one account (wallet) per currency.
+-- The first wallet of holder is named after holder, others are "<holder>:<currency>",
+-- equity accounts "equity:<currency>" belong to holder "equity".
+
+ALTER TABLE public.account ADD COLUMN holder_id VARCHAR(40);
+
+UPDATE public.account SET holder_id = CASE WHEN equity THEN split_part(user_id, ':', 1) ELSE user_id END;
+
+ALTER TABLE public.account ALTER COLUMN holder_id SET NOT NULL;
+
+CREATE UNIQUE INDEX account_holder_currency_idx ON public.account (holder_id, currency);
+
+-- account created without holder is its own holder
+CREATE FUNCTION public.account_default_holder() RETURNS TRIGGER AS
+$$
+BEGIN
+  NEW.holder_id := COALESCE(NEW.holder_id, NEW.user_id);
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER account_default_holder
+  BEFORE INSERT
+  ON public.account
+  FOR EACH ROW
+EXECUTE PROCEDURE public.account_default_holder();
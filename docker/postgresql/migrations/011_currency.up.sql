@@ -0,0 +1,50 @@
+-- Currency registry: currencies of ISO 4217 are built into payment system,
+-- this table overrides them (f.e. disables currency) or adds new ones.
+-- Unset numeric code and exponent are taken from ISO 4217, f.e.
+--   INSERT INTO currency(code, enabled) VALUES ('RUB', false);
+
+CREATE TABLE public.currency
+(
+  code     VARCHAR(3) PRIMARY KEY
+    CONSTRAINT valid_code CHECK (code ~ '^[A-Z]{3}$'),
+  numeric  SMALLINT,
+  exponent SMALLINT
+    CONSTRAINT valid_exponent CHECK (exponent BETWEEN 0 AND 4),
+  enabled  BOOLEAN NOT NULL DEFAULT true
+);
+
+-- Currency of account is always given.
+ALTER TABLE public.account ALTER COLUMN currency DROP DEFAULT;
+ALTER TABLE public.account ADD CONSTRAINT valid_currency CHECK (currency ~ '^[A-Z]{3}$');
+
+-- Amounts are stored with 4 decimals, the greatest exponent of ISO 4217.
+ALTER TABLE public.account
+  ALTER COLUMN balance TYPE NUMERIC(17, 4),
+  ALTER COLUMN credit_limit TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.payment
+  ALTER COLUMN amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN fee TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.account_limit
+  ALTER COLUMN max_amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN daily_amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN monthly_amount TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.currency_limit
+  ALTER COLUMN max_amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN daily_amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN monthly_amount TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.fee_schedule
+  ALTER COLUMN fixed TYPE NUMERIC(17, 4),
+  ALTER COLUMN min_fee TYPE NUMERIC(17, 4),
+  ALTER COLUMN max_fee TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.fee_tier
+  ALTER COLUMN min_amount TYPE NUMERIC(17, 4),
+  ALTER COLUMN fixed TYPE NUMERIC(17, 4);
+
+ALTER TABLE public.balance_snapshot
+  ALTER COLUMN balance TYPE NUMERIC(17, 4),
+  ALTER COLUMN ledger_balance TYPE NUMERIC(17, 4);
@@ -0,0 +1,57 @@
+-- Account activity: balance changes and new payments are notified on channel
+-- "account_activity" as JSON events, so every instance of payment system
+-- streams activity of all of them. Notifications are sent on commit only.
+
+CREATE FUNCTION public.notify_balance_activity() RETURNS TRIGGER AS
+$$
+BEGIN
+  IF TG_OP = 'UPDATE' AND OLD.balance = NEW.balance THEN
+    RETURN NULL;
+  END IF;
+  PERFORM pg_notify('account_activity', json_build_object(
+    'type', 'balance',
+    'holders', json_build_array(NEW.holder_id),
+    'balance', json_build_object(
+      'account', NEW.user_id,
+      'holder', NEW.holder_id,
+      'currency', NEW.currency,
+      'balance', NEW.balance
+    )
+  )::text);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER account_activity
+  AFTER INSERT OR UPDATE OF balance
+  ON public.account
+  FOR EACH ROW
+EXECUTE PROCEDURE public.notify_balance_activity();
+
+CREATE FUNCTION public.notify_payment_activity() RETURNS TRIGGER AS
+$$
+BEGIN
+  PERFORM pg_notify('account_activity', json_build_object(
+    'type', 'payment',
+    'holders', (SELECT json_agg(DISTINCT holder_id) FROM public.account WHERE user_id IN (NEW.payer, NEW.payee)),
+    'payment', json_build_object(
+      'id', NEW.txn_id,
+      'direction', NEW.direction,
+      'date', NEW.date,
+      'payer', NEW.payer,
+      'payee', NEW.payee,
+      'amount', NEW.amount,
+      'fee', NEW.fee,
+      'currency', NEW.currency,
+      'error', NEW.error
+    )
+  )::text);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER payment_activity
+  AFTER INSERT
+  ON public.payment
+  FOR EACH ROW
+EXECUTE PROCEDURE public.notify_payment_activity();
@@ -0,0 +1,26 @@
+-- Transactional outbox: events of accounts are written in the same transaction
+-- as their balances. Sequence number of account is incremented under lock of
+-- its row, so events of account are numbered without gaps and committed in
+-- order. Relays publish events and save sequence number of the last published
+-- event of every account as their offset.
+
+ALTER TABLE public.account ADD COLUMN outbox_seq BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE public.outbox
+(
+  id         BIGSERIAL PRIMARY KEY,
+  account    VARCHAR(40) NOT NULL REFERENCES account (user_id) ON DELETE CASCADE,
+  seq        BIGINT      NOT NULL,
+  type       VARCHAR(20) NOT NULL,
+  payload    JSONB       NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (account, seq)
+);
+
+CREATE TABLE public.outbox_offset
+(
+  relay   VARCHAR(40) NOT NULL,
+  account VARCHAR(40) NOT NULL REFERENCES account (user_id) ON DELETE CASCADE,
+  seq     BIGINT      NOT NULL,
+  PRIMARY KEY (relay, account)
+);
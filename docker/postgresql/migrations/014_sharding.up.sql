@@ -0,0 +1,50 @@
+-- Sharding: accounts are spread over databases by hash of their names, so
+-- payment history and fee schedules refer accounts of other databases and can
+-- not keep foreign keys. Accounts must still be frozen instead of deleted.
+-- Changes spanning databases are committed by sagas, see ShardedRepository.
+
+ALTER TABLE public.payment
+  DROP CONSTRAINT payment_payer_fkey,
+  DROP CONSTRAINT payment_payee_fkey;
+
+ALTER TABLE public.fee_schedule DROP CONSTRAINT fee_schedule_revenue_account_fkey;
+
+CREATE FUNCTION public.forbid_account_delete() RETURNS TRIGGER AS
+$$
+BEGIN
+  RAISE EXCEPTION 'account % must be frozen instead of deleted', OLD.user_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER account_no_delete
+  BEFORE DELETE
+  ON public.account
+  FOR EACH ROW
+EXECUTE PROCEDURE public.forbid_account_delete();
+
+-- records written by saga are failed if saga is compensated
+ALTER TABLE public.payment ADD COLUMN saga_id VARCHAR(32);
+
+CREATE INDEX payment_saga_id_idx ON public.payment (saga_id) WHERE saga_id IS NOT NULL;
+
+-- saga is written by its coordinator along with its own step
+CREATE TABLE public.saga
+(
+  id         VARCHAR(32) PRIMARY KEY,
+  state      VARCHAR(20) NOT NULL
+    CONSTRAINT valid_saga_state CHECK (state IN ('pending', 'completed', 'compensated')),
+  steps      JSONB       NOT NULL,
+  error      TEXT        NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX saga_pending_idx ON public.saga (created_at) WHERE state = 'pending';
+
+-- markers of applied (or fenced off) steps of sagas coordinated by other
+-- databases, ID of reverted step is suffixed by "/undo"
+CREATE TABLE public.saga_step
+(
+  id         VARCHAR(40) PRIMARY KEY,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
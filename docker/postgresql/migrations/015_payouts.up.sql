@@ -0,0 +1,28 @@
+-- Payouts to accounts of external banks: amount is booked from account to
+-- clearing account of its currency along with outgoing history record, which ID
+-- payout shares, then payout processor moves payout through its states:
+-- pending -> sent -> confirmed, or failed -> compensated by refund from
+-- clearing account. History record may live in another database when sharded,
+-- so there is no foreign key.
+
+CREATE TABLE public.payout
+(
+  id              BIGINT PRIMARY KEY,
+  account         VARCHAR(40)    NOT NULL,
+  bank_account    VARCHAR(64)    NOT NULL,
+  amount          NUMERIC(17, 4) NOT NULL,
+  currency        VARCHAR(3)     NOT NULL,
+  state           VARCHAR(20)    NOT NULL
+    CONSTRAINT valid_payout_state CHECK (state IN ('pending', 'sent', 'confirmed', 'failed', 'compensated')),
+  bank_ref        VARCHAR(64)    NOT NULL DEFAULT '',
+  error           TEXT           NOT NULL DEFAULT '',
+  attempts        INT            NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ    NOT NULL DEFAULT now(),
+  created_at      TIMESTAMPTZ    NOT NULL DEFAULT now(),
+  updated_at      TIMESTAMPTZ    NOT NULL DEFAULT now(),
+  saga_id         VARCHAR(32)
+);
+
+CREATE INDEX payout_due_idx ON public.payout (next_attempt_at) WHERE state IN ('pending', 'sent', 'failed');
+
+CREATE INDEX payout_saga_id_idx ON public.payout (saga_id) WHERE saga_id IS NOT NULL;
@@ -0,0 +1,25 @@
+-- Event sourcing: changes of accounts are appended to their streams of events,
+-- state of account is replayed from them starting at the latest snapshot.
+-- Tables account and payment are projections of events then, which may be
+-- rebuilt. Version of stream is unique, so concurrent appends of the same
+-- version conflict. Accounts are adopted by their first event, which carries
+-- state they had, so there is nothing to backfill.
+
+CREATE TABLE public.account_event
+(
+  seq        BIGSERIAL PRIMARY KEY,
+  account    VARCHAR(40) NOT NULL,
+  version    BIGINT      NOT NULL,
+  type       VARCHAR(20) NOT NULL,
+  data       JSONB       NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (account, version)
+);
+
+CREATE TABLE public.account_snapshot
+(
+  account    VARCHAR(40) PRIMARY KEY,
+  version    BIGINT      NOT NULL,
+  state      JSONB       NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
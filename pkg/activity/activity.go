@@ -0,0 +1,172 @@
+// Package activity delivers balance changes and payments of accounts to
+// subscribers of their holders in real time.
+package activity
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of events.
+const (
+	TypeBalance = "balance"
+	TypePayment = "payment"
+)
+
+// Buffer is a number of events buffered per subscription. Subscription which
+// falls behind is closed, its subscriber should subscribe again.
+const Buffer = 64
+
+// Event is a balance change or a new payment record of account.
+type Event struct {
+	Type string `json:"type"`
+	// Holders are account holders event is delivered to
+	Holders []string `json:"holders"`
+	Balance *Balance `json:"balance,omitempty"`
+	Payment *Payment `json:"payment,omitempty"`
+}
+
+// Balance is a balance of account (wallet of holder).
+type Balance struct {
+	Account  string  `json:"account"`
+	Holder   string  `json:"holder"`
+	Currency string  `json:"currency"`
+	Balance  float64 `json:"balance"`
+}
+
+// Payment is a payment record, Error is empty for successful one.
+type Payment struct {
+	ID        int64     `json:"id"`
+	Direction string    `json:"direction"`
+	Date      time.Time `json:"date"`
+	Payer     string    `json:"payer"`
+	Payee     string    `json:"payee"`
+	Amount    float64   `json:"amount"`
+	Fee       float64   `json:"fee"`
+	Currency  string    `json:"currency"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Subscription receives events of account holder.
+type Subscription struct {
+	// Snapshot are events delivered before ones of Events, f.e. current balances
+	Snapshot []*Event
+	events   <-chan *Event
+	close    func()
+	once     sync.Once
+}
+
+// NewSubscription returns subscription receiving events from channel, close
+// releases its source.
+func NewSubscription(events <-chan *Event, close func()) *Subscription {
+	return &Subscription{events: events, close: close}
+}
+
+// Events returns channel of events, it is closed when subscription is closed.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Close cancels subscription.
+func (s *Subscription) Close() {
+	s.once.Do(s.close)
+}
+
+// Publisher publishes events.
+type Publisher interface {
+	Publish(event *Event)
+}
+
+// Broker is an in-process Publisher delivering events to subscriptions of
+// their holders.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[string]map[chan *Event]struct{} // by holder
+	closed bool
+}
+
+// NewBroker returns broker without subscriptions.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[chan *Event]struct{})}
+}
+
+// Subscribe returns subscription to events of holder. Subscription of closed
+// broker is closed at once.
+func (b *Broker) Subscribe(holder string) *Subscription {
+	events := make(chan *Event, Buffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(events)
+	} else {
+		if b.subs[holder] == nil {
+			b.subs[holder] = make(map[chan *Event]struct{})
+		}
+		b.subs[holder][events] = struct{}{}
+	}
+	return NewSubscription(events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(holder, events)
+	})
+}
+
+// Publish implements Publisher, it never blocks: subscriptions which can't
+// take event are closed.
+func (b *Broker) Publish(event *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, holder := range event.Holders {
+		if duplicate(event.Holders[:i], holder) {
+			continue
+		}
+		for events := range b.subs[holder] {
+			select {
+			case events <- event:
+			default:
+				b.unsubscribe(holder, events)
+			}
+		}
+	}
+}
+
+// Reset closes all subscriptions, so subscribers get current state again
+// after events may have been lost.
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for holder, subs := range b.subs {
+		for events := range subs {
+			b.unsubscribe(holder, events)
+		}
+	}
+}
+
+// Close closes all subscriptions and rejects new ones.
+func (b *Broker) Close() {
+	b.Reset()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+}
+
+// unsubscribe removes subscription unless it is removed already, b.mu must be held.
+func (b *Broker) unsubscribe(holder string, events chan *Event) {
+	if _, ok := b.subs[holder][events]; !ok {
+		return
+	}
+	delete(b.subs[holder], events)
+	if len(b.subs[holder]) == 0 {
+		delete(b.subs, holder)
+	}
+	close(events)
+}
+
+func duplicate(holders []string, holder string) bool {
+	for _, h := range holders {
+		if h == holder {
+			return true
+		}
+	}
+	return false
+}
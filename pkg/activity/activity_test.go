@@ -0,0 +1,48 @@
+package activity
+
+import "testing"
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+	alice := broker.Subscribe("alice456")
+	bob := broker.Subscribe("bob123")
+
+	// test event is delivered once to every its holder
+	payment := &Event{Type: TypePayment, Holders: []string{"alice456", "bob123", "alice456"}, Payment: &Payment{ID: 1}}
+	broker.Publish(payment)
+	broker.Publish(&Event{Type: TypeBalance, Holders: []string{"bob123"}, Balance: &Balance{Account: "bob123"}})
+	if e := <-alice.Events(); e != payment {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if len(alice.Events()) != 0 || len(bob.Events()) != 2 {
+		t.Errorf("Unexpected number of events: %d, %d", len(alice.Events()), len(bob.Events()))
+	}
+
+	// test subscription falling behind is closed
+	for i := 0; i <= Buffer; i++ {
+		broker.Publish(&Event{Type: TypeBalance, Holders: []string{"alice456"}})
+	}
+	for range bob.Events() {
+		if len(bob.Events()) == 0 {
+			break
+		}
+	}
+	n := 0
+	for range alice.Events() {
+		n++
+	}
+	if n != Buffer {
+		t.Errorf("Subscription should be closed after %d events, got %d", Buffer, n)
+	}
+	alice.Close()
+
+	// test closed broker closes subscriptions
+	broker.Close()
+	if _, ok := <-bob.Events(); ok {
+		t.Error("Subscription should be closed")
+	}
+	bob.Close()
+	if _, ok := <-broker.Subscribe("bob123").Events(); ok {
+		t.Error("Subscription of closed broker should be closed")
+	}
+}
@@ -0,0 +1,81 @@
+package activity
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/lib/pq"
+)
+
+// Channel is a Postgres notification channel, triggers of account and payment
+// tables notify it with JSON encoded Event on commit.
+const Channel = "account_activity"
+
+// Listener publishes events notified by Postgres, so events of every instance
+// of payment system reach subscribers of all of them.
+type Listener struct {
+	listener *pq.Listener
+	broker   *Broker
+	logger   log.Logger
+	done     chan struct{}
+}
+
+// NewListener returns listener of database at dsn publishing events to broker.
+func NewListener(dsn string, broker *Broker, logger log.Logger) *Listener {
+	logger = log.With(logger, "activity", "listener")
+	return &Listener{
+		listener: pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				_ = level.Warn(logger).Log("event", event, "err", err)
+			}
+		}),
+		broker: broker,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+// Run listens to notifications until Close is called. If connection to database
+// is lost, broker is reset once it is restored, as notifications may be missed.
+func (l *Listener) Run() error {
+	if err := l.listener.Listen(Channel); err != nil {
+		select {
+		case <-l.done:
+			return nil
+		default:
+			return err
+		}
+	}
+	_ = level.Info(l.logger).Log("msg", "listening", "channel", Channel)
+	ping := time.NewTicker(time.Minute)
+	defer ping.Stop()
+	for {
+		select {
+		case n := <-l.listener.Notify:
+			if n == nil {
+				_ = level.Warn(l.logger).Log("msg", "reconnected, subscriptions are reset")
+				l.broker.Reset()
+				continue
+			}
+			event := &Event{}
+			if err := json.Unmarshal([]byte(n.Extra), event); err != nil {
+				_ = level.Error(l.logger).Log("during", "Unmarshal", "err", err)
+				continue
+			}
+			l.broker.Publish(event)
+		case <-ping.C:
+			// detects broken connection when there are no notifications
+			go l.listener.Ping()
+		case <-l.done:
+			return nil
+		}
+	}
+}
+
+// Close stops listening.
+func (l *Listener) Close() {
+	close(l.done)
+	_ = l.listener.Close()
+}
@@ -0,0 +1,756 @@
+// Package config holds settings of payment system. Every setting has a key in
+// config file, an environment variable and a flag; later ones override former:
+// defaults, file, environment, flags.
+//
+// Config file is a YAML subset: top level sections of "key: value" scalars,
+// strings may be quoted, "#" starts a comment.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is a configuration of payment system.
+type Config struct {
+	// File is a path of config file, it is set by flag or CONFIG_FILE variable only
+	File  string
+	HTTP  HTTPConfig
+	TLS   TLSConfig
+	DB    DBConfig
+	Log   LogConfig
+	Trace TraceConfig
+	Rate  RateConfig
+	// Reconcile configures daily reconciliation worker
+	Reconcile ReconcileConfig
+	// Snapshot configures periodic balance snapshots
+	Snapshot SnapshotConfig
+	// Outbox configures relay of outbox events
+	Outbox OutboxConfig
+	// Payout configures processor sending payouts to bank
+	Payout PayoutConfig
+	// Events configures event-sourced mode of accounts
+	Events EventsConfig
+
+	flags map[string]string
+}
+
+// HTTPConfig configures HTTP server.
+type HTTPConfig struct {
+	Addr         string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// DrainDelay is a time between failing health check and stopping accepting requests
+	DrainDelay time.Duration
+	// ShutdownTimeout limits waiting for completion of in-flight requests
+	ShutdownTimeout time.Duration
+	// TrustedProxies are comma separated IP addresses or CIDR networks of
+	// proxies, only they may set principal and client address headers
+	TrustedProxies string
+	// MetricsAddr is an internal listen address of expvar metrics, they are
+	// not served if it is empty
+	MetricsAddr string
+	// Admins are comma separated principals allowed to call admin endpoints,
+	// they must be authenticated by client certificate or trusted proxy
+	Admins string
+}
+
+// AdminPrincipals returns principals allowed to call admin endpoints.
+func (c HTTPConfig) AdminPrincipals() []string {
+	admins := make([]string, 0)
+	for _, admin := range strings.Split(c.Admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+	return admins
+}
+
+// TrustedProxyNets returns networks of trusted proxies, single addresses are
+// networks of one host.
+func (c HTTPConfig) TrustedProxyNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, proxy := range strings.Split(c.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// TLSConfig configures HTTPS of HTTP server, it is disabled if certificate is not set.
+type TLSConfig struct {
+	Cert string
+	Key  string
+	// ClientCA is a CA bundle verifying client certificates (mutual TLS)
+	ClientCA string
+	// ClientAuth is "require" or "optional" (verify if given) client certificate
+	ClientAuth string
+}
+
+// Enabled reports whether server listens HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != ""
+}
+
+// DBConfig configures connection pool of postgresql database.
+type DBConfig struct {
+	Host             string
+	Port             int
+	Name             string
+	User             string
+	Password         string
+	SSLMode          string
+	SSLCert          string
+	SSLKey           string
+	SSLRootCert      string
+	MaxOpenConns     int
+	MaxIdleConns     int
+	ConnMaxLifetime  time.Duration
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+	// Replicas are comma separated DSNs of read-only replicas, listing of accounts
+	// and payment history are served by them
+	Replicas string
+	// ReplicaMaxLag is a replication lag replica is not used beyond
+	ReplicaMaxLag time.Duration
+	// ReplicaCheckInterval is a time between checks of replication lag
+	ReplicaCheckInterval time.Duration
+	// Shards are comma separated DSNs of databases accounts are spread over along
+	// with this one, the order of shards must never change
+	Shards string
+	// SagaRecoveryInterval is a time between recoveries of pending sagas
+	SagaRecoveryInterval time.Duration
+	// SagaTimeout is an age of pending saga recovery takes over
+	SagaTimeout time.Duration
+}
+
+// ReplicaDSNs returns DSNs of replicas.
+func (c DBConfig) ReplicaDSNs() []string {
+	dsns := make([]string, 0)
+	for _, dsn := range strings.Split(c.Replicas, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
+}
+
+// ShardDSNs returns DSNs of shards following this database.
+func (c DBConfig) ShardDSNs() []string {
+	dsns := make([]string, 0)
+	for _, dsn := range strings.Split(c.Shards, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
+}
+
+// LogConfig configures logger.
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// TraceConfig configures tracing.
+type TraceConfig struct {
+	Exporter string
+}
+
+// RateConfig configures flooding protection, zero means "no limit".
+type RateConfig struct {
+	Principal              float64
+	IP                     float64
+	Burst                  int
+	MaxConcurrentTransfers int
+}
+
+// ReconcileConfig configures daily reconciliation of accounts.
+type ReconcileConfig struct {
+	// At is a time of day (UTC, HH:MM) of reconciliation, it is disabled if empty
+	At string
+	// Snapshot enables saving daily balance snapshot
+	Snapshot bool
+}
+
+// Enabled reports whether daily reconciliation is scheduled.
+func (c ReconcileConfig) Enabled() bool {
+	return c.At != ""
+}
+
+// TimeOfDay returns offset of At from midnight, zero if it is not valid.
+func (c ReconcileConfig) TimeOfDay() time.Duration {
+	t, err := time.Parse(timeOfDayLayout, c.At)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// SnapshotConfig configures balance snapshots, which point-in-time balances are computed from.
+type SnapshotConfig struct {
+	// Interval is a time between snapshots, they are disabled if it is zero
+	Interval time.Duration
+}
+
+// OutboxConfig configures relay publishing events of transactional outbox.
+type OutboxConfig struct {
+	// Publisher is "file", "nats" or "kafka", relay is disabled if it is empty
+	Publisher string
+	// Target is a path of file, URL of NATS server or URL of Kafka REST Proxy
+	Target string
+	// Topic is a NATS subject prefix or Kafka topic
+	Topic string
+	// Relay is a name offset of relay is saved under
+	Relay    string
+	Interval time.Duration
+}
+
+// Enabled reports whether outbox events are published.
+func (c OutboxConfig) Enabled() bool {
+	return c.Publisher != ""
+}
+
+// PayoutConfig configures processor sending payouts to external bank.
+type PayoutConfig struct {
+	// Connector is a connector of bank, processor is disabled if it is empty
+	Connector string
+	// Interval is a time between polls of due payouts and the first retry delay
+	Interval time.Duration
+	// MaxAttempts is a number of failed attempts to send payout before bank is
+	// asked whether it received payout, payout is failed if it didn't
+	MaxAttempts int
+}
+
+// Enabled reports whether payouts are sent to bank.
+func (c PayoutConfig) Enabled() bool {
+	return c.Connector != ""
+}
+
+// EventsConfig configures event-sourced mode of accounts.
+type EventsConfig struct {
+	// Sourcing enables event-sourced mode: changes of accounts are appended as
+	// events and account table and history are their projections
+	Sourcing bool
+	// SnapshotEvery is a number of events of account between snapshots of its aggregate
+	SnapshotEvery int
+}
+
+// timeOfDayLayout is a layout of time of day settings
+const timeOfDayLayout = "15:04"
+
+// Log levels and formats
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+var (
+	logLevels  = []string{"debug", "info", "warn", "error"}
+	logFormats = []string{LogFormatLogfmt, LogFormatJSON}
+	// client certificate modes of mutual TLS
+	clientAuths = []string{"require", "optional"}
+	// publishers of outbox events
+	outboxPublishers = []string{"file", "nats", "kafka"}
+	// connectors of bank
+	payoutConnectors = []string{"fake"}
+	// sslmodes supported by lib/pq
+	sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+)
+
+// masked replaces secrets in printed configuration
+const masked = "********"
+
+// New returns configuration with default settings.
+func New() *Config {
+	return &Config{
+		HTTP: HTTPConfig{
+			Addr:            ":8000",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			DrainDelay:      5 * time.Second,
+			ShutdownTimeout: 25 * time.Second,
+		},
+		TLS: TLSConfig{
+			ClientAuth: "require",
+		},
+		DB: DBConfig{
+			Host:                 "localhost",
+			Port:                 5432,
+			Name:                 "psdb",
+			User:                 "postgres",
+			Password:             "postgres",
+			SSLMode:              "disable",
+			MaxOpenConns:         20,
+			MaxIdleConns:         5,
+			ConnMaxLifetime:      30 * time.Minute,
+			ConnectTimeout:       10 * time.Second,
+			ReplicaMaxLag:        5 * time.Second,
+			ReplicaCheckInterval: 5 * time.Second,
+			SagaRecoveryInterval: 10 * time.Second,
+			SagaTimeout:          time.Minute,
+		},
+		Log: LogConfig{
+			Level:  "debug",
+			Format: LogFormatLogfmt,
+		},
+		Rate: RateConfig{
+			Burst: 20,
+		},
+		Outbox: OutboxConfig{
+			Topic:    "payments",
+			Relay:    "default",
+			Interval: time.Second,
+		},
+		Payout: PayoutConfig{
+			Interval:    5 * time.Second,
+			MaxAttempts: 10,
+		},
+		Events: EventsConfig{
+			SnapshotEvery: 100,
+		},
+		flags: make(map[string]string),
+	}
+}
+
+// setting binds config file key, environment variable and flag to field of Config.
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  interface{} // *string, *int, *float64, *bool or *time.Duration
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"http.addr", "HTTP_ADDR", "http-addr", "HTTP listen address", false, &c.HTTP.Addr},
+		{"http.read_timeout", "HTTP_READ_TIMEOUT", "http-read-timeout", "HTTP request read timeout", false, &c.HTTP.ReadTimeout},
+		{"http.write_timeout", "HTTP_WRITE_TIMEOUT", "http-write-timeout", "HTTP response write timeout", false, &c.HTTP.WriteTimeout},
+		{"http.idle_timeout", "HTTP_IDLE_TIMEOUT", "http-idle-timeout", "HTTP keep-alive idle timeout", false, &c.HTTP.IdleTimeout},
+		{"http.drain_delay", "HTTP_DRAIN_DELAY", "http-drain-delay", "time to report unhealthy before shutdown, so load balancer stops sending requests", false, &c.HTTP.DrainDelay},
+		{"http.shutdown_timeout", "HTTP_SHUTDOWN_TIMEOUT", "http-shutdown-timeout", "time to wait for in-flight requests on shutdown", false, &c.HTTP.ShutdownTimeout},
+		{"http.trusted_proxies", "TRUSTED_PROXIES", "trusted-proxies", "comma separated addresses or CIDR networks of proxies trusted to set X-Principal and X-Real-IP", false, &c.HTTP.TrustedProxies},
+		{"http.metrics_addr", "METRICS_ADDR", "metrics-addr", "internal listen address of expvar metrics (/debug/vars), empty to disable", false, &c.HTTP.MetricsAddr},
+		{"http.admins", "ADMIN_PRINCIPALS", "admin-principals", "comma separated authenticated principals allowed to call admin endpoints", false, &c.HTTP.Admins},
+		{"tls.cert", "TLS_CERT", "tls-cert", "server certificate file, enables HTTPS", false, &c.TLS.Cert},
+		{"tls.key", "TLS_KEY", "tls-key", "server key file", false, &c.TLS.Key},
+		{"tls.client_ca", "TLS_CLIENT_CA", "tls-client-ca", "CA bundle verifying client certificates, enables mutual TLS", false, &c.TLS.ClientCA},
+		{"tls.client_auth", "TLS_CLIENT_AUTH", "tls-client-auth", "client certificate of mutual TLS: require or optional", false, &c.TLS.ClientAuth},
+		{"db.host", "DB_HOST", "db-host", "postgresql host", false, &c.DB.Host},
+		{"db.port", "DB_PORT", "db-port", "postgresql port", false, &c.DB.Port},
+		{"db.name", "DB_NAME", "db-name", "postgresql database name", false, &c.DB.Name},
+		{"db.user", "DB_USER", "db-user", "postgresql user", false, &c.DB.User},
+		{"db.password", "DB_PASSWORD", "db-password", "postgresql password", true, &c.DB.Password},
+		{"db.sslmode", "DB_SSLMODE", "db-sslmode", "postgresql SSL mode: disable, require, verify-ca or verify-full", false, &c.DB.SSLMode},
+		{"db.sslcert", "DB_SSLCERT", "db-sslcert", "postgresql client certificate file", false, &c.DB.SSLCert},
+		{"db.sslkey", "DB_SSLKEY", "db-sslkey", "postgresql client key file", false, &c.DB.SSLKey},
+		{"db.sslrootcert", "DB_SSLROOTCERT", "db-sslrootcert", "postgresql server CA certificate file", false, &c.DB.SSLRootCert},
+		{"db.max_open_conns", "DB_MAX_OPEN_CONNS", "db-max-open-conns", "maximum open connections, 0 for no limit", false, &c.DB.MaxOpenConns},
+		{"db.max_idle_conns", "DB_MAX_IDLE_CONNS", "db-max-idle-conns", "maximum idle connections", false, &c.DB.MaxIdleConns},
+		{"db.conn_max_lifetime", "DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "maximum lifetime of connection, 0 for no limit", false, &c.DB.ConnMaxLifetime},
+		{"db.connect_timeout", "DB_CONNECT_TIMEOUT", "db-connect-timeout", "connect timeout, 0 for no limit", false, &c.DB.ConnectTimeout},
+		{"db.statement_timeout", "DB_STATEMENT_TIMEOUT", "db-statement-timeout", "SQL statement timeout, 0 for no limit", false, &c.DB.StatementTimeout},
+		{"db.replicas", "DB_REPLICAS", "db-replicas", "comma separated DSNs (postgresql://...) of read-only replicas", true, &c.DB.Replicas},
+		{"db.replica_max_lag", "DB_REPLICA_MAX_LAG", "db-replica-max-lag", "replication lag replica is not used beyond", false, &c.DB.ReplicaMaxLag},
+		{"db.replica_check_interval", "DB_REPLICA_CHECK_INTERVAL", "db-replica-check-interval", "time between checks of replication lag", false, &c.DB.ReplicaCheckInterval},
+		{"db.shards", "DB_SHARDS", "db-shards", "comma separated DSNs (postgresql://...) of shards following this database", true, &c.DB.Shards},
+		{"db.saga_recovery_interval", "DB_SAGA_RECOVERY_INTERVAL", "db-saga-recovery-interval", "time between recoveries of pending sagas", false, &c.DB.SagaRecoveryInterval},
+		{"db.saga_timeout", "DB_SAGA_TIMEOUT", "db-saga-timeout", "age of pending saga recovery takes over", false, &c.DB.SagaTimeout},
+		{"log.level", "LOG_LEVEL", "log-level", "log level: debug, info, warn or error", false, &c.Log.Level},
+		{"log.format", "LOG_FORMAT", "log-format", "log format: logfmt or json", false, &c.Log.Format},
+		{"trace.exporter", "TRACE_EXPORTER", "trace-exporter", "trace exporter: stdout or URL of Zipkin-compatible collector, empty to disable tracing", false, &c.Trace.Exporter},
+		{"rate.principal", "RATE_PRINCIPAL", "rate-principal", "requests per second allowed to API principal, 0 for no limit", false, &c.Rate.Principal},
+		{"rate.ip", "RATE_IP", "rate-ip", "requests per second allowed from source IP address, 0 for no limit", false, &c.Rate.IP},
+		{"rate.burst", "RATE_BURST", "rate-burst", "requests allowed at once above the rate", false, &c.Rate.Burst},
+		{"rate.max_concurrent_transfers", "MAX_CONCURRENT_TRANSFERS", "max-concurrent-transfers", "transfers processed at once, 0 for no limit", false, &c.Rate.MaxConcurrentTransfers},
+		{"reconcile.at", "RECONCILE_AT", "reconcile-at", "time of day (UTC, HH:MM) of daily reconciliation, empty to disable", false, &c.Reconcile.At},
+		{"reconcile.snapshot", "RECONCILE_SNAPSHOT", "reconcile-snapshot", "save balance snapshot on reconciliation", false, &c.Reconcile.Snapshot},
+		{"snapshot.interval", "SNAPSHOT_INTERVAL", "snapshot-interval", "time between balance snapshots, 0 to disable", false, &c.Snapshot.Interval},
+		{"outbox.publisher", "OUTBOX_PUBLISHER", "outbox-publisher", "publisher of outbox events: file, nats or kafka, empty to disable relay", false, &c.Outbox.Publisher},
+		{"outbox.target", "OUTBOX_TARGET", "outbox-target", "file path, NATS server URL or Kafka REST Proxy URL of outbox events", false, &c.Outbox.Target},
+		{"outbox.topic", "OUTBOX_TOPIC", "outbox-topic", "NATS subject prefix or Kafka topic of outbox events", false, &c.Outbox.Topic},
+		{"outbox.relay", "OUTBOX_RELAY", "outbox-relay", "name of relay its offset is saved under", false, &c.Outbox.Relay},
+		{"outbox.interval", "OUTBOX_INTERVAL", "outbox-interval", "time between polls of outbox", false, &c.Outbox.Interval},
+		{"payout.connector", "PAYOUT_CONNECTOR", "payout-connector", "connector of bank payouts are sent to: fake, empty to disable payout processor", false, &c.Payout.Connector},
+		{"payout.interval", "PAYOUT_INTERVAL", "payout-interval", "time between polls of due payouts and the first retry delay", false, &c.Payout.Interval},
+		{"payout.max_attempts", "PAYOUT_MAX_ATTEMPTS", "payout-max-attempts", "failed attempts to send payout before it is looked up by bank and failed if not found", false, &c.Payout.MaxAttempts},
+		{"events.sourcing", "EVENT_SOURCING", "event-sourcing", "append changes of accounts as events, account table and history become their projections", false, &c.Events.Sourcing},
+		{"events.snapshot_every", "EVENT_SNAPSHOT_EVERY", "event-snapshot-every", "events of account between snapshots of its aggregate", false, &c.Events.SnapshotEvery},
+	}
+}
+
+func (s setting) set(v string) error {
+	var err error
+	switch p := s.value.(type) {
+	case *string:
+		*p = v
+	case *int:
+		*p, err = strconv.Atoi(v)
+	case *float64:
+		*p, err = strconv.ParseFloat(v, 64)
+	case *bool:
+		*p, err = strconv.ParseBool(v)
+	case *time.Duration:
+		*p, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q", s.key, v)
+	}
+	return nil
+}
+
+func (s setting) get() string {
+	switch p := s.value.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *float64:
+		return strconv.FormatFloat(*p, 'g', -1, 64)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+// flagValue records flag, so it overrides config file and environment on Load.
+type flagValue struct {
+	setting
+	flags map[string]string
+}
+
+func (f flagValue) String() string {
+	if f.secret {
+		return masked
+	}
+	return f.get()
+}
+
+// IsBoolFlag lets bool setting be turned on by flag without value.
+func (f flagValue) IsBoolFlag() bool {
+	_, ok := f.value.(*bool)
+	return ok
+}
+
+func (f flagValue) Set(v string) error {
+	if err := f.setting.set(v); err != nil {
+		return err
+	}
+	f.flags[f.key] = v
+	return nil
+}
+
+// RegisterFlags defines flags of all settings and -config flag in fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "config", "", "config file, CONFIG_FILE variable may be used too")
+	for _, s := range c.settings() {
+		fs.Var(flagValue{setting: s, flags: c.flags}, s.flag, s.usage+" ("+s.env+")")
+	}
+}
+
+// Load applies config file, environment variables (getenv returns them, empty
+// means unset) and then flags over current settings.
+func (c *Config) Load(getenv func(string) string) error {
+	if c.File == "" {
+		c.File = getenv("CONFIG_FILE")
+	}
+	settings := c.settings()
+	if c.File != "" {
+		f, err := os.Open(c.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		values, err := Parse(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.File, err)
+		}
+		for _, s := range settings {
+			if v, ok := values[s.key]; ok {
+				if err = s.set(v); err != nil {
+					return fmt.Errorf("%s: %v", c.File, err)
+				}
+				delete(values, s.key)
+			}
+		}
+		if len(values) > 0 {
+			unknown := make([]string, 0, len(values))
+			for key := range values {
+				unknown = append(unknown, key)
+			}
+			sort.Strings(unknown)
+			return fmt.Errorf("%s: unknown settings: %s", c.File, strings.Join(unknown, ", "))
+		}
+	}
+	// HTTP_PORT is kept for compatibility, HTTP_ADDR overrides it
+	if port := getenv("HTTP_PORT"); port != "" {
+		c.HTTP.Addr = ":" + port
+	}
+	for _, s := range settings {
+		if v := getenv(s.env); v != "" {
+			if err := s.set(v); err != nil {
+				return fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := c.flags[s.key]; ok {
+			if err := s.set(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Parse reads file of sections of "key: value" settings into map of
+// "section.key" to value. It is a format of config file.
+func Parse(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: key: value expected", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case !indented && value == "":
+			section = key
+		case indented && section != "":
+			v, err := unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			values[section+"."+key] = v
+		default:
+			return nil, fmt.Errorf("line %d: setting outside of section", n)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// stripComment removes comment outside of quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		return strconv.Unquote(value)
+	}
+	return value, nil
+}
+
+// Validate checks settings, it reports all problems at once.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.HTTP.Addr != "", "http.addr is required")
+	check(c.HTTP.ReadTimeout >= 0, "http.read_timeout must not be negative")
+	check(c.HTTP.WriteTimeout >= 0, "http.write_timeout must not be negative")
+	check(c.HTTP.IdleTimeout >= 0, "http.idle_timeout must not be negative")
+	check(c.HTTP.DrainDelay >= 0, "http.drain_delay must not be negative")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+	_, err := c.HTTP.TrustedProxyNets()
+	check(err == nil, "http.trusted_proxies must be addresses or CIDR networks: %v", err)
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls.cert and tls.key must be set together")
+	check(c.TLS.ClientCA == "" || c.TLS.Enabled(), "tls.client_ca requires tls.cert")
+	check(oneOf(c.TLS.ClientAuth, clientAuths), "tls.client_auth must be one of %s", strings.Join(clientAuths, ", "))
+	check(c.DB.Host != "", "db.host is required")
+	check(c.DB.Port > 0 && c.DB.Port < 65536, "db.port must be in 1..65535")
+	check(c.DB.Name != "", "db.name is required")
+	check(c.DB.User != "", "db.user is required")
+	check(oneOf(c.DB.SSLMode, sslModes), "db.sslmode must be one of %s", strings.Join(sslModes, ", "))
+	check((c.DB.SSLCert == "") == (c.DB.SSLKey == ""), "db.sslcert and db.sslkey must be set together")
+	for _, file := range []struct{ key, path string }{
+		{"tls.cert", c.TLS.Cert}, {"tls.key", c.TLS.Key}, {"tls.client_ca", c.TLS.ClientCA},
+		{"db.sslcert", c.DB.SSLCert}, {"db.sslkey", c.DB.SSLKey}, {"db.sslrootcert", c.DB.SSLRootCert},
+	} {
+		if file.path != "" {
+			_, err := os.Stat(file.path)
+			check(err == nil, "%s: %v", file.key, err)
+		}
+	}
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns must not be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns must not exceed db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.DB.ConnectTimeout >= 0, "db.connect_timeout must not be negative")
+	check(c.DB.StatementTimeout >= 0, "db.statement_timeout must not be negative")
+	for _, dsn := range c.DB.ReplicaDSNs() {
+		u, err := url.Parse(dsn)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") && u.Host != "",
+			"db.replicas must be postgresql:// URLs")
+	}
+	check(c.DB.ReplicaMaxLag > 0, "db.replica_max_lag must be positive")
+	check(c.DB.ReplicaCheckInterval > 0, "db.replica_check_interval must be positive")
+	for _, dsn := range c.DB.ShardDSNs() {
+		u, err := url.Parse(dsn)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") && u.Host != "",
+			"db.shards must be postgresql:// URLs")
+	}
+	check(c.DB.SagaRecoveryInterval > 0, "db.saga_recovery_interval must be positive")
+	check(c.DB.SagaTimeout > 0, "db.saga_timeout must be positive")
+	check(oneOf(c.Log.Level, logLevels), "log.level must be one of %s", strings.Join(logLevels, ", "))
+	check(oneOf(c.Log.Format, logFormats), "log.format must be one of %s", strings.Join(logFormats, ", "))
+	check(c.Trace.Exporter == "" || c.Trace.Exporter == "stdout" || strings.HasPrefix(c.Trace.Exporter, "http://") ||
+		strings.HasPrefix(c.Trace.Exporter, "https://"), "trace.exporter must be stdout or URL")
+	check(c.Rate.Principal >= 0, "rate.principal must not be negative")
+	check(c.Rate.IP >= 0, "rate.ip must not be negative")
+	check(c.Rate.Burst >= 0, "rate.burst must not be negative")
+	check(c.Rate.MaxConcurrentTransfers >= 0, "rate.max_concurrent_transfers must not be negative")
+	if c.Reconcile.Enabled() {
+		_, err := time.Parse(timeOfDayLayout, c.Reconcile.At)
+		check(err == nil, "reconcile.at must be time of day HH:MM")
+	}
+	check(c.Snapshot.Interval >= 0, "snapshot.interval must not be negative")
+	if c.Outbox.Enabled() {
+		check(oneOf(c.Outbox.Publisher, outboxPublishers), "outbox.publisher must be one of %s", strings.Join(outboxPublishers, ", "))
+		check(c.Outbox.Target != "", "outbox.target is required")
+		switch c.Outbox.Publisher {
+		case "nats":
+			check(strings.HasPrefix(c.Outbox.Target, "nats://"), "outbox.target must be nats:// URL")
+		case "kafka":
+			check(strings.HasPrefix(c.Outbox.Target, "http://") || strings.HasPrefix(c.Outbox.Target, "https://"),
+				"outbox.target must be URL")
+		}
+		check(c.Outbox.Publisher == "file" || c.Outbox.Topic != "", "outbox.topic is required")
+		check(c.Outbox.Relay != "" && len(c.Outbox.Relay) <= 40, "outbox.relay must be 1..40 characters")
+		check(c.Outbox.Interval > 0, "outbox.interval must be positive")
+	}
+	if c.Payout.Enabled() {
+		check(oneOf(c.Payout.Connector, payoutConnectors), "payout.connector must be one of %s", strings.Join(payoutConnectors, ", "))
+		check(c.Payout.Interval > 0, "payout.interval must be positive")
+		check(c.Payout.MaxAttempts > 0, "payout.max_attempts must be positive")
+	}
+	if c.Events.Sourcing {
+		check(c.Events.SnapshotEvery > 0, "events.snapshot_every must be positive")
+		check(len(c.DB.ShardDSNs()) == 0, "events.sourcing is not supported with db.shards")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func oneOf(v string, values []string) bool {
+	for _, value := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes effective configuration to w in config file format with secrets masked.
+func (c *Config) Print(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if c.File != "" {
+		fmt.Fprintf(bw, "# config file: %s\n", c.File)
+	}
+	section := ""
+	for _, s := range c.settings() {
+		i := strings.Index(s.key, ".")
+		if s.key[:i] != section {
+			section = s.key[:i]
+			fmt.Fprintf(bw, "%s:\n", section)
+		}
+		v := s.get()
+		if s.secret && v != "" {
+			v = masked
+		}
+		if _, ok := s.value.(*string); ok {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(bw, "  %s: %s\n", s.key[i+1:], v)
+	}
+	return bw.Flush()
+}
+
+// DSN returns connection string of database.
+func (c DBConfig) DSN() string {
+	query := url.Values{}
+	query.Set("sslmode", c.SSLMode)
+	if c.SSLCert != "" {
+		query.Set("sslcert", c.SSLCert)
+		query.Set("sslkey", c.SSLKey)
+	}
+	if c.SSLRootCert != "" {
+		query.Set("sslrootcert", c.SSLRootCert)
+	}
+	if c.ConnectTimeout > 0 {
+		query.Set("connect_timeout", strconv.Itoa(int((c.ConnectTimeout+time.Second-1)/time.Second)))
+	}
+	if c.StatementTimeout > 0 {
+		// unknown parameters are sent to server as run-time parameters
+		query.Set("statement_timeout", strconv.FormatInt(int64(c.StatementTimeout/time.Millisecond), 10))
+	}
+	DSN := &url.URL{
+		Scheme:   "postgresql",
+		RawQuery: query.Encode(),
+		Host:     c.Host + ":" + strconv.Itoa(c.Port),
+		Path:     c.Name,
+		User:     url.UserPassword(c.User, c.Password),
+	}
+	return DSN.String()
+}
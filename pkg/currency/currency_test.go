@@ -0,0 +1,55 @@
+package currency
+
+import "testing"
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(
+		Currency{Code: "RUB", Exponent: -1, Enabled: false},
+		Currency{Code: "JPY", Exponent: 2, Enabled: true},
+		Currency{Code: "XTS", Numeric: 963, Exponent: -1, Enabled: true},
+	)
+
+	// test overrides keep unset fields of ISO 4217
+	if c, ok := r.Lookup("RUB"); !ok || c.Numeric != 643 || c.Exponent != 2 || c.Enabled {
+		t.Errorf("Unexpected RUB: %+v", c)
+	}
+	if c, _ := r.Lookup("JPY"); c.Numeric != 392 || c.Exponent != 2 {
+		t.Errorf("Unexpected JPY: %+v", c)
+	}
+	if c, ok := r.Lookup("XTS"); !ok || c.Exponent != DefaultExponent || !r.Enabled("XTS") {
+		t.Errorf("Unexpected XTS: %+v", c)
+	}
+	if r.Enabled("RUB") || r.Enabled("XYZ") || !r.Enabled("USD") {
+		t.Error("Only known currencies which are not disabled should be enabled")
+	}
+	currencies := r.Currencies()
+	if len(currencies) != len(iso4217)+1 || currencies[0].Code != "AED" {
+		t.Errorf("Unexpected currencies: %d, first %+v", len(currencies), currencies[0])
+	}
+
+	// test amounts follow exponent of currency
+	for _, test := range []struct {
+		code      string
+		amount    float64
+		rounded   float64
+		formatted string
+		fits      bool
+	}{
+		{"USD", 10.005, 10.01, "10.01", false},
+		{"USD", 0.1 + 0.2, 0.3, "0.30", true},
+		{"KWD", 1.2345, 1.235, "1.235", false},
+		{"KWD", 1.234, 1.234, "1.234", true},
+		{"ISK", 99.5, 100, "100", false},
+		{"CLF", 0.0001, 0.0001, "0.0001", true},
+	} {
+		if rounded := NewRegistry().Round(test.amount, test.code); rounded != test.rounded {
+			t.Errorf("%v %s should be rounded to %v, got %v", test.amount, test.code, test.rounded, rounded)
+		}
+		if formatted := Format(test.rounded, test.code); formatted != test.formatted {
+			t.Errorf("%v %s should be formatted as %s, got %s", test.rounded, test.code, test.formatted, formatted)
+		}
+		if fits := Fits(test.amount, test.code); fits != test.fits {
+			t.Errorf("%v %s should fit into minor units: %t", test.amount, test.code, test.fits)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package endpoint
+
+import (
+	"context"
+	"net/http"
+
+	ep "github.com/go-kit/kit/endpoint"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// ErrAdminRequired error fired when admin endpoint is called by principal, which
+// is not authenticated or is not an admin
+var ErrAdminRequired = errs.New("admin_required", "Authenticated admin principal required", http.StatusForbidden)
+
+// AdminMiddleware returns an endpoint middleware, which rejects requests unless
+// their principal is authenticated by transport and is one of admins. Claimed
+// principals are never admins, nobody is if admins are empty.
+func AdminMiddleware(admins []string) ep.Middleware {
+	allowed := make(map[string]bool, len(admins))
+	for _, admin := range admins {
+		allowed[admin] = true
+	}
+	return func(next ep.Endpoint) ep.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if !service.PrincipalAuthenticated(ctx) || !allowed[service.PrincipalFromContext(ctx)] {
+				return nil, ErrAdminRequired
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	ep "github.com/go-kit/kit/endpoint"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// ErrCircuitOpen error fired by client when remote service is considered down
+var ErrCircuitOpen = errs.NewRetryable("circuit_open", "Circuit breaker is open", http.StatusServiceUnavailable)
+
+// CircuitBreaker stops calls to remote service for cooldown period after number of
+// consecutive failures, then lets one trial call through (half-open state).
+// Failures are transport errors and errors which are retryable or internal (5xx);
+// errors of request, like insufficient funds, are answers of healthy service.
+type CircuitBreaker struct {
+	failures  int
+	cooldown  time.Duration
+	count     int
+	openUntil time.Time
+	trial     bool
+	mutex     sync.Mutex
+}
+
+// NewCircuitBreaker returns CircuitBreaker opening after failures in a row for cooldown.
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failures: failures,
+		cooldown: cooldown,
+	}
+}
+
+// Middleware returns an endpoint middleware guarded by the breaker.
+// The same breaker may guard all endpoints of remote service.
+func (cb *CircuitBreaker) Middleware() ep.Middleware {
+	return func(next ep.Endpoint) ep.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			allowed, trial := cb.allow()
+			if !allowed {
+				return nil, ErrCircuitOpen
+			}
+			response, err := next(ctx, request)
+			if err != nil {
+				cb.done(trial, serviceFailure(err))
+			} else {
+				cb.done(trial, serviceFailure(failed(response)))
+			}
+			return response, err
+		}
+	}
+}
+
+// allow reports whether call may be made and whether it is the trial call of
+// half-open breaker.
+func (cb *CircuitBreaker) allow() (allowed, trial bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.count < cb.failures {
+		return true, false
+	}
+	if time.Now().Before(cb.openUntil) || cb.trial {
+		return false, false
+	}
+	cb.trial = true
+	return true, true
+}
+
+// done records outcome of call, only the trial call ends half-open state, as
+// calls started before breaker opened may finish meanwhile.
+func (cb *CircuitBreaker) done(trial, failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if trial {
+		cb.trial = false
+	}
+	if !failed {
+		cb.count = 0
+		return
+	}
+	cb.count++
+	if cb.count >= cb.failures {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// serviceFailure reports whether err of call tells remote service is failing:
+// transport errors and domain errors which are retryable or internal.
+func serviceFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var e *errs.Error
+	if errors.As(err, &e) {
+		return e.Retryable || e.Status >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// RetryMiddleware returns an endpoint middleware, which repeats call up to retries
+// times with growing backoff. Requests rejected without processing (rate limited,
+// overloaded, circuit open) are always repeated, other failures only if idempotent
+// is true, as request could have been processed already.
+func RetryMiddleware(retries int, backoff time.Duration, idempotent bool) ep.Middleware {
+	return func(next ep.Endpoint) ep.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			delay := backoff
+			for attempt := 0; ; attempt++ {
+				response, err = next(ctx, request)
+				if attempt == retries || !shouldRetry(response, err, idempotent) {
+					return response, err
+				}
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return response, err
+				}
+				delay *= 2
+			}
+		}
+	}
+}
+
+func shouldRetry(response interface{}, err error, idempotent bool) bool {
+	if err == nil {
+		err = failed(response)
+	}
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrOverloaded) || errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var e *errs.Error
+	if errors.As(err, &e) {
+		return idempotent && e.Retryable
+	}
+	// transport error
+	return idempotent
+}
+
+func failed(response interface{}) error {
+	if f, ok := response.(ep.Failer); ok {
+		return f.Failed()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int
+	var result error
+	cb := NewCircuitBreaker(2, time.Hour)
+	e := cb.Middleware()(func(ctx context.Context, request interface{}) (interface{}, error) {
+		calls++
+		return nil, result
+	})
+	ctx := context.Background()
+
+	// test errors of requests don't open breaker
+	result = errs.New("test_invalid", "Invalid", http.StatusBadRequest)
+	for i := 0; i < 3; i++ {
+		_, _ = e(ctx, nil)
+	}
+	if _, err := e(ctx, nil); errors.Is(err, ErrCircuitOpen) || calls != 4 {
+		t.Errorf("Breaker should stay closed on errors of requests, got %v after %d calls", err, calls)
+	}
+
+	// test transport and internal errors open breaker
+	result = errs.New("test_internal", "Internal", http.StatusInternalServerError)
+	_, _ = e(ctx, nil)
+	result = errors.New("connection refused")
+	_, _ = e(ctx, nil)
+	if _, err := e(ctx, nil); !errors.Is(err, ErrCircuitOpen) || calls != 6 {
+		t.Errorf("Error should be: %v after 6 calls, got %v after %d", ErrCircuitOpen, err, calls)
+	}
+}
+
+func TestCircuitBreakerTrial(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Millisecond)
+	if allowed, trial := cb.allow(); !allowed || trial {
+		t.Fatal("Closed breaker should allow calls")
+	}
+	cb.done(false, true)
+	time.Sleep(2 * time.Millisecond)
+
+	// test only one trial call is let through while half-open
+	if allowed, trial := cb.allow(); !allowed || !trial {
+		t.Fatal("Trial call should be allowed after cooldown")
+	}
+	if allowed, _ := cb.allow(); allowed {
+		t.Error("Second call should not be allowed while trial is in flight")
+	}
+
+	// test call started before breaker opened doesn't end half-open state
+	cb.done(false, true)
+	time.Sleep(2 * time.Millisecond)
+	if allowed, _ := cb.allow(); allowed {
+		t.Error("Call should not be allowed until trial finishes")
+	}
+	cb.done(true, false)
+	if allowed, trial := cb.allow(); !allowed || trial {
+		t.Error("Breaker should close after successful trial")
+	}
+}
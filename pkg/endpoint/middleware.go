@@ -7,6 +7,8 @@ import (
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+
+	"github.com/khaliullov/payment-system/pkg/tracing"
 )
 
 // LoggingMiddleware returns an endpoint middleware that logs the
@@ -15,9 +17,28 @@ func LoggingMiddleware(logger log.Logger) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 			defer func(begin time.Time) {
-				_ = level.Info(logger).Log("transport_error", err, "took", time.Since(begin))
+				_ = level.Info(logger).Log("request_id", tracing.RequestIDFromContext(ctx), "transport_error", err,
+					"took", time.Since(begin))
 			}(time.Now())
 			return next(ctx, request)
 		}
 	}
 }
+
+// TracingMiddleware returns an endpoint middleware that wraps each invocation
+// into a span, failed responses mark span with their error.
+func TracingMiddleware(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			ctx, span := tracing.StartSpan(ctx, "endpoint."+name, tracing.KindInternal)
+			defer func() {
+				if f, ok := response.(endpoint.Failer); ok && err == nil {
+					span.Finish(f.Failed())
+					return
+				}
+				span.Finish(err)
+			}()
+			return next(ctx, request)
+		}
+	}
+}
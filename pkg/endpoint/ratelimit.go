@@ -0,0 +1,158 @@
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	ep "github.com/go-kit/kit/endpoint"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+var (
+	// ErrRateLimited error fired when client exceeds its request rate
+	ErrRateLimited = errs.NewRetryable("rate_limited", "Rate limit exceeded", http.StatusTooManyRequests)
+
+	// ErrOverloaded error fired when too many requests are processed concurrently
+	ErrOverloaded = errs.NewRetryable("overloaded", "Too many concurrent requests", http.StatusServiceUnavailable)
+)
+
+// Limits configures protection of endpoints from flooding. Zero value of any limit means "no limit".
+type Limits struct {
+	// PrincipalRate is a number of requests per second allowed to API principal
+	PrincipalRate float64
+	// IPRate is a number of requests per second allowed from source IP address
+	IPRate float64
+	// Burst is a number of requests allowed at once above the rate
+	Burst int
+	// MaxConcurrentTransfers is a number of transfers processed at once by instance
+	MaxConcurrentTransfers int
+}
+
+// TokenBucket is a token bucket rate limiter.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// NewTokenBucket returns full bucket refilled with rate tokens per second up to burst tokens.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes token from bucket, it reports false if bucket is empty.
+func (tb *TokenBucket) Allow() bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// idle returns true if bucket is full again, so it may be forgotten.
+func (tb *TokenBucket) idle(now time.Time) bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return tb.tokens+now.Sub(tb.last).Seconds()*tb.rate >= tb.burst
+}
+
+// keyedLimiterSweep is an interval of forgetting idle buckets of KeyedLimiter
+const keyedLimiterSweep = time.Minute
+
+// KeyedLimiter keeps separate token bucket for every key (principal, IP address).
+type KeyedLimiter struct {
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+	swept   time.Time
+	mutex   sync.Mutex
+}
+
+// NewKeyedLimiter returns KeyedLimiter allowing rate requests per second for every key.
+func NewKeyedLimiter(rate float64, burst int) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*TokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow takes token from bucket of key, it reports false if bucket is empty.
+func (kl *KeyedLimiter) Allow(key string) bool {
+	kl.mutex.Lock()
+	now := time.Now()
+	if now.Sub(kl.swept) > keyedLimiterSweep {
+		for k, bucket := range kl.buckets {
+			if bucket.idle(now) {
+				delete(kl.buckets, k)
+			}
+		}
+		kl.swept = now
+	}
+	bucket, ok := kl.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(kl.rate, kl.burst)
+		kl.buckets[key] = bucket
+	}
+	kl.mutex.Unlock()
+	return bucket.Allow()
+}
+
+// RateLimitMiddleware returns an endpoint middleware, which rejects requests exceeding
+// rate of their principal or source IP address. Requests without authenticated principal
+// are limited by IP only, so claimed principals can't be used to spread them over buckets.
+// Limiters are shared, so the same limiters should be passed for all endpoints.
+func RateLimitMiddleware(byPrincipal, byIP *KeyedLimiter) ep.Middleware {
+	return func(next ep.Endpoint) ep.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if byPrincipal != nil && service.PrincipalAuthenticated(ctx) &&
+				!byPrincipal.Allow(service.PrincipalFromContext(ctx)) {
+				return nil, ErrRateLimited
+			}
+			if byIP != nil && !byIP.Allow(service.ClientIPFromContext(ctx)) {
+				return nil, ErrRateLimited
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// ConcurrencyLimitMiddleware returns an endpoint middleware, which rejects requests
+// when max requests are already being processed.
+func ConcurrencyLimitMiddleware(max int) ep.Middleware {
+	slots := make(chan struct{}, max)
+	return func(next ep.Endpoint) ep.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				return next(ctx, request)
+			default:
+				return nil, ErrOverloaded
+			}
+		}
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"time"
 
 	ep "github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/export"
 	"github.com/khaliullov/payment-system/pkg/repository"
 	"github.com/khaliullov/payment-system/pkg/service"
 )
@@ -20,36 +24,213 @@ type Set struct {
 	AccountEndpoint            ep.Endpoint
 	TransactionHistoryEndpoint ep.Endpoint
 	TransferEndpoint           ep.Endpoint
+	LimitsEndpoint             ep.Endpoint
+	SetLimitsEndpoint          ep.Endpoint
+	QuoteEndpoint              ep.Endpoint
+	FeeScheduleEndpoint        ep.Endpoint
+	SetFeeScheduleEndpoint     ep.Endpoint
+	SetCreditLimitEndpoint     ep.Endpoint
+	FreezeEndpoint             ep.Endpoint
+	FreezeHistoryEndpoint      ep.Endpoint
+	AuditLogEndpoint           ep.Endpoint
+	ExportTransactionsEndpoint ep.Endpoint
+	ImportAccountsEndpoint     ep.Endpoint
+	BalanceAtEndpoint          ep.Endpoint
+	CurrenciesEndpoint         ep.Endpoint
+	ActivityEndpoint           ep.Endpoint
+	PayoutEndpoint             ep.Endpoint
+	PaymentEndpoint            ep.Endpoint
 }
 
 // New returns a Set that wraps the provided server, and wires in all of the
-// expected endpoint middlewares via the various parameters.
-func New(svc service.Service, logger log.Logger) Set {
+// expected endpoint middlewares via the various parameters. Admin endpoints
+// may be called by authenticated admins only.
+func New(svc service.Service, limits Limits, logger log.Logger, admins ...string) Set {
+	admin := AdminMiddleware(admins)
+	rateLimit := func(next ep.Endpoint) ep.Endpoint { return next }
+	if limits.PrincipalRate > 0 || limits.IPRate > 0 {
+		var byPrincipal, byIP *KeyedLimiter
+		if limits.PrincipalRate > 0 {
+			byPrincipal = NewKeyedLimiter(limits.PrincipalRate, limits.Burst)
+		}
+		if limits.IPRate > 0 {
+			byIP = NewKeyedLimiter(limits.IPRate, limits.Burst)
+		}
+		rateLimit = RateLimitMiddleware(byPrincipal, byIP)
+	}
 	var healthCheckEndpoint ep.Endpoint
 	{
 		healthCheckEndpoint = MakeHealthCheckEndpoint(svc)
+		healthCheckEndpoint = TracingMiddleware("HealthCheck")(healthCheckEndpoint)
 		healthCheckEndpoint = LoggingMiddleware(log.With(logger, "method", "HealthCheck"))(healthCheckEndpoint)
 	}
 	var accountEndpoint ep.Endpoint
 	{
 		accountEndpoint = MakeAccountEndpoint(svc)
+		accountEndpoint = rateLimit(accountEndpoint)
+		accountEndpoint = TracingMiddleware("Account")(accountEndpoint)
 		accountEndpoint = LoggingMiddleware(log.With(logger, "method", "Account"))(accountEndpoint)
 	}
 	var transactionHistoryEndpoint ep.Endpoint
 	{
 		transactionHistoryEndpoint = MakeTransactionHistoryEndpoint(svc)
+		transactionHistoryEndpoint = rateLimit(transactionHistoryEndpoint)
+		transactionHistoryEndpoint = TracingMiddleware("TransactionHistory")(transactionHistoryEndpoint)
 		transactionHistoryEndpoint = LoggingMiddleware(log.With(logger, "method", "TransactionHistory"))(transactionHistoryEndpoint)
 	}
 	var transferEndpoint ep.Endpoint
 	{
 		transferEndpoint = MakeTransferEndpoint(svc)
+		if limits.MaxConcurrentTransfers > 0 {
+			transferEndpoint = ConcurrencyLimitMiddleware(limits.MaxConcurrentTransfers)(transferEndpoint)
+		}
+		transferEndpoint = rateLimit(transferEndpoint)
+		transferEndpoint = TracingMiddleware("Transfer")(transferEndpoint)
 		transferEndpoint = LoggingMiddleware(log.With(logger, "method", "Transfer"))(transferEndpoint)
 	}
+	var limitsEndpoint ep.Endpoint
+	{
+		limitsEndpoint = MakeLimitsEndpoint(svc)
+		limitsEndpoint = rateLimit(limitsEndpoint)
+		limitsEndpoint = TracingMiddleware("Limits")(limitsEndpoint)
+		limitsEndpoint = LoggingMiddleware(log.With(logger, "method", "Limits"))(limitsEndpoint)
+	}
+	var setLimitsEndpoint ep.Endpoint
+	{
+		setLimitsEndpoint = MakeSetLimitsEndpoint(svc)
+		setLimitsEndpoint = admin(setLimitsEndpoint)
+		setLimitsEndpoint = rateLimit(setLimitsEndpoint)
+		setLimitsEndpoint = TracingMiddleware("SetLimits")(setLimitsEndpoint)
+		setLimitsEndpoint = LoggingMiddleware(log.With(logger, "method", "SetLimits"))(setLimitsEndpoint)
+	}
+	var quoteEndpoint ep.Endpoint
+	{
+		quoteEndpoint = MakeQuoteEndpoint(svc)
+		quoteEndpoint = rateLimit(quoteEndpoint)
+		quoteEndpoint = TracingMiddleware("Quote")(quoteEndpoint)
+		quoteEndpoint = LoggingMiddleware(log.With(logger, "method", "Quote"))(quoteEndpoint)
+	}
+	var feeScheduleEndpoint ep.Endpoint
+	{
+		feeScheduleEndpoint = MakeFeeScheduleEndpoint(svc)
+		feeScheduleEndpoint = rateLimit(feeScheduleEndpoint)
+		feeScheduleEndpoint = TracingMiddleware("FeeSchedule")(feeScheduleEndpoint)
+		feeScheduleEndpoint = LoggingMiddleware(log.With(logger, "method", "FeeSchedule"))(feeScheduleEndpoint)
+	}
+	var setFeeScheduleEndpoint ep.Endpoint
+	{
+		setFeeScheduleEndpoint = MakeSetFeeScheduleEndpoint(svc)
+		setFeeScheduleEndpoint = admin(setFeeScheduleEndpoint)
+		setFeeScheduleEndpoint = rateLimit(setFeeScheduleEndpoint)
+		setFeeScheduleEndpoint = TracingMiddleware("SetFeeSchedule")(setFeeScheduleEndpoint)
+		setFeeScheduleEndpoint = LoggingMiddleware(log.With(logger, "method", "SetFeeSchedule"))(setFeeScheduleEndpoint)
+	}
+	var setCreditLimitEndpoint ep.Endpoint
+	{
+		setCreditLimitEndpoint = MakeSetCreditLimitEndpoint(svc)
+		setCreditLimitEndpoint = admin(setCreditLimitEndpoint)
+		setCreditLimitEndpoint = rateLimit(setCreditLimitEndpoint)
+		setCreditLimitEndpoint = TracingMiddleware("SetCreditLimit")(setCreditLimitEndpoint)
+		setCreditLimitEndpoint = LoggingMiddleware(log.With(logger, "method", "SetCreditLimit"))(setCreditLimitEndpoint)
+	}
+	var freezeEndpoint ep.Endpoint
+	{
+		freezeEndpoint = MakeFreezeEndpoint(svc)
+		freezeEndpoint = admin(freezeEndpoint)
+		freezeEndpoint = rateLimit(freezeEndpoint)
+		freezeEndpoint = TracingMiddleware("Freeze")(freezeEndpoint)
+		freezeEndpoint = LoggingMiddleware(log.With(logger, "method", "Freeze"))(freezeEndpoint)
+	}
+	var freezeHistoryEndpoint ep.Endpoint
+	{
+		freezeHistoryEndpoint = MakeFreezeHistoryEndpoint(svc)
+		freezeHistoryEndpoint = admin(freezeHistoryEndpoint)
+		freezeHistoryEndpoint = rateLimit(freezeHistoryEndpoint)
+		freezeHistoryEndpoint = TracingMiddleware("FreezeHistory")(freezeHistoryEndpoint)
+		freezeHistoryEndpoint = LoggingMiddleware(log.With(logger, "method", "FreezeHistory"))(freezeHistoryEndpoint)
+	}
+	var auditLogEndpoint ep.Endpoint
+	{
+		auditLogEndpoint = MakeAuditLogEndpoint(svc)
+		auditLogEndpoint = admin(auditLogEndpoint)
+		auditLogEndpoint = rateLimit(auditLogEndpoint)
+		auditLogEndpoint = TracingMiddleware("AuditLog")(auditLogEndpoint)
+		auditLogEndpoint = LoggingMiddleware(log.With(logger, "method", "AuditLog"))(auditLogEndpoint)
+	}
+	var exportTransactionsEndpoint ep.Endpoint
+	{
+		exportTransactionsEndpoint = MakeExportTransactionsEndpoint(svc)
+		exportTransactionsEndpoint = rateLimit(exportTransactionsEndpoint)
+		exportTransactionsEndpoint = TracingMiddleware("ExportTransactions")(exportTransactionsEndpoint)
+		exportTransactionsEndpoint = LoggingMiddleware(log.With(logger, "method", "ExportTransactions"))(exportTransactionsEndpoint)
+	}
+	var importAccountsEndpoint ep.Endpoint
+	{
+		importAccountsEndpoint = MakeImportAccountsEndpoint(svc)
+		importAccountsEndpoint = admin(importAccountsEndpoint)
+		importAccountsEndpoint = rateLimit(importAccountsEndpoint)
+		importAccountsEndpoint = TracingMiddleware("ImportAccounts")(importAccountsEndpoint)
+		importAccountsEndpoint = LoggingMiddleware(log.With(logger, "method", "ImportAccounts"))(importAccountsEndpoint)
+	}
+	var balanceAtEndpoint ep.Endpoint
+	{
+		balanceAtEndpoint = MakeBalanceAtEndpoint(svc)
+		balanceAtEndpoint = rateLimit(balanceAtEndpoint)
+		balanceAtEndpoint = TracingMiddleware("BalanceAt")(balanceAtEndpoint)
+		balanceAtEndpoint = LoggingMiddleware(log.With(logger, "method", "BalanceAt"))(balanceAtEndpoint)
+	}
+	var currenciesEndpoint ep.Endpoint
+	{
+		currenciesEndpoint = MakeCurrenciesEndpoint(svc)
+		currenciesEndpoint = rateLimit(currenciesEndpoint)
+		currenciesEndpoint = TracingMiddleware("Currencies")(currenciesEndpoint)
+		currenciesEndpoint = LoggingMiddleware(log.With(logger, "method", "Currencies"))(currenciesEndpoint)
+	}
+	var activityEndpoint ep.Endpoint
+	{
+		activityEndpoint = MakeActivityEndpoint(svc)
+		activityEndpoint = rateLimit(activityEndpoint)
+		activityEndpoint = TracingMiddleware("Activity")(activityEndpoint)
+		activityEndpoint = LoggingMiddleware(log.With(logger, "method", "Activity"))(activityEndpoint)
+	}
+	var payoutEndpoint ep.Endpoint
+	{
+		payoutEndpoint = MakePayoutEndpoint(svc)
+		if limits.MaxConcurrentTransfers > 0 {
+			payoutEndpoint = ConcurrencyLimitMiddleware(limits.MaxConcurrentTransfers)(payoutEndpoint)
+		}
+		payoutEndpoint = rateLimit(payoutEndpoint)
+		payoutEndpoint = TracingMiddleware("Payout")(payoutEndpoint)
+		payoutEndpoint = LoggingMiddleware(log.With(logger, "method", "Payout"))(payoutEndpoint)
+	}
+	var paymentEndpoint ep.Endpoint
+	{
+		paymentEndpoint = MakePaymentEndpoint(svc)
+		paymentEndpoint = rateLimit(paymentEndpoint)
+		paymentEndpoint = TracingMiddleware("Payment")(paymentEndpoint)
+		paymentEndpoint = LoggingMiddleware(log.With(logger, "method", "Payment"))(paymentEndpoint)
+	}
 	return Set{
 		HealthCheckEndpoint:        healthCheckEndpoint,
 		AccountEndpoint:            accountEndpoint,
 		TransactionHistoryEndpoint: transactionHistoryEndpoint,
 		TransferEndpoint:           transferEndpoint,
+		LimitsEndpoint:             limitsEndpoint,
+		SetLimitsEndpoint:          setLimitsEndpoint,
+		QuoteEndpoint:              quoteEndpoint,
+		FeeScheduleEndpoint:        feeScheduleEndpoint,
+		SetFeeScheduleEndpoint:     setFeeScheduleEndpoint,
+		SetCreditLimitEndpoint:     setCreditLimitEndpoint,
+		FreezeEndpoint:             freezeEndpoint,
+		FreezeHistoryEndpoint:      freezeHistoryEndpoint,
+		AuditLogEndpoint:           auditLogEndpoint,
+		ExportTransactionsEndpoint: exportTransactionsEndpoint,
+		ImportAccountsEndpoint:     importAccountsEndpoint,
+		BalanceAtEndpoint:          balanceAtEndpoint,
+		CurrenciesEndpoint:         currenciesEndpoint,
+		ActivityEndpoint:           activityEndpoint,
+		PayoutEndpoint:             payoutEndpoint,
+		PaymentEndpoint:            paymentEndpoint,
 	}
 }
 
@@ -66,7 +247,7 @@ func (s Set) HealthCheck(ctx context.Context) (bool, error) {
 
 // Account implements the service interface, so Set may be used as a service.
 // This is primarily useful in the context of a client library.
-func (s Set) Account(ctx context.Context) ([]*repository.Account, error) {
+func (s Set) Account(ctx context.Context) ([]*repository.Holder, error) {
 	resp, err := s.AccountEndpoint(ctx, AccountRequest{})
 	if err != nil {
 		return nil, err
@@ -94,7 +275,106 @@ func (s Set) Transfer(ctx context.Context, from, to string, amount float64, curr
 		return nil, err
 	}
 	response := resp.(TransferResponse)
-	return nil, response.Error
+	return response.Transaction, response.Error
+}
+
+// Limits implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Limits(ctx context.Context, userID string) (*repository.Limits, *repository.LimitUsage, error) {
+	resp, err := s.LimitsEndpoint(ctx, LimitsRequest{UserID: userID})
+	if err != nil {
+		return nil, nil, err
+	}
+	response := resp.(LimitsResponse)
+	return response.Limits, response.Usage, response.Error
+}
+
+// SetLimits implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) SetLimits(ctx context.Context, limits *repository.Limits) error {
+	resp, err := s.SetLimitsEndpoint(ctx, SetLimitsRequest{Limits: limits})
+	if err != nil {
+		return err
+	}
+	response := resp.(SetLimitsResponse)
+	return response.Error
+}
+
+// Quote implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Quote(ctx context.Context, from, to string, amount float64, currency string) (*repository.Quote, error) {
+	resp, err := s.QuoteEndpoint(ctx, TransferRequest{From: from, To: to, Amount: amount, Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(QuoteResponse)
+	return response.Quote, response.Error
+}
+
+// FeeSchedule implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) FeeSchedule(ctx context.Context, currency string) (*repository.FeeSchedule, error) {
+	resp, err := s.FeeScheduleEndpoint(ctx, FeeScheduleRequest{Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(FeeScheduleResponse)
+	return response.Schedule, response.Error
+}
+
+// SetFeeSchedule implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) SetFeeSchedule(ctx context.Context, schedule *repository.FeeSchedule) error {
+	resp, err := s.SetFeeScheduleEndpoint(ctx, SetFeeScheduleRequest{Schedule: schedule})
+	if err != nil {
+		return err
+	}
+	response := resp.(SetFeeScheduleResponse)
+	return response.Error
+}
+
+// SetCreditLimit implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) SetCreditLimit(ctx context.Context, userID string, creditLimit float64) error {
+	resp, err := s.SetCreditLimitEndpoint(ctx, SetCreditLimitRequest{UserID: userID, CreditLimit: creditLimit})
+	if err != nil {
+		return err
+	}
+	response := resp.(SetCreditLimitResponse)
+	return response.Error
+}
+
+// Freeze implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Freeze(ctx context.Context, userID, state, reason, comment string) error {
+	resp, err := s.FreezeEndpoint(ctx, FreezeRequest{UserID: userID, State: state, Reason: reason, Comment: comment})
+	if err != nil {
+		return err
+	}
+	response := resp.(FreezeResponse)
+	return response.Error
+}
+
+// FreezeHistory implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) FreezeHistory(ctx context.Context, userID string) ([]*repository.FreezeRecord, error) {
+	resp, err := s.FreezeHistoryEndpoint(ctx, FreezeHistoryRequest{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(FreezeHistoryResponse)
+	return response.History, response.Error
+}
+
+// AuditLog implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) AuditLog(ctx context.Context, after int64, limit int) ([]*repository.AuditRecord, error) {
+	resp, err := s.AuditLogEndpoint(ctx, AuditLogRequest{After: after, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(AuditLogResponse)
+	return response.Records, response.Error
 }
 
 // MakeHealthCheckEndpoint constructs a HealthCheck endpoint wrapping the service.
@@ -133,12 +413,237 @@ func MakeTransactionHistoryEndpoint(s service.Service) ep.Endpoint {
 func MakeTransferEndpoint(s service.Service) ep.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(TransferRequest)
-		_, err = s.Transfer(ctx, req.From, req.To, req.Amount, req.Currency)
+		v, err := s.Transfer(ctx, req.From, req.To, req.Amount, req.Currency)
 		success := false
 		if err == nil {
 			success = true
+		} else {
+			v = nil
 		}
-		return TransferResponse{Success: success, Error: err}, nil
+		return TransferResponse{Success: success, Transaction: v, Error: err}, nil
+	}
+}
+
+// MakeLimitsEndpoint constructs a Limits endpoint wrapping the service.
+func MakeLimitsEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(LimitsRequest)
+		limits, usage, err := s.Limits(ctx, req.UserID)
+		return LimitsResponse{Success: err == nil, Limits: limits, Usage: usage, Error: err}, nil
+	}
+}
+
+// MakeSetLimitsEndpoint constructs a SetLimits endpoint wrapping the service.
+func MakeSetLimitsEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SetLimitsRequest)
+		err = s.SetLimits(ctx, req.Limits)
+		return SetLimitsResponse{Success: err == nil, Error: err}, nil
+	}
+}
+
+// MakeQuoteEndpoint constructs a Quote endpoint wrapping the service.
+func MakeQuoteEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(TransferRequest)
+		v, err := s.Quote(ctx, req.From, req.To, req.Amount, req.Currency)
+		return QuoteResponse{Success: err == nil, Quote: v, Error: err}, nil
+	}
+}
+
+// MakeFeeScheduleEndpoint constructs a FeeSchedule endpoint wrapping the service.
+func MakeFeeScheduleEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(FeeScheduleRequest)
+		v, err := s.FeeSchedule(ctx, req.Currency)
+		return FeeScheduleResponse{Success: err == nil, Schedule: v, Error: err}, nil
+	}
+}
+
+// MakeSetFeeScheduleEndpoint constructs a SetFeeSchedule endpoint wrapping the service.
+func MakeSetFeeScheduleEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SetFeeScheduleRequest)
+		err = s.SetFeeSchedule(ctx, req.Schedule)
+		return SetFeeScheduleResponse{Success: err == nil, Error: err}, nil
+	}
+}
+
+// MakeSetCreditLimitEndpoint constructs a SetCreditLimit endpoint wrapping the service.
+func MakeSetCreditLimitEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SetCreditLimitRequest)
+		err = s.SetCreditLimit(ctx, req.UserID, req.CreditLimit)
+		return SetCreditLimitResponse{Success: err == nil, Error: err}, nil
+	}
+}
+
+// MakeFreezeEndpoint constructs a Freeze endpoint wrapping the service.
+func MakeFreezeEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(FreezeRequest)
+		err = s.Freeze(ctx, req.UserID, req.State, req.Reason, req.Comment)
+		return FreezeResponse{Success: err == nil, Error: err}, nil
+	}
+}
+
+// MakeFreezeHistoryEndpoint constructs a FreezeHistory endpoint wrapping the service.
+func MakeFreezeHistoryEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(FreezeHistoryRequest)
+		v, err := s.FreezeHistory(ctx, req.UserID)
+		return FreezeHistoryResponse{Success: err == nil, History: v, Error: err}, nil
+	}
+}
+
+// ExportTransactions implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) ExportTransactions(ctx context.Context, filter *repository.TransactionFilter) (repository.TransactionCursor, error) {
+	resp, err := s.ExportTransactionsEndpoint(ctx, ExportTransactionsRequest{Filter: filter, Format: export.FormatJSONL})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(ExportTransactionsResponse)
+	return response.Cursor, response.Error
+}
+
+// ImportAccounts implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) ImportAccounts(ctx context.Context, rows []*repository.AccountImport, options *repository.ImportOptions) (*repository.ImportReport, error) {
+	resp, err := s.ImportAccountsEndpoint(ctx, ImportAccountsRequest{Rows: rows, Options: options})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(ImportAccountsResponse)
+	if response.Report == nil && response.Error != nil {
+		// report of failed import is carried by error
+		return service.ImportReportFromError(response.Error), response.Error
+	}
+	return response.Report, response.Error
+}
+
+// BalanceAt implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) BalanceAt(ctx context.Context, userID string, at time.Time) (*repository.BalanceAt, error) {
+	resp, err := s.BalanceAtEndpoint(ctx, BalanceAtRequest{UserID: userID, At: at})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(BalanceAtResponse)
+	return response.Balance, response.Error
+}
+
+// Currencies implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Currencies(ctx context.Context) ([]currency.Currency, error) {
+	resp, err := s.CurrenciesEndpoint(ctx, CurrenciesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(CurrenciesResponse)
+	return response.Currencies, response.Error
+}
+
+// Activity implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Activity(ctx context.Context) (*activity.Subscription, error) {
+	resp, err := s.ActivityEndpoint(ctx, ActivityRequest{})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(ActivityResponse)
+	return response.Subscription, response.Error
+}
+
+// Payout implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Payout(ctx context.Context, from, bankAccount string, amount float64, currency string) (*repository.Payout, error) {
+	resp, err := s.PayoutEndpoint(ctx, PayoutRequest{From: from, BankAccount: bankAccount, Amount: amount, Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(PayoutResponse)
+	return response.Payout, response.Error
+}
+
+// Payment implements the service interface, so Set may be used as a service.
+// This is primarily useful in the context of a client library.
+func (s Set) Payment(ctx context.Context, id int64) (*repository.PaymentStatus, error) {
+	resp, err := s.PaymentEndpoint(ctx, PaymentRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	response := resp.(PaymentResponse)
+	return response.Payment, response.Error
+}
+
+// MakeAuditLogEndpoint constructs a AuditLog endpoint wrapping the service.
+func MakeAuditLogEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(AuditLogRequest)
+		v, err := s.AuditLog(ctx, req.After, req.Limit)
+		return AuditLogResponse{Success: err == nil, Records: v, Error: err}, nil
+	}
+}
+
+// MakeExportTransactionsEndpoint constructs a ExportTransactions endpoint wrapping the service.
+func MakeExportTransactionsEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(ExportTransactionsRequest)
+		v, err := s.ExportTransactions(ctx, req.Filter)
+		return ExportTransactionsResponse{Format: req.Format, Filter: req.Filter, Cursor: v, Error: err}, nil
+	}
+}
+
+// MakeImportAccountsEndpoint constructs a ImportAccounts endpoint wrapping the service.
+func MakeImportAccountsEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(ImportAccountsRequest)
+		v, err := s.ImportAccounts(ctx, req.Rows, req.Options)
+		return ImportAccountsResponse{Success: err == nil, Report: v, Error: err}, nil
+	}
+}
+
+// MakeBalanceAtEndpoint constructs a BalanceAt endpoint wrapping the service.
+func MakeBalanceAtEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(BalanceAtRequest)
+		v, err := s.BalanceAt(ctx, req.UserID, req.At)
+		return BalanceAtResponse{Success: err == nil, Balance: v, Error: err}, nil
+	}
+}
+
+// MakeCurrenciesEndpoint constructs a Currencies endpoint wrapping the service.
+func MakeCurrenciesEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, _ interface{}) (response interface{}, err error) {
+		v, err := s.Currencies(ctx)
+		return CurrenciesResponse{Success: err == nil, Currencies: v, Error: err}, nil
+	}
+}
+
+// MakeActivityEndpoint constructs a Activity endpoint wrapping the service.
+func MakeActivityEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, _ interface{}) (response interface{}, err error) {
+		v, err := s.Activity(ctx)
+		return ActivityResponse{Subscription: v, Error: err}, nil
+	}
+}
+
+// MakePayoutEndpoint constructs a Payout endpoint wrapping the service.
+func MakePayoutEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(PayoutRequest)
+		v, err := s.Payout(ctx, req.From, req.BankAccount, req.Amount, req.Currency)
+		return PayoutResponse{Success: err == nil, Payout: v, Error: err}, nil
+	}
+}
+
+// MakePaymentEndpoint constructs a Payment endpoint wrapping the service.
+func MakePaymentEndpoint(s service.Service) ep.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(PaymentRequest)
+		v, err := s.Payment(ctx, req.ID)
+		return PaymentResponse{Success: err == nil, Payment: v, Error: err}, nil
 	}
 }
 
@@ -148,6 +653,22 @@ var (
 	_ ep.Failer = AccountResponse{}
 	_ ep.Failer = TransactionHistoryResponse{}
 	_ ep.Failer = TransferResponse{}
+	_ ep.Failer = LimitsResponse{}
+	_ ep.Failer = SetLimitsResponse{}
+	_ ep.Failer = QuoteResponse{}
+	_ ep.Failer = FeeScheduleResponse{}
+	_ ep.Failer = SetFeeScheduleResponse{}
+	_ ep.Failer = SetCreditLimitResponse{}
+	_ ep.Failer = FreezeResponse{}
+	_ ep.Failer = FreezeHistoryResponse{}
+	_ ep.Failer = AuditLogResponse{}
+	_ ep.Failer = ExportTransactionsResponse{}
+	_ ep.Failer = ImportAccountsResponse{}
+	_ ep.Failer = BalanceAtResponse{}
+	_ ep.Failer = CurrenciesResponse{}
+	_ ep.Failer = ActivityResponse{}
+	_ ep.Failer = PayoutResponse{}
+	_ ep.Failer = PaymentResponse{}
 )
 
 // HealthCheckRequest collects the request parameters for the HealthCheck method.
@@ -161,8 +682,92 @@ type TransactionHistoryRequest struct{}
 
 // TransferRequest collects the request parameters for the Transfer method.
 type TransferRequest struct {
-	From, To, Currency string
-	Amount             float64
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+// LimitsRequest collects the request parameters for the Limits method.
+type LimitsRequest struct {
+	UserID string
+}
+
+// SetLimitsRequest collects the request parameters for the SetLimits method.
+type SetLimitsRequest struct {
+	Limits *repository.Limits
+}
+
+// FeeScheduleRequest collects the request parameters for the FeeSchedule method.
+type FeeScheduleRequest struct {
+	Currency string
+}
+
+// SetFeeScheduleRequest collects the request parameters for the SetFeeSchedule method.
+type SetFeeScheduleRequest struct {
+	Schedule *repository.FeeSchedule
+}
+
+// SetCreditLimitRequest collects the request parameters for the SetCreditLimit method.
+type SetCreditLimitRequest struct {
+	UserID      string  `json:"-"`
+	CreditLimit float64 `json:"credit_limit"`
+}
+
+// FreezeRequest collects the request parameters for the Freeze method.
+type FreezeRequest struct {
+	UserID  string `json:"-"`
+	State   string `json:"state"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment"`
+}
+
+// FreezeHistoryRequest collects the request parameters for the FreezeHistory method.
+type FreezeHistoryRequest struct {
+	UserID string
+}
+
+// AuditLogRequest collects the request parameters for the AuditLog method.
+type AuditLogRequest struct {
+	After int64
+	Limit int
+}
+
+// ExportTransactionsRequest collects the request parameters for the ExportTransactions method.
+type ExportTransactionsRequest struct {
+	Filter *repository.TransactionFilter
+	Format string
+}
+
+// ImportAccountsRequest collects the request parameters for the ImportAccounts method.
+type ImportAccountsRequest struct {
+	Rows    []*repository.AccountImport
+	Options *repository.ImportOptions
+}
+
+// BalanceAtRequest collects the request parameters for the BalanceAt method.
+type BalanceAtRequest struct {
+	UserID string
+	At     time.Time
+}
+
+// CurrenciesRequest collects the request parameters for the Currencies method.
+type CurrenciesRequest struct{}
+
+// ActivityRequest collects the request parameters for the Activity method.
+type ActivityRequest struct{}
+
+// PayoutRequest collects the request parameters for the Payout method.
+type PayoutRequest struct {
+	From        string  `json:"from"`
+	BankAccount string  `json:"bank_account"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+}
+
+// PaymentRequest collects the request parameters for the Payment method.
+type PaymentRequest struct {
+	ID int64
 }
 
 // HealthCheckResponse collects the response values for the HealthCheck method.
@@ -173,9 +778,9 @@ type HealthCheckResponse struct {
 
 // AccountResponse collects the response values for the Account method.
 type AccountResponse struct {
-	Success  bool                  `json:"success"`
-	Accounts []*repository.Account `json:"accounts"`
-	Error    error                 `json:"error,omitempty"`
+	Success  bool                 `json:"success"`
+	Accounts []*repository.Holder `json:"accounts"`
+	Error    error                `json:"error,omitempty"`
 }
 
 // TransactionHistoryResponse collects the response values for the TransactionHistory method.
@@ -187,22 +792,145 @@ type TransactionHistoryResponse struct {
 
 // TransferResponse collects the response values for the Transfer method.
 type TransferResponse struct {
+	Success     bool                    `json:"success"`
+	Transaction *repository.Transaction `json:"transaction,omitempty"`
+	Error       error                   `json:"error,omitempty"`
+}
+
+// LimitsResponse collects the response values for the Limits method.
+type LimitsResponse struct {
+	Success bool                   `json:"success"`
+	Limits  *repository.Limits     `json:"limits"`
+	Usage   *repository.LimitUsage `json:"usage"`
+	Error   error                  `json:"error,omitempty"`
+}
+
+// SetLimitsResponse collects the response values for the SetLimits method.
+type SetLimitsResponse struct {
 	Success bool  `json:"success"`
 	Error   error `json:"error,omitempty"`
 }
 
+// QuoteResponse collects the response values for the Quote method.
+type QuoteResponse struct {
+	Success bool              `json:"success"`
+	Quote   *repository.Quote `json:"quote,omitempty"`
+	Error   error             `json:"error,omitempty"`
+}
+
+// FeeScheduleResponse collects the response values for the FeeSchedule method.
+type FeeScheduleResponse struct {
+	Success  bool                    `json:"success"`
+	Schedule *repository.FeeSchedule `json:"fee_schedule,omitempty"`
+	Error    error                   `json:"error,omitempty"`
+}
+
+// SetFeeScheduleResponse collects the response values for the SetFeeSchedule method.
+type SetFeeScheduleResponse struct {
+	Success bool  `json:"success"`
+	Error   error `json:"error,omitempty"`
+}
+
+// SetCreditLimitResponse collects the response values for the SetCreditLimit method.
+type SetCreditLimitResponse struct {
+	Success bool  `json:"success"`
+	Error   error `json:"error,omitempty"`
+}
+
+// FreezeResponse collects the response values for the Freeze method.
+type FreezeResponse struct {
+	Success bool  `json:"success"`
+	Error   error `json:"error,omitempty"`
+}
+
+// FreezeHistoryResponse collects the response values for the FreezeHistory method.
+type FreezeHistoryResponse struct {
+	Success bool                       `json:"success"`
+	History []*repository.FreezeRecord `json:"history"`
+	Error   error                      `json:"error,omitempty"`
+}
+
+// AuditLogResponse collects the response values for the AuditLog method.
+type AuditLogResponse struct {
+	Success bool                      `json:"success"`
+	Records []*repository.AuditRecord `json:"records"`
+	Error   error                     `json:"error,omitempty"`
+}
+
+// ExportTransactionsResponse collects the response values for the ExportTransactions method.
+// Cursor is streamed by transport in requested format.
+type ExportTransactionsResponse struct {
+	Format string
+	Filter *repository.TransactionFilter
+	Cursor repository.TransactionCursor
+	Error  error
+}
+
+// BalanceAtResponse collects the response values for the BalanceAt method.
+type BalanceAtResponse struct {
+	Success bool                  `json:"success"`
+	Balance *repository.BalanceAt `json:"balance,omitempty"`
+	Error   error                 `json:"error,omitempty"`
+}
+
+// CurrenciesResponse collects the response values for the Currencies method.
+type CurrenciesResponse struct {
+	Success    bool                `json:"success"`
+	Currencies []currency.Currency `json:"currencies"`
+	Error      error               `json:"error,omitempty"`
+}
+
+// ActivityResponse collects the response values for the Activity method.
+// Events of subscription are streamed by transport until it is closed.
+type ActivityResponse struct {
+	Subscription *activity.Subscription
+	Error        error
+}
+
+// ImportAccountsResponse collects the response values for the ImportAccounts method.
+// Report of failed import is carried by error details.
+type ImportAccountsResponse struct {
+	Success bool                     `json:"success"`
+	Report  *repository.ImportReport `json:"report,omitempty"`
+	Error   error                    `json:"error,omitempty"`
+}
+
+// PayoutResponse collects the response values for the Payout method.
+type PayoutResponse struct {
+	Success bool               `json:"success"`
+	Payout  *repository.Payout `json:"payout,omitempty"`
+	Error   error              `json:"error,omitempty"`
+}
+
+// PaymentResponse collects the response values for the Payment method.
+type PaymentResponse struct {
+	Success bool                      `json:"success"`
+	Payment *repository.PaymentStatus `json:"payment,omitempty"`
+	Error   error                     `json:"error,omitempty"`
+}
+
 func (tr *TransferResponse) UnmarshalJSON(data []byte) error {
-	var dict map[string]interface{}
+	var dict map[string]json.RawMessage
 	if err := json.Unmarshal(data, &dict); err != nil {
 		return err
 	}
 	for k, v := range dict {
 		switch k {
 		case "success":
-			tr.Success = v.(bool)
+			if err := json.Unmarshal(v, &tr.Success); err != nil {
+				return err
+			}
+		case "transaction":
+			if err := json.Unmarshal(v, &tr.Transaction); err != nil {
+				return err
+			}
 		case "error":
-			if v.(string) != "" {
-				tr.Error = errors.New(v.(string))
+			var msg string
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if msg != "" {
+				tr.Error = errors.New(msg)
 			} else {
 				tr.Error = nil
 			}
@@ -230,3 +958,83 @@ func (thr TransactionHistoryResponse) Failed() error {
 func (tr TransferResponse) Failed() error {
 	return tr.Error
 }
+
+// Failed implements endpoint.Failer.
+func (lr LimitsResponse) Failed() error {
+	return lr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (slr SetLimitsResponse) Failed() error {
+	return slr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (qr QuoteResponse) Failed() error {
+	return qr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (fsr FeeScheduleResponse) Failed() error {
+	return fsr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (sfsr SetFeeScheduleResponse) Failed() error {
+	return sfsr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (sclr SetCreditLimitResponse) Failed() error {
+	return sclr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (fr FreezeResponse) Failed() error {
+	return fr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (fhr FreezeHistoryResponse) Failed() error {
+	return fhr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (alr AuditLogResponse) Failed() error {
+	return alr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (etr ExportTransactionsResponse) Failed() error {
+	return etr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (iar ImportAccountsResponse) Failed() error {
+	return iar.Error
+}
+
+// Failed implements endpoint.Failer.
+func (bar BalanceAtResponse) Failed() error {
+	return bar.Error
+}
+
+// Failed implements endpoint.Failer.
+func (cr CurrenciesResponse) Failed() error {
+	return cr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (avr ActivityResponse) Failed() error {
+	return avr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (pr PayoutResponse) Failed() error {
+	return pr.Error
+}
+
+// Failed implements endpoint.Failer.
+func (pmr PaymentResponse) Failed() error {
+	return pmr.Error
+}
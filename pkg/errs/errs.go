@@ -0,0 +1,84 @@
+// Package errs implements domain errors with stable machine codes, which
+// survive transport: client reconstructs them by code, so errors.Is works
+// on both sides of the wire.
+package errs
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Error is a domain error. Errors are equal (in terms of errors.Is) when their codes are.
+type Error struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Status    int         `json:"-"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+var (
+	registry      = make(map[string]*Error)
+	registryMutex sync.RWMutex
+)
+
+// ErrInternal is reported for errors which are not domain ones.
+var ErrInternal = New("internal_error", "Internal error", http.StatusInternalServerError)
+
+// New returns domain error and registers it by code, so it could be restored with FromCode.
+func New(code, message string, status int) *Error {
+	err := &Error{
+		Code:    code,
+		Message: message,
+		Status:  status,
+	}
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[code] = err
+	return err
+}
+
+// NewRetryable returns domain error, which may succeed if retried later.
+func NewRetryable(code, message string, status int) *Error {
+	err := New(code, message, status)
+	err.Retryable = true
+	return err
+}
+
+// FromCode restores error by its code, message and details received from the wire.
+// Unknown codes result in internal errors keeping the code.
+func FromCode(code, message string, details interface{}) *Error {
+	registryMutex.RLock()
+	known, ok := registry[code]
+	registryMutex.RUnlock()
+	err := &Error{
+		Code:    code,
+		Message: message,
+		Status:  http.StatusInternalServerError,
+		Details: details,
+	}
+	if ok {
+		err.Status, err.Retryable = known.Status, known.Retryable
+		if message == "" {
+			err.Message = known.Message
+		}
+	}
+	return err
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is makes errors.Is(err, target) compare codes, as err may be restored from the wire.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns copy of error carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	err := *e
+	err.Details = details
+	return &err
+}
@@ -0,0 +1,197 @@
+// Package eventsource implements event-sourced mode of repository: changes of
+// account are appended to its stream as AccountOpened, Credited, Debited and
+// Frozen events, and state of account is replayed from them starting at the
+// latest snapshot of its aggregate. Account table and payment history are
+// projections of events written along with them, which may be rebuilt from
+// events at any time.
+package eventsource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Types of events of account
+const (
+	AccountOpened = "AccountOpened"
+	Credited      = "Credited"
+	Debited       = "Debited"
+	Frozen        = "Frozen"
+)
+
+// DefaultSnapshotEvery is a number of events of account between snapshots of its aggregate.
+const DefaultSnapshotEvery = 100
+
+// Opened is data of AccountOpened event. Account written before event sourcing
+// is adopted by AccountOpened event carrying balance and freeze state it had.
+type Opened struct {
+	Holder       string  `json:"holder"`
+	Currency     string  `json:"currency"`
+	Balance      float64 `json:"balance"`
+	CreditLimit  float64 `json:"credit_limit"`
+	Equity       bool    `json:"equity,omitempty"`
+	Freeze       string  `json:"freeze,omitempty"`
+	FreezeReason string  `json:"freeze_reason,omitempty"`
+}
+
+// Change is data of Credited and Debited events, Amount is positive and Balance
+// is a balance of account after change. Entry is a history record booked by
+// change if it belongs to account: outgoing record belongs to its payer, other
+// ones belong to their payees. Balance set without history record is changed
+// without Entry.
+type Change struct {
+	Amount  float64 `json:"amount"`
+	Balance float64 `json:"balance"`
+	Entry   *Entry  `json:"entry,omitempty"`
+}
+
+// Entry is a successful history record, it is projected to payment history with its ID.
+type Entry struct {
+	TxnID     int     `json:"txn_id"`
+	Direction string  `json:"direction"`
+	Payer     string  `json:"payer"`
+	Payee     string  `json:"payee"`
+	Amount    float64 `json:"amount"`
+	Fee       float64 `json:"fee"`
+	Currency  string  `json:"currency"`
+}
+
+// Freeze is data of Frozen event, account is unfrozen by state "none".
+type Freeze struct {
+	State   string `json:"state"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment"`
+	Actor   string `json:"actor"`
+}
+
+// Account is an aggregate of account replayed from its events.
+type Account struct {
+	Name         string  `json:"name"`
+	Holder       string  `json:"holder"`
+	Currency     string  `json:"currency"`
+	Balance      float64 `json:"balance"`
+	CreditLimit  float64 `json:"credit_limit"`
+	Equity       bool    `json:"equity"`
+	Freeze       string  `json:"freeze"`
+	FreezeReason string  `json:"freeze_reason"`
+	// Version is a version of the last applied event
+	Version int64 `json:"version"`
+}
+
+// Opened reports whether account is opened, i.e. its stream is not empty.
+func (a *Account) Opened() bool {
+	return a.Version > 0
+}
+
+// Apply applies event following the last applied one to account.
+func (a *Account) Apply(event *repository.AccountEvent) error {
+	if event.Version != a.Version+1 {
+		return fmt.Errorf("event %d of %s does not follow version %d", event.Version, a.Name, a.Version)
+	}
+	if event.Type != AccountOpened && !a.Opened() {
+		return fmt.Errorf("%s event of %s precedes %s", event.Type, a.Name, AccountOpened)
+	}
+	switch event.Type {
+	case AccountOpened:
+		var opened Opened
+		if err := json.Unmarshal(event.Data, &opened); err != nil {
+			return err
+		}
+		a.Holder, a.Currency, a.Balance, a.CreditLimit = opened.Holder, opened.Currency, opened.Balance, opened.CreditLimit
+		a.Equity, a.Freeze, a.FreezeReason = opened.Equity, opened.Freeze, opened.FreezeReason
+		if a.Freeze == "" {
+			a.Freeze = repository.FreezeNone
+		}
+	case Credited, Debited:
+		var change Change
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			return err
+		}
+		if event.Type == Debited {
+			change.Amount = -change.Amount
+		}
+		a.Balance = currency.Round(a.Balance+change.Amount, a.Currency)
+	case Frozen:
+		var freeze Freeze
+		if err := json.Unmarshal(event.Data, &freeze); err != nil {
+			return err
+		}
+		a.Freeze, a.FreezeReason = freeze.State, freeze.Reason
+	default:
+		return fmt.Errorf("unknown event %q of %s", event.Type, a.Name)
+	}
+	a.Version = event.Version
+	return nil
+}
+
+// Projection returns row of account table projected from account.
+func (a *Account) Projection() *repository.Account {
+	return &repository.Account{
+		UserID:       a.Name,
+		Holder:       a.Holder,
+		Balance:      a.Balance,
+		Currency:     a.Currency,
+		CreditLimit:  a.CreditLimit,
+		Freeze:       a.Freeze,
+		FreezeReason: a.FreezeReason,
+	}
+}
+
+// newEvent returns event of account following its last one with data encoded as JSON.
+func newEvent(account *Account, eventType string, data interface{}) (*repository.AccountEvent, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &repository.AccountEvent{
+		Account: account.Name,
+		Version: account.Version + 1,
+		Type:    eventType,
+		Data:    encoded,
+	}, nil
+}
+
+// entryChanges returns changes of balances of accounts booked by successful
+// history record, the one of account record belongs to carries it as Entry.
+func entryChanges(record *repository.Transaction) []entryChange {
+	entry := &Entry{
+		TxnID:     record.TxnID,
+		Direction: record.Direction,
+		Payer:     record.Payer,
+		Payee:     record.Payee,
+		Amount:    record.Amount,
+		Fee:       record.Fee,
+		Currency:  record.Currency,
+	}
+	switch record.Direction {
+	case repository.DirectionOutgoing:
+		return []entryChange{{record.Payer, -(record.Amount + record.Fee), entry}}
+	case repository.DirectionOpening: // booked against payer
+		return []entryChange{{record.Payee, record.Amount, entry}, {record.Payer, -record.Amount, nil}}
+	}
+	return []entryChange{{record.Payee, record.Amount, entry}}
+}
+
+type entryChange struct {
+	account string
+	delta   float64
+	entry   *Entry
+}
+
+// record returns history record of entry booked at date.
+func (e *Entry) record(date time.Time) *repository.Transaction {
+	return &repository.Transaction{
+		TxnID:     e.TxnID,
+		Direction: e.Direction,
+		Date:      date,
+		Payer:     e.Payer,
+		Payee:     e.Payee,
+		Amount:    e.Amount,
+		Fee:       e.Fee,
+		Currency:  e.Currency,
+	}
+}
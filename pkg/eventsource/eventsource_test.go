@@ -0,0 +1,178 @@
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestRepository(t *testing.T) {
+	store := inmem.NewInmem().(*inmem.RepositoryInmem)
+	store.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	store.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	repo := New(store, 3, log.NewNopLogger())
+	svc := service.NewPaymentService(repo)
+	ctx := context.Background()
+
+	// test accounts are adopted with their state and transfer is appended as events
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 30, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkStream(t, store, "alice456", []string{AccountOpened, Debited})
+	checkStream(t, store, "bob123", []string{AccountOpened, Credited})
+	checkAggregates(t, repo, store)
+
+	// test failed transfer is not an event
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 1000, ""); err == nil {
+		t.Fatal("Transfer should fail")
+	}
+	checkStream(t, store, "alice456", []string{AccountOpened, Debited})
+
+	// test freeze is appended as event
+	if err := svc.Freeze(ctx, "bob123", repository.FreezeCredit, "SANCTIONS", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkStream(t, store, "bob123", []string{AccountOpened, Credited, Frozen})
+	checkAggregates(t, repo, store)
+
+	// test imported accounts are opened with balances booked against equity
+	_, err := svc.ImportAccounts(ctx, []*repository.AccountImport{
+		{UserID: "carol", Currency: "USD", Balance: 50},
+		{UserID: "dave", Currency: "USD", Balance: -20, CreditLimit: 30},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStream(t, store, "carol", []string{AccountOpened, Credited})
+	checkStream(t, store, "dave", []string{AccountOpened, Debited})
+	checkStream(t, store, service.EquityAccount("USD"), []string{AccountOpened, Debited, Credited})
+	checkAggregates(t, repo, store)
+
+	// test aggregate is replayed from snapshot
+	if _, err = svc.Transfer(ctx, "alice456", "carol", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := store.GetAggregateSnapshot(nil, "alice456")
+	if err != nil || snapshot == nil || snapshot.Version != 3 {
+		t.Fatalf("Snapshot of version 3 should be saved, got %+v %v", snapshot, err)
+	}
+	store.Events = store.Events[3:] // events before snapshot are not replayed
+	if account, err := repo.Aggregate("alice456"); err != nil || account.Balance != 60 || account.Version != 3 {
+		t.Errorf("Aggregate should be replayed from snapshot, got %+v %v", account, err)
+	}
+}
+
+func TestVersionConflict(t *testing.T) {
+	store := inmem.NewInmem().(*inmem.RepositoryInmem)
+	store.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	repo := New(store, 0, log.NewNopLogger())
+
+	// test concurrent change of account fails on commit
+	var txns []repository.DBTransaction
+	for i := 0; i < 2; i++ {
+		txn, err := repo.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		account, err := repo.GetAndLockAccount(txn, "alice456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = repo.UpdateBalance(txn, "alice456", account.Balance-10); err != nil {
+			t.Fatal(err)
+		}
+		txns = append(txns, txn)
+	}
+	if err := txns[0].Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txns[1].Commit(); err != repository.ErrVersionConflict {
+		t.Errorf("Commit should fail with %v, got %v", repository.ErrVersionConflict, err)
+	}
+	checkStream(t, store, "alice456", []string{AccountOpened, Debited})
+}
+
+func TestRebuild(t *testing.T) {
+	store := inmem.NewInmem().(*inmem.RepositoryInmem)
+	store.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	store.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	repo := New(store, 0, log.NewNopLogger())
+	svc := service.NewPaymentService(repo)
+	ctx := context.Background()
+	for _, amount := range []float64{10, 20, 1000, 30} {
+		_, _ = svc.Transfer(ctx, "alice456", "bob123", amount, "")
+	}
+	if err := svc.Freeze(ctx, "alice456", repository.FreezeDebit, "FRAUD_SUSPECTED", ""); err != nil {
+		t.Fatal(err)
+	}
+	history, _ := store.GetTransactionPage(&repository.TransactionFilter{}, 0, 100)
+
+	// test lost and damaged projections are rebuilt
+	store.Accounts = store.Accounts[1:]
+	store.Accounts[0].Balance = 1
+	store.Transactions = store.Transactions[:5] // record of failed transfer is kept, as it is not an event
+	report, err := repo.Rebuild(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 9 || report.Accounts != 2 || report.Records != 6 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	for name, balance := range map[string]float64{"alice456": 40, "bob123": 60} {
+		if account, err := store.GetAccount(name); err != nil || account.Balance != balance {
+			t.Errorf("Balance of %s should be %v, got %+v %v", name, balance, account, err)
+		}
+	}
+	if account, _ := store.GetAccount("alice456"); account.Freeze != repository.FreezeDebit {
+		t.Errorf("Account should be frozen, got %+v", account)
+	}
+	rebuilt, _ := store.GetTransactionPage(&repository.TransactionFilter{}, 0, 100)
+	if len(rebuilt) != len(history) {
+		t.Fatalf("History should have %d records, got %d", len(history), len(rebuilt))
+	}
+	for i, record := range rebuilt {
+		expected := history[i]
+		if expected.TxnID != record.TxnID || expected.Direction != record.Direction || expected.Amount != record.Amount {
+			t.Errorf("Record %d should be %+v, got %+v", i, expected, record)
+		}
+	}
+	checkAggregates(t, repo, store)
+}
+
+func checkStream(t *testing.T, store repository.EventStore, accountName string, types []string) {
+	t.Helper()
+	events, err := store.GetEvents(nil, accountName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, len(events))
+	for i, event := range events {
+		actual[i] = event.Type
+	}
+	expected, _ := json.Marshal(types)
+	if got, _ := json.Marshal(actual); string(got) != string(expected) {
+		t.Errorf("Events of %s should be %s, got %s", accountName, expected, got)
+	}
+}
+
+// checkAggregates checks that every account is a projection of its aggregate.
+func checkAggregates(t *testing.T, repo *Repository, store repository.Repository) {
+	t.Helper()
+	accounts, _ := store.GetAccounts()
+	for _, account := range accounts {
+		aggregate, err := repo.Aggregate(account.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		projection := aggregate.Projection()
+		if projection.Balance != account.Balance || projection.Freeze != account.Freeze || projection.Currency != account.Currency {
+			t.Errorf("Account %+v should be projection of %+v", account, aggregate)
+		}
+	}
+}
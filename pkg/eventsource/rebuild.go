@@ -0,0 +1,98 @@
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// DefaultPageSize is a number of events read at once by Rebuild.
+const DefaultPageSize = 1000
+
+// RebuildReport is an outcome of Rebuild.
+type RebuildReport struct {
+	Events   int `json:"events"`
+	Accounts int `json:"accounts"`
+	Records  int `json:"records"`
+}
+
+// Rebuild rebuilds projections from scratch: history records carried by events
+// are written with their IDs, missing ones are restored and changed ones are
+// overwritten, then every account having events is replayed from the whole
+// stream, snapshots aside, and written to account table under its lock. Records
+// of failed transfers and of changes made before event sourcing are not events,
+// so they are left as they are. Service may keep running meanwhile.
+func (r *Repository) Rebuild(ctx context.Context, pageSize int) (*RebuildReport, error) {
+	store := r.WithContext(ctx).(*Repository)
+	report := &RebuildReport{}
+	accounts := make([]string, 0)
+	seen := make(map[string]bool)
+	var afterSeq int64
+	for {
+		events, err := store.EventRepository.GetEventPage(afterSeq, pageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, event := range events {
+			afterSeq = event.Seq
+			report.Events++
+			if !seen[event.Account] {
+				seen[event.Account] = true
+				accounts = append(accounts, event.Account)
+			}
+			if event.Type != Credited && event.Type != Debited {
+				continue
+			}
+			var change Change
+			if err = json.Unmarshal(event.Data, &change); err != nil {
+				return report, err
+			}
+			if change.Entry == nil {
+				continue
+			}
+			if err = store.EventRepository.ProjectTransaction(nil, change.Entry.record(event.CreatedAt)); err != nil {
+				return report, err
+			}
+			report.Records++
+		}
+		if len(events) < pageSize {
+			break
+		}
+	}
+	for _, name := range accounts {
+		if err := store.rebuildAccount(name); err != nil {
+			_ = level.Error(r.logger).Log("rebuild", name, "err", err)
+			return report, err
+		}
+		report.Accounts++
+	}
+	return report, nil
+}
+
+// rebuildAccount writes account replayed from its whole stream to account
+// table, existing account is locked meanwhile.
+func (r *Repository) rebuildAccount(accountName string) (err error) {
+	txn, err := r.EventRepository.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	if _, err = r.EventRepository.GetAndLockAccount(txn, accountName); err != nil && err != repository.ErrAccountNotFound {
+		return err
+	}
+	account, _, err := r.replay(txn, accountName, false)
+	if err != nil {
+		return err
+	}
+	if err = r.EventRepository.ProjectAccount(txn, account.Projection(), account.Equity); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
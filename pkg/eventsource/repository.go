@@ -0,0 +1,364 @@
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Repository is an event-sourced repository. Its transactions turn changes of
+// accounts made by service into events appended on commit: history records
+// become Credited and Debited events of accounts they change, balances set
+// without records are adjusted by events without Entry. Projections are written
+// at once within the same transaction, so readers see them as before. Locked
+// accounts are replayed from events, and events are appended with the version
+// of stream they were replayed at, so commit fails with
+// repository.ErrVersionConflict if account is changed concurrently.
+type Repository struct {
+	repository.EventRepository
+	snapshotEvery int64
+	logger        log.Logger
+}
+
+// New returns event-sourced repository keeping events in store, aggregates are
+// snapshotted every snapshotEvery events.
+func New(store repository.EventRepository, snapshotEvery int, logger log.Logger) *Repository {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	return &Repository{
+		EventRepository: store,
+		snapshotEvery:   int64(snapshotEvery),
+		logger:          log.With(logger, "component", "eventsource"),
+	}
+}
+
+// WithContext returns repository which store is bound to ctx.
+func (r *Repository) WithContext(ctx context.Context) repository.Repository {
+	return &Repository{
+		EventRepository: r.EventRepository.WithContext(ctx).(repository.EventRepository),
+		snapshotEvery:   r.snapshotEvery,
+		logger:          r.logger,
+	}
+}
+
+// Aggregate returns account replayed from its latest snapshot and events
+// appended after it, account which is not opened has zero Version.
+func (r *Repository) Aggregate(accountName string) (*Account, error) {
+	account, _, err := r.replay(nil, accountName, true)
+	return account, err
+}
+
+// replay returns account replayed from events of its stream within txn starting
+// at the latest snapshot if useSnapshot is set, along with version of snapshot.
+func (r *Repository) replay(txn repository.DBTransaction, accountName string, useSnapshot bool) (*Account, int64, error) {
+	account := &Account{Name: accountName}
+	var snapshotVersion int64
+	if useSnapshot {
+		snapshot, err := r.EventRepository.GetAggregateSnapshot(txn, accountName)
+		if err != nil {
+			return nil, 0, err
+		}
+		if snapshot != nil {
+			if err = json.Unmarshal(snapshot.State, account); err != nil {
+				return nil, 0, err
+			}
+			account.Name, account.Version, snapshotVersion = accountName, snapshot.Version, snapshot.Version
+		}
+	}
+	events, err := r.EventRepository.GetEvents(txn, accountName, account.Version)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, event := range events {
+		if err = account.Apply(event); err != nil {
+			return nil, 0, err
+		}
+	}
+	return account, snapshotVersion, nil
+}
+
+// Begin starts transaction collecting events of accounts.
+func (r *Repository) Begin() (repository.DBTransaction, error) {
+	txn, err := r.EventRepository.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &eventTxn{
+		DBTransaction: txn,
+		r:             r,
+		accounts:      make(map[string]*stream),
+	}, nil
+}
+
+// GetAndLockAccount locks account till the end of txn and returns its state
+// replayed from events, balance set within txn is returned if any.
+func (r *Repository) GetAndLockAccount(txn repository.DBTransaction, accountName string) (*repository.Account, error) {
+	inner, et := unwrap(txn)
+	account, err := r.EventRepository.GetAndLockAccount(inner, accountName)
+	if err != nil || et == nil {
+		return account, err
+	}
+	s, err := et.stream(accountName)
+	if err != nil {
+		return nil, err
+	}
+	account.Balance, account.Freeze, account.FreezeReason = s.account.Balance, s.account.Freeze, s.account.FreezeReason
+	if s.balance != nil {
+		account.Balance = *s.balance
+	}
+	return account, nil
+}
+
+// UpdateBalance sets balance of account projection, the change is appended on
+// commit as events of history records of txn.
+func (r *Repository) UpdateBalance(txn repository.DBTransaction, accountName string, balance float64) error {
+	inner, et := unwrap(txn)
+	if et != nil {
+		s, err := et.stream(accountName)
+		if err != nil {
+			return err
+		}
+		s.balance = &balance
+	}
+	return r.EventRepository.UpdateBalance(inner, accountName, balance)
+}
+
+// InsertTransaction inserts record into history, successful records of txn
+// are appended as events of accounts on commit.
+func (r *Repository) InsertTransaction(txn repository.DBTransaction, record *repository.Transaction) error {
+	inner, et := unwrap(txn)
+	if err := r.EventRepository.InsertTransaction(inner, record); err != nil {
+		return err
+	}
+	if et != nil && record.Error == "" {
+		written := *record
+		et.records = append(et.records, &written)
+	}
+	return nil
+}
+
+// CreateAccount opens account, opening balance is booked on commit by events
+// of history records of txn.
+func (r *Repository) CreateAccount(txn repository.DBTransaction, account *repository.Account) error {
+	inner, et := unwrap(txn)
+	if et == nil {
+		return r.EventRepository.CreateAccount(inner, account)
+	}
+	s, err := et.stream(account.UserID)
+	if err != nil {
+		return err
+	}
+	if s.account.Opened() {
+		return repository.ErrAccountExists
+	}
+	if err = r.EventRepository.CreateAccount(inner, account); err != nil {
+		return err
+	}
+	holder := account.Holder
+	if holder == "" {
+		holder = account.UserID
+	}
+	err = et.append(s, AccountOpened, &Opened{Holder: holder, Currency: account.Currency, CreditLimit: account.CreditLimit})
+	if err != nil {
+		return err
+	}
+	if account.Balance != 0 {
+		balance := account.Balance
+		s.balance = &balance
+	}
+	return nil
+}
+
+// CreateEquityAccount opens equity account unless it is opened.
+func (r *Repository) CreateEquityAccount(txn repository.DBTransaction, holderID, accountName, currency string) error {
+	inner, et := unwrap(txn)
+	if et == nil {
+		return r.EventRepository.CreateEquityAccount(inner, holderID, accountName, currency)
+	}
+	s, err := et.stream(accountName)
+	if err != nil {
+		return err
+	}
+	if s.account.Opened() {
+		return nil
+	}
+	if err = r.EventRepository.CreateEquityAccount(inner, holderID, accountName, currency); err != nil {
+		return err
+	}
+	return et.append(s, AccountOpened, &Opened{Holder: holderID, Currency: currency, Equity: true})
+}
+
+// UpdateFreeze sets freeze state of account and appends Frozen event on commit.
+func (r *Repository) UpdateFreeze(txn repository.DBTransaction, record *repository.FreezeRecord) error {
+	inner, et := unwrap(txn)
+	if et == nil {
+		return r.EventRepository.UpdateFreeze(inner, record)
+	}
+	s, err := et.stream(record.UserID)
+	if err != nil {
+		return err
+	}
+	if !s.account.Opened() {
+		return repository.ErrAccountNotFound
+	}
+	if err = r.EventRepository.UpdateFreeze(inner, record); err != nil {
+		return err
+	}
+	return et.append(s, Frozen, &Freeze{State: record.State, Reason: record.Reason, Comment: record.Comment, Actor: record.Actor})
+}
+
+// unwrap returns transaction of store along with event transaction, which is
+// nil if txn is not one.
+func unwrap(txn repository.DBTransaction) (repository.DBTransaction, *eventTxn) {
+	if et, ok := txn.(*eventTxn); ok {
+		return et.DBTransaction, et
+	}
+	return txn, nil
+}
+
+// eventTxn is a transaction of store collecting events of accounts, which are
+// appended on commit.
+type eventTxn struct {
+	repository.DBTransaction
+	r        *Repository
+	accounts map[string]*stream
+	order    []string // names of accounts in order they are touched
+	records  []*repository.Transaction
+}
+
+// stream is a stream of account changed within txn.
+type stream struct {
+	// account is replayed from events and changed by pending ones
+	account *Account
+	// snapshot is a version of the latest snapshot of account
+	snapshot int64
+	// balance is a balance of account set within txn, if any
+	balance *float64
+	pending []*repository.AccountEvent
+}
+
+// stream returns stream of account replayed on first use. Account written
+// before event sourcing is adopted with its current state.
+func (et *eventTxn) stream(accountName string) (*stream, error) {
+	if s, ok := et.accounts[accountName]; ok {
+		return s, nil
+	}
+	account, snapshot, err := et.r.replay(et.DBTransaction, accountName, true)
+	if err != nil {
+		return nil, err
+	}
+	s := &stream{account: account, snapshot: snapshot}
+	if !account.Opened() {
+		existing, err := et.r.EventRepository.GetAndLockAccount(et.DBTransaction, accountName)
+		switch {
+		case err == nil:
+			err = et.append(s, AccountOpened, &Opened{
+				Holder:       existing.Holder,
+				Currency:     existing.Currency,
+				Balance:      existing.Balance,
+				CreditLimit:  existing.CreditLimit,
+				Freeze:       existing.Freeze,
+				FreezeReason: existing.FreezeReason,
+			})
+			if err != nil {
+				return nil, err
+			}
+		case err != repository.ErrAccountNotFound:
+			return nil, err
+		}
+	}
+	et.accounts[accountName] = s
+	et.order = append(et.order, accountName)
+	return s, nil
+}
+
+// append applies event of type to account of stream and leaves it pending till commit.
+func (et *eventTxn) append(s *stream, eventType string, data interface{}) error {
+	event, err := newEvent(s.account, eventType, data)
+	if err != nil {
+		return err
+	}
+	if err = s.account.Apply(event); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, event)
+	return nil
+}
+
+// change appends Credited or Debited event changing balance of account by delta.
+func (et *eventTxn) change(s *stream, delta float64, entry *Entry) error {
+	eventType, amount := Credited, delta
+	if delta < 0 {
+		eventType, amount = Debited, -delta
+	}
+	balance := currency.Round(s.account.Balance+delta, s.account.Currency)
+	return et.append(s, eventType, &Change{Amount: amount, Balance: balance, Entry: entry})
+}
+
+// Commit appends events of txn and commits it, events of account are appended
+// with versions following the one it is replayed at. Aggregates are
+// snapshotted every snapshotEvery events.
+func (et *eventTxn) Commit() (err error) {
+	defer func() {
+		if err != nil {
+			_ = et.DBTransaction.Rollback()
+		}
+	}()
+	for _, record := range et.records {
+		for _, change := range entryChanges(record) {
+			s, err := et.stream(change.account)
+			if err != nil {
+				return err
+			}
+			if !s.account.Opened() { // record refers account missing from store
+				continue
+			}
+			if err = et.change(s, change.delta, change.entry); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range et.order {
+		s := et.accounts[name]
+		if s.balance == nil || !s.account.Opened() {
+			continue
+		}
+		if delta := currency.Round(*s.balance-s.account.Balance, s.account.Currency); delta != 0 {
+			if err = et.change(s, delta, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range et.order {
+		s := et.accounts[name]
+		for _, event := range s.pending {
+			if err = et.r.EventRepository.AppendEvent(et.DBTransaction, event); err != nil {
+				return err
+			}
+		}
+		if len(s.pending) == 0 || s.account.Version-s.snapshot < et.r.snapshotEvery {
+			continue
+		}
+		state, err := json.Marshal(s.account)
+		if err != nil {
+			return err
+		}
+		snapshot := &repository.AggregateSnapshot{Account: name, Version: s.account.Version, State: state}
+		if err = et.r.EventRepository.SaveAggregateSnapshot(et.DBTransaction, snapshot); err != nil {
+			return err
+		}
+	}
+	et.accounts, et.order, et.records = make(map[string]*stream), nil, nil
+	return et.DBTransaction.Commit()
+}
+
+// Rollback discards events of txn and rolls it back.
+func (et *eventTxn) Rollback() error {
+	et.accounts, et.order, et.records = make(map[string]*stream), nil, nil
+	return et.DBTransaction.Rollback()
+}
@@ -0,0 +1,245 @@
+// Package export writes transaction history in formats of finance tools:
+// CSV, JSON Lines and OFX bank statement.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Export formats
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatOFX   = "ofx"
+)
+
+var (
+	// ErrUnknownFormat error fired when export format is not supported
+	ErrUnknownFormat = errs.New("unknown_export_format", "Unknown export format", http.StatusBadRequest)
+
+	// ErrAccountRequired error fired when OFX statement is requested without account
+	ErrAccountRequired = errs.New("export_account_required", "Account is required for OFX statement", http.StatusBadRequest)
+)
+
+// Writer writes transactions in export format.
+type Writer interface {
+	Write(txn *repository.Transaction) error
+	// Close writes the rest of export and flushes it, it doesn't close underlying writer.
+	Close() error
+}
+
+// Validate checks whether transactions of filter may be exported in format.
+func Validate(format string, filter *repository.TransactionFilter) error {
+	switch format {
+	case FormatCSV, FormatJSONL:
+		return nil
+	case FormatOFX:
+		if filter == nil || filter.Account == "" {
+			return ErrAccountRequired
+		}
+		return nil
+	}
+	return ErrUnknownFormat
+}
+
+// NewWriter returns Writer of format. OFX statement is made for account of filter.
+func NewWriter(format string, w io.Writer, filter *repository.TransactionFilter) (Writer, error) {
+	if err := Validate(format, filter); err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatJSONL:
+		return newJSONLWriter(w), nil
+	case FormatOFX:
+		return newOFXWriter(w, filter), nil
+	}
+	return newCSVWriter(w), nil
+}
+
+// ContentType returns MIME type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	case FormatOFX:
+		return "application/x-ofx"
+	}
+	return "application/octet-stream"
+}
+
+// ParseDate parses RFC 3339 timestamp or date (YYYY-MM-DD) of date range,
+// empty one is zero time.
+func ParseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// FormatAmount formats amount with number of decimals of currency.
+func FormatAmount(amount float64, code string) string {
+	return currency.Format(amount, code)
+}
+
+// csvHeader is a header row of CSV export
+var csvHeader = []string{"id", "date", "direction", "payer", "payee", "amount", "fee", "currency", "error"}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (cw *csvWriter) writeHeader() error {
+	if cw.header {
+		return nil
+	}
+	cw.header = true
+	return cw.w.Write(csvHeader)
+}
+
+func (cw *csvWriter) Write(txn *repository.Transaction) error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	return cw.w.Write([]string{
+		strconv.Itoa(txn.TxnID),
+		txn.Date.UTC().Format(time.RFC3339),
+		txn.Direction,
+		txn.Payer,
+		txn.Payee,
+		FormatAmount(txn.Amount, txn.Currency),
+		FormatAmount(txn.Fee, txn.Currency),
+		txn.Currency,
+		txn.Error,
+	})
+}
+
+func (cw *csvWriter) Close() error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// Record is a transaction of JSON Lines export.
+type Record struct {
+	ID        int         `json:"id"`
+	Date      time.Time   `json:"date"`
+	Direction string      `json:"direction"`
+	Payer     string      `json:"payer"`
+	Payee     string      `json:"payee"`
+	Amount    json.Number `json:"amount"`
+	Fee       json.Number `json:"fee"`
+	Currency  string      `json:"currency"`
+	Error     string      `json:"error"`
+}
+
+type jsonlWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonlWriter{w: bw, encoder: json.NewEncoder(bw)}
+}
+
+func (jw *jsonlWriter) Write(txn *repository.Transaction) error {
+	return jw.encoder.Encode(Record{
+		ID:        txn.TxnID,
+		Date:      txn.Date.UTC(),
+		Direction: txn.Direction,
+		Payer:     txn.Payer,
+		Payee:     txn.Payee,
+		Amount:    json.Number(FormatAmount(txn.Amount, txn.Currency)),
+		Fee:       json.Number(FormatAmount(txn.Fee, txn.Currency)),
+		Currency:  txn.Currency,
+		Error:     txn.Error,
+	})
+}
+
+func (jw *jsonlWriter) Close() error {
+	return jw.w.Flush()
+}
+
+// NewJSONLReader returns cursor over transactions of JSON Lines export read from r.
+// Cursor closes r.
+func NewJSONLReader(r io.ReadCloser) repository.TransactionCursor {
+	return &jsonlReader{r: r, decoder: json.NewDecoder(r)}
+}
+
+type jsonlReader struct {
+	r       io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (jr *jsonlReader) Next() (*repository.Transaction, error) {
+	var record Record
+	if err := jr.decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+	amount, err := record.Amount.Float64()
+	if err != nil {
+		return nil, err
+	}
+	fee, err := record.Fee.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return &repository.Transaction{
+		TxnID:     record.ID,
+		Direction: record.Direction,
+		Date:      record.Date,
+		Payer:     record.Payer,
+		Payee:     record.Payee,
+		Amount:    amount,
+		Fee:       fee,
+		Currency:  record.Currency,
+		Error:     record.Error,
+	}, nil
+}
+
+func (jr *jsonlReader) Close() error {
+	return jr.r.Close()
+}
+
+// Copy writes all transactions of cursor with w and closes w, it returns number of
+// written transactions.
+func Copy(w Writer, cursor repository.TransactionCursor) (n int, err error) {
+	for {
+		var txn *repository.Transaction
+		txn, err = cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("export interrupted after %d transactions: %v", n, err)
+		}
+		if err = w.Write(txn); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, w.Close()
+}
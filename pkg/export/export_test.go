@@ -0,0 +1,119 @@
+package export
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+var date = time.Date(2019, 7, 18, 12, 30, 0, 0, time.UTC)
+
+var transactions = []*repository.Transaction{
+	{TxnID: 1, Direction: repository.DirectionIncoming, Date: date, Payer: "alice456", Payee: "bob123", Amount: 10.5, Currency: "USD"},
+	{TxnID: 2, Direction: repository.DirectionOutgoing, Date: date, Payer: "alice456", Payee: "bob123", Amount: 10.5, Fee: 0.3, Currency: "USD"},
+	{TxnID: 3, Direction: repository.DirectionFee, Date: date, Payer: "alice456", Payee: "revenue", Amount: 0.3, Currency: "USD"},
+	{TxnID: 4, Direction: repository.DirectionOutgoing, Date: date, Payer: "alice456", Payee: "bob123", Amount: 1000, Currency: "USD", Error: "Insufficient funds"},
+	{TxnID: 5, Direction: repository.DirectionIncoming, Date: date, Payer: "bob123", Payee: "alice456", Amount: 1, Currency: "USD"},
+	{TxnID: 6, Direction: repository.DirectionOutgoing, Date: date, Payer: "bob123", Payee: "alice456", Amount: 1, Currency: "USD"},
+}
+
+// sliceCursor iterates over transactions
+type sliceCursor []*repository.Transaction
+
+func (c *sliceCursor) Next() (*repository.Transaction, error) {
+	if len(*c) == 0 {
+		return nil, io.EOF
+	}
+	txn := (*c)[0]
+	*c = (*c)[1:]
+	return txn, nil
+}
+
+func (c *sliceCursor) Close() error {
+	return nil
+}
+
+func export(t *testing.T, format string, filter *repository.TransactionFilter) string {
+	var buf bytes.Buffer
+	w, err := NewWriter(format, &buf, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := sliceCursor(transactions)
+	if n, err := Copy(w, &cursor); err != nil || n != len(transactions) {
+		t.Fatalf("%d transactions should be exported, got %d %v", len(transactions), n, err)
+	}
+	return buf.String()
+}
+
+func TestFormatAmount(t *testing.T) {
+	for _, c := range []struct {
+		amount   float64
+		currency string
+		expected string
+	}{
+		{10.5, "USD", "10.50"},
+		{1000, "JPY", "1000"},
+		{1.25, "KWD", "1.250"},
+	} {
+		if s := FormatAmount(c.amount, c.currency); s != c.expected {
+			t.Errorf("Amount should be: %s, got %s", c.expected, s)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	lines := strings.Split(export(t, FormatCSV, nil), "\n")
+	if lines[0] != "id,date,direction,payer,payee,amount,fee,currency,error" ||
+		lines[2] != "2,2019-07-18T12:30:00Z,outgoing,alice456,bob123,10.50,0.30,USD," {
+		t.Errorf("Unexpected CSV: %v", lines)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	out := export(t, FormatJSONL, nil)
+	if !strings.Contains(out, `"amount":10.50,"fee":0.30`) {
+		t.Errorf("Amounts should keep decimals of currency: %s", out)
+	}
+
+	// test export is read back
+	cursor := NewJSONLReader(ioutil.NopCloser(strings.NewReader(out)))
+	defer cursor.Close()
+	for _, expected := range transactions {
+		txn, err := cursor.Next()
+		if err != nil || *txn != *expected {
+			t.Fatalf("Transaction should be: %+v, got %+v %v", expected, txn, err)
+		}
+	}
+	if _, err := cursor.Next(); err != io.EOF {
+		t.Errorf("Error should be: %v, got %v", io.EOF, err)
+	}
+}
+
+func TestOFX(t *testing.T) {
+	if _, err := NewWriter(FormatOFX, ioutil.Discard, nil); err != ErrAccountRequired {
+		t.Errorf("Error should be: %v, got %v", ErrAccountRequired, err)
+	}
+	out := export(t, FormatOFX, &repository.TransactionFilter{Account: "alice456"})
+	for _, expected := range []string{
+		"<CURDEF>USD</CURDEF>",
+		"<ACCTID>alice456</ACCTID>",
+		"<TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20190718123000.000[0:GMT]</DTPOSTED><TRNAMT>-10.50</TRNAMT><FITID>2</FITID>",
+		"<TRNTYPE>FEE</TRNTYPE><DTPOSTED>20190718123000.000[0:GMT]</DTPOSTED><TRNAMT>-0.30</TRNAMT><FITID>3</FITID>",
+		"<TRNTYPE>CREDIT</TRNTYPE><DTPOSTED>20190718123000.000[0:GMT]</DTPOSTED><TRNAMT>1.00</TRNAMT><FITID>5</FITID>",
+		"</OFX>",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("OFX should contain %s:\n%s", expected, out)
+		}
+	}
+	// failed transfers and other side records are skipped
+	if n := strings.Count(out, "<STMTTRN>"); n != 3 {
+		t.Errorf("Statement should have 3 transactions, got %d", n)
+	}
+}
@@ -0,0 +1,103 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// ofxBankID identifies payment system as a bank of OFX statement
+const ofxBankID = "PAYMENT-SYSTEM"
+
+// ofxDateFormat is a date format of OFX
+const ofxDateFormat = "20060102150405.000[0:GMT]"
+
+// ofxWriter writes OFX 2.2 bank statement of account. Header is written with the
+// first transaction, as currency of statement is not known before it.
+type ofxWriter struct {
+	w       *bufio.Writer
+	filter  *repository.TransactionFilter
+	started bool
+	last    time.Time
+}
+
+func newOFXWriter(w io.Writer, filter *repository.TransactionFilter) *ofxWriter {
+	return &ofxWriter{w: bufio.NewWriter(w), filter: filter}
+}
+
+func (ow *ofxWriter) writeHeader(currency string, start time.Time) {
+	ow.started = true
+	if !ow.filter.From.IsZero() {
+		start = ow.filter.From
+	}
+	fmt.Fprintf(ow.w, "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?>\n"+
+		"<?OFX OFXHEADER=\"200\" VERSION=\"220\" SECURITY=\"NONE\" OLDFILEUID=\"NONE\" NEWFILEUID=\"NONE\"?>\n"+
+		"<OFX>\n"+
+		"<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>"+
+		"<DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n"+
+		"<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>\n"+
+		"<STMTRS><CURDEF>%s</CURDEF>\n"+
+		"<BANKACCTFROM><BANKID>%s</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n"+
+		"<BANKTRANLIST><DTSTART>%s</DTSTART>\n",
+		ofxDate(time.Now()), escape(currency), ofxBankID, escape(ow.filter.Account), ofxDate(start))
+}
+
+// Write writes successful transactions changing balance of account.
+func (ow *ofxWriter) Write(txn *repository.Transaction) error {
+	var (
+		trnType string
+		amount  float64
+		name    string
+	)
+	switch {
+	case txn.Error != "":
+		return nil
+	case txn.Direction == repository.DirectionOutgoing && txn.Payer == ow.filter.Account:
+		trnType, amount, name = "DEBIT", -txn.Amount, txn.Payee
+	case txn.Direction == repository.DirectionFee && txn.Payer == ow.filter.Account:
+		trnType, amount, name = "FEE", -txn.Amount, txn.Payee
+	case txn.Direction == repository.DirectionIncoming && txn.Payee == ow.filter.Account,
+		txn.Direction == repository.DirectionFee && txn.Payee == ow.filter.Account:
+		trnType, amount, name = "CREDIT", txn.Amount, txn.Payer
+	default:
+		return nil
+	}
+	if !ow.started {
+		ow.writeHeader(txn.Currency, txn.Date)
+	}
+	ow.last = txn.Date
+	_, err := fmt.Fprintf(ow.w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT>"+
+		"<FITID>%s</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+		trnType, ofxDate(txn.Date), FormatAmount(amount, txn.Currency), strconv.Itoa(txn.TxnID),
+		escape(name), txn.Direction)
+	return err
+}
+
+func (ow *ofxWriter) Close() error {
+	if !ow.started {
+		// empty statement, currency is unknown
+		ow.writeHeader("XXX", time.Now())
+	}
+	end := ow.filter.To
+	if end.IsZero() {
+		end = time.Now()
+	}
+	fmt.Fprintf(ow.w, "<DTEND>%s</DTEND></BANKTRANLIST>\n</STMTRS></STMTTRNRS></BANKMSGSRSV1>\n</OFX>\n", ofxDate(end))
+	return ow.w.Flush()
+}
+
+func ofxDate(t time.Time) string {
+	return t.UTC().Format(ofxDateFormat)
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,216 @@
+// Package importer reads accounts with opening balances of bulk import from
+// CSV and JSON Lines files and writes per-row report of import.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Import formats
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// CSV columns, column order is taken from header row
+const (
+	ColumnID          = "id"
+	ColumnCurrency    = "currency"
+	ColumnBalance     = "balance"
+	ColumnCreditLimit = "credit_limit"
+)
+
+// maxLineSize is a maximum size of line of JSON Lines file
+const maxLineSize = 64 * 1024
+
+var (
+	// ErrUnknownFormat error fired when import format is not supported
+	ErrUnknownFormat = errs.New("unknown_import_format", "Unknown import format", http.StatusBadRequest)
+
+	// ErrMalformedImport error fired when import file can't be read at all
+	ErrMalformedImport = errs.New("malformed_import", "Malformed import file", http.StatusBadRequest)
+)
+
+// Record is an account of JSON Lines import. Line is optional, it keeps numbering
+// of original file when rows are sent over the wire.
+type Record struct {
+	Line        int         `json:"line,omitempty"`
+	ID          string      `json:"id"`
+	Currency    string      `json:"currency"`
+	Balance     json.Number `json:"balance,omitempty"`
+	CreditLimit json.Number `json:"credit_limit,omitempty"`
+}
+
+// Read returns rows of import file of format. Rows, which can't be parsed, are
+// returned with Error set, so they are reported along with other invalid rows.
+func Read(format string, r io.Reader) ([]*repository.AccountImport, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(r)
+	case FormatJSONL:
+		return readJSONL(r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// malformed returns ErrMalformedImport with message explaining problem.
+func malformed(format string, args ...interface{}) error {
+	err := ErrMalformedImport.WithDetails(nil)
+	err.Message = ErrMalformedImport.Message + ": " + fmt.Sprintf(format, args...)
+	return err
+}
+
+func readCSV(r io.Reader) ([]*repository.AccountImport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, malformed("no header row")
+	}
+	if err != nil {
+		return nil, malformed("%v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{ColumnID, ColumnCurrency} {
+		if _, ok := columns[name]; !ok {
+			return nil, malformed("no %q column", name)
+		}
+	}
+
+	rows := make([]*repository.AccountImport, 0)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, err
+			}
+			return nil, malformed("%v", err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := &repository.AccountImport{
+			Line:     line,
+			UserID:   field(ColumnID),
+			Currency: field(ColumnCurrency),
+		}
+		if len(record) != len(header) {
+			row.Error = fmt.Sprintf("expected %d fields, got %d", len(header), len(record))
+		}
+		parseAmounts(row, field(ColumnBalance), field(ColumnCreditLimit))
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONL(r io.Reader) ([]*repository.AccountImport, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	rows := make([]*repository.AccountImport, 0)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record Record
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			rows = append(rows, &repository.AccountImport{Line: line, Error: "invalid JSON: " + err.Error()})
+			continue
+		}
+		row := &repository.AccountImport{
+			Line:     line,
+			UserID:   record.ID,
+			Currency: record.Currency,
+		}
+		if record.Line > 0 {
+			row.Line = record.Line
+		}
+		parseAmounts(row, record.Balance.String(), record.CreditLimit.String())
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, malformed("line is longer than %d bytes", maxLineSize)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// parseAmounts sets balance and credit limit of row, empty ones are zero.
+func parseAmounts(row *repository.AccountImport, balance, creditLimit string) {
+	var err error
+	if balance != "" {
+		if row.Balance, err = strconv.ParseFloat(balance, 64); err != nil && row.Error == "" {
+			row.Error = fmt.Sprintf("invalid balance %q", balance)
+		}
+	}
+	if creditLimit != "" {
+		if row.CreditLimit, err = strconv.ParseFloat(creditLimit, 64); err != nil && row.Error == "" {
+			row.Error = fmt.Sprintf("invalid credit limit %q", creditLimit)
+		}
+	}
+}
+
+// WriteJSONL writes rows as JSON Lines import file.
+func WriteJSONL(w io.Writer, rows []*repository.AccountImport) error {
+	encoder := json.NewEncoder(w)
+	for _, row := range rows {
+		err := encoder.Encode(Record{
+			Line:        row.Line,
+			ID:          row.UserID,
+			Currency:    row.Currency,
+			Balance:     json.Number(strconv.FormatFloat(row.Balance, 'f', -1, 64)),
+			CreditLimit: json.Number(strconv.FormatFloat(row.CreditLimit, 'f', -1, 64)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportHeader is a header row of CSV report
+var reportHeader = []string{"line", "id", "status", "code", "error"}
+
+// WriteReport writes per-row outcome of import as CSV.
+func WriteReport(w io.Writer, report *repository.ImportReport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(reportHeader); err != nil {
+		return err
+	}
+	for _, row := range report.Rows {
+		err := writer.Write([]string{strconv.Itoa(row.Line), row.UserID, row.Status, row.Code, row.Error})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+func TestReadCSV(t *testing.T) {
+	rows, err := Read(FormatCSV, strings.NewReader("currency,id,balance\n"+
+		"USD,alice456,10.50\n"+
+		"EUR, bob123 ,\n"+
+		"USD,vasya,ten\n"+
+		"USD,petya\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []repository.AccountImport{
+		{Line: 2, UserID: "alice456", Currency: "USD", Balance: 10.5},
+		{Line: 3, UserID: "bob123", Currency: "EUR"},
+		{Line: 4, UserID: "vasya", Currency: "USD", Error: `invalid balance "ten"`},
+		{Line: 5, UserID: "petya", Currency: "USD", Error: "expected 3 fields, got 2"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("%d rows should be read, got %d", len(expected), len(rows))
+	}
+	for i, row := range rows {
+		if *row != expected[i] {
+			t.Errorf("Row should be %+v, got %+v", expected[i], *row)
+		}
+	}
+
+	if _, err = Read(FormatCSV, strings.NewReader("id,balance\nalice456,1\n")); !errors.Is(err, ErrMalformedImport) {
+		t.Errorf("Error should be: %v, got %v", ErrMalformedImport, err)
+	}
+	if _, err = Read("xls", strings.NewReader("")); err != ErrUnknownFormat {
+		t.Errorf("Error should be: %v, got %v", ErrUnknownFormat, err)
+	}
+}
+
+func TestReadJSONL(t *testing.T) {
+	rows, err := Read(FormatJSONL, strings.NewReader(`{"id":"alice456","currency":"USD","balance":10.5,"credit_limit":"100"}`+"\n\n"+
+		`{"id":"bob123","currency":"EUR","iban":"DE00"}`+"\n"+
+		`{"id":"vasya",`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("3 rows should be read, got %d", len(rows))
+	}
+	if *rows[0] != (repository.AccountImport{Line: 1, UserID: "alice456", Currency: "USD", Balance: 10.5, CreditLimit: 100}) {
+		t.Errorf("Unexpected row: %+v", *rows[0])
+	}
+	if rows[1].Line != 3 || !strings.Contains(rows[1].Error, "iban") || rows[2].Line != 4 || rows[2].Error == "" {
+		t.Errorf("Unexpected rows: %+v %+v", *rows[1], *rows[2])
+	}
+
+	// test rows keep their lines over the wire
+	var buf bytes.Buffer
+	if err = WriteJSONL(&buf, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	rows[0].Line = 7
+	if err = WriteJSONL(&buf, rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(FormatJSONL, &buf)
+	if err != nil || len(read) != 2 || read[0].Line != 1 || read[1].Line != 7 || read[1].CreditLimit != 100 {
+		t.Errorf("Unexpected rows: %v %v", read, err)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteReport(&buf, &repository.ImportReport{Rows: []*repository.ImportRowResult{
+		{Line: 2, UserID: "alice456", Status: repository.ImportCreated},
+		{Line: 3, UserID: "bob 123", Status: repository.ImportFailed, Code: "invalid_account_id", Error: "Account ID, invalid"},
+	}})
+	expected := "line,id,status,code,error\n2,alice456,created,,\n3,bob 123,failed,invalid_account_id,\"Account ID, invalid\"\n"
+	if err != nil || buf.String() != expected {
+		t.Errorf("Report should be %q, got %q %v", expected, buf.String(), err)
+	}
+}
@@ -0,0 +1,286 @@
+// Package openapi builds OpenAPI 3 documents describing HTTP API. Schemas of
+// request and response bodies are generated from Go types the way
+// encoding/json marshals them, so the document follows the code.
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Version is a version of OpenAPI specification documents conform to.
+const Version = "3.0.3"
+
+// Document is an OpenAPI document.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	// names of component schemas by types they are generated from
+	names map[reflect.Type]string
+}
+
+// Info is a metadata of API.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem is a set of operations of path by lower case HTTP methods.
+type PathItem map[string]*Operation
+
+// Operation is an operation of API on path.
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a parameter of operation, either inline or a reference to
+// parameter of components.
+type Parameter struct {
+	Ref         string  `json:"$ref,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	In          string  `json:"in,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+// Locations of parameters
+const (
+	InPath   = "path"
+	InQuery  = "query"
+	InHeader = "header"
+)
+
+// RequestBody is a body of request by media types.
+type RequestBody struct {
+	Description string                `json:"description,omitempty"`
+	Required    bool                  `json:"required"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+// Response is a response of operation, either inline or a reference to
+// response of components.
+type Response struct {
+	Ref         string                `json:"$ref,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is a content of body of media type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds schemas, parameters and responses referenced by operations.
+type Components struct {
+	Schemas    map[string]*Schema    `json:"schemas"`
+	Parameters map[string]*Parameter `json:"parameters,omitempty"`
+	Responses  map[string]*Response  `json:"responses,omitempty"`
+}
+
+// Schema is a JSON schema of value, empty schema allows any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// New returns document of API without operations.
+func New(info Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			Schemas:    make(map[string]*Schema),
+			Parameters: make(map[string]*Parameter),
+			Responses:  make(map[string]*Response),
+		},
+		names: make(map[reflect.Type]string),
+	}
+}
+
+// Add adds operation on path of HTTP method.
+func (d *Document) Add(method, path string, op *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = op
+}
+
+// Operations returns operations of document as "METHOD path" strings.
+func (d *Document) Operations() []string {
+	operations := make([]string, 0)
+	for path, item := range d.Paths {
+		for method := range *item {
+			operations = append(operations, strings.ToUpper(method)+" "+path)
+		}
+	}
+	return operations
+}
+
+// ParameterRef returns reference to parameter of components.
+func ParameterRef(name string) *Parameter {
+	return &Parameter{Ref: "#/components/parameters/" + name}
+}
+
+// ResponseRef returns reference to response of components.
+func ResponseRef(name string) *Response {
+	return &Response{Ref: "#/components/responses/" + name}
+}
+
+// JSON returns content of JSON body of schema.
+func JSON(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	numberType     = reflect.TypeOf(json.Number(""))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Schema returns schema of JSON encoding of v, which may be a nil pointer of
+// type. Structs are added to component schemas named after their types and
+// referenced. Fields of error type are omitted, as they are not encoded.
+func (d *Document) Schema(v interface{}) *Schema {
+	return d.schema(reflect.TypeOf(v))
+}
+
+// NamedSchema returns schema of v like Schema, but component schema of its
+// struct type is named name.
+func (d *Document) NamedSchema(name string, v interface{}) *Schema {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if _, ok := d.names[t]; !ok && t.Kind() == reflect.Struct {
+		d.names[t] = name
+		d.Components.Schemas[name] = &Schema{}
+		d.Components.Schemas[name] = d.structSchema(t)
+	}
+	return d.schema(t)
+}
+
+func (d *Document) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &Schema{Type: "integer", Format: "int64", Description: "nanoseconds"}
+	case numberType:
+		return &Schema{Type: "number"}
+	case rawMessageType:
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		return d.ref(t)
+	}
+	return &Schema{} // interfaces hold any value
+}
+
+// ref returns reference to component schema of struct type t, adding it first.
+func (d *Document) ref(t reflect.Type) *Schema {
+	name, ok := d.names[t]
+	if !ok {
+		name = t.Name()
+		if _, taken := d.Components.Schemas[name]; taken {
+			pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		d.names[t] = name
+		d.Components.Schemas[name] = &Schema{} // placeholder for recursive types
+		d.Components.Schemas[name] = d.structSchema(t)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// structSchema returns object schema of fields of struct type t, fields of
+// embedded structs are promoted.
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || field.Type == errorType || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, property := range d.structSchema(embedded).Properties {
+					if _, ok := schema.Properties[key]; !ok {
+						schema.Properties[key] = property
+					}
+				}
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := d.schema(field.Type)
+		if strings.Contains(opts, "string") {
+			property = &Schema{Type: "string"}
+		}
+		schema.Properties[name] = property
+	}
+	return schema
+}
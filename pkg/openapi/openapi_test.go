@@ -0,0 +1,64 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type base struct {
+	ID string `json:"id"`
+}
+
+type record struct {
+	base
+	Amount  float64           `json:"amount"`
+	Date    time.Time         `json:"date"`
+	Secret  string            `json:"-"`
+	Count   int64             `json:"count,string"`
+	Tags    []string          `json:"tags,omitempty"`
+	Extra   map[string]*child `json:"extra"`
+	Err     error             `json:"error,omitempty"`
+	Any     interface{}       `json:"any"`
+	Untaged bool
+	hidden  bool
+}
+
+type child struct {
+	Parent *record `json:"parent"`
+}
+
+func TestSchema(t *testing.T) {
+	d := New(Info{Title: "test", Version: "1"})
+
+	// test schema follows JSON encoding of struct and references its types
+	if ref := d.Schema(&record{}); ref.Ref != "#/components/schemas/record" {
+		t.Fatalf("Struct should be referenced, got %+v", ref)
+	}
+	expected := map[string]string{
+		"record": `{"type":"object","properties":{"Untaged":{"type":"boolean"},"amount":{"type":"number","format":"double"},` +
+			`"any":{},"count":{"type":"string"},"date":{"type":"string","format":"date-time"},` +
+			`"extra":{"type":"object","additionalProperties":{"$ref":"#/components/schemas/child"}},"id":{"type":"string"},` +
+			`"tags":{"type":"array","items":{"type":"string"}}}}`,
+		"child": `{"type":"object","properties":{"parent":{"$ref":"#/components/schemas/record"}}}`,
+	}
+	if len(d.Components.Schemas) != len(expected) {
+		t.Errorf("Schemas should be %v, got %v", expected, d.Components.Schemas)
+	}
+	for name, schema := range expected {
+		if actual, _ := json.Marshal(d.Components.Schemas[name]); string(actual) != schema {
+			t.Errorf("Schema %s should be %s, got %s", name, schema, actual)
+		}
+	}
+
+	// test struct may be named explicitly
+	if ref := d.NamedSchema("Base", base{}); ref.Ref != "#/components/schemas/Base" || d.Components.Schemas["Base"] == nil {
+		t.Errorf("Struct should be referenced as Base, got %+v", ref)
+	}
+
+	// test operations are listed by methods and paths
+	d.Add("get", "/records/{id}", &Operation{OperationID: "getRecord"})
+	if operations := d.Operations(); len(operations) != 1 || operations[0] != "GET /records/{id}" {
+		t.Errorf("Operations should be [GET /records/{id}], got %v", operations)
+	}
+}
@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// FilePublisher appends events to local file as JSON lines, file is synced
+// before Publish returns.
+type FilePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFilePublisher returns publisher appending to file at path, file is created
+// if it doesn't exist.
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{file: file}, nil
+}
+
+// Publish implements EventPublisher.
+func (fp *FilePublisher) Publish(_ context.Context, events []*repository.OutboxEvent) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if _, err := fp.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return fp.file.Sync()
+}
+
+// Close implements EventPublisher.
+func (fp *FilePublisher) Close() error {
+	return fp.file.Close()
+}
@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Media types of Kafka REST Proxy API v2
+const (
+	kafkaJSONContentType = "application/vnd.kafka.json.v2+json"
+	kafkaAccept          = "application/vnd.kafka.v2+json"
+)
+
+// kafkaTimeout limits publishing of batch.
+const kafkaTimeout = 30 * time.Second
+
+// KafkaPublisher publishes events to Kafka topic through REST Proxy (API v2).
+// Account is a key of record, so events of account go to the same partition
+// and keep their order.
+type KafkaPublisher struct {
+	url    string
+	client *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string                  `json:"key"`
+	Value *repository.OutboxEvent `json:"value"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+type kafkaError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// NewKafkaPublisher returns publisher to topic through REST Proxy at proxyURL.
+func NewKafkaPublisher(proxyURL, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		url:    strings.TrimRight(proxyURL, "/") + "/topics/" + topic,
+		client: &http.Client{Timeout: kafkaTimeout},
+	}
+}
+
+// Publish implements EventPublisher.
+func (kp *KafkaPublisher) Publish(ctx context.Context, events []*repository.OutboxEvent) error {
+	records := make([]kafkaRecord, len(events))
+	for i, event := range events {
+		records[i] = kafkaRecord{Key: event.Account, Value: event}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, kp.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaJSONContentType)
+	req.Header.Set("Accept", kafkaAccept)
+	resp, err := kp.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e kafkaError
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("kafka: %s (%d)", e.Message, e.ErrorCode)
+		}
+		return fmt.Errorf("kafka: unexpected status %s", resp.Status)
+	}
+	var produced kafkaProduceResponse
+	if err = json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return err
+	}
+	for i, offset := range produced.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("kafka: record %d: %s (%d)", i, offset.Error, *offset.ErrorCode)
+		}
+	}
+	return nil
+}
+
+// Close implements EventPublisher.
+func (kp *KafkaPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// MemoryPublisher keeps published events in memory, it is useful in tests.
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []*repository.OutboxEvent
+	err    error
+}
+
+// NewMemoryPublisher returns empty MemoryPublisher.
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{events: make([]*repository.OutboxEvent, 0)}
+}
+
+// Publish implements EventPublisher.
+func (mp *MemoryPublisher) Publish(_ context.Context, events []*repository.OutboxEvent) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.err != nil {
+		return mp.err
+	}
+	mp.events = append(mp.events, events...)
+	return nil
+}
+
+// Fail makes Publish return err instead of publishing, nil restores publishing.
+func (mp *MemoryPublisher) Fail(err error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.err = err
+}
+
+// Events returns published events in order of publishing.
+func (mp *MemoryPublisher) Events() []*repository.OutboxEvent {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	events := make([]*repository.OutboxEvent, len(mp.events))
+	copy(events, mp.events)
+	return events
+}
+
+// Close implements EventPublisher.
+func (mp *MemoryPublisher) Close() error {
+	return nil
+}
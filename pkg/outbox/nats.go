@@ -0,0 +1,188 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// natsTimeout limits connecting and publishing of batch unless context has deadline.
+const natsTimeout = 10 * time.Second
+
+// NATSPublisher publishes events to NATS server by its text protocol. Subject of
+// event is subject prefix followed by account, so subscribers of "<subject>.>"
+// get events of all accounts. Batch is followed by PING and it is published once
+// PONG is received, as server handles messages of connection in order.
+type NATSPublisher struct {
+	mu      sync.Mutex
+	addr    string
+	user    *url.Userinfo
+	subject string
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+// NewNATSPublisher returns publisher to NATS server at rawurl
+// (nats://[user:password@]host[:port]), it connects on first Publish.
+func NewNATSPublisher(rawurl, subject string) (*NATSPublisher, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, fmt.Errorf("nats: invalid server URL %q", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &NATSPublisher{addr: addr, user: u.User, subject: subject}, nil
+}
+
+// Publish implements EventPublisher. Connection is dropped on error and
+// restored by the next Publish.
+func (np *NATSPublisher) Publish(ctx context.Context, events []*repository.OutboxEvent) error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsTimeout)
+	}
+	err := np.publish(ctx, deadline, events)
+	if err != nil && np.conn != nil {
+		np.conn.Close()
+		np.conn = nil
+	}
+	return err
+}
+
+func (np *NATSPublisher) publish(ctx context.Context, deadline time.Time, events []*repository.OutboxEvent) error {
+	if np.conn == nil {
+		if err := np.connect(ctx, deadline); err != nil {
+			return err
+		}
+	}
+	// cancellation of ctx interrupts waiting for server
+	stop := make(chan struct{})
+	defer close(stop)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}(np.conn)
+	_ = np.conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(np.conn)
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "PUB %s.%s %d\r\n", np.subject, event.Account, len(data))
+		_, _ = w.Write(data)
+		_, _ = w.WriteString("\r\n")
+	}
+	_, _ = w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return np.waitPong()
+}
+
+// connect connects to server and sends CONNECT in reply to its INFO.
+func (np *NATSPublisher) connect(ctx context.Context, deadline time.Time) error {
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", np.addr)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(deadline)
+	np.conn, np.r = conn, bufio.NewReader(conn)
+	line, err := np.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err = json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return err
+	}
+	if info.TLSRequired {
+		return errors.New("nats: TLS is not supported")
+	}
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "payment-system",
+		"lang":     "go",
+		"version":  "1.0.0",
+	}
+	if np.user != nil {
+		options["user"] = np.user.Username()
+		if password, ok := np.user.Password(); ok {
+			options["pass"] = password
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\n", data)
+	return err
+}
+
+// waitPong reads messages of server until PONG, error reported by server is returned.
+func (np *NATSPublisher) waitPong() error {
+	for {
+		line, err := np.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = np.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates are skipped
+	}
+}
+
+func (np *NATSPublisher) readLine() (string, error) {
+	line, err := np.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Close implements EventPublisher.
+func (np *NATSPublisher) Close() error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	if np.conn == nil {
+		return nil
+	}
+	err := np.conn.Close()
+	np.conn = nil
+	return err
+}
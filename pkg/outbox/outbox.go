@@ -0,0 +1,124 @@
+// Package outbox publishes events written to transactional outbox: events are
+// committed in the same transaction as balances they describe, and relay
+// publishes them afterwards to a file, NATS or Kafka. Events of account are
+// published in order of their Seq, every event is published at least once.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Kinds of publishers
+const (
+	PublisherFile  = "file"
+	PublisherNATS  = "nats"
+	PublisherKafka = "kafka"
+)
+
+// DefaultBatch limits number of events published at once.
+const DefaultBatch = 100
+
+// EventPublisher publishes events of outbox to a broker or a sink.
+type EventPublisher interface {
+	// Publish publishes events in given order and returns once all of them are
+	// accepted. Some of them may be published on error, they are published again.
+	Publish(ctx context.Context, events []*repository.OutboxEvent) error
+	// Close releases resources of publisher.
+	Close() error
+}
+
+// NewPublisher returns publisher of kind: events are appended to file at target,
+// or published to NATS server at target with subject prefix topic, or to Kafka
+// topic through REST Proxy at target.
+func NewPublisher(kind, target, topic string) (EventPublisher, error) {
+	switch kind {
+	case PublisherFile:
+		return NewFilePublisher(target)
+	case PublisherNATS:
+		return NewNATSPublisher(target, topic)
+	case PublisherKafka:
+		return NewKafkaPublisher(target, topic), nil
+	}
+	return nil, fmt.Errorf("unknown publisher %q", kind)
+}
+
+// Relay publishes events of outbox. Offset of relay (Seq of the last published
+// event of every account) is saved after events are published, so events are
+// published again if relay stops or fails in between. Relays of different names
+// track their offsets independently.
+type Relay struct {
+	name       string
+	repository repository.Repository
+	publisher  EventPublisher
+	batch      int
+	logger     log.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewRelay returns relay of name publishing events of repo by publisher.
+func NewRelay(name string, repo repository.Repository, publisher EventPublisher, logger log.Logger) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		name:       name,
+		repository: repo,
+		publisher:  publisher,
+		batch:      DefaultBatch,
+		logger:     log.With(logger, "component", "outbox", "relay", name),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Publish publishes up to DefaultBatch pending events and saves offset of relay,
+// it returns number of published events.
+func (r *Relay) Publish(ctx context.Context) (int, error) {
+	repo := r.repository.WithContext(ctx)
+	events, err := repo.GetOutbox(r.name, r.batch)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err = r.publisher.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+	if err = repo.SaveOutboxOffsets(r.name, events); err != nil {
+		return 0, err
+	}
+	_ = level.Debug(r.logger).Log("published", len(events), "last", events[len(events)-1].ID)
+	return len(events), nil
+}
+
+// Run publishes pending events every interval until Close is called, full
+// batches are followed by the next one at once. Failure is logged and retried
+// next interval.
+func (r *Relay) Run(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := r.Publish(r.ctx)
+		if err != nil && r.ctx.Err() == nil {
+			_ = level.Error(r.logger).Log("during", "Publish", "err", err)
+		}
+		if err != nil || n < r.batch {
+			select {
+			case <-ticker.C:
+			case <-r.ctx.Done():
+				return nil
+			}
+		} else if r.ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Close stops relay, publishing in progress is cancelled.
+func (r *Relay) Close() {
+	r.cancel()
+}
@@ -0,0 +1,191 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestRelay(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	svc := service.NewPaymentService(repo)
+	for _, amount := range []float64{10, 20, 30} {
+		if _, err := svc.Transfer(context.Background(), "alice456", "bob123", amount, "USD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// failed transfer is not written to outbox
+	if _, err := svc.Transfer(context.Background(), "bob123", "alice456", 1000, "USD"); err == nil {
+		t.Fatal("Transfer should fail")
+	}
+
+	// test failed publishing is retried
+	publisher := NewMemoryPublisher()
+	relay := NewRelay("memory", repo, publisher, log.NewNopLogger())
+	relay.batch = 4
+	publisher.Fail(errors.New("broker is down"))
+	if _, err := relay.Publish(context.Background()); err == nil {
+		t.Error("Publish should fail")
+	}
+	publisher.Fail(nil)
+	for {
+		n, err := relay.Publish(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	// test events of every account are published once in order
+	events := publisher.Events()
+	if len(events) != 6 {
+		t.Fatalf("Unexpected number of events: %d", len(events))
+	}
+	seqs := make(map[string]int64)
+	for _, event := range events {
+		if event.Type != repository.EventPayment || event.Seq != seqs[event.Account]+1 {
+			t.Errorf("Unexpected event %+v", event)
+		}
+		seqs[event.Account] = event.Seq
+	}
+	var change repository.BalanceChange
+	if err := json.Unmarshal(events[len(events)-1].Payload, &change); err != nil {
+		t.Fatal(err)
+	}
+	if events[len(events)-1].Account != "bob123" || change.Direction != repository.DirectionIncoming || change.Balance != 60 {
+		t.Errorf("Unexpected last event %+v", change)
+	}
+
+	// test relays track their offsets independently
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+	file, err := NewPublisher(PublisherFile, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := NewRelay("file", repo, file, log.NewNopLogger()).Publish(context.Background()); n != 6 || err != nil {
+		t.Errorf("Unexpected outcome of file relay: %d, %v", n, err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Unexpected number of lines: %d", len(lines))
+	}
+	var event repository.OutboxEvent
+	if err = json.Unmarshal([]byte(lines[0]), &event); err != nil || event.ID != events[0].ID {
+		t.Errorf("Unexpected line %s: %v", lines[0], err)
+	}
+	if n, err := relay.Publish(context.Background()); n != 0 || err != nil {
+		t.Errorf("Nothing should be published: %d, %v", n, err)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if scanner.Text() == "PING" {
+				fmt.Fprint(conn, "PONG\r\n")
+				break
+			}
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	publisher, err := NewNATSPublisher("nats://ps:secret@"+ln.Addr().String(), "payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	event := &repository.OutboxEvent{ID: 1, Account: "alice456", Seq: 1, Type: repository.EventPayment, Payload: json.RawMessage(`{}`)}
+	if err = publisher.Publish(context.Background(), []*repository.OutboxEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+	data, _ := json.Marshal(event)
+	if len(lines) != 3 || !strings.Contains(lines[0], `"user":"ps"`) || !strings.Contains(lines[0], `"pass":"secret"`) ||
+		lines[1] != fmt.Sprintf("PUB payments.alice456 %d", len(data)) || lines[2] != string(data) {
+		t.Errorf("Unexpected messages %q", lines)
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	var records struct {
+		Records []struct {
+			Key   string                 `json:"key"`
+			Value repository.OutboxEvent `json:"value"`
+		} `json:"records"`
+	}
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/payments" || r.Header.Get("Content-Type") != kafkaJSONContentType {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&records)
+		if fail {
+			fmt.Fprint(w, `{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"Leader not available"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"offsets":[{"partition":0,"offset":7,"error_code":null,"error":null}]}`)
+	}))
+	defer server.Close()
+
+	publisher := NewKafkaPublisher(server.URL+"/", "payments")
+	events := []*repository.OutboxEvent{{ID: 1, Account: "alice456", Seq: 1, Payload: json.RawMessage(`{}`)}}
+	if err := publisher.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 1 || records.Records[0].Key != "alice456" || records.Records[0].Value.Seq != 1 {
+		t.Errorf("Unexpected records %+v", records)
+	}
+	fail = true
+	if err := publisher.Publish(context.Background(), events); err == nil || !strings.Contains(err.Error(), "Leader not available") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package payout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Transfer is a transfer of payout received by FakeConnector.
+type Transfer struct {
+	Reference   string
+	PayoutID    int64
+	BankAccount string
+	Amount      float64
+	Currency    string
+	Status      string
+	Reason      string
+}
+
+// FakeConnector is a stand-in bank keeping transfers in memory, it is useful in
+// tests and demos. Transfers are confirmed at once unless connector holds them.
+type FakeConnector struct {
+	mu        sync.Mutex
+	transfers []*Transfer
+	rejected  map[string]string // reasons of rejection by bank account
+	hold      bool
+	err       error
+	sendErr   error
+	deliver   bool // transfer is received despite sendErr
+}
+
+// NewFakeConnector returns FakeConnector confirming transfers at once.
+func NewFakeConnector() *FakeConnector {
+	return &FakeConnector{
+		transfers: make([]*Transfer, 0),
+		rejected:  make(map[string]string),
+	}
+}
+
+// Send implements Connector.
+func (fc *FakeConnector) Send(_ context.Context, payout *repository.Payout) (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.err != nil {
+		return "", fc.err
+	}
+	if fc.sendErr != nil && !fc.deliver {
+		return "", fc.sendErr
+	}
+	for _, transfer := range fc.transfers {
+		if transfer.PayoutID == payout.ID {
+			return transfer.Reference, fc.sendErr
+		}
+	}
+	if reason, ok := fc.rejected[payout.BankAccount]; ok {
+		return "", fmt.Errorf("%w: %s", ErrRejected, reason)
+	}
+	transfer := &Transfer{
+		Reference:   fmt.Sprintf("fake-%d", len(fc.transfers)+1),
+		PayoutID:    payout.ID,
+		BankAccount: payout.BankAccount,
+		Amount:      payout.Amount,
+		Currency:    payout.Currency,
+		Status:      StatusConfirmed,
+	}
+	if fc.hold {
+		transfer.Status = StatusPending
+	}
+	fc.transfers = append(fc.transfers, transfer)
+	if fc.sendErr != nil {
+		return "", fc.sendErr
+	}
+	return transfer.Reference, nil
+}
+
+// Status implements Connector.
+func (fc *FakeConnector) Status(_ context.Context, reference string) (string, string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.err != nil {
+		return "", "", fc.err
+	}
+	for _, transfer := range fc.transfers {
+		if transfer.Reference == reference {
+			return transfer.Status, transfer.Reason, nil
+		}
+	}
+	return "", "", fmt.Errorf("transfer %q not found", reference)
+}
+
+// Lookup implements Connector.
+func (fc *FakeConnector) Lookup(_ context.Context, payoutID int64) (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.err != nil {
+		return "", fc.err
+	}
+	for _, transfer := range fc.transfers {
+		if transfer.PayoutID == payoutID {
+			return transfer.Reference, nil
+		}
+	}
+	return "", nil
+}
+
+// Fail makes Send, Status and Lookup return err, nil restores them.
+func (fc *FakeConnector) Fail(err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.err = err
+}
+
+// FailSend makes Send return err, transfer is received by bank anyway if
+// deliver is set, as if answer of bank was lost. Nil err restores Send.
+func (fc *FakeConnector) FailSend(err error, deliver bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.sendErr, fc.deliver = err, deliver
+}
+
+// Reject makes bank refuse transfers to bankAccount for reason.
+func (fc *FakeConnector) Reject(bankAccount, reason string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.rejected[bankAccount] = reason
+}
+
+// Hold keeps transfers sent afterwards pending until they are settled, false
+// restores confirming them at once.
+func (fc *FakeConnector) Hold(hold bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.hold = hold
+}
+
+// Settle sets status of transfer by reference, reason is reported for failed one.
+func (fc *FakeConnector) Settle(reference, status, reason string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, transfer := range fc.transfers {
+		if transfer.Reference == reference {
+			transfer.Status, transfer.Reason = status, reason
+			return nil
+		}
+	}
+	return fmt.Errorf("transfer %q not found", reference)
+}
+
+// Transfers returns received transfers in order of receiving.
+func (fc *FakeConnector) Transfers() []Transfer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	transfers := make([]Transfer, len(fc.transfers))
+	for i, transfer := range fc.transfers {
+		transfers[i] = *transfer
+	}
+	return transfers
+}
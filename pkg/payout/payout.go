@@ -0,0 +1,318 @@
+// Package payout sends payouts to external bank: payout booked by service to
+// clearing account is sent by connector of bank, its outcome is polled until
+// bank settles it, and failed payout is compensated by refund from clearing
+// account. State of every payout is persisted by repository, so processor
+// resumes where it stopped after restart.
+package payout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// Kinds of connectors
+const (
+	ConnectorFake = "fake"
+)
+
+// Statuses of transfer reported by bank
+const (
+	StatusPending   = "pending"
+	StatusConfirmed = "confirmed"
+	StatusFailed    = "failed"
+)
+
+// DefaultBatch limits number of payouts processed at once.
+const DefaultBatch = 100
+
+// MaxBackoff limits delay between attempts.
+const MaxBackoff = time.Hour
+
+// ErrRejected is returned by connector when bank refuses transfer for good,
+// it is not retried.
+var ErrRejected = errors.New("rejected by bank")
+
+// Connector sends transfers to bank and reports their outcome.
+type Connector interface {
+	// Send sends transfer of payout to bank and returns its reference. It is
+	// idempotent by ID of payout: transfer sent already is not sent again, its
+	// reference is returned. ErrRejected (possibly wrapped) is returned when bank
+	// refuses transfer, other errors are retried.
+	Send(ctx context.Context, payout *repository.Payout) (string, error)
+	// Status returns status of transfer by reference, and reason if it failed.
+	Status(ctx context.Context, reference string) (status, reason string, err error)
+	// Lookup returns reference of transfer of payout by ID of payout, empty if
+	// bank has not received it.
+	Lookup(ctx context.Context, payoutID int64) (string, error)
+}
+
+// NewConnector returns connector of kind.
+func NewConnector(kind string) (Connector, error) {
+	switch kind {
+	case ConnectorFake:
+		return NewFakeConnector(), nil
+	}
+	return nil, fmt.Errorf("unknown connector %q", kind)
+}
+
+// Processor moves due payouts one state at a time: pending payout is sent to
+// bank, sent payout is confirmed or failed by its status, failed payout is
+// refunded and becomes compensated. Failed attempts are retried with
+// exponential backoff. After maxAttempts of them bank is asked whether it
+// received transfer of pending payout anyway, payout is failed only if it
+// didn't: send may fail after bank has accepted transfer.
+type Processor struct {
+	repository  repository.Repository
+	connector   Connector
+	interval    time.Duration
+	maxAttempts int
+	batch       int
+	logger      log.Logger
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewProcessor returns processor sending payouts of repo by connector. Interval
+// is a time between polls of due payouts and the first retry delay.
+func NewProcessor(repo repository.Repository, connector Connector, interval time.Duration, maxAttempts int, logger log.Logger) *Processor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Processor{
+		repository:  repo,
+		connector:   connector,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		batch:       DefaultBatch,
+		logger:      log.With(logger, "component", "payout"),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Process moves up to DefaultBatch due payouts to their next states and returns
+// number of them. Failure of payout is logged and doesn't stop the rest.
+func (p *Processor) Process(ctx context.Context) (int, error) {
+	repo := p.repository.WithContext(ctx)
+	payouts, err := repo.GetDuePayouts(p.batch)
+	if err != nil {
+		return 0, err
+	}
+	for _, payout := range payouts {
+		from := payout.State
+		err = p.step(ctx, repo, payout)
+		if err == repository.ErrPayoutStateChanged {
+			continue // moved by another processor
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			_ = level.Error(p.logger).Log("payout", payout.ID, "state", from, "err", err)
+			continue
+		}
+		_ = level.Debug(p.logger).Log("payout", payout.ID, "from", from, "to", payout.State, "attempts", payout.Attempts)
+	}
+	return len(payouts), nil
+}
+
+// step moves payout to its next state or schedules the next attempt.
+func (p *Processor) step(ctx context.Context, repo repository.Repository, payout *repository.Payout) error {
+	from := payout.State
+	switch from {
+	case repository.PayoutPending:
+		reference, err := p.connector.Send(ctx, payout)
+		switch {
+		case errors.Is(err, ErrRejected):
+			p.fail(payout, err.Error())
+		case err != nil:
+			payout.Error = err.Error()
+			if p.retry(payout) >= p.maxAttempts {
+				p.resolve(ctx, payout, err)
+			}
+		default:
+			p.sent(payout, reference)
+		}
+		return repo.UpdatePayout(nil, payout, from)
+	case repository.PayoutSent:
+		status, reason, err := p.connector.Status(ctx, payout.BankRef)
+		switch {
+		case err != nil: // sent payout may be settled yet, so it is polled until bank knows
+			payout.Error = err.Error()
+			p.retry(payout)
+		case status == StatusConfirmed:
+			payout.State, payout.Error = repository.PayoutConfirmed, ""
+		case status == StatusFailed:
+			p.fail(payout, reason)
+		default:
+			payout.NextAttemptAt = time.Now().Add(p.interval)
+		}
+		return repo.UpdatePayout(nil, payout, from)
+	case repository.PayoutFailed:
+		err := p.compensate(repo, payout)
+		if err == nil || err == repository.ErrPayoutStateChanged {
+			return err
+		}
+		p.retry(payout) // reason of failure is kept
+		if updateErr := repo.UpdatePayout(nil, payout, from); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+	return fmt.Errorf("unexpected state %q", from)
+}
+
+// resolve looks up transfer of pending payout, which sends failed without
+// answer of bank, by its ID. Payout received by bank is sent, otherwise it is
+// failed. Payout stays pending while bank can't be asked, as it would be
+// refunded while bank may pay it out.
+func (p *Processor) resolve(ctx context.Context, payout *repository.Payout, sendErr error) {
+	reference, err := p.connector.Lookup(ctx, payout.ID)
+	switch {
+	case err != nil:
+		payout.Error = fmt.Sprintf("%v, lookup: %v", sendErr, err)
+	case reference != "":
+		p.sent(payout, reference)
+	default:
+		p.fail(payout, sendErr.Error())
+	}
+}
+
+// sent moves payout to sent state, its status is polled after interval.
+func (p *Processor) sent(payout *repository.Payout, reference string) {
+	payout.State, payout.BankRef, payout.Error, payout.Attempts = repository.PayoutSent, reference, "", 0
+	payout.NextAttemptAt = time.Now().Add(p.interval)
+}
+
+// fail moves payout to failed state, it is refunded at once.
+func (p *Processor) fail(payout *repository.Payout, reason string) {
+	payout.State, payout.Error, payout.Attempts = repository.PayoutFailed, reason, 0
+	payout.NextAttemptAt = time.Now()
+}
+
+// retry counts failed attempt and schedules the next one, it returns number of
+// failed attempts.
+func (p *Processor) retry(payout *repository.Payout) int {
+	payout.Attempts++
+	backoff := float64(p.interval) * math.Pow(2, float64(payout.Attempts-1))
+	if backoff > float64(MaxBackoff) {
+		backoff = float64(MaxBackoff)
+	}
+	payout.NextAttemptAt = time.Now().Add(time.Duration(backoff))
+	return payout.Attempts
+}
+
+// compensate refunds failed payout from clearing account and moves it to
+// compensated state within the same transaction, so it is refunded once. Payout
+// is left as is on error.
+func (p *Processor) compensate(repo repository.Repository, payout *repository.Payout) (err error) {
+	txn, err := repo.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	clearing := service.ClearingAccount(payout.Currency)
+	names := []string{clearing, payout.Account}
+	sort.Strings(names) // to avoid deadlock with transfers
+	balances := make(map[string]float64)
+	for _, name := range names {
+		account, err := repo.GetAndLockAccount(txn, name)
+		if err != nil {
+			return err
+		}
+		balances[name] = account.Balance
+	}
+	balances[clearing] -= payout.Amount
+	balances[payout.Account] += payout.Amount
+	for _, name := range names {
+		if err = repo.UpdateBalance(txn, name, balances[name]); err != nil {
+			return err
+		}
+	}
+
+	for _, direction := range []string{repository.DirectionIncoming, repository.DirectionOutgoing} {
+		err = repo.InsertTransaction(txn, &repository.Transaction{
+			Direction: direction,
+			Payer:     clearing,
+			Payee:     payout.Account,
+			Amount:    payout.Amount,
+			Currency:  payout.Currency,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		change := &repository.BalanceChange{
+			Direction: repository.DirectionIncoming,
+			Payer:     clearing,
+			Payee:     payout.Account,
+			Amount:    payout.Amount,
+			Currency:  payout.Currency,
+			Balance:   balances[name],
+		}
+		if name == clearing {
+			change.Direction = repository.DirectionOutgoing
+		}
+		event, err := repository.NewOutboxEvent(name, repository.EventPayment, change)
+		if err != nil {
+			return err
+		}
+		if err = repo.AppendOutbox(txn, event); err != nil {
+			return err
+		}
+	}
+
+	compensated := *payout
+	compensated.State, compensated.Attempts = repository.PayoutCompensated, 0
+	if err = repo.UpdatePayout(txn, &compensated, repository.PayoutFailed); err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	*payout = compensated
+	return nil
+}
+
+// Run processes due payouts every interval until Close is called, full
+// batches are followed by the next one at once. Failure is logged and retried
+// next interval.
+func (p *Processor) Run() error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		n, err := p.Process(p.ctx)
+		if err != nil && p.ctx.Err() == nil {
+			_ = level.Error(p.logger).Log("during", "Process", "err", err)
+		}
+		if err != nil || n < p.batch {
+			select {
+			case <-ticker.C:
+			case <-p.ctx.Done():
+				return nil
+			}
+		} else if p.ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Close stops processor, processing in progress is cancelled.
+func (p *Processor) Close() {
+	p.cancel()
+}
@@ -0,0 +1,168 @@
+package payout
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestProcessor(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	svc := service.NewPaymentService(repo)
+	ctx := context.Background()
+	connector := NewFakeConnector()
+	processor := NewProcessor(repo, connector, 0, 3, log.NewNopLogger())
+
+	// test payout is sent and confirmed
+	payout, err := svc.Payout(ctx, "alice456", "DE89370400440532013000", 30, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, repo, map[string]float64{"alice456": 70, "clearing:USD": 30})
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutConfirmed, "")
+	if transfers := connector.Transfers(); len(transfers) != 1 || transfers[0].PayoutID != payout.ID || transfers[0].Amount != 30 {
+		t.Errorf("Unexpected transfers %+v", transfers)
+	}
+
+	// test rejected payout is refunded
+	connector.Reject("closed", "account closed")
+	payout, err = svc.Payout(ctx, "alice456", "closed", 20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutCompensated, "account closed")
+	checkBalances(t, repo, map[string]float64{"alice456": 70, "clearing:USD": 30})
+
+	// test payout not received by bank is failed after max attempts and refunded
+	connector.FailSend(errors.New("timeout"), false)
+	payout, err = svc.Payout(ctx, "alice456", "DE89370400440532013000", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutPending, "timeout")
+	process(t, processor, 1)
+	checkPayout(t, svc, payout.ID, repository.PayoutFailed, "timeout")
+	connector.FailSend(nil, false)
+	process(t, processor, 1)
+	checkPayout(t, svc, payout.ID, repository.PayoutCompensated, "timeout")
+	checkBalances(t, repo, map[string]float64{"alice456": 70, "clearing:USD": 30})
+
+	// test payout received by bank despite failed sends is found, not refunded
+	connector.FailSend(errors.New("connection reset"), true)
+	payout, err = svc.Payout(ctx, "alice456", "DE89370400440532013000", 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 3)
+	checkPayout(t, svc, payout.ID, repository.PayoutSent, "")
+	connector.FailSend(nil, false)
+	process(t, processor, 1)
+	checkPayout(t, svc, payout.ID, repository.PayoutConfirmed, "")
+	checkBalances(t, repo, map[string]float64{"alice456": 65, "clearing:USD": 35})
+
+	// test payout is not failed while bank can't be asked
+	connector.Fail(errors.New("bank is down"))
+	payout, err = svc.Payout(ctx, "alice456", "DE89370400440532013000", 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 5)
+	checkPayout(t, svc, payout.ID, repository.PayoutPending, "bank is down")
+	connector.Fail(nil)
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutConfirmed, "")
+	checkBalances(t, repo, map[string]float64{"alice456": 60, "clearing:USD": 40})
+
+	// test processor started anew resumes payout where it stopped
+	connector.Hold(true)
+	payout, err = svc.Payout(ctx, "alice456", "DE89370400440532013000", 40, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 1)
+	processor.Close()
+	processor = NewProcessor(repo, connector, 0, 3, log.NewNopLogger())
+	process(t, processor, 1)
+	status := checkPayout(t, svc, payout.ID, repository.PayoutSent, "")
+	if err = connector.Settle(status.Payout.BankRef, StatusFailed, "beneficiary bank rejected"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutCompensated, "beneficiary bank rejected")
+	checkBalances(t, repo, map[string]float64{"alice456": 60, "clearing:USD": 40})
+	if n, err := processor.Process(ctx); n != 0 || err != nil {
+		t.Errorf("Nothing should be due, got %d %v", n, err)
+	}
+	if len(connector.Transfers()) != 4 {
+		t.Errorf("Unexpected transfers %+v", connector.Transfers())
+	}
+}
+
+func TestProcessorSharded(t *testing.T) {
+	var stores []*inmem.RepositoryInmem
+	var shards []repository.Shard
+	for i := 0; i < 3; i++ {
+		store := inmem.NewInmem().(*inmem.RepositoryInmem)
+		stores, shards = append(stores, store), append(shards, store)
+	}
+	repo := repository.NewSharded(shards, log.NewNopLogger())
+	svc := service.NewPaymentService(repo)
+	ctx := context.Background()
+	payer := "alice456"
+	stores[repo.ShardOf(payer)].InsertAccount(&repository.Account{UserID: payer, Balance: 100, Currency: "USD"})
+	connector := NewFakeConnector()
+	connector.Reject("closed", "account closed")
+	processor := NewProcessor(repo, connector, 0, 3, log.NewNopLogger())
+
+	// test payout spanning shards is refunded by saga as well
+	payout, err := svc.Payout(ctx, payer, "closed", 25, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, repo, map[string]float64{payer: 75, "clearing:USD": 25})
+	process(t, processor, 2)
+	checkPayout(t, svc, payout.ID, repository.PayoutCompensated, "account closed")
+	checkBalances(t, repo, map[string]float64{payer: 100, "clearing:USD": 0})
+}
+
+// process runs n rounds of processor.
+func process(t *testing.T, processor *Processor, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := processor.Process(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkPayout(t *testing.T, svc service.Service, id int64, state, reason string) *repository.PaymentStatus {
+	t.Helper()
+	status, err := svc.Payment(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != state || status.Payout == nil || status.Payout.State != state || !strings.Contains(status.Payout.Error, reason) {
+		t.Errorf("Payout should be %s with %q, got %+v", state, reason, status.Payout)
+	}
+	return status
+}
+
+func checkBalances(t *testing.T, repo repository.Repository, balances map[string]float64) {
+	t.Helper()
+	for name, balance := range balances {
+		if account, err := repo.GetAccount(name); err != nil || account.Balance != balance {
+			t.Errorf("Balance of %s should be %v, got %+v %v", name, balance, account, err)
+		}
+	}
+}
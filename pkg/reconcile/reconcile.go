@@ -0,0 +1,298 @@
+// Package reconcile checks consistency of accounts: stored balance of every
+// account is compared with balance recomputed from payment history, and total
+// money of every currency is checked to be conserved. Balances may be saved as
+// snapshots, which point-in-time balances are computed from.
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	kitexpvar "github.com/go-kit/kit/metrics/expvar"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// Report formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// tolerance returns a half of minor unit of currency, balances are stored with
+// more decimals than currencies have and sums of float64 amounts carry rounding
+// errors far below it
+func tolerance(code string) float64 {
+	return currency.MinorUnit(code) / 2
+}
+
+// CurrencyTotal represents total money of currency. Money is conserved when both
+// totals are zero: every transfer moves it between accounts and opening balances
+// are booked against equity account.
+type CurrencyTotal struct {
+	Currency string `json:"currency"`
+	Accounts int    `json:"accounts"`
+	// Balance is a sum of stored balances of accounts
+	Balance float64 `json:"balance"`
+	// Ledger is a sum of balances recomputed from payment history
+	Ledger    float64 `json:"ledger_balance"`
+	Conserved bool    `json:"conserved"`
+}
+
+// Report represents outcome of reconciliation.
+type Report struct {
+	TakenAt  time.Time `json:"taken_at"`
+	Accounts int       `json:"accounts"`
+	// Discrepancies are accounts which stored balance differs from recomputed one
+	Discrepancies []*repository.LedgerBalance `json:"discrepancies"`
+	Currencies    []*CurrencyTotal            `json:"currencies"`
+	// Snapshot reports whether balances are saved as snapshot
+	Snapshot bool `json:"snapshot"`
+}
+
+// OK reports whether no discrepancies are found.
+func (r *Report) OK() bool {
+	if len(r.Discrepancies) > 0 {
+		return false
+	}
+	for _, total := range r.Currencies {
+		if !total.Conserved {
+			return false
+		}
+	}
+	return true
+}
+
+// Unbalanced returns number of currencies which money is not conserved.
+func (r *Report) Unbalanced() int {
+	n := 0
+	for _, total := range r.Currencies {
+		if !total.Conserved {
+			n++
+		}
+	}
+	return n
+}
+
+// Metrics are gauges describing the last reconciliation.
+type Metrics struct {
+	// Discrepancies is a number of accounts which balance differs from payment history
+	Discrepancies metrics.Gauge
+	// Unbalanced is a number of currencies which money is not conserved
+	Unbalanced metrics.Gauge
+	// LastRun is a Unix time of the last completed reconciliation
+	LastRun metrics.Gauge
+	// Duration is a number of seconds the last reconciliation took
+	Duration metrics.Gauge
+}
+
+// NewExpvarMetrics returns Metrics published by expvar (/debug/vars), names are
+// prefixed by "reconcile_". It may be called once per process.
+func NewExpvarMetrics() *Metrics {
+	return &Metrics{
+		Discrepancies: kitexpvar.NewGauge("reconcile_discrepancies"),
+		Unbalanced:    kitexpvar.NewGauge("reconcile_unbalanced_currencies"),
+		LastRun:       kitexpvar.NewGauge("reconcile_last_run_timestamp"),
+		Duration:      kitexpvar.NewGauge("reconcile_duration_seconds"),
+	}
+}
+
+// Reconciler reconciles accounts of repository.
+type Reconciler struct {
+	repository repository.Repository
+	metrics    *Metrics
+	logger     log.Logger
+}
+
+// New returns Reconciler, metrics may be nil.
+func New(repo repository.Repository, metrics *Metrics, logger log.Logger) *Reconciler {
+	if metrics == nil {
+		metrics = &Metrics{
+			Discrepancies: discard.NewGauge(),
+			Unbalanced:    discard.NewGauge(),
+			LastRun:       discard.NewGauge(),
+			Duration:      discard.NewGauge(),
+		}
+	}
+	return &Reconciler{
+		repository: repo,
+		metrics:    metrics,
+		logger:     log.With(logger, "component", "reconcile"),
+	}
+}
+
+// Run reconciles accounts and saves their balances as snapshot if snapshot
+// is set. Discrepancies are reported, not returned as error.
+func (rc *Reconciler) Run(ctx context.Context, snapshot bool) (*Report, error) {
+	start := time.Now()
+	repo := rc.repository.WithContext(ctx)
+	balances, err := repo.GetLedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+	report := Check(balances)
+	if snapshot {
+		if err = repo.SaveBalanceSnapshot(balances); err != nil {
+			return nil, err
+		}
+		report.Snapshot = true
+	}
+
+	rc.metrics.Discrepancies.Set(float64(len(report.Discrepancies)))
+	rc.metrics.Unbalanced.Set(float64(report.Unbalanced()))
+	rc.metrics.LastRun.Set(float64(report.TakenAt.Unix()))
+	rc.metrics.Duration.Set(time.Since(start).Seconds())
+	logger := level.Info(rc.logger)
+	if !report.OK() {
+		logger = level.Warn(rc.logger)
+	}
+	_ = logger.Log("accounts", report.Accounts, "discrepancies", len(report.Discrepancies),
+		"unbalanced", report.Unbalanced(), "snapshot", report.Snapshot, "took", time.Since(start))
+	return report, nil
+}
+
+// Schedule runs reconciliation every day at time of day at (offset from UTC
+// midnight) until stop is closed. Failed run is logged and retried next day.
+func (rc *Reconciler) Schedule(at time.Duration, snapshot bool, stop <-chan struct{}) {
+	for {
+		next := Next(time.Now(), at)
+		_ = level.Debug(rc.logger).Log("next", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if _, err := rc.Run(ctx, snapshot); err != nil {
+			_ = level.Error(rc.logger).Log("during", "Run", "err", err)
+		}
+		cancel()
+	}
+}
+
+// Snapshot saves balances of all accounts as snapshot, point-in-time balances
+// are computed from the latest snapshot preceding time in question.
+func (rc *Reconciler) Snapshot(ctx context.Context) (*repository.LedgerSnapshot, error) {
+	repo := rc.repository.WithContext(ctx)
+	snapshot, err := repo.GetLedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+	if err = repo.SaveBalanceSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	_ = level.Debug(rc.logger).Log("snapshot", snapshot.TakenAt, "accounts", len(snapshot.Balances))
+	return snapshot, nil
+}
+
+// ScheduleSnapshots saves snapshot every interval until stop is closed.
+func (rc *Reconciler) ScheduleSnapshots(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := rc.Snapshot(context.Background()); err != nil {
+				_ = level.Error(rc.logger).Log("during", "Snapshot", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Next returns the first time of day at (offset from UTC midnight) after now.
+func Next(now time.Time, at time.Duration) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(at)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Check compares stored balances of snapshot with recomputed ones and sums up
+// money of every currency.
+func Check(snapshot *repository.LedgerSnapshot) *Report {
+	report := &Report{
+		TakenAt:       snapshot.TakenAt,
+		Accounts:      len(snapshot.Balances),
+		Discrepancies: make([]*repository.LedgerBalance, 0),
+		Currencies:    make([]*CurrencyTotal, 0),
+	}
+	totals := make(map[string]*CurrencyTotal)
+	for _, balance := range snapshot.Balances {
+		if math.Abs(balance.Balance-balance.Ledger) >= tolerance(balance.Currency) {
+			report.Discrepancies = append(report.Discrepancies, balance)
+		}
+		total, ok := totals[balance.Currency]
+		if !ok {
+			total = &CurrencyTotal{Currency: balance.Currency}
+			totals[balance.Currency] = total
+			report.Currencies = append(report.Currencies, total)
+		}
+		total.Accounts++
+		total.Balance += balance.Balance
+		total.Ledger += balance.Ledger
+	}
+	for _, total := range report.Currencies {
+		total.Balance, total.Ledger = currency.Round(total.Balance, total.Currency), currency.Round(total.Ledger, total.Currency)
+		total.Conserved = math.Abs(total.Balance) < tolerance(total.Currency) && math.Abs(total.Ledger) < tolerance(total.Currency)
+	}
+	sort.Slice(report.Currencies, func(i, j int) bool {
+		return report.Currencies[i].Currency < report.Currencies[j].Currency
+	})
+	return report
+}
+
+// WriteReport writes report in format: human readable text or JSON.
+func WriteReport(w io.Writer, format string, report *Report) error {
+	if format == FormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	if format != FormatText {
+		return fmt.Errorf("unknown report format %q", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "reconciliation at %s: %d accounts, %d discrepancies, %d unbalanced currencies\n",
+		report.TakenAt.Format(time.RFC3339), report.Accounts, len(report.Discrepancies), report.Unbalanced())
+	if len(report.Discrepancies) > 0 {
+		fmt.Fprintf(tw, "\naccount\tcurrency\tbalance\tledger\tdifference\t\n")
+		for _, d := range report.Discrepancies {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", d.UserID, d.Currency, currency.Format(d.Balance, d.Currency),
+				currency.Format(d.Ledger, d.Currency), currency.Format(d.Difference, d.Currency))
+		}
+	}
+	fmt.Fprintf(tw, "\ncurrency\taccounts\tbalance\tledger\tconserved\t\n")
+	for _, total := range report.Currencies {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%t\t\n", total.Currency, total.Accounts,
+			currency.Format(total.Balance, total.Currency), currency.Format(total.Ledger, total.Currency), total.Conserved)
+	}
+	if report.Snapshot {
+		fmt.Fprintf(tw, "\nbalances saved as snapshot\n")
+	}
+	return tw.Flush()
+}
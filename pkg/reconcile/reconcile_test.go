@@ -0,0 +1,113 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestRun(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := service.NewPaymentService(repo)
+	ctx := context.Background()
+	_, err := svc.ImportAccounts(ctx, []*repository.AccountImport{
+		{UserID: "alice456", Currency: "USD", Balance: 100},
+		{UserID: "bob123", Currency: "USD", Balance: -5, CreditLimit: 10},
+		{UserID: "revenue", Currency: "USD"},
+		{UserID: "hans", Currency: "EUR", Balance: 20},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.SetFeeSchedule(ctx, &repository.FeeSchedule{Currency: "USD", RevenueAccount: "revenue", Fixed: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 10.1, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.Transfer(ctx, "bob123", "alice456", 1000, "USD"); err == nil {
+		t.Fatal("Transfer should fail")
+	}
+
+	metrics := &Metrics{
+		Discrepancies: generic.NewGauge("discrepancies"),
+		Unbalanced:    generic.NewGauge("unbalanced"),
+		LastRun:       generic.NewGauge("last_run"),
+		Duration:      generic.NewGauge("duration"),
+	}
+	reconciler := New(repo, metrics, log.NewNopLogger())
+
+	// test consistent accounts
+	report, err := reconciler.Run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Accounts != 6 || len(report.Currencies) != 2 || !report.Snapshot {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if usd := report.Currencies[1]; usd.Currency != "USD" || usd.Accounts != 4 || usd.Balance != 0 || usd.Ledger != 0 {
+		t.Errorf("Unexpected USD total: %+v", usd)
+	}
+	if metrics.LastRun.(*generic.Gauge).Value() != float64(report.TakenAt.Unix()) {
+		t.Error("Time of last run should be published")
+	}
+	if len(inmemRepo.Snapshots) != 1 || !inmemRepo.Snapshots[0].TakenAt.Equal(report.TakenAt) {
+		t.Fatalf("Snapshot should be saved, got %+v", inmemRepo.Snapshots)
+	}
+	if snapshot := inmemRepo.Snapshots[0].Balances; len(snapshot) != 6 || snapshot[0].UserID != "alice456" ||
+		snapshot[0].Balance != 89.4 {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+
+	// test balance changed bypassing payment history
+	if err = repo.UpdateBalance(nil, "bob123", 50); err != nil {
+		t.Fatal(err)
+	}
+	report, err = reconciler.Run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Discrepancies) != 1 || report.Unbalanced() != 1 || report.Currencies[1].Conserved {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if d := report.Discrepancies[0]; d.UserID != "bob123" || d.Ledger != 5.1 || d.Balance != 50 {
+		t.Errorf("Unexpected discrepancy: %+v", d)
+	}
+	if metrics.Discrepancies.(*generic.Gauge).Value() != 1 || metrics.Unbalanced.(*generic.Gauge).Value() != 1 {
+		t.Error("Discrepancies should be published")
+	}
+
+	var out bytes.Buffer
+	if err = WriteReport(&out, FormatText, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"6 accounts, 1 discrepancies, 1 unbalanced currencies", "bob123", "44.90", "false"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Report should contain %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := 23*time.Hour + 55*time.Minute
+	for _, test := range []struct{ now, next string }{
+		{"2020-03-01T10:00:00Z", "2020-03-01T23:55:00Z"},
+		{"2020-03-01T23:55:00Z", "2020-03-02T23:55:00Z"},
+		{"2020-03-01T23:59:00+03:00", "2020-03-01T23:55:00Z"},
+	} {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		if next := Next(now, at).Format(time.RFC3339); next != test.next {
+			t.Errorf("Next run after %s should be at %s, got %s", test.now, test.next, next)
+		}
+	}
+}
@@ -1,8 +1,37 @@
 package repository
 
-// Account represents user account of payment system.
+// Account represents user account of payment system, it is a wallet of account
+// holder in single currency. Balance of account may go negative down to
+// -CreditLimit (approved overdraft).
 type Account struct {
-	UserID   string  `json:"id"`
-	Balance  float64 `json:"balance"`
-	Currency string  `json:"currency"`
+	UserID          string  `json:"id"`
+	Holder          string  `json:"holder"`
+	Balance         float64 `json:"balance"`
+	Currency        string  `json:"currency"`
+	CreditLimit     float64 `json:"credit_limit"`
+	AvailableCredit float64 `json:"available_credit"`
+	Freeze          string  `json:"freeze"`
+	FreezeReason    string  `json:"freeze_reason,omitempty"`
+}
+
+// Available returns amount of money available for transfers including credit.
+func (a *Account) Available() float64 {
+	return a.Balance + a.CreditLimit
+}
+
+// UnusedCredit returns part of credit limit which is not used yet.
+func (a *Account) UnusedCredit() float64 {
+	if a.Balance >= 0 {
+		return a.CreditLimit
+	}
+	if a.Available() < 0 {
+		return 0
+	}
+	return a.Available()
+}
+
+// Holder represents account holder owning wallets in different currencies.
+type Holder struct {
+	ID      string     `json:"id"`
+	Wallets []*Account `json:"wallets"`
 }
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Lengths of audit log columns, longer values are truncated to fit them.
+const (
+	MaxAuditActor     = 100
+	MaxAuditTarget    = 100
+	MaxAuditError     = 200
+	MaxAuditRequestID = 64
+	MaxAuditClientIP  = 45
+)
+
+// AuditRecord represents entry of append-only audit log. Every record contains hash
+// of the previous one, so any change of the log breaks the chain.
+type AuditRecord struct {
+	ID        int64           `json:"id"`
+	Date      time.Time       `json:"date"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Error     string          `json:"error"`
+	RequestID string          `json:"request_id"`
+	ClientIP  string          `json:"client_ip"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+// ComputeHash returns hash of record content chained with PrevHash.
+func (ar *AuditRecord) ComputeHash() string {
+	content, _ := json.Marshal([]interface{}{
+		ar.ID,
+		ar.Date.UTC().Format(time.RFC3339Nano),
+		ar.Actor,
+		ar.Action,
+		ar.Target,
+		string(ar.Before),
+		string(ar.After),
+		ar.Error,
+		ar.RequestID,
+		ar.ClientIP,
+	})
+	sum := sha256.Sum256(append([]byte(ar.PrevHash+"\n"), content...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Valid reports whether record follows record with prevHash and wasn't changed since.
+func (ar *AuditRecord) Valid(prevHash string) bool {
+	return ar.PrevHash == prevHash && ar.Hash == ar.ComputeHash()
+}
+
+// Truncate cuts values longer than their columns, so record is appended anyway.
+// It must be called before hash is computed.
+func (ar *AuditRecord) Truncate() {
+	ar.Actor = truncate(ar.Actor, MaxAuditActor)
+	ar.Target = truncate(ar.Target, MaxAuditTarget)
+	ar.Error = truncate(ar.Error, MaxAuditError)
+	ar.RequestID = truncate(ar.RequestID, MaxAuditRequestID)
+	ar.ClientIP = truncate(ar.ClientIP, MaxAuditClientIP)
+}
+
+// truncate returns first max characters of s.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
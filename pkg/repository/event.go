@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/lib/pq"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+var (
+	// QueryAppendEvent is a query for appending event to stream of account, version
+	// of stream is unique, so concurrent append of the same version fails
+	QueryAppendEvent = "INSERT INTO account_event(account, version, type, data) VALUES ($1, $2, $3, $4) " +
+		"RETURNING seq, created_at"
+
+	// QueryEvents is a query for fetching events of account after version in order of versions
+	QueryEvents = "SELECT seq, account, version, type, data, created_at FROM account_event " +
+		"WHERE account = $1 AND version > $2 ORDER BY version"
+
+	// QueryEventPage is a query for fetching page of events of all accounts in order of appending
+	QueryEventPage = "SELECT seq, account, version, type, data, created_at FROM account_event " +
+		"WHERE seq > $1 ORDER BY seq LIMIT $2"
+
+	// QueryAggregateSnapshot is a query for fetching the latest snapshot of account aggregate
+	QueryAggregateSnapshot = "SELECT account, version, state, created_at FROM account_snapshot WHERE account = $1"
+
+	// QuerySaveAggregateSnapshot is a query for saving snapshot of account aggregate unless newer one is saved
+	QuerySaveAggregateSnapshot = "INSERT INTO account_snapshot(account, version, state) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (account) DO UPDATE SET version = EXCLUDED.version, state = EXCLUDED.state, created_at = now() " +
+		"WHERE account_snapshot.version < EXCLUDED.version"
+
+	// QueryProjectAccount is a query for writing state of account aggregate to account table
+	QueryProjectAccount = "INSERT INTO account(user_id, holder_id, balance, currency, credit_limit, equity, freeze, freeze_reason) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (user_id) DO UPDATE SET balance = EXCLUDED.balance, " +
+		"freeze = EXCLUDED.freeze, freeze_reason = EXCLUDED.freeze_reason"
+
+	// QueryProjectTransaction is a query for writing history record of event keeping its ID
+	QueryProjectTransaction = "INSERT INTO payment(txn_id, direction, date, payer, payee, amount, fee, currency, error) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, '') ON CONFLICT (txn_id) DO UPDATE SET direction = EXCLUDED.direction, " +
+		"payer = EXCLUDED.payer, payee = EXCLUDED.payee, amount = EXCLUDED.amount, fee = EXCLUDED.fee, " +
+		"currency = EXCLUDED.currency, error = ''"
+
+	// ErrVersionConflict error fired when stream of account is appended concurrently
+	ErrVersionConflict = errs.NewRetryable("version_conflict", "Account changed concurrently", http.StatusConflict)
+)
+
+// AccountEvent is an event of account aggregate. Events of account form its stream
+// numbered by Version without gaps, Seq orders events of all accounts.
+type AccountEvent struct {
+	Seq       int64           `json:"seq"`
+	Account   string          `json:"account"`
+	Version   int64           `json:"version"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AggregateSnapshot is a state of account aggregate after Version events, which
+// aggregate is replayed from instead of the whole stream.
+type AggregateSnapshot struct {
+	Account   string          `json:"account"`
+	Version   int64           `json:"version"`
+	State     json.RawMessage `json:"state"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventStore keeps streams of events of accounts and snapshots of their aggregates,
+// and writes projections of them, see eventsource package.
+type EventStore interface {
+	// AppendEvent appends event to stream of its account within txn, Version of event
+	// must follow the last one, ErrVersionConflict is returned if it is taken. Seq and
+	// CreatedAt of event are filled in.
+	AppendEvent(txn DBTransaction, event *AccountEvent) error
+	// GetEvents returns events of account after version in order of versions, txn may be nil
+	GetEvents(txn DBTransaction, accountName string, afterVersion int64) ([]*AccountEvent, error)
+	// GetEventPage returns up to limit events of all accounts after seq in order of appending
+	GetEventPage(afterSeq int64, limit int) ([]*AccountEvent, error)
+	// GetAggregateSnapshot returns the latest snapshot of account, nil if there is none, txn may be nil
+	GetAggregateSnapshot(txn DBTransaction, accountName string) (*AggregateSnapshot, error)
+	// SaveAggregateSnapshot saves snapshot within txn unless newer one is saved
+	SaveAggregateSnapshot(txn DBTransaction, snapshot *AggregateSnapshot) error
+	// ProjectAccount writes balance and freeze state of account within txn, account
+	// is created if it is missing
+	ProjectAccount(txn DBTransaction, account *Account, equity bool) error
+	// ProjectTransaction writes successful history record within txn keeping its TxnID,
+	// record with the same TxnID is overwritten
+	ProjectTransaction(txn DBTransaction, record *Transaction) error
+}
+
+// EventRepository is a Repository keeping events of accounts, it is wrapped by
+// event-sourced repository of eventsource package.
+type EventRepository interface {
+	Repository
+	EventStore
+}
+
+// AppendEvent appends event to stream of its account within txn.
+func (r *repository) AppendEvent(txn DBTransaction, event *AccountEvent) (err error) {
+	err = txn.QueryRow(QueryAppendEvent, event.Account, event.Version, event.Type, string(event.Data)).Scan(&event.Seq,
+		&event.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pgUniqueViolation {
+		return ErrVersionConflict
+	}
+	event.CreatedAt = event.CreatedAt.UTC()
+	return
+}
+
+// GetEvents returns events of account after version in order of versions.
+func (r *repository) GetEvents(txn DBTransaction, accountName string, afterVersion int64) ([]*AccountEvent, error) {
+	return r.queryEvents(r.querier(txn), "GetEvents", QueryEvents, accountName, afterVersion)
+}
+
+// GetEventPage returns up to limit events of all accounts after seq in order of appending.
+func (r *repository) GetEventPage(afterSeq int64, limit int) ([]*AccountEvent, error) {
+	return r.queryEvents(r.querier(nil), "GetEventPage", QueryEventPage, afterSeq, limit)
+}
+
+func (r *repository) queryEvents(q querier, method, query string, args ...interface{}) ([]*AccountEvent, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", method, "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AccountEvent, 0)
+	for rows.Next() {
+		event := &AccountEvent{}
+		var data []byte
+		if err = rows.Scan(&event.Seq, &event.Account, &event.Version, &event.Type, &data, &event.CreatedAt); err != nil {
+			_ = level.Error(r.logger).Log("method", method, "err", err)
+			return nil, err
+		}
+		event.Data, event.CreatedAt = data, event.CreatedAt.UTC()
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", method, "err", err)
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetAggregateSnapshot returns the latest snapshot of account, nil if there is none.
+func (r *repository) GetAggregateSnapshot(txn DBTransaction, accountName string) (*AggregateSnapshot, error) {
+	snapshot := &AggregateSnapshot{}
+	var state []byte
+	err := r.querier(txn).QueryRow(QueryAggregateSnapshot, accountName).Scan(&snapshot.Account, &snapshot.Version,
+		&state, &snapshot.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetAggregateSnapshot", "err", err)
+		return nil, err
+	}
+	snapshot.State, snapshot.CreatedAt = state, snapshot.CreatedAt.UTC()
+	return snapshot, nil
+}
+
+// SaveAggregateSnapshot saves snapshot within txn unless newer one is saved.
+func (r *repository) SaveAggregateSnapshot(txn DBTransaction, snapshot *AggregateSnapshot) (err error) {
+	_, err = r.querier(txn).Exec(QuerySaveAggregateSnapshot, snapshot.Account, snapshot.Version, string(snapshot.State))
+	return
+}
+
+// ProjectAccount writes balance and freeze state of account within txn.
+func (r *repository) ProjectAccount(txn DBTransaction, account *Account, equity bool) (err error) {
+	holder := account.Holder
+	if holder == "" {
+		holder = account.UserID
+	}
+	_, err = r.querier(txn).Exec(QueryProjectAccount, account.UserID, holder, account.Balance, account.Currency,
+		account.CreditLimit, equity, account.Freeze, account.FreezeReason)
+	return
+}
+
+// ProjectTransaction writes successful history record within txn keeping its TxnID.
+func (r *repository) ProjectTransaction(txn DBTransaction, record *Transaction) (err error) {
+	_, err = r.querier(txn).Exec(QueryProjectTransaction, record.TxnID, record.Direction, record.Date, record.Payer,
+		record.Payee, record.Amount, record.Fee, record.Currency)
+	return
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"sort"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+)
+
+// FeeSchedule represents transfer fees of currency, which are booked to revenue account.
+// Tier with the greatest MinAmount not exceeding transfer amount overrides Fixed and Percent.
+type FeeSchedule struct {
+	Currency       string    `json:"currency"`
+	RevenueAccount string    `json:"revenue_account"`
+	Fixed          float64   `json:"fixed"`
+	Percent        float64   `json:"percent"`
+	MinFee         float64   `json:"min_fee"`
+	MaxFee         float64   `json:"max_fee"`
+	Tiers          []FeeTier `json:"tiers,omitempty"`
+}
+
+// FeeTier represents fees applied to transfers starting from MinAmount.
+type FeeTier struct {
+	MinAmount float64 `json:"min_amount"`
+	Fixed     float64 `json:"fixed"`
+	Percent   float64 `json:"percent"`
+}
+
+// Fee represents breakdown of transfer fee. Adjustment is a difference made by
+// MinFee or MaxFee, so Fixed, Percentage and Adjustment add up to Amount.
+type Fee struct {
+	Fixed      float64 `json:"fixed"`
+	Percentage float64 `json:"percentage"`
+	Adjustment float64 `json:"adjustment,omitempty"`
+	Amount     float64 `json:"amount"`
+	Account    string  `json:"-"`
+}
+
+// Calculate returns fee of transfer of amount. Zero MaxFee means no cap.
+func (fs *FeeSchedule) Calculate(amount float64) *Fee {
+	fixed, percent := fs.Fixed, fs.Percent
+	tiers := make([]FeeTier, len(fs.Tiers))
+	copy(tiers, fs.Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinAmount < tiers[j].MinAmount })
+	for _, tier := range tiers {
+		if tier.MinAmount > amount {
+			break
+		}
+		fixed, percent = tier.Fixed, tier.Percent
+	}
+	fee := &Fee{
+		Fixed:      currency.Round(fixed, fs.Currency),
+		Percentage: currency.Round(amount*percent/100, fs.Currency),
+		Account:    fs.RevenueAccount,
+	}
+	fee.Amount = currency.Round(fee.Fixed+fee.Percentage, fs.Currency)
+	capped := fee.Amount
+	if capped < fs.MinFee {
+		capped = fs.MinFee
+	}
+	if fs.MaxFee > 0 && capped > fs.MaxFee {
+		capped = fs.MaxFee
+	}
+	if capped = currency.Round(capped, fs.Currency); capped != fee.Amount {
+		fee.Adjustment = currency.Round(capped-fee.Amount, fs.Currency)
+		fee.Amount = capped
+	}
+	return fee
+}
+
+// Quote represents outcome of transfer calculated without moving money.
+type Quote struct {
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+	Fee          *Fee    `json:"fee"`
+	Total        float64 `json:"total"`
+	PayerBalance float64 `json:"payer_balance"`
+	PayeeBalance float64 `json:"payee_balance"`
+}
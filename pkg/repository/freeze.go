@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"time"
+)
+
+// Freeze states of account
+const (
+	FreezeNone   = "none"
+	FreezeDebit  = "debit"  // outgoing transfers are blocked
+	FreezeCredit = "credit" // incoming transfers are blocked
+	FreezeBoth   = "both"
+)
+
+// FreezeRecord represents change of account freeze state made by compliance.
+type FreezeRecord struct {
+	UserID  string    `json:"id"`
+	State   string    `json:"state"`
+	Reason  string    `json:"reason"`
+	Comment string    `json:"comment"`
+	Actor   string    `json:"actor"`
+	Date    time.Time `json:"date"`
+}
+
+// DebitBlocked reports whether outgoing transfers of account are blocked.
+func (a *Account) DebitBlocked() bool {
+	return a.Freeze == FreezeDebit || a.Freeze == FreezeBoth
+}
+
+// CreditBlocked reports whether incoming transfers of account are blocked.
+func (a *Account) CreditBlocked() bool {
+	return a.Freeze == FreezeCredit || a.Freeze == FreezeBoth
+}
@@ -0,0 +1,56 @@
+package repository
+
+// Statuses of imported row
+const (
+	ImportCreated    = "created"     // account is created and committed
+	ImportFailed     = "failed"      // row is invalid or account is not created
+	ImportRolledBack = "rolled_back" // row is valid, but its chunk failed
+	ImportSkipped    = "skipped"     // row precedes resume token
+	ImportPending    = "pending"     // row is not imported due to failure of other rows
+)
+
+// AccountImport represents account with opening balance of bulk import.
+type AccountImport struct {
+	// Line is a position of row in imported file, it is used in report
+	Line int `json:"line"`
+	// UserID is ID of account holder, holder gets wallet in currency of row
+	UserID      string  `json:"id"`
+	Currency    string  `json:"currency"`
+	Balance     float64 `json:"balance"`
+	CreditLimit float64 `json:"credit_limit"`
+	// Error is a problem found while row was parsed
+	Error string `json:"error,omitempty"`
+	// Wallet is ID of account created for row, it is named on validation
+	Wallet string `json:"-"`
+}
+
+// ImportOptions controls how bulk import is committed.
+type ImportOptions struct {
+	// ChunkSize is a number of rows committed at once, all rows are imported
+	// within single DB transaction when it is zero.
+	ChunkSize int `json:"chunk_size"`
+	// Resume is a token of report of interrupted import, rows preceding it are skipped.
+	Resume string `json:"resume,omitempty"`
+}
+
+// ImportRowResult is an outcome of imported row.
+type ImportRowResult struct {
+	Line int `json:"line"`
+	// UserID is ID of created wallet once row is validated, ID of holder otherwise
+	UserID string `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportReport is a per-row outcome of bulk import.
+type ImportReport struct {
+	Total   int `json:"total"`
+	Created int `json:"created"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+	// Resume is a token to continue interrupted chunked import with, empty when
+	// there is nothing to continue.
+	Resume string             `json:"resume,omitempty"`
+	Rows   []*ImportRowResult `json:"rows"`
+}
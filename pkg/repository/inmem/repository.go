@@ -1,9 +1,14 @@
 package inmem
 
 import (
+	"context"
 	"database/sql"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
 	"github.com/khaliullov/payment-system/pkg/repository"
 )
 
@@ -13,25 +18,79 @@ func NewInmem() repository.Repository {
 	return &RepositoryInmem{
 		Accounts:     make([]*repository.Account, 0),
 		Transactions: make([]interface{}, 0),
+		Limits:       make(map[string]*repository.Limits),
+		Defaults:     make(map[string]*repository.Limits),
+		Fees:         make(map[string]*repository.FeeSchedule),
+		Freezes:      make([]*repository.FreezeRecord, 0),
+		Audit:        make([]*repository.AuditRecord, 0),
+		Snapshots:    make([]*repository.LedgerSnapshot, 0),
+		Currencies:   make([]currency.Currency, 0),
+		Outbox:       make([]*repository.OutboxEvent, 0),
+		Offsets:      make(map[string]map[string]int64),
+		Sagas:        make([]*repository.Saga, 0),
+		SagaSteps:    make(map[string]bool),
+		Payouts:      make([]*repository.Payout, 0),
+		Events:       make([]*repository.AccountEvent, 0),
+		Aggregates:   make(map[string]*repository.AggregateSnapshot),
 		acMutex:      new(sync.RWMutex),
 		txMutex:      new(sync.RWMutex),
+		lmMutex:      new(sync.RWMutex),
+		auMutex:      new(sync.RWMutex),
+		obMutex:      new(sync.RWMutex),
+		sgMutex:      new(sync.RWMutex),
+		poMutex:      new(sync.RWMutex),
+		evMutex:      new(sync.RWMutex),
+		broker:       activity.NewBroker(),
 	}
 }
 
 type RepositoryInmem struct {
 	Accounts     []*repository.Account
 	Transactions []interface{}
+	Limits       map[string]*repository.Limits // by UserID
+	Defaults     map[string]*repository.Limits // by Currency
+	Fees         map[string]*repository.FeeSchedule
+	Freezes      []*repository.FreezeRecord
+	Audit        []*repository.AuditRecord
+	Snapshots    []*repository.LedgerSnapshot
+	Currencies   []currency.Currency // overrides of ISO 4217
+	Outbox       []*repository.OutboxEvent
+	Offsets      map[string]map[string]int64 // seq of the last published event by relay and account
+	Sagas        []*repository.Saga
+	SagaSteps    map[string]bool // markers of applied saga steps
+	Payouts      []*repository.Payout
+	Events       []*repository.AccountEvent
+	Aggregates   map[string]*repository.AggregateSnapshot // latest snapshots by account
 	acMutex      *sync.RWMutex
 	txMutex      *sync.RWMutex
+	lmMutex      *sync.RWMutex
+	auMutex      *sync.RWMutex
+	obMutex      *sync.RWMutex
+	sgMutex      *sync.RWMutex
+	poMutex      *sync.RWMutex
+	evMutex      *sync.RWMutex
+	broker       *activity.Broker
 }
 
-type fakeDBTransaction struct{}
+// fakeDBTransaction applies changes at once, but markers of saga steps, which
+// are written on commit.
+type fakeDBTransaction struct {
+	ir        *RepositoryInmem
+	sagaSteps []string
+}
 
-func (fdbt fakeDBTransaction) Commit() error {
+func (fdbt *fakeDBTransaction) Commit() error {
+	fdbt.ir.sgMutex.Lock()
+	defer fdbt.ir.sgMutex.Unlock()
+	for _, stepID := range fdbt.sagaSteps {
+		fdbt.ir.SagaSteps[stepID] = true
+	}
+	fdbt.sagaSteps = nil
 	return nil
 }
 
-func (fdbt fakeDBTransaction) Rollback() error {
+func (fdbt *fakeDBTransaction) Rollback() error {
+	fdbt.sagaSteps = nil
 	return nil
 }
 
@@ -39,19 +98,73 @@ func (fdbt fakeDBTransaction) QueryRow(query string, args ...interface{}) *sql.R
 	return nil
 }
 
+func (fdbt fakeDBTransaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, nil
+}
+
 func (fdbt fakeDBTransaction) Exec(query string, args ...interface{}) (sql.Result, error) {
 	return nil, nil
 }
 
-// GetAccounts returns all Accounts
+// WithContext returns the same store, as there is nothing to bind to ctx
+func (ir *RepositoryInmem) WithContext(ctx context.Context) repository.Repository {
+	return ir
+}
+
+// GetAccounts returns all Accounts ordered by holder and currency
 func (ir *RepositoryInmem) GetAccounts() ([]*repository.Account, error) {
 	accounts := make([]*repository.Account, len(ir.Accounts))
 	ir.acMutex.RLock()
 	copy(accounts, ir.Accounts)
 	defer ir.acMutex.RUnlock()
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Holder != accounts[j].Holder {
+			return accounts[i].Holder < accounts[j].Holder
+		}
+		return accounts[i].Currency < accounts[j].Currency
+	})
 	return accounts, nil
 }
 
+// GetAccount returns Account by its name
+func (ir *RepositoryInmem) GetAccount(accountName string) (*repository.Account, error) {
+	account := ir.getAccount(accountName)
+	if account == nil {
+		return nil, repository.ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// GetWallet returns wallet of holder in currency, wallet itself is preferred
+func (ir *RepositoryInmem) GetWallet(holderID, currency string) (*repository.Account, error) {
+	if account := ir.getAccount(holderID); account != nil && account.Currency == currency {
+		return account, nil
+	}
+	ir.acMutex.RLock()
+	defer ir.acMutex.RUnlock()
+	for _, acc := range ir.Accounts {
+		if acc.Holder == holderID && acc.Currency == currency {
+			return acc, nil
+		}
+	}
+	return nil, repository.ErrAccountNotFound
+}
+
+// GetHolder returns holder with its wallets ordered by currency
+func (ir *RepositoryInmem) GetHolder(holderID string) (*repository.Holder, error) {
+	accounts, _ := ir.GetAccounts()
+	holder := &repository.Holder{ID: holderID, Wallets: make([]*repository.Account, 0)}
+	for _, acc := range accounts {
+		if acc.Holder == holderID {
+			holder.Wallets = append(holder.Wallets, acc)
+		}
+	}
+	if len(holder.Wallets) == 0 {
+		return nil, repository.ErrAccountNotFound
+	}
+	return holder, nil
+}
+
 // GetTransactions returns all Transaction history.
 func (ir *RepositoryInmem) GetTransactions() ([]interface{}, error) {
 	transactions := make([]interface{}, len(ir.Transactions))
@@ -61,29 +174,51 @@ func (ir *RepositoryInmem) GetTransactions() ([]interface{}, error) {
 	return transactions, nil
 }
 
-// Begin - start transaction
-func (ir *RepositoryInmem) Begin() (repository.DBTransaction, error) {
-	return fakeDBTransaction{}, nil
-}
-
-// GetAndLockTwoAccounts - get 2 accounts from store
-func (ir *RepositoryInmem) GetAndLockTwoAccounts(txn repository.DBTransaction, lockingOrder repository.LockOrder, accountName1, accountName2 string) (acc1, acc2 *repository.Account, err error) {
-	acc1 = ir.getAccount(accountName1)
-	if acc1 == nil {
-		if lockingOrder == repository.LockFromTo {
-			return nil, nil, repository.ErrPayerNotFound
+// GetTransactionPage returns up to limit transactions matching filter following afterID.
+func (ir *RepositoryInmem) GetTransactionPage(filter *repository.TransactionFilter, afterID int, limit int) ([]*repository.Transaction, error) {
+	ir.txMutex.RLock()
+	defer ir.txMutex.RUnlock()
+	transactions := make([]*repository.Transaction, 0, limit)
+	for _, t := range ir.Transactions {
+		var txn repository.Transaction
+		switch t := t.(type) {
+		case *repository.Transaction:
+			txn = *t
+		case *repository.TransactionIncoming:
+			txn = repository.Transaction{
+				TxnID:     t.TxnID,
+				Direction: t.Direction,
+				Date:      t.Date,
+				Payer:     t.Payer,
+				Payee:     t.Payee,
+				Amount:    t.Amount,
+				Fee:       t.Fee,
+				Currency:  t.Currency,
+				Error:     t.Error,
+			}
 		}
-		return nil, nil, repository.ErrPayeeNotFound
-	}
-	acc2 = ir.getAccount(accountName2)
-	if acc2 == nil {
-		if lockingOrder == repository.LockToFrom {
-			return nil, nil, repository.ErrPayerNotFound
+		if txn.TxnID <= afterID ||
+			filter.Account != "" && txn.Payer != filter.Account && txn.Payee != filter.Account ||
+			!filter.From.IsZero() && txn.Date.Before(filter.From) ||
+			!filter.To.IsZero() && !txn.Date.Before(filter.To) {
+			continue
+		}
+		transactions = append(transactions, &txn)
+		if len(transactions) == limit {
+			break
 		}
-		return nil, nil, repository.ErrPayeeNotFound
 	}
+	return transactions, nil
+}
 
-	return acc1, acc2, nil
+// Begin - start transaction
+func (ir *RepositoryInmem) Begin() (repository.DBTransaction, error) {
+	return &fakeDBTransaction{ir: ir}, nil
+}
+
+// GetAndLockAccount - get account from store
+func (ir *RepositoryInmem) GetAndLockAccount(txn repository.DBTransaction, accountName string) (*repository.Account, error) {
+	return ir.GetAccount(accountName)
 }
 
 func (ir *RepositoryInmem) getAccount(accountName string) *repository.Account {
@@ -98,28 +233,49 @@ func (ir *RepositoryInmem) getAccount(accountName string) *repository.Account {
 }
 
 // InsertTransaction insert transaction into the transcation history
-func (ir *RepositoryInmem) InsertTransaction(direction, from, to string, amount float64, currency, txnError string) (err error) {
+func (ir *RepositoryInmem) InsertTransaction(txn repository.DBTransaction, record *repository.Transaction) (err error) {
 	ir.txMutex.Lock()
 	defer ir.txMutex.Unlock()
-	if direction == repository.DirectionIncoming {
+	payment := &activity.Payment{
+		ID:        int64(len(ir.Transactions) + 1),
+		Direction: record.Direction,
+		Date:      time.Now(),
+		Payer:     record.Payer,
+		Payee:     record.Payee,
+		Amount:    record.Amount,
+		Fee:       record.Fee,
+		Currency:  record.Currency,
+		Error:     record.Error,
+	}
+	if record.Direction == repository.DirectionIncoming {
 		transaction := &repository.TransactionIncoming{
-			Direction: direction,
-			Payer:     from,
-			Payee:     to,
-			Amount:    amount,
-			Currency:  currency,
+			TxnID:     int(payment.ID),
+			Direction: record.Direction,
+			Date:      payment.Date,
+			Payer:     record.Payer,
+			Payee:     record.Payee,
+			Amount:    record.Amount,
+			Fee:       record.Fee,
+			Currency:  record.Currency,
+			Error:     record.Error,
+			SagaID:    record.SagaID,
 		}
 		ir.Transactions = append(ir.Transactions, transaction)
 	} else {
-		transaction := &repository.Transaction{
-			Direction: direction,
-			Payer:     from,
-			Payee:     to,
-			Amount:    amount,
-			Currency:  currency,
+		transaction := *record
+		transaction.TxnID = int(payment.ID)
+		transaction.Date = payment.Date
+		transaction.Breakdown = nil
+		ir.Transactions = append(ir.Transactions, &transaction)
+	}
+	record.TxnID = int(payment.ID)
+	var holders []string
+	for _, accountName := range []string{record.Payer, record.Payee} {
+		if account := ir.getAccount(accountName); account != nil {
+			holders = append(holders, account.Holder)
 		}
-		ir.Transactions = append(ir.Transactions, transaction)
 	}
+	ir.broker.Publish(&activity.Event{Type: activity.TypePayment, Holders: holders, Payment: payment})
 	return nil
 }
 
@@ -130,25 +286,669 @@ func (ir *RepositoryInmem) UpdateBalance(txn repository.DBTransaction, accountNa
 	defer ir.acMutex.Unlock()
 	if account != nil {
 		account.Balance = balance
+		ir.publishBalance(account)
 		return nil
 	}
 	return sql.ErrNoRows
 }
 
+// CreateAccount - create account, fails if it or wallet of its holder in the same currency exists
+func (ir *RepositoryInmem) CreateAccount(txn repository.DBTransaction, account *repository.Account) (err error) {
+	holder := account.Holder
+	if holder == "" {
+		holder = account.UserID
+	}
+	if ir.getAccount(account.UserID) != nil {
+		return repository.ErrAccountExists
+	}
+	if wallet, err := ir.GetWallet(holder, account.Currency); err == nil && wallet.Holder == holder {
+		return repository.ErrAccountExists
+	}
+	created := *account
+	ir.InsertAccount(&created)
+	ir.publishBalance(&created)
+	return nil
+}
+
+func (ir *RepositoryInmem) publishBalance(account *repository.Account) {
+	ir.broker.Publish(&activity.Event{
+		Type:    activity.TypeBalance,
+		Holders: []string{account.Holder},
+		Balance: &activity.Balance{Account: account.UserID, Holder: account.Holder, Currency: account.Currency, Balance: account.Balance},
+	})
+}
+
+// CreateEquityAccount - create equity account unless it exists
+func (ir *RepositoryInmem) CreateEquityAccount(txn repository.DBTransaction, holderID, accountName, currency string) (err error) {
+	if ir.getAccount(accountName) != nil {
+		return nil
+	}
+	ir.InsertAccount(&repository.Account{UserID: accountName, Holder: holderID, Currency: currency})
+	return nil
+}
+
+// GetLimits - get account limits merged with currency defaults
+func (ir *RepositoryInmem) GetLimits(txn repository.DBTransaction, accountName, currency string) (*repository.Limits, error) {
+	ir.lmMutex.RLock()
+	defer ir.lmMutex.RUnlock()
+	limits := &repository.Limits{}
+	if l, ok := ir.Limits[accountName]; ok {
+		limits = l.Merge(nil)
+	}
+	limits.UserID = accountName
+	limits.Currency = currency
+	return limits.Merge(ir.Defaults[currency]), nil
+}
+
+// GetLimitUsage - calculate outgoing totals of account for current day, month and last hour
+func (ir *RepositoryInmem) GetLimitUsage(txn repository.DBTransaction, accountName string) (*repository.LimitUsage, error) {
+	ir.txMutex.RLock()
+	defer ir.txMutex.RUnlock()
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	usage := &repository.LimitUsage{}
+	for _, t := range ir.Transactions {
+		txn, ok := t.(*repository.Transaction)
+		if !ok || txn.Direction != repository.DirectionOutgoing || txn.Payer != accountName || txn.Error != "" ||
+			txn.Date.Before(month) {
+			continue
+		}
+		usage.MonthlyAmount += txn.Amount
+		if !txn.Date.Before(day) {
+			usage.DailyAmount += txn.Amount
+		}
+		if now.Sub(txn.Date) <= time.Hour {
+			usage.HourlyCount++
+		}
+	}
+	return usage, nil
+}
+
+// SetLimits - set account limits, or currency defaults if UserID is empty
+func (ir *RepositoryInmem) SetLimits(limits *repository.Limits) error {
+	if limits.UserID != "" && ir.getAccount(limits.UserID) == nil {
+		return repository.ErrAccountNotFound
+	}
+	ir.lmMutex.Lock()
+	defer ir.lmMutex.Unlock()
+	if limits.UserID != "" {
+		ir.Limits[limits.UserID] = limits.Merge(nil)
+	} else {
+		ir.Defaults[limits.Currency] = limits.Merge(nil)
+	}
+	return nil
+}
+
+// GetFeeSchedule - get fee schedule of currency, nil if there is none
+func (ir *RepositoryInmem) GetFeeSchedule(txn repository.DBTransaction, currency string) (*repository.FeeSchedule, error) {
+	ir.lmMutex.RLock()
+	defer ir.lmMutex.RUnlock()
+	return ir.Fees[currency], nil
+}
+
+// SetFeeSchedule - set fee schedule of currency
+func (ir *RepositoryInmem) SetFeeSchedule(schedule *repository.FeeSchedule) error {
+	// revenue account is checked by service, it may be kept by other shard
+	ir.lmMutex.Lock()
+	defer ir.lmMutex.Unlock()
+	ir.Fees[schedule.Currency] = schedule
+	return nil
+}
+
+// UpdateCreditLimit - set new credit limit for account
+func (ir *RepositoryInmem) UpdateCreditLimit(txn repository.DBTransaction, accountName string, creditLimit float64) (err error) {
+	account := ir.getAccount(accountName)
+	ir.acMutex.Lock()
+	defer ir.acMutex.Unlock()
+	if account != nil {
+		account.CreditLimit = creditLimit
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// UpdateFreeze - set freeze state of account and record the change
+func (ir *RepositoryInmem) UpdateFreeze(txn repository.DBTransaction, record *repository.FreezeRecord) (err error) {
+	account := ir.getAccount(record.UserID)
+	if account == nil {
+		return sql.ErrNoRows
+	}
+	ir.acMutex.Lock()
+	account.Freeze = record.State
+	account.FreezeReason = record.Reason
+	ir.acMutex.Unlock()
+	ir.lmMutex.Lock()
+	defer ir.lmMutex.Unlock()
+	stored := *record
+	stored.Date = time.Now()
+	ir.Freezes = append(ir.Freezes, &stored)
+	return nil
+}
+
+// GetFreezeHistory - get changes of freeze state of account
+func (ir *RepositoryInmem) GetFreezeHistory(accountName string) ([]*repository.FreezeRecord, error) {
+	ir.lmMutex.RLock()
+	defer ir.lmMutex.RUnlock()
+	history := make([]*repository.FreezeRecord, 0)
+	for _, record := range ir.Freezes {
+		if record.UserID == accountName {
+			history = append(history, record)
+		}
+	}
+	return history, nil
+}
+
+// AppendAudit - append record to audit log chaining it with the last one
+func (ir *RepositoryInmem) AppendAudit(record *repository.AuditRecord) error {
+	ir.auMutex.Lock()
+	defer ir.auMutex.Unlock()
+	record.Truncate()
+	record.ID = int64(len(ir.Audit) + 1)
+	record.Date = time.Now().UTC()
+	record.PrevHash = ""
+	if len(ir.Audit) > 0 {
+		record.PrevHash = ir.Audit[len(ir.Audit)-1].Hash
+	}
+	record.Hash = record.ComputeHash()
+	stored := *record
+	ir.Audit = append(ir.Audit, &stored)
+	return nil
+}
+
+// GetAuditLog - get up to limit audit log records following record with afterID
+func (ir *RepositoryInmem) GetAuditLog(afterID int64, limit int) ([]*repository.AuditRecord, error) {
+	ir.auMutex.RLock()
+	defer ir.auMutex.RUnlock()
+	records := make([]*repository.AuditRecord, 0)
+	for _, record := range ir.Audit {
+		if record.ID > afterID && len(records) < limit {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// ledgerEntries calls entry for every change of balance by successful transactions
+func (ir *RepositoryInmem) ledgerEntries(entry func(userID string, amount float64, date time.Time)) {
+	for _, t := range ir.Transactions {
+		var txn repository.Transaction
+		switch t := t.(type) {
+		case *repository.Transaction:
+			txn = *t
+		case *repository.TransactionIncoming:
+			txn = repository.Transaction{Direction: t.Direction, Date: t.Date, Payer: t.Payer, Payee: t.Payee,
+				Amount: t.Amount, Fee: t.Fee, Error: t.Error}
+		}
+		if txn.Error != "" {
+			continue
+		}
+		switch txn.Direction {
+		case repository.DirectionIncoming, repository.DirectionFee:
+			entry(txn.Payee, txn.Amount, txn.Date)
+		case repository.DirectionOutgoing:
+			entry(txn.Payer, -(txn.Amount + txn.Fee), txn.Date)
+		case repository.DirectionOpening:
+			entry(txn.Payee, txn.Amount, txn.Date)
+			entry(txn.Payer, -txn.Amount, txn.Date)
+		}
+	}
+}
+
+// GetLedgerBalances - get stored balances of accounts along with balances recomputed from transactions
+func (ir *RepositoryInmem) GetLedgerBalances() (*repository.LedgerSnapshot, error) {
+	ir.acMutex.RLock()
+	defer ir.acMutex.RUnlock()
+	ir.txMutex.RLock()
+	defer ir.txMutex.RUnlock()
+	ledger := make(map[string]float64)
+	ir.ledgerEntries(func(userID string, amount float64, _ time.Time) {
+		ledger[userID] += amount
+	})
+	snapshot := &repository.LedgerSnapshot{
+		TakenAt:  time.Now().UTC(),
+		Balances: make([]*repository.LedgerBalance, 0, len(ir.Accounts)),
+	}
+	for _, account := range ir.Accounts {
+		snapshot.Balances = append(snapshot.Balances, &repository.LedgerBalance{
+			UserID:     account.UserID,
+			Currency:   account.Currency,
+			Balance:    account.Balance,
+			Ledger:     ledger[account.UserID],
+			Difference: account.Balance - ledger[account.UserID],
+		})
+	}
+	sort.Slice(snapshot.Balances, func(i, j int) bool { return snapshot.Balances[i].UserID < snapshot.Balances[j].UserID })
+	return snapshot, nil
+}
+
+// SaveBalanceSnapshot - save balances of snapshot
+func (ir *RepositoryInmem) SaveBalanceSnapshot(snapshot *repository.LedgerSnapshot) error {
+	ir.lmMutex.Lock()
+	defer ir.lmMutex.Unlock()
+	saved := &repository.LedgerSnapshot{
+		TakenAt:  snapshot.TakenAt,
+		Balances: make([]*repository.LedgerBalance, len(snapshot.Balances)),
+	}
+	for i, balance := range snapshot.Balances {
+		copied := *balance
+		saved.Balances[i] = &copied
+	}
+	ir.Snapshots = append(ir.Snapshots, saved)
+	return nil
+}
+
+// GetBalanceAt - get balance of account at time from the latest snapshot and transactions following it
+func (ir *RepositoryInmem) GetBalanceAt(accountName string, at time.Time) (*repository.BalanceAt, error) {
+	account := ir.getAccount(accountName)
+	if account == nil {
+		return nil, repository.ErrAccountNotFound
+	}
+	balance := &repository.BalanceAt{UserID: accountName, Currency: account.Currency, At: at}
+	ir.lmMutex.RLock()
+	for _, snapshot := range ir.Snapshots {
+		for _, b := range snapshot.Balances {
+			takenAt := snapshot.TakenAt
+			if !b.TakenAt.IsZero() {
+				takenAt = b.TakenAt
+			}
+			if b.UserID != accountName || takenAt.After(at) || balance.SnapshotAt != nil && !takenAt.After(*balance.SnapshotAt) {
+				continue
+			}
+			balance.Balance, balance.SnapshotAt = b.Ledger, &takenAt
+		}
+	}
+	ir.lmMutex.RUnlock()
+	ir.txMutex.RLock()
+	defer ir.txMutex.RUnlock()
+	ir.ledgerEntries(func(userID string, amount float64, date time.Time) {
+		if userID == accountName && !date.After(at) && (balance.SnapshotAt == nil || date.After(*balance.SnapshotAt)) {
+			balance.Balance += amount
+		}
+	})
+	balance.Balance = currency.Round(balance.Balance, balance.Currency)
+	return balance, nil
+}
+
+// GetCurrencies - get overrides of ISO 4217 currencies
+func (ir *RepositoryInmem) GetCurrencies() ([]currency.Currency, error) {
+	ir.lmMutex.RLock()
+	defer ir.lmMutex.RUnlock()
+	currencies := make([]currency.Currency, len(ir.Currencies))
+	copy(currencies, ir.Currencies)
+	return currencies, nil
+}
+
+// Subscribe - subscribe to balance changes and payments of wallets of holder
+func (ir *RepositoryInmem) Subscribe(holderID string) *activity.Subscription {
+	return ir.broker.Subscribe(holderID)
+}
+
+// AppendOutbox - append event of account to outbox
+func (ir *RepositoryInmem) AppendOutbox(txn repository.DBTransaction, event *repository.OutboxEvent) error {
+	if ir.getAccount(event.Account) == nil {
+		return repository.ErrAccountNotFound
+	}
+	ir.obMutex.Lock()
+	defer ir.obMutex.Unlock()
+	event.ID = int64(len(ir.Outbox) + 1)
+	event.Seq = 1
+	for _, e := range ir.Outbox {
+		if e.Account == event.Account {
+			event.Seq = e.Seq + 1
+		}
+	}
+	event.CreatedAt = time.Now().UTC()
+	stored := *event
+	ir.Outbox = append(ir.Outbox, &stored)
+	return nil
+}
+
+// GetOutbox - get up to limit events not published by relay yet
+func (ir *RepositoryInmem) GetOutbox(relay string, limit int) ([]*repository.OutboxEvent, error) {
+	ir.obMutex.RLock()
+	defer ir.obMutex.RUnlock()
+	events := make([]*repository.OutboxEvent, 0)
+	for _, event := range ir.Outbox {
+		if event.Seq > ir.Offsets[relay][event.Account] && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// SaveOutboxOffsets - mark events as published by relay
+func (ir *RepositoryInmem) SaveOutboxOffsets(relay string, events []*repository.OutboxEvent) error {
+	ir.obMutex.Lock()
+	defer ir.obMutex.Unlock()
+	offsets, ok := ir.Offsets[relay]
+	if !ok {
+		offsets = make(map[string]int64)
+		ir.Offsets[relay] = offsets
+	}
+	for account, seq := range repository.OutboxOffsets(events) {
+		if seq > offsets[account] {
+			offsets[account] = seq
+		}
+	}
+	return nil
+}
+
+// InsertSaga - write pending saga
+func (ir *RepositoryInmem) InsertSaga(txn repository.DBTransaction, saga *repository.Saga) error {
+	ir.sgMutex.Lock()
+	defer ir.sgMutex.Unlock()
+	saga.CreatedAt = time.Now().UTC()
+	stored := *saga
+	ir.Sagas = append(ir.Sagas, &stored)
+	return nil
+}
+
+// InsertSagaStep - mark step of saga applied on commit of txn unless it is marked already
+func (ir *RepositoryInmem) InsertSagaStep(txn repository.DBTransaction, stepID string) error {
+	fdbt := txn.(*fakeDBTransaction)
+	ir.sgMutex.RLock()
+	defer ir.sgMutex.RUnlock()
+	if ir.SagaSteps[stepID] {
+		return repository.ErrSagaStepApplied
+	}
+	for _, id := range fdbt.sagaSteps {
+		if id == stepID {
+			return repository.ErrSagaStepApplied
+		}
+	}
+	fdbt.sagaSteps = append(fdbt.sagaSteps, stepID)
+	return nil
+}
+
+// GetPendingSagas - get up to limit pending sagas created before time
+func (ir *RepositoryInmem) GetPendingSagas(before time.Time, limit int) ([]*repository.Saga, error) {
+	ir.sgMutex.RLock()
+	defer ir.sgMutex.RUnlock()
+	sagas := make([]*repository.Saga, 0)
+	for _, saga := range ir.Sagas {
+		if saga.State == repository.SagaPending && saga.CreatedAt.Before(before) && len(sagas) < limit {
+			copied := *saga
+			sagas = append(sagas, &copied)
+		}
+	}
+	return sagas, nil
+}
+
+// UpdateSagaState - set state of saga
+func (ir *RepositoryInmem) UpdateSagaState(sagaID, state, reason string) error {
+	ir.sgMutex.Lock()
+	defer ir.sgMutex.Unlock()
+	for _, saga := range ir.Sagas {
+		if saga.ID == sagaID {
+			saga.State, saga.Error = state, reason
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// FailSagaTransactions - set error of successful history records written by saga
+func (ir *RepositoryInmem) FailSagaTransactions(txn repository.DBTransaction, sagaID, reason string) error {
+	ir.txMutex.Lock()
+	defer ir.txMutex.Unlock()
+	for _, t := range ir.Transactions {
+		switch t := t.(type) {
+		case *repository.Transaction:
+			if t.SagaID == sagaID && t.Error == "" {
+				t.Error = reason
+			}
+		case *repository.TransactionIncoming:
+			if t.SagaID == sagaID && t.Error == "" {
+				t.Error = reason
+			}
+		}
+	}
+	ir.poMutex.Lock()
+	defer ir.poMutex.Unlock()
+	for _, payout := range ir.Payouts {
+		if payout.SagaID == sagaID && payout.State == repository.PayoutPending {
+			payout.State, payout.Error, payout.UpdatedAt = repository.PayoutCompensated, reason, time.Now().UTC()
+		}
+	}
+	return nil
+}
+
+// InsertPayout - write booked payout, its times are filled in
+func (ir *RepositoryInmem) InsertPayout(txn repository.DBTransaction, payout *repository.Payout) error {
+	ir.poMutex.Lock()
+	defer ir.poMutex.Unlock()
+	now := time.Now().UTC()
+	payout.CreatedAt, payout.UpdatedAt, payout.NextAttemptAt = now, now, now
+	stored := *payout
+	ir.Payouts = append(ir.Payouts, &stored)
+	return nil
+}
+
+// GetPayout - get payout by ID
+func (ir *RepositoryInmem) GetPayout(id int64) (*repository.Payout, error) {
+	ir.poMutex.RLock()
+	defer ir.poMutex.RUnlock()
+	for _, payout := range ir.Payouts {
+		if payout.ID == id {
+			copied := *payout
+			return &copied, nil
+		}
+	}
+	return nil, repository.ErrPayoutNotFound
+}
+
+// GetDuePayouts - get up to limit unfinished payouts which next attempt is due, the most overdue first
+func (ir *RepositoryInmem) GetDuePayouts(limit int) ([]*repository.Payout, error) {
+	ir.poMutex.RLock()
+	defer ir.poMutex.RUnlock()
+	now := time.Now()
+	payouts := make([]*repository.Payout, 0)
+	for _, payout := range ir.Payouts {
+		if !payout.Finished() && !payout.NextAttemptAt.After(now) {
+			copied := *payout
+			payouts = append(payouts, &copied)
+		}
+	}
+	sort.SliceStable(payouts, func(i, j int) bool {
+		return payouts[i].NextAttemptAt.Before(payouts[j].NextAttemptAt)
+	})
+	if len(payouts) > limit {
+		payouts = payouts[:limit]
+	}
+	return payouts, nil
+}
+
+// UpdatePayout - move payout from state to payout.State
+func (ir *RepositoryInmem) UpdatePayout(txn repository.DBTransaction, payout *repository.Payout, from string) error {
+	ir.poMutex.Lock()
+	defer ir.poMutex.Unlock()
+	for _, stored := range ir.Payouts {
+		if stored.ID == payout.ID {
+			if stored.State != from {
+				return repository.ErrPayoutStateChanged
+			}
+			payout.UpdatedAt = time.Now().UTC()
+			*stored = *payout
+			return nil
+		}
+	}
+	return repository.ErrPayoutStateChanged
+}
+
+// AppendEvent - append event to stream of its account, its Version must follow the last one
+func (ir *RepositoryInmem) AppendEvent(txn repository.DBTransaction, event *repository.AccountEvent) error {
+	ir.evMutex.Lock()
+	defer ir.evMutex.Unlock()
+	var version int64
+	for _, e := range ir.Events {
+		if e.Account == event.Account {
+			version = e.Version
+		}
+	}
+	if event.Version != version+1 {
+		return repository.ErrVersionConflict
+	}
+	event.Seq = int64(len(ir.Events) + 1)
+	event.CreatedAt = time.Now().UTC()
+	stored := *event
+	ir.Events = append(ir.Events, &stored)
+	return nil
+}
+
+// GetEvents - get events of account after version
+func (ir *RepositoryInmem) GetEvents(txn repository.DBTransaction, accountName string, afterVersion int64) ([]*repository.AccountEvent, error) {
+	ir.evMutex.RLock()
+	defer ir.evMutex.RUnlock()
+	events := make([]*repository.AccountEvent, 0)
+	for _, event := range ir.Events {
+		if event.Account == accountName && event.Version > afterVersion {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// GetEventPage - get up to limit events of all accounts after seq
+func (ir *RepositoryInmem) GetEventPage(afterSeq int64, limit int) ([]*repository.AccountEvent, error) {
+	ir.evMutex.RLock()
+	defer ir.evMutex.RUnlock()
+	events := make([]*repository.AccountEvent, 0)
+	for _, event := range ir.Events {
+		if event.Seq > afterSeq && len(events) < limit {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// GetAggregateSnapshot - get the latest snapshot of account, nil if there is none
+func (ir *RepositoryInmem) GetAggregateSnapshot(txn repository.DBTransaction, accountName string) (*repository.AggregateSnapshot, error) {
+	ir.evMutex.RLock()
+	defer ir.evMutex.RUnlock()
+	snapshot, ok := ir.Aggregates[accountName]
+	if !ok {
+		return nil, nil
+	}
+	copied := *snapshot
+	return &copied, nil
+}
+
+// SaveAggregateSnapshot - save snapshot unless newer one is saved
+func (ir *RepositoryInmem) SaveAggregateSnapshot(txn repository.DBTransaction, snapshot *repository.AggregateSnapshot) error {
+	ir.evMutex.Lock()
+	defer ir.evMutex.Unlock()
+	if saved, ok := ir.Aggregates[snapshot.Account]; ok && saved.Version >= snapshot.Version {
+		return nil
+	}
+	stored := *snapshot
+	stored.CreatedAt = time.Now().UTC()
+	ir.Aggregates[snapshot.Account] = &stored
+	return nil
+}
+
+// ProjectAccount - write balance and freeze state of account, create it if it is missing
+func (ir *RepositoryInmem) ProjectAccount(txn repository.DBTransaction, account *repository.Account, equity bool) error {
+	if stored := ir.getAccount(account.UserID); stored != nil {
+		ir.acMutex.Lock()
+		defer ir.acMutex.Unlock()
+		stored.Balance, stored.Freeze, stored.FreezeReason = account.Balance, account.Freeze, account.FreezeReason
+		ir.publishBalance(stored)
+		return nil
+	}
+	created := *account
+	ir.InsertAccount(&created)
+	ir.publishBalance(&created)
+	return nil
+}
+
+// ProjectTransaction - write successful history record keeping its TxnID, overwrite record with the same TxnID
+func (ir *RepositoryInmem) ProjectTransaction(txn repository.DBTransaction, record *repository.Transaction) error {
+	ir.txMutex.Lock()
+	defer ir.txMutex.Unlock()
+	projected := *record
+	projected.Error, projected.Breakdown, projected.SagaID = "", nil, ""
+	var stored interface{} = &projected
+	if record.Direction == repository.DirectionIncoming {
+		stored = &repository.TransactionIncoming{
+			TxnID:     projected.TxnID,
+			Direction: projected.Direction,
+			Date:      projected.Date,
+			Payer:     projected.Payer,
+			Payee:     projected.Payee,
+			Amount:    projected.Amount,
+			Fee:       projected.Fee,
+			Currency:  projected.Currency,
+		}
+	}
+	for i, t := range ir.Transactions {
+		var txnID int
+		switch t := t.(type) {
+		case *repository.Transaction:
+			txnID = t.TxnID
+		case *repository.TransactionIncoming:
+			txnID = t.TxnID
+		}
+		if txnID == record.TxnID {
+			ir.Transactions[i] = stored
+			return nil
+		}
+		if txnID > record.TxnID {
+			ir.Transactions = append(ir.Transactions[:i], append([]interface{}{stored}, ir.Transactions[i:]...)...)
+			return nil
+		}
+	}
+	ir.Transactions = append(ir.Transactions, stored)
+	return nil
+}
+
 // FlushStore - reset store (flush/purge all data)
 func (ir *RepositoryInmem) FlushStore() {
 	ir.acMutex.Lock()
 	ir.txMutex.Lock()
+	ir.lmMutex.Lock()
+	ir.auMutex.Lock()
+	ir.obMutex.Lock()
+	ir.sgMutex.Lock()
+	ir.poMutex.Lock()
+	ir.evMutex.Lock()
 	defer func() {
 		ir.acMutex.Unlock()
 		ir.txMutex.Unlock()
+		ir.lmMutex.Unlock()
+		ir.auMutex.Unlock()
+		ir.obMutex.Unlock()
+		ir.sgMutex.Unlock()
+		ir.poMutex.Unlock()
+		ir.evMutex.Unlock()
 	}()
 	ir.Accounts = ir.Accounts[:0]
 	ir.Transactions = ir.Transactions[:0]
+	ir.Limits = make(map[string]*repository.Limits)
+	ir.Defaults = make(map[string]*repository.Limits)
+	ir.Fees = make(map[string]*repository.FeeSchedule)
+	ir.Freezes = ir.Freezes[:0]
+	ir.Audit = ir.Audit[:0]
+	ir.Snapshots = ir.Snapshots[:0]
+	ir.Outbox = ir.Outbox[:0]
+	ir.Offsets = make(map[string]map[string]int64)
+	ir.Sagas = ir.Sagas[:0]
+	ir.SagaSteps = make(map[string]bool)
+	ir.Payouts = ir.Payouts[:0]
+	ir.Events = ir.Events[:0]
+	ir.Aggregates = make(map[string]*repository.AggregateSnapshot)
 }
 
-// InsertAccount - inserts account into store
+// InsertAccount - inserts account into store, account is its own holder unless Holder is set
 func (ir *RepositoryInmem) InsertAccount(account *repository.Account) {
+	if account.Freeze == "" {
+		account.Freeze = repository.FreezeNone
+	}
+	if account.Holder == "" {
+		account.Holder = account.UserID
+	}
 	ir.acMutex.Lock()
 	defer ir.acMutex.Unlock()
 	ir.Accounts = append(ir.Accounts, account)
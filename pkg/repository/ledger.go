@@ -0,0 +1,34 @@
+package repository
+
+import "time"
+
+// LedgerBalance represents stored balance of account along with balance
+// recomputed from successful transactions of payment history.
+type LedgerBalance struct {
+	UserID   string  `json:"id"`
+	Currency string  `json:"currency"`
+	Balance  float64 `json:"balance"`
+	Ledger   float64 `json:"ledger_balance"`
+	// Difference is Balance less Ledger, it is zero for consistent account
+	Difference float64 `json:"difference"`
+	// TakenAt is a time balance is taken at if it differs from time of snapshot
+	// (shards are read one by one)
+	TakenAt time.Time `json:"-"`
+}
+
+// LedgerSnapshot represents balances of all accounts taken at once.
+type LedgerSnapshot struct {
+	TakenAt  time.Time        `json:"taken_at"`
+	Balances []*LedgerBalance `json:"balances"`
+}
+
+// BalanceAt represents balance of account at point in time.
+type BalanceAt struct {
+	UserID   string    `json:"id"`
+	Currency string    `json:"currency"`
+	Balance  float64   `json:"balance"`
+	At       time.Time `json:"at"`
+	// SnapshotAt is a time of snapshot balance is computed from, it is nil
+	// if balance is computed from the whole payment history
+	SnapshotAt *time.Time `json:"snapshot_at,omitempty"`
+}
@@ -0,0 +1,39 @@
+package repository
+
+// Limits represents transfer limits of an account or default limits of a currency.
+// Zero value of any limit means "no limit".
+type Limits struct {
+	UserID        string  `json:"id,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	MaxAmount     float64 `json:"max_amount"`
+	DailyAmount   float64 `json:"daily_amount"`
+	MonthlyAmount float64 `json:"monthly_amount"`
+	HourlyCount   int     `json:"hourly_count"`
+}
+
+// Merge fills unset (zero) limits from defaults and returns result.
+func (l Limits) Merge(defaults *Limits) *Limits {
+	if defaults == nil {
+		return &l
+	}
+	if l.MaxAmount == 0 {
+		l.MaxAmount = defaults.MaxAmount
+	}
+	if l.DailyAmount == 0 {
+		l.DailyAmount = defaults.DailyAmount
+	}
+	if l.MonthlyAmount == 0 {
+		l.MonthlyAmount = defaults.MonthlyAmount
+	}
+	if l.HourlyCount == 0 {
+		l.HourlyCount = defaults.HourlyCount
+	}
+	return &l
+}
+
+// LimitUsage represents current usage of outgoing transfer limits of an account.
+type LimitUsage struct {
+	DailyAmount   float64 `json:"daily_amount"`
+	MonthlyAmount float64 `json:"monthly_amount"`
+	HourlyCount   int     `json:"hourly_count"`
+}
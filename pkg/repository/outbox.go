@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Types of outbox events
+const (
+	// EventPayment is written for every account changed by transfer
+	EventPayment = "payment"
+	// EventOpening is written for every account created or changed by import
+	EventOpening = "opening"
+)
+
+// OutboxEvent represents event written to outbox in the same transaction as the
+// change it describes, so it is published if and only if the change is committed.
+// Seq numbers events of account without gaps, consumers may drop events of
+// account which Seq is not greater than the last one seen.
+type OutboxEvent struct {
+	ID        int64           `json:"id"`
+	Account   string          `json:"account"`
+	Seq       int64           `json:"seq"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// BalanceChange is a payload of outbox events: transaction as seen by account
+// and balance of account after it.
+type BalanceChange struct {
+	Direction string  `json:"direction"`
+	Payer     string  `json:"payer"`
+	Payee     string  `json:"payee"`
+	Amount    float64 `json:"amount"`
+	Fee       float64 `json:"fee"`
+	Currency  string  `json:"currency"`
+	Balance   float64 `json:"balance"`
+}
+
+// NewOutboxEvent returns event of account with payload encoded as JSON.
+func NewOutboxEvent(account, eventType string, payload interface{}) (*OutboxEvent, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{Account: account, Type: eventType, Payload: data}, nil
+}
+
+// OutboxOffsets returns the greatest Seq of every account of events.
+func OutboxOffsets(events []*OutboxEvent) map[string]int64 {
+	offsets := make(map[string]int64)
+	for _, event := range events {
+		if event.Seq > offsets[event.Account] {
+			offsets[event.Account] = event.Seq
+		}
+	}
+	return offsets
+}
@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// States of payout
+const (
+	// PayoutPending payout is booked to clearing account, but not sent to bank yet
+	PayoutPending = "pending"
+	// PayoutSent payout is accepted by bank, its outcome is not known yet
+	PayoutSent = "sent"
+	// PayoutConfirmed payout is settled by bank
+	PayoutConfirmed = "confirmed"
+	// PayoutFailed payout is rejected by bank or can not be sent, it is not refunded yet
+	PayoutFailed = "failed"
+	// PayoutCompensated amount of failed payout is refunded to its account
+	PayoutCompensated = "compensated"
+)
+
+// Statuses of history records which are not payouts
+const (
+	PaymentCompleted = "completed"
+	PaymentFailed    = "failed"
+)
+
+var (
+	// QueryInsertPayout is a query for writing booked payout
+	QueryInsertPayout = "INSERT INTO payout(id, account, bank_account, amount, currency, state, saga_id) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')) RETURNING created_at, updated_at, next_attempt_at"
+
+	// QueryPayout is a query for fetching payout by ID
+	QueryPayout = "SELECT id, account, bank_account, amount, currency, state, bank_ref, error, attempts, " +
+		"next_attempt_at, created_at, updated_at, COALESCE(saga_id, '') FROM payout WHERE id = $1"
+
+	// QueryDuePayouts is a query for fetching unfinished payouts which next attempt is due
+	QueryDuePayouts = "SELECT id, account, bank_account, amount, currency, state, bank_ref, error, attempts, " +
+		"next_attempt_at, created_at, updated_at, COALESCE(saga_id, '') FROM payout " +
+		"WHERE state IN ('pending', 'sent', 'failed') AND next_attempt_at <= now() ORDER BY next_attempt_at LIMIT $1"
+
+	// QueryUpdatePayout is a query for moving payout from state to another one
+	QueryUpdatePayout = "UPDATE payout SET state = $2, bank_ref = $3, error = $4, attempts = $5, next_attempt_at = $6, " +
+		"updated_at = now() WHERE id = $1 AND state = $7 RETURNING updated_at"
+
+	// QueryCompensateSagaPayouts is a query for finishing pending payouts written by compensated saga
+	QueryCompensateSagaPayouts = "UPDATE payout SET state = 'compensated', error = $2, updated_at = now() " +
+		"WHERE saga_id = $1 AND state = 'pending'"
+
+	// ErrPaymentNotFound error fired when there is no history record with ID
+	ErrPaymentNotFound = errs.New("payment_not_found", "Payment not found", http.StatusNotFound)
+
+	// ErrPayoutNotFound error fired when there is no payout with ID
+	ErrPayoutNotFound = errs.New("payout_not_found", "Payout not found", http.StatusNotFound)
+
+	// ErrPayoutStateChanged error fired when payout is moved to another state concurrently
+	ErrPayoutStateChanged = errs.New("payout_state_changed", "Payout state changed", http.StatusConflict)
+)
+
+// Payout is a transfer to account of external bank. It is booked from its
+// account to clearing account of its currency along with outgoing history
+// record, which ID it shares, then it is sent to bank. Failed payout is
+// compensated by refund from clearing account.
+type Payout struct {
+	ID          int64   `json:"id"`
+	Account     string  `json:"account"`
+	BankAccount string  `json:"bank_account"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	State       string  `json:"state"`
+	// BankRef is a reference of transfer given by bank once it is sent
+	BankRef string `json:"bank_ref,omitempty"`
+	// Error is a reason of failure
+	Error string `json:"error,omitempty"`
+	// Attempts is a number of failed attempts to send payout or to get its status
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// SagaID is an ID of saga which wrote payout, if any
+	SagaID string `json:"-"`
+}
+
+// Finished reports whether payout is in final state.
+func (p *Payout) Finished() bool {
+	return p.State == PayoutConfirmed || p.State == PayoutCompensated
+}
+
+// PaymentStatus is a history record along with its status: state of payout
+// if record is one, PaymentCompleted or PaymentFailed otherwise.
+type PaymentStatus struct {
+	ID        int       `json:"id"`
+	Direction string    `json:"direction"`
+	Date      time.Time `json:"date"`
+	Payer     string    `json:"account"`
+	Payee     string    `json:"to_account"`
+	Amount    float64   `json:"amount"`
+	Fee       float64   `json:"fee"`
+	Currency  string    `json:"currency"`
+	Error     string    `json:"error"`
+	Status    string    `json:"status"`
+	Payout    *Payout   `json:"payout,omitempty"`
+}
+
+// InsertPayout writes booked payout within txn, its times are filled in.
+func (r *repository) InsertPayout(txn DBTransaction, payout *Payout) error {
+	err := r.querier(txn).QueryRow(QueryInsertPayout, payout.ID, payout.Account, payout.BankAccount, payout.Amount,
+		payout.Currency, payout.State, payout.SagaID).Scan(&payout.CreatedAt, &payout.UpdatedAt, &payout.NextAttemptAt)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "InsertPayout", "payout", payout.ID, "err", err)
+		return err
+	}
+	payout.CreatedAt, payout.UpdatedAt = payout.CreatedAt.UTC(), payout.UpdatedAt.UTC()
+	payout.NextAttemptAt = payout.NextAttemptAt.UTC()
+	return nil
+}
+
+// GetPayout returns payout by ID, ErrPayoutNotFound if there is no such one.
+func (r *repository) GetPayout(id int64) (*Payout, error) {
+	payouts, err := r.queryPayouts("GetPayout", QueryPayout, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(payouts) == 0 {
+		return nil, ErrPayoutNotFound
+	}
+	return payouts[0], nil
+}
+
+// GetDuePayouts returns up to limit unfinished payouts which next attempt is due,
+// the most overdue first.
+func (r *repository) GetDuePayouts(limit int) ([]*Payout, error) {
+	return r.queryPayouts("GetDuePayouts", QueryDuePayouts, limit)
+}
+
+func (r *repository) queryPayouts(method, query string, args ...interface{}) ([]*Payout, error) {
+	rows, err := r.querier(nil).Query(query, args...)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", method, "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := make([]*Payout, 0)
+	for rows.Next() {
+		p := &Payout{}
+		err = rows.Scan(&p.ID, &p.Account, &p.BankAccount, &p.Amount, &p.Currency, &p.State, &p.BankRef, &p.Error,
+			&p.Attempts, &p.NextAttemptAt, &p.CreatedAt, &p.UpdatedAt, &p.SagaID)
+		if err != nil {
+			_ = level.Error(r.logger).Log("method", method, "err", err)
+			return nil, err
+		}
+		p.NextAttemptAt, p.CreatedAt, p.UpdatedAt = p.NextAttemptAt.UTC(), p.CreatedAt.UTC(), p.UpdatedAt.UTC()
+		payouts = append(payouts, p)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", method, "err", err)
+		return nil, err
+	}
+	return payouts, nil
+}
+
+// UpdatePayout moves payout from state to payout.State within txn, or directly
+// if txn is nil. ErrPayoutStateChanged is returned if payout is not in state.
+func (r *repository) UpdatePayout(txn DBTransaction, payout *Payout, from string) error {
+	err := r.querier(txn).QueryRow(QueryUpdatePayout, payout.ID, payout.State, payout.BankRef, payout.Error,
+		payout.Attempts, payout.NextAttemptAt, from).Scan(&payout.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrPayoutStateChanged
+	}
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "UpdatePayout", "payout", payout.ID, "err", err)
+		return err
+	}
+	payout.UpdatedAt = payout.UpdatedAt.UTC()
+	return nil
+}
@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// QueryReplicaLag is a query for replication lag of replica in seconds. Replica which
+// replayed all received WAL has no lag even if primary is idle, -1 means that nothing
+// is replayed yet.
+var QueryReplicaLag = "SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+	"ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), -1) END"
+
+// Replica is a read-only replica of database.
+type Replica struct {
+	Name    string
+	db      *sql.DB
+	healthy int32
+}
+
+// Healthy reports whether replica is reachable and its lag is acceptable.
+func (r *Replica) Healthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *Replica) setHealthy(healthy bool) (changed bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	return atomic.SwapInt32(&r.healthy, v) != v
+}
+
+// ReplicaPool routes read-only queries to healthy replicas round-robin. Replicas
+// are unhealthy until checked, nil pool has no replicas.
+type ReplicaPool struct {
+	replicas []*Replica
+	maxLag   time.Duration
+	next     uint32
+	logger   log.Logger
+}
+
+// NewReplicaPool returns empty pool, replicas lagging behind primary more than
+// maxLag are not used.
+func NewReplicaPool(maxLag time.Duration, logger log.Logger) *ReplicaPool {
+	return &ReplicaPool{
+		replicas: make([]*Replica, 0),
+		maxLag:   maxLag,
+		logger:   log.With(logger, "component", "replicas"),
+	}
+}
+
+// Add adds replica db named name to pool.
+func (p *ReplicaPool) Add(name string, db *sql.DB) {
+	p.replicas = append(p.replicas, &Replica{Name: name, db: db})
+}
+
+// Pick returns the next healthy replica, nil if there is none.
+func (p *ReplicaPool) Pick() *Replica {
+	if p == nil || len(p.replicas) == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&p.next, 1))
+	for i := 0; i < len(p.replicas); i++ {
+		if replica := p.replicas[(start+i)%len(p.replicas)]; replica.Healthy() {
+			return replica
+		}
+	}
+	return nil
+}
+
+// Check checks lag of every replica and marks them healthy or not.
+func (p *ReplicaPool) Check(ctx context.Context) {
+	for _, replica := range p.replicas {
+		var lag float64
+		err := replica.db.QueryRowContext(ctx, QueryReplicaLag).Scan(&lag)
+		healthy := err == nil && lag >= 0 && time.Duration(lag*float64(time.Second)) <= p.maxLag
+		if !replica.setHealthy(healthy) {
+			continue
+		}
+		if healthy {
+			_ = level.Info(p.logger).Log("replica", replica.Name, "healthy", true, "lag", lag)
+		} else {
+			_ = level.Warn(p.logger).Log("replica", replica.Name, "healthy", false, "lag", lag, "err", err)
+		}
+	}
+}
+
+// fail marks replica unhealthy until the next check.
+func (p *ReplicaPool) fail(replica *Replica, err error) {
+	if replica.setHealthy(false) {
+		_ = level.Warn(p.logger).Log("replica", replica.Name, "healthy", false, "err", err)
+	}
+}
+
+// Run checks replicas every interval until stop is closed.
+func (p *ReplicaPool) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			p.Check(ctx)
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close closes databases of replicas.
+func (p *ReplicaPool) Close() error {
+	var err error
+	for _, replica := range p.replicas {
+		if e := replica.db.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type consistencyContextKey struct{}
+
+// ContextWithReadYourWrites returns context which reads are served by primary
+// database, so they see writes committed just before.
+func ContextWithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistencyContextKey{}, true)
+}
+
+// ReadYourWritesFromContext reports whether reads of context are served by primary database.
+func ReadYourWritesFromContext(ctx context.Context) bool {
+	readYourWrites, _ := ctx.Value(consistencyContextKey{}).(bool)
+	return readYourWrites
+}
+
+// read runs read-only query on replica unless read-your-writes consistency is
+// requested or there is no healthy replica. Query failed on replica is retried
+// on primary.
+func (r *repository) read(method string, query func(q querier) error) error {
+	if !ReadYourWritesFromContext(r.ctx) {
+		if replica := r.replicas.Pick(); replica != nil {
+			err := query(tracedQuerier{ctx: r.ctx, q: replica.db})
+			if err == nil || r.ctx.Err() != nil {
+				return err
+			}
+			_ = level.Warn(r.logger).Log("method", method, "replica", replica.Name, "msg", "falling back to primary")
+			r.replicas.fail(replica, err)
+		}
+	}
+	return query(r.querier(nil))
+}
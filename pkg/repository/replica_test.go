@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeDB is a database of fakeDriver, it answers QueryReplicaLag with lag and
+// other queries with no rows.
+type fakeDB struct {
+	mu      sync.Mutex
+	lag     float64
+	err     error
+	queries int
+	// args are arguments of the last query
+	args []driver.Value
+}
+
+func (db *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.err != nil {
+		return nil, db.err
+	}
+	if query == QueryReplicaLag {
+		return &fakeRows{values: []driver.Value{db.lag}}, nil
+	}
+	db.queries++
+	db.args = args
+	return &fakeRows{}, nil
+}
+
+func (db *fakeDB) set(lag float64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lag, db.err = lag, err
+}
+
+func (db *fakeDB) count() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.queries
+}
+
+var fakeDBs = map[string]*fakeDB{
+	"primary": {}, "replica1": {}, "replica2": {}, "replica3": {}, "history": {},
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{fakeDBs[name]}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) { return s.db.query(s.query, args) }
+
+// fakeRows is a single row of values or no rows.
+type fakeRows struct{ values []driver.Value }
+
+func (r *fakeRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+func openFake(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReplicaPool(t *testing.T) {
+	fakeDBs["replica2"].set(60, nil)                             // lagging
+	fakeDBs["replica3"].set(0, errors.New("connection refused")) // down
+	pool := NewReplicaPool(5*time.Second, log.NewNopLogger())
+	for _, name := range []string{"replica1", "replica2", "replica3"} {
+		pool.Add(name, openFake(t, name))
+	}
+	defer pool.Close()
+	if pool.Pick() != nil {
+		t.Error("Replicas should be unhealthy until checked")
+	}
+	pool.Check(context.Background())
+	for i := 0; i < 3; i++ {
+		if replica := pool.Pick(); replica == nil || replica.Name != "replica1" {
+			t.Fatalf("Healthy replica should be picked, got %+v", replica)
+		}
+	}
+
+	// test reads are served by replica unless read-your-writes is requested
+	primary := openFake(t, "primary")
+	defer primary.Close()
+	repo := New(primary, pool, nil, log.NewNopLogger())
+	if _, err := repo.GetAccounts(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.WithContext(ContextWithReadYourWrites(context.Background())).GetTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	if fakeDBs["replica1"].count() != 1 || fakeDBs["primary"].count() != 1 {
+		t.Errorf("Unexpected queries: replica %d, primary %d", fakeDBs["replica1"].count(), fakeDBs["primary"].count())
+	}
+
+	// test failed replica falls back to primary until it recovers
+	fakeDBs["replica1"].set(0, errors.New("connection reset"))
+	if _, err := repo.GetTransactionPage(&TransactionFilter{}, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Pick() != nil || fakeDBs["primary"].count() != 2 {
+		t.Errorf("Replica should fail over to primary, primary queries %d", fakeDBs["primary"].count())
+	}
+	fakeDBs["replica1"].set(0, nil)
+	fakeDBs["replica2"].set(1, nil)
+	pool.Check(context.Background())
+	names := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		names[pool.Pick().Name] = true
+	}
+	if len(names) != 2 {
+		t.Errorf("Healthy replicas should be picked round-robin, got %v", names)
+	}
+
+	var noReplicas *ReplicaPool
+	if noReplicas.Pick() != nil {
+		t.Error("Nil pool has no replicas")
+	}
+}
@@ -1,20 +1,27 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-)
+	"github.com/lib/pq"
 
-// Account lock order
-type LockOrder int
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/tracing"
+)
 
-// Account lock order
+// postgresql error codes
 const (
-	LockFromTo LockOrder = iota
-	LockToFrom
+	pgForeignKeyViolation = "23503"
+	pgUniqueViolation     = "23505"
 )
 
 var (
@@ -25,48 +32,262 @@ var (
 	DirectionOutgoing = "outgoing"
 
 	// QueryLock is a query for locking account for update
-	QueryLock = "SELECT user_id, balance, currency FROM account WHERE user_id = $1 FOR NO KEY UPDATE"
+	QueryLock = "SELECT user_id, holder_id, balance, currency, credit_limit, freeze, freeze_reason FROM account WHERE user_id = $1 FOR NO KEY UPDATE"
+
+	// QueryAccount is a query for fetching all accounts grouped by holder
+	QueryAccount = "SELECT user_id, holder_id, balance, currency, credit_limit, freeze, freeze_reason FROM account ORDER BY holder_id, currency"
+
+	// QueryAccountByID is a query for fetching single account
+	QueryAccountByID = "SELECT user_id, holder_id, balance, currency, credit_limit, freeze, freeze_reason FROM account WHERE user_id = $1"
+
+	// QueryWallet is a query for fetching wallet of holder in currency, wallet
+	// itself is preferred if it is given instead of holder
+	QueryWallet = "SELECT user_id, holder_id, balance, currency, credit_limit, freeze, freeze_reason FROM account " +
+		"WHERE currency = $2 AND (holder_id = $1 OR user_id = $1) ORDER BY user_id = $1 DESC LIMIT 1"
 
-	// QueryAccount is a query for fetching all accounts
-	QueryAccount = "SELECT user_id, balance, currency FROM account"
+	// QueryHolder is a query for fetching wallets of holder
+	QueryHolder = "SELECT user_id, holder_id, balance, currency, credit_limit, freeze, freeze_reason FROM account WHERE holder_id = $1 ORDER BY currency"
+
+	// DirectionFee transaction direction of fee booked to revenue account
+	DirectionFee = "fee"
+
+	// DirectionOpening transaction direction of opening balance booked against equity account
+	DirectionOpening = "opening"
+
+	// QueryInsertAccount is a query for creating account
+	QueryInsertAccount = "INSERT INTO account(user_id, holder_id, balance, currency, credit_limit) VALUES ($1, $2, $3, $4, $5)"
+
+	// QueryInsertEquityAccount is a query for creating equity account unless it exists
+	QueryInsertEquityAccount = "INSERT INTO account(user_id, holder_id, balance, currency, equity) VALUES ($1, $2, 0, $3, true) " +
+		"ON CONFLICT (user_id) DO NOTHING"
 
 	// QueryTransaction is a query for fetching all transactions
-	QueryTransaction = "SELECT txn_id, direction, date, payer, payee, amount, currency, error FROM payment"
+	QueryTransaction = "SELECT txn_id, direction, date, payer, payee, amount, fee, currency, error FROM payment"
+
+	// QueryTransactionPage is a query for fetching page of transactions matching filter
+	QueryTransactionPage = "SELECT txn_id, direction, date, payer, payee, amount, fee, currency, error FROM payment " +
+		"WHERE txn_id > $1 AND ($2 = '' OR payer = $2 OR payee = $2) AND ($3::TIMESTAMPTZ IS NULL OR date >= $3) " +
+		"AND ($4::TIMESTAMPTZ IS NULL OR date < $4) ORDER BY txn_id LIMIT $5"
+
+	// QueryUpdateCreditLimit is a query for updating accounts credit limit
+	QueryUpdateCreditLimit = "UPDATE account SET credit_limit = $1 WHERE user_id = $2"
+
+	// QueryUpdateFreeze is a query for updating accounts freeze state
+	QueryUpdateFreeze = "UPDATE account SET freeze = $1, freeze_reason = $2 WHERE user_id = $3"
+
+	// QueryInsertFreeze is a query for inserting change of freeze state into audit trail
+	QueryInsertFreeze = "INSERT INTO account_freeze(user_id, state, reason, comment, actor) VALUES ($1, $2, $3, $4, $5)"
+
+	// QueryFreezeHistory is a query for fetching audit trail of freeze state changes of account
+	QueryFreezeHistory = "SELECT user_id, state, reason, comment, actor, date FROM account_freeze WHERE user_id = $1 ORDER BY id"
+
+	// QueryAuditLock is a query for serializing appends to audit log between instances
+	QueryAuditLock = "SELECT pg_advisory_xact_lock(hashtext('audit_log'))"
+
+	// QueryAuditLast is a query for fetching id and hash of the last audit log record
+	QueryAuditLast = "SELECT id, hash FROM audit_log ORDER BY id DESC LIMIT 1"
+
+	// QueryAuditInsert is a query for appending record to audit log
+	QueryAuditInsert = "INSERT INTO audit_log(id, date, actor, action, target, before, after, error, request_id, " +
+		"client_ip, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
+
+	// QueryAuditLog is a query for fetching page of audit log records
+	QueryAuditLog = "SELECT id, date, actor, action, target, before, after, error, request_id, client_ip, prev_hash, " +
+		"hash FROM audit_log WHERE id > $1 ORDER BY id LIMIT $2"
 
 	// QueryUpdate is a query for updating accounts balance
 	QueryUpdate = "UPDATE account SET balance = $1 WHERE user_id = $2"
 
 	// QueryInsert is a query for inserting trasaction into history
-	QueryInsert = "INSERT INTO payment(direction, payer, payee, amount, currency, error) VALUES ($1, $2, $3, $4, $5, $6)"
+	QueryInsert = "INSERT INTO payment(direction, payer, payee, amount, fee, currency, error, saga_id) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')) RETURNING txn_id"
+
+	// QueryFeeSchedule is a query for fetching fee schedule of currency
+	QueryFeeSchedule = "SELECT currency, revenue_account, fixed, percent, min_fee, max_fee FROM fee_schedule WHERE currency = $1"
+
+	// QueryFeeTiers is a query for fetching fee tiers of currency
+	QueryFeeTiers = "SELECT min_amount, fixed, percent FROM fee_tier WHERE currency = $1 ORDER BY min_amount"
+
+	// QueryUpsertFeeSchedule is a query for setting fee schedule of currency
+	QueryUpsertFeeSchedule = "INSERT INTO fee_schedule(currency, revenue_account, fixed, percent, min_fee, max_fee) " +
+		"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (currency) DO UPDATE SET revenue_account = EXCLUDED.revenue_account, " +
+		"fixed = EXCLUDED.fixed, percent = EXCLUDED.percent, min_fee = EXCLUDED.min_fee, max_fee = EXCLUDED.max_fee"
+
+	// QueryDeleteFeeTiers is a query for deleting fee tiers of currency
+	QueryDeleteFeeTiers = "DELETE FROM fee_tier WHERE currency = $1"
+
+	// QueryInsertFeeTier is a query for inserting fee tier of currency
+	QueryInsertFeeTier = "INSERT INTO fee_tier(currency, min_amount, fixed, percent) VALUES ($1, $2, $3, $4)"
+
+	// QueryAccountLimits is a query for fetching transfer limits of account
+	QueryAccountLimits = "SELECT max_amount, daily_amount, monthly_amount, hourly_count FROM account_limit WHERE user_id = $1"
+
+	// QueryCurrencyLimits is a query for fetching default transfer limits of currency
+	QueryCurrencyLimits = "SELECT max_amount, daily_amount, monthly_amount, hourly_count FROM currency_limit WHERE currency = $1"
+
+	// QueryUpsertAccountLimits is a query for setting transfer limits of account
+	QueryUpsertAccountLimits = "INSERT INTO account_limit(user_id, max_amount, daily_amount, monthly_amount, hourly_count) " +
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO UPDATE SET max_amount = EXCLUDED.max_amount, " +
+		"daily_amount = EXCLUDED.daily_amount, monthly_amount = EXCLUDED.monthly_amount, hourly_count = EXCLUDED.hourly_count"
+
+	// QueryUpsertCurrencyLimits is a query for setting default transfer limits of currency
+	QueryUpsertCurrencyLimits = "INSERT INTO currency_limit(currency, max_amount, daily_amount, monthly_amount, hourly_count) " +
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (currency) DO UPDATE SET max_amount = EXCLUDED.max_amount, " +
+		"daily_amount = EXCLUDED.daily_amount, monthly_amount = EXCLUDED.monthly_amount, hourly_count = EXCLUDED.hourly_count"
+
+	// QueryLimitUsage is a query for calculating outgoing totals of account for current day, month and last hour
+	QueryLimitUsage = "SELECT " +
+		"COALESCE(SUM(amount) FILTER (WHERE date >= date_trunc('day', now())), 0), " +
+		"COALESCE(SUM(amount), 0), " +
+		"COUNT(*) FILTER (WHERE date >= now() - INTERVAL '1 hour') " +
+		"FROM payment WHERE payer = $1 AND direction = 'outgoing' AND error = '' " +
+		"AND date >= date_trunc('month', now())"
+
+	// ledgerEntries is a subquery of (user_id, amount, date) entries of successful transactions:
+	// incoming, fee and opening records credit payee, outgoing records debit payer by amount
+	// and fee, opening records debit payer (equity)
+	ledgerEntries = "SELECT payee AS user_id, amount, date FROM payment " +
+		"WHERE error = '' AND direction IN ('incoming', 'fee', 'opening') " +
+		"UNION ALL SELECT payer, -(amount + fee), date FROM payment WHERE error = '' AND direction = 'outgoing' " +
+		"UNION ALL SELECT payer, -amount, date FROM payment WHERE error = '' AND direction = 'opening'"
+
+	// QueryLedgerBalances is a query for stored balances of all accounts along with balances
+	// recomputed from successful transactions
+	QueryLedgerBalances = "SELECT a.user_id, a.currency, a.balance, COALESCE(l.balance, 0), " +
+		"a.balance - COALESCE(l.balance, 0) FROM account a LEFT JOIN (" +
+		"SELECT user_id, SUM(amount) AS balance FROM (" + ledgerEntries + ") AS entries " +
+		"GROUP BY user_id) AS l ON l.user_id = a.user_id ORDER BY a.user_id"
+
+	// QueryAccountCurrency is a query for currency of account
+	QueryAccountCurrency = "SELECT currency FROM account WHERE user_id = $1"
+
+	// QueryBalanceSnapshotAt is a query for the latest balance snapshot of account taken not after time
+	QueryBalanceSnapshotAt = "SELECT ledger_balance, taken_at FROM balance_snapshot " +
+		"WHERE user_id = $1 AND taken_at <= $2 ORDER BY taken_at DESC LIMIT 1"
+
+	// QueryLedgerDelta is a query for change of balance of account by transactions made
+	// after snapshot time (from the very beginning if it is NULL) up to time inclusive
+	QueryLedgerDelta = "SELECT COALESCE(SUM(amount), 0) FROM (" + ledgerEntries + ") AS entries " +
+		"WHERE user_id = $1 AND ($2::TIMESTAMPTZ IS NULL OR date > $2) AND date <= $3"
+
+	// QueryCurrencies is a query for fetching overrides of ISO 4217 currencies, unset
+	// numeric code and exponent are taken from ISO 4217
+	QueryCurrencies = "SELECT code, COALESCE(numeric, 0), COALESCE(exponent, -1), enabled FROM currency ORDER BY code"
+
+	// QueryNow is a query for start time of transaction, which snapshot is taken at
+	QueryNow = "SELECT now()"
+
+	// QueryInsertBalanceSnapshot is a query for saving balance snapshot of account
+	QueryInsertBalanceSnapshot = "INSERT INTO balance_snapshot(user_id, currency, balance, ledger_balance, taken_at) " +
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, taken_at) DO NOTHING"
+
+	// QueryAppendOutbox is a query for writing event of account to outbox, sequence number
+	// of account is incremented under lock of its row, so events of account are committed in order
+	QueryAppendOutbox = "WITH a AS (UPDATE account SET outbox_seq = outbox_seq + 1 WHERE user_id = $1 RETURNING outbox_seq) " +
+		"INSERT INTO outbox(account, seq, type, payload) SELECT $1, outbox_seq, $2, $3 FROM a RETURNING id, seq, created_at"
+
+	// QueryOutbox is a query for fetching events not published by relay yet
+	QueryOutbox = "SELECT o.id, o.account, o.seq, o.type, o.payload, o.created_at FROM outbox o " +
+		"LEFT JOIN outbox_offset f ON f.relay = $1 AND f.account = o.account " +
+		"WHERE o.seq > COALESCE(f.seq, 0) ORDER BY o.id LIMIT $2"
+
+	// QuerySaveOutboxOffset is a query for saving sequence number of the last event of account published by relay
+	QuerySaveOutboxOffset = "INSERT INTO outbox_offset(relay, account, seq) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (relay, account) DO UPDATE SET seq = GREATEST(outbox_offset.seq, EXCLUDED.seq)"
 
 	// ErrPayerNotFound error fired when payer (sender) not found
-	ErrPayerNotFound = errors.New("Payer not found")
+	ErrPayerNotFound = errs.New("payer_not_found", "Payer not found", http.StatusBadRequest)
 
 	// ErrPayeeNotFound error fired when payee (receiver) not found
-	ErrPayeeNotFound = errors.New("Payee not found")
+	ErrPayeeNotFound = errs.New("payee_not_found", "Payee not found", http.StatusBadRequest)
+
+	// ErrAccountNotFound error fired when account not found
+	ErrAccountNotFound = errs.New("account_not_found", "Account not found", http.StatusNotFound)
+
+	// ErrAccountExists error fired when created account already exists
+	ErrAccountExists = errs.New("account_exists", "Account already exists", http.StatusConflict)
 )
 
 type Repository interface {
+	WithContext(ctx context.Context) Repository
 	GetAccounts() ([]*Account, error)
+	GetAccount(accountName string) (*Account, error)
+	GetWallet(holderID, currency string) (*Account, error)
+	GetHolder(holderID string) (*Holder, error)
 	GetTransactions() ([]interface{}, error)
+	GetTransactionPage(filter *TransactionFilter, afterID int, limit int) ([]*Transaction, error)
 	Begin() (DBTransaction, error)
-	GetAndLockTwoAccounts(txn DBTransaction, lockingOrder LockOrder, accountName1, accountName2 string) (acc1, acc2 *Account, err error)
-	InsertTransaction(direction, from, to string, amount float64, currency, txnError string) (err error)
+	GetAndLockAccount(txn DBTransaction, accountName string) (*Account, error)
+	InsertTransaction(txn DBTransaction, record *Transaction) (err error)
 	UpdateBalance(txn DBTransaction, accountName string, balance float64) (err error)
+	CreateAccount(txn DBTransaction, account *Account) (err error)
+	CreateEquityAccount(txn DBTransaction, holderID, accountName, currency string) (err error)
+	UpdateCreditLimit(txn DBTransaction, accountName string, creditLimit float64) (err error)
+	UpdateFreeze(txn DBTransaction, record *FreezeRecord) (err error)
+	GetFreezeHistory(accountName string) ([]*FreezeRecord, error)
+	AppendAudit(record *AuditRecord) error
+	GetAuditLog(afterID int64, limit int) ([]*AuditRecord, error)
+	GetLimits(txn DBTransaction, accountName, currency string) (*Limits, error)
+	GetLimitUsage(txn DBTransaction, accountName string) (*LimitUsage, error)
+	SetLimits(limits *Limits) error
+	GetFeeSchedule(txn DBTransaction, currency string) (*FeeSchedule, error)
+	SetFeeSchedule(schedule *FeeSchedule) error
+	GetLedgerBalances() (*LedgerSnapshot, error)
+	SaveBalanceSnapshot(snapshot *LedgerSnapshot) error
+	GetBalanceAt(accountName string, at time.Time) (*BalanceAt, error)
+	GetCurrencies() ([]currency.Currency, error)
+	Subscribe(holderID string) *activity.Subscription
+	AppendOutbox(txn DBTransaction, event *OutboxEvent) error
+	GetOutbox(relay string, limit int) ([]*OutboxEvent, error)
+	SaveOutboxOffsets(relay string, events []*OutboxEvent) error
+	InsertPayout(txn DBTransaction, payout *Payout) error
+	GetPayout(id int64) (*Payout, error)
+	GetDuePayouts(limit int) ([]*Payout, error)
+	UpdatePayout(txn DBTransaction, payout *Payout, from string) error
 }
 
-// New returns a payment Repository.
-func New(db *sql.DB, logger log.Logger) Repository {
+// New returns a payment Repository. Listing of accounts and payment history are
+// served by replicas if there are healthy ones, replicas may be nil. Its
+// subscriptions are served by broker, which is fed by activity.Listener of database.
+func New(db *sql.DB, replicas *ReplicaPool, broker *activity.Broker, logger log.Logger) Repository {
+	return NewShard(db, replicas, broker, logger)
+}
+
+// NewShard returns a payment Repository which keeps sagas as well, so it may be
+// a shard of ShardedRepository.
+func NewShard(db *sql.DB, replicas *ReplicaPool, broker *activity.Broker, logger log.Logger) Shard {
 	// return  repository
 	return &repository{
-		db:     db,
-		logger: log.With(logger, "repository", "paymentsdb"),
+		db:       db,
+		replicas: replicas,
+		broker:   broker,
+		logger:   log.With(logger, "repository", "paymentsdb"),
+		ctx:      context.Background(),
 	}
 }
 
 type repository struct {
-	db     *sql.DB
-	logger log.Logger
+	db       *sql.DB
+	replicas *ReplicaPool
+	broker   *activity.Broker
+	logger   log.Logger
+	ctx      context.Context
+}
+
+// WithContext returns repository bound to ctx of request: its logs carry request ID
+// and its SQL statements are traced as children of current span of ctx.
+func (r *repository) WithContext(ctx context.Context) Repository {
+	logger := r.logger
+	if requestID := tracing.RequestIDFromContext(ctx); requestID != "" {
+		logger = log.With(logger, "request_id", requestID)
+	}
+	return &repository{
+		db:       r.db,
+		replicas: r.replicas,
+		broker:   r.broker,
+		logger:   logger,
+		ctx:      ctx,
+	}
 }
 
 // DBTransaction is a wrapper for sql.Tx
@@ -74,45 +295,147 @@ type DBTransaction interface {
 	Rollback() error
 	Commit() error
 	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is implemented by both sql.DB and DBTransaction
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
 // NewDBTranscation creates new instance with wrapped sql.Tx
 func NewDBTranscation(txn *sql.Tx) DBTransaction {
+	return newDBTransaction(context.Background(), txn)
+}
+
+func newDBTransaction(ctx context.Context, txn *sql.Tx) DBTransaction {
 	return dbTransaction{
-		txn: txn,
+		txn:    txn,
+		traced: tracedQuerier{ctx: ctx, q: txn},
 	}
 }
 
 type dbTransaction struct {
-	txn *sql.Tx
+	txn    *sql.Tx
+	traced tracedQuerier
 }
 
 // Rollback is a wrapper for Rollback
-func (dbt dbTransaction) Rollback() error {
+func (dbt dbTransaction) Rollback() (err error) {
+	span := dbt.traced.startSpan("ROLLBACK")
+	defer func() { span.Finish(err) }()
 	return dbt.txn.Rollback()
 }
 
 // Commit is a wrapper
-func (dbt dbTransaction) Commit() error {
+func (dbt dbTransaction) Commit() (err error) {
+	span := dbt.traced.startSpan("COMMIT")
+	defer func() { span.Finish(err) }()
 	return dbt.txn.Commit()
 }
 
 // QueryRow wrapper
 func (dbt dbTransaction) QueryRow(query string, args ...interface{}) *sql.Row {
-	return dbt.txn.QueryRow(query, args...)
+	return dbt.traced.QueryRow(query, args...)
+}
+
+// Query wrapper
+func (dbt dbTransaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return dbt.traced.Query(query, args...)
 }
 
 // Exec wrapper
 func (dbt dbTransaction) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return dbt.txn.Exec(query, args...)
+	return dbt.traced.Exec(query, args...)
+}
+
+// tracedQuerier traces every SQL statement as a span
+type tracedQuerier struct {
+	ctx context.Context
+	q   querier
+}
+
+func (tq tracedQuerier) startSpan(statement string) *tracing.Span {
+	_, span := tracing.StartSpan(tq.ctx, "sql "+strings.SplitN(statement, " ", 2)[0], tracing.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", statement)
+	return span
+}
+
+func (tq tracedQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := tq.startSpan(query)
+	row := tq.q.QueryRow(query, args...)
+	span.Finish(row.Err())
+	return row
+}
+
+func (tq tracedQuerier) Query(query string, args ...interface{}) (rows *sql.Rows, err error) {
+	span := tq.startSpan(query)
+	defer func() { span.Finish(err) }()
+	return tq.q.Query(query, args...)
+}
+
+func (tq tracedQuerier) Exec(query string, args ...interface{}) (result sql.Result, err error) {
+	span := tq.startSpan(query)
+	defer func() { span.Finish(err) }()
+	return tq.q.Exec(query, args...)
+}
+
+// GetAccounts returns all Accounts ordered by holder and currency, they may be read from replica
+func (r *repository) GetAccounts() (accounts []*Account, err error) {
+	err = r.read("GetAccounts", func(q querier) error {
+		accounts, err = r.queryAccounts(q, "GetAccounts", QueryAccount)
+		return err
+	})
+	return
+}
+
+// GetAccount returns Account by its name
+func (r *repository) GetAccount(accountName string) (*Account, error) {
+	return r.queryAccount("GetAccount", QueryAccountByID, accountName)
+}
+
+// GetWallet returns wallet of holder in currency. Wallet itself may be given
+// instead of holder, ErrAccountNotFound is returned if it is of other currency.
+func (r *repository) GetWallet(holderID, currency string) (*Account, error) {
+	return r.queryAccount("GetWallet", QueryWallet, holderID, currency)
+}
+
+// GetHolder returns holder with its wallets ordered by currency, ErrAccountNotFound
+// is returned if holder has no wallets.
+func (r *repository) GetHolder(holderID string) (*Holder, error) {
+	wallets, err := r.queryAccounts(r.querier(nil), "GetHolder", QueryHolder, holderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(wallets) == 0 {
+		return nil, ErrAccountNotFound
+	}
+	return &Holder{ID: holderID, Wallets: wallets}, nil
+}
+
+func (r *repository) queryAccount(method, query string, args ...interface{}) (*Account, error) {
+	account := &Account{}
+	row := r.querier(nil).QueryRow(query, args...)
+	err := row.Scan(&account.UserID, &account.Holder, &account.Balance, &account.Currency, &account.CreditLimit,
+		&account.Freeze, &account.FreezeReason)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		_ = level.Error(r.logger).Log("method", method, "err", err)
+		return nil, err
+	}
+	return account, nil
 }
 
-// GetAccounts returns all Accounts
-func (r *repository) GetAccounts() ([]*Account, error) {
-	rows, err := r.db.Query(QueryAccount)
+func (r *repository) queryAccounts(q querier, method, query string, args ...interface{}) ([]*Account, error) {
+	rows, err := q.Query(query, args...)
 	if err != nil {
-		_ = level.Error(r.logger).Log("method", "GetAccounts", "err", err)
+		_ = level.Error(r.logger).Log("method", method, "err", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -120,23 +443,32 @@ func (r *repository) GetAccounts() ([]*Account, error) {
 	var accounts = make([]*Account, 0)
 	for rows.Next() {
 		account := &Account{}
-		err := rows.Scan(&account.UserID, &account.Balance, &account.Currency)
+		err := rows.Scan(&account.UserID, &account.Holder, &account.Balance, &account.Currency, &account.CreditLimit,
+			&account.Freeze, &account.FreezeReason)
 		if err != nil {
-			_ = level.Error(r.logger).Log("method", "GetAccounts", "err", err)
+			_ = level.Error(r.logger).Log("method", method, "err", err)
 			return nil, err
 		}
 		accounts = append(accounts, account)
 	}
 	if err = rows.Err(); err != nil {
-		_ = level.Error(r.logger).Log("method", "GetAccounts", "err", err)
+		_ = level.Error(r.logger).Log("method", method, "err", err)
 		return nil, err
 	}
 	return accounts, nil
 }
 
-// GetTransactions returns all Transaction history.
-func (r *repository) GetTransactions() ([]interface{}, error) {
-	rows, err := r.db.Query(QueryTransaction)
+// GetTransactions returns all Transaction history, it may be read from replica.
+func (r *repository) GetTransactions() (transactions []interface{}, err error) {
+	err = r.read("GetTransactions", func(q querier) error {
+		transactions, err = r.queryTransactions(q)
+		return err
+	})
+	return
+}
+
+func (r *repository) queryTransactions(q querier) ([]interface{}, error) {
+	rows, err := q.Query(QueryTransaction)
 	if err != nil {
 		_ = level.Error(r.logger).Log("method", "GetTransactions", "err", err)
 		return nil, err
@@ -146,8 +478,8 @@ func (r *repository) GetTransactions() ([]interface{}, error) {
 	var transactions = make([]interface{}, 0)
 	for rows.Next() {
 		txn := &Transaction{}
-		err := rows.Scan(&txn.TxnID, &txn.Direction, &txn.Date, &txn.Payer, &txn.Payee, &txn.Amount, &txn.Currency,
-			&txn.Error)
+		err := rows.Scan(&txn.TxnID, &txn.Direction, &txn.Date, &txn.Payer, &txn.Payee, &txn.Amount, &txn.Fee,
+			&txn.Currency, &txn.Error)
 		if err != nil {
 			_ = level.Error(r.logger).Log("method", "GetTransactions", "err", err)
 			return nil, err
@@ -160,6 +492,7 @@ func (r *repository) GetTransactions() ([]interface{}, error) {
 				Payer:     txn.Payer,
 				Payee:     txn.Payee,
 				Amount:    txn.Amount,
+				Fee:       txn.Fee,
 				Currency:  txn.Currency,
 				Error:     txn.Error,
 			})
@@ -174,55 +507,532 @@ func (r *repository) GetTransactions() ([]interface{}, error) {
 	return transactions, nil
 }
 
+// GetTransactionPage returns up to limit transactions matching filter following afterID,
+// they may be read from replica.
+func (r *repository) GetTransactionPage(filter *TransactionFilter, afterID int, limit int) (transactions []*Transaction, err error) {
+	err = r.read("GetTransactionPage", func(q querier) error {
+		transactions, err = r.queryTransactionPage(q, filter, afterID, limit)
+		return err
+	})
+	return
+}
+
+func (r *repository) queryTransactionPage(q querier, filter *TransactionFilter, afterID int, limit int) ([]*Transaction, error) {
+	rows, err := q.Query(QueryTransactionPage, afterID, filter.Account, nullTime(filter.From),
+		nullTime(filter.To), limit)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetTransactionPage", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := make([]*Transaction, 0, limit)
+	for rows.Next() {
+		txn := &Transaction{}
+		err := rows.Scan(&txn.TxnID, &txn.Direction, &txn.Date, &txn.Payer, &txn.Payee, &txn.Amount, &txn.Fee,
+			&txn.Currency, &txn.Error)
+		if err != nil {
+			_ = level.Error(r.logger).Log("method", "GetTransactionPage", "err", err)
+			return nil, err
+		}
+		transactions = append(transactions, txn)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetTransactionPage", "err", err)
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// nullTime returns NULL for zero time, so it may be used as optional parameter.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
 func (r *repository) Begin() (DBTransaction, error) {
 	txn, err := r.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	return NewDBTranscation(txn), nil
+	return newDBTransaction(r.ctx, txn), nil
 }
 
-func (r *repository) GetAndLockTwoAccounts(txn DBTransaction, lockingOrder LockOrder, accountName1, accountName2 string) (acc1, acc2 *Account, err error) {
-	acc1, err = r.getAndLockAccount(txn, accountName1)
+// GetAndLockAccount locks account for update till the end of txn and returns it
+func (r *repository) GetAndLockAccount(txn DBTransaction, accountName string) (account *Account, err error) {
+	account = &Account{}
+	row := txn.QueryRow(QueryLock, accountName)
+	err = row.Scan(&account.UserID, &account.Holder, &account.Balance, &account.Currency, &account.CreditLimit,
+		&account.Freeze, &account.FreezeReason)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			if lockingOrder == LockFromTo {
-				return nil, nil, ErrPayerNotFound
-			}
-			return nil, nil, ErrPayeeNotFound
+			return nil, ErrAccountNotFound
 		}
-		return nil, nil, err
+		return nil, err
 	}
-	acc2, err = r.getAndLockAccount(txn, accountName2)
+	return account, nil
+}
+
+func (r *repository) UpdateBalance(txn DBTransaction, accountName string, balance float64) (err error) {
+	_, err = txn.Exec(QueryUpdate, balance, accountName)
+	return
+}
+
+// CreateAccount creates account within txn, ErrAccountExists is returned if it or
+// wallet of its holder in the same currency already exists. Account is its own
+// holder unless Holder is set.
+func (r *repository) CreateAccount(txn DBTransaction, account *Account) (err error) {
+	holder := account.Holder
+	if holder == "" {
+		holder = account.UserID
+	}
+	_, err = txn.Exec(QueryInsertAccount, account.UserID, holder, account.Balance, account.Currency, account.CreditLimit)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pgUniqueViolation {
+		return ErrAccountExists
+	}
+	return
+}
+
+// CreateEquityAccount creates equity account of currency owned by holderID within txn unless it exists.
+// Balance of equity account is not limited, it goes negative by opening balances
+// booked against it.
+func (r *repository) CreateEquityAccount(txn DBTransaction, holderID, accountName, currency string) (err error) {
+	_, err = txn.Exec(QueryInsertEquityAccount, accountName, holderID, currency)
+	return
+}
+
+// UpdateCreditLimit sets credit limit (allowed overdraft) of account
+func (r *repository) UpdateCreditLimit(txn DBTransaction, accountName string, creditLimit float64) (err error) {
+	_, err = txn.Exec(QueryUpdateCreditLimit, creditLimit, accountName)
+	return
+}
+
+// UpdateFreeze sets freeze state of account and records the change into audit trail
+func (r *repository) UpdateFreeze(txn DBTransaction, record *FreezeRecord) (err error) {
+	_, err = txn.Exec(QueryUpdateFreeze, record.State, record.Reason, record.UserID)
+	if err != nil {
+		return
+	}
+	_, err = txn.Exec(QueryInsertFreeze, record.UserID, record.State, record.Reason, record.Comment, record.Actor)
+	return
+}
+
+// GetFreezeHistory returns audit trail of freeze state changes of account
+func (r *repository) GetFreezeHistory(accountName string) ([]*FreezeRecord, error) {
+	rows, err := r.querier(nil).Query(QueryFreezeHistory, accountName)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetFreezeHistory", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history = make([]*FreezeRecord, 0)
+	for rows.Next() {
+		record := &FreezeRecord{}
+		err := rows.Scan(&record.UserID, &record.State, &record.Reason, &record.Comment, &record.Actor, &record.Date)
+		if err != nil {
+			_ = level.Error(r.logger).Log("method", "GetFreezeHistory", "err", err)
+			return nil, err
+		}
+		history = append(history, record)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetFreezeHistory", "err", err)
+		return nil, err
+	}
+	return history, nil
+}
+
+// InsertTransaction inserts record into history within txn, or directly if txn is nil
+// (f.e. to record failed transfer after rollback). TxnID of record is filled in.
+func (r *repository) InsertTransaction(txn DBTransaction, record *Transaction) (err error) {
+	return r.querier(txn).QueryRow(QueryInsert, record.Direction, record.Payer, record.Payee, record.Amount, record.Fee,
+		record.Currency, record.Error, record.SagaID).Scan(&record.TxnID)
+}
+
+// GetLimits returns transfer limits of account merged with default limits of currency.
+func (r *repository) GetLimits(txn DBTransaction, accountName, currency string) (*Limits, error) {
+	q := r.querier(txn)
+	limits := &Limits{UserID: accountName, Currency: currency}
+	err := q.QueryRow(QueryAccountLimits, accountName).Scan(&limits.MaxAmount, &limits.DailyAmount,
+		&limits.MonthlyAmount, &limits.HourlyCount)
+	if err != nil && err != sql.ErrNoRows {
+		_ = level.Error(r.logger).Log("method", "GetLimits", "err", err)
+		return nil, err
+	}
+	defaults := &Limits{}
+	err = q.QueryRow(QueryCurrencyLimits, currency).Scan(&defaults.MaxAmount, &defaults.DailyAmount,
+		&defaults.MonthlyAmount, &defaults.HourlyCount)
+	if err != nil && err != sql.ErrNoRows {
+		_ = level.Error(r.logger).Log("method", "GetLimits", "err", err)
+		return nil, err
+	}
+	return limits.Merge(defaults), nil
+}
+
+// GetLimitUsage returns outgoing totals of account for current day, month and last hour.
+func (r *repository) GetLimitUsage(txn DBTransaction, accountName string) (*LimitUsage, error) {
+	usage := &LimitUsage{}
+	err := r.querier(txn).QueryRow(QueryLimitUsage, accountName).Scan(&usage.DailyAmount, &usage.MonthlyAmount,
+		&usage.HourlyCount)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetLimitUsage", "err", err)
+		return nil, err
+	}
+	return usage, nil
+}
+
+// SetLimits sets transfer limits of account, or default limits of currency if UserID is empty.
+func (r *repository) SetLimits(limits *Limits) (err error) {
+	if limits.UserID != "" {
+		_, err = r.querier(nil).Exec(QueryUpsertAccountLimits, limits.UserID, limits.MaxAmount, limits.DailyAmount,
+			limits.MonthlyAmount, limits.HourlyCount)
+	} else {
+		_, err = r.querier(nil).Exec(QueryUpsertCurrencyLimits, limits.Currency, limits.MaxAmount, limits.DailyAmount,
+			limits.MonthlyAmount, limits.HourlyCount)
+	}
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pgForeignKeyViolation {
+			return ErrAccountNotFound
+		}
+		_ = level.Error(r.logger).Log("method", "SetLimits", "err", err)
+	}
+	return
+}
+
+// GetFeeSchedule returns fee schedule of currency, or nil if transfers in currency are free of charge.
+func (r *repository) GetFeeSchedule(txn DBTransaction, currency string) (*FeeSchedule, error) {
+	q := r.querier(txn)
+	schedule := &FeeSchedule{}
+	err := q.QueryRow(QueryFeeSchedule, currency).Scan(&schedule.Currency, &schedule.RevenueAccount, &schedule.Fixed,
+		&schedule.Percent, &schedule.MinFee, &schedule.MaxFee)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			if lockingOrder == LockToFrom {
-				return nil, nil, ErrPayerNotFound
+			return nil, nil
+		}
+		_ = level.Error(r.logger).Log("method", "GetFeeSchedule", "err", err)
+		return nil, err
+	}
+	rows, err := q.Query(QueryFeeTiers, currency)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetFeeSchedule", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tier FeeTier
+		if err = rows.Scan(&tier.MinAmount, &tier.Fixed, &tier.Percent); err != nil {
+			_ = level.Error(r.logger).Log("method", "GetFeeSchedule", "err", err)
+			return nil, err
+		}
+		schedule.Tiers = append(schedule.Tiers, tier)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetFeeSchedule", "err", err)
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// SetFeeSchedule replaces fee schedule of currency together with its tiers.
+func (r *repository) SetFeeSchedule(schedule *FeeSchedule) (err error) {
+	txn, err := r.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pgForeignKeyViolation {
+				err = ErrAccountNotFound
+				return
 			}
-			return nil, nil, ErrPayeeNotFound
+			_ = level.Error(r.logger).Log("method", "SetFeeSchedule", "err", err)
 		}
-		return nil, nil, err
+	}()
+	_, err = txn.Exec(QueryUpsertFeeSchedule, schedule.Currency, schedule.RevenueAccount, schedule.Fixed,
+		schedule.Percent, schedule.MinFee, schedule.MaxFee)
+	if err != nil {
+		return
+	}
+	if _, err = txn.Exec(QueryDeleteFeeTiers, schedule.Currency); err != nil {
+		return
+	}
+	for _, tier := range schedule.Tiers {
+		if _, err = txn.Exec(QueryInsertFeeTier, schedule.Currency, tier.MinAmount, tier.Fixed, tier.Percent); err != nil {
+			return
+		}
+	}
+	return txn.Commit()
+}
+
+// GetLedgerBalances returns stored and recomputed balances of all accounts. They are
+// read within single read only transaction, so they are consistent to each other.
+func (r *repository) GetLedgerBalances() (snapshot *LedgerSnapshot, err error) {
+	sqlTxn, err := r.db.BeginTx(r.ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetLedgerBalances", "err", err)
+		return nil, err
 	}
+	txn := newDBTransaction(r.ctx, sqlTxn)
+	defer func() {
+		_ = txn.Rollback() // nothing is written
+		if err != nil {
+			_ = level.Error(r.logger).Log("method", "GetLedgerBalances", "err", err)
+		}
+	}()
 
-	return acc1, acc2, nil
+	snapshot = &LedgerSnapshot{Balances: make([]*LedgerBalance, 0)}
+	if err = txn.QueryRow(QueryNow).Scan(&snapshot.TakenAt); err != nil {
+		return nil, err
+	}
+	snapshot.TakenAt = snapshot.TakenAt.UTC()
+	rows, err := txn.Query(QueryLedgerBalances)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		balance := &LedgerBalance{}
+		err = rows.Scan(&balance.UserID, &balance.Currency, &balance.Balance, &balance.Ledger, &balance.Difference)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Balances = append(snapshot.Balances, balance)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
 }
 
-func (r *repository) getAndLockAccount(txn DBTransaction, accountName string) (account *Account, err error) {
-	account = &Account{}
-	row := txn.QueryRow(QueryLock, accountName)
-	err = row.Scan(&account.UserID, &account.Balance, &account.Currency)
+// GetBalanceAt returns balance of account at time computed from the latest snapshot
+// taken not after it plus transactions made since snapshot up to time inclusive.
+func (r *repository) GetBalanceAt(accountName string, at time.Time) (balance *BalanceAt, err error) {
+	sqlTxn, err := r.db.BeginTx(r.ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetBalanceAt", "err", err)
 		return nil, err
 	}
-	return account, nil
+	txn := newDBTransaction(r.ctx, sqlTxn)
+	defer func() {
+		_ = txn.Rollback() // nothing is written
+		if err != nil && err != ErrAccountNotFound {
+			_ = level.Error(r.logger).Log("method", "GetBalanceAt", "err", err)
+		}
+	}()
+
+	balance = &BalanceAt{UserID: accountName, At: at}
+	err = txn.QueryRow(QueryAccountCurrency, accountName).Scan(&balance.Currency)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshotAt time.Time
+	err = txn.QueryRow(QueryBalanceSnapshotAt, accountName, at).Scan(&balance.Balance, &snapshotAt)
+	switch {
+	case err == nil:
+		snapshotAt = snapshotAt.UTC()
+		balance.SnapshotAt = &snapshotAt
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	var delta float64
+	if err = txn.QueryRow(QueryLedgerDelta, accountName, nullTime(snapshotAt), at).Scan(&delta); err != nil {
+		return nil, err
+	}
+	balance.Balance = currency.Round(balance.Balance+delta, balance.Currency)
+	return balance, nil
 }
 
-func (r *repository) UpdateBalance(txn DBTransaction, accountName string, balance float64) (err error) {
-	_, err = txn.Exec(QueryUpdate, balance, accountName)
-	return
+// SaveBalanceSnapshot saves balances of snapshot, point-in-time balances are computed from them.
+func (r *repository) SaveBalanceSnapshot(snapshot *LedgerSnapshot) (err error) {
+	txn, err := r.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+			_ = level.Error(r.logger).Log("method", "SaveBalanceSnapshot", "err", err)
+		}
+	}()
+	for _, balance := range snapshot.Balances {
+		takenAt := snapshot.TakenAt
+		if !balance.TakenAt.IsZero() {
+			takenAt = balance.TakenAt
+		}
+		_, err = txn.Exec(QueryInsertBalanceSnapshot, balance.UserID, balance.Currency, balance.Balance,
+			balance.Ledger, takenAt)
+		if err != nil {
+			return
+		}
+	}
+	return txn.Commit()
 }
 
-func (r *repository) InsertTransaction(direction, from, to string, amount float64, currency, txnError string) (err error) {
-	_, err = r.db.Exec(QueryInsert, direction, from, to, amount, currency, txnError)
+// GetCurrencies returns overrides of ISO 4217 currencies, see currency.NewRegistry.
+func (r *repository) GetCurrencies() ([]currency.Currency, error) {
+	rows, err := r.querier(nil).Query(QueryCurrencies)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetCurrencies", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	currencies := make([]currency.Currency, 0)
+	for rows.Next() {
+		var c currency.Currency
+		if err = rows.Scan(&c.Code, &c.Numeric, &c.Exponent, &c.Enabled); err != nil {
+			_ = level.Error(r.logger).Log("method", "GetCurrencies", "err", err)
+			return nil, err
+		}
+		currencies = append(currencies, c)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetCurrencies", "err", err)
+		return nil, err
+	}
+	return currencies, nil
+}
+
+// AppendAudit appends record to audit log, ID, Date, PrevHash and Hash of record are filled in.
+func (r *repository) AppendAudit(record *AuditRecord) (err error) {
+	txn, err := r.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+			_ = level.Error(r.logger).Log("method", "AppendAudit", "err", err)
+		}
+	}()
+	if _, err = txn.Exec(QueryAuditLock); err != nil {
+		return
+	}
+	var lastID int64
+	var lastHash string
+	err = txn.QueryRow(QueryAuditLast).Scan(&lastID, &lastHash)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+	record.Truncate()
+	record.ID = lastID + 1
+	record.Date = time.Now().UTC().Truncate(time.Microsecond) // precision of postgresql
+	record.PrevHash = lastHash
+	record.Hash = record.ComputeHash()
+	_, err = txn.Exec(QueryAuditInsert, record.ID, record.Date, record.Actor, record.Action, record.Target,
+		string(record.Before), string(record.After), record.Error, record.RequestID, record.ClientIP,
+		record.PrevHash, record.Hash)
+	if err != nil {
+		return
+	}
+	return txn.Commit()
+}
+
+// GetAuditLog returns up to limit audit log records following record with afterID.
+func (r *repository) GetAuditLog(afterID int64, limit int) ([]*AuditRecord, error) {
+	rows, err := r.querier(nil).Query(QueryAuditLog, afterID, limit)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetAuditLog", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*AuditRecord, 0)
+	for rows.Next() {
+		record := &AuditRecord{}
+		var before, after string
+		err := rows.Scan(&record.ID, &record.Date, &record.Actor, &record.Action, &record.Target, &before, &after,
+			&record.Error, &record.RequestID, &record.ClientIP, &record.PrevHash, &record.Hash)
+		if err != nil {
+			_ = level.Error(r.logger).Log("method", "GetAuditLog", "err", err)
+			return nil, err
+		}
+		record.Date = record.Date.UTC()
+		record.Before, record.After = json.RawMessage(before), json.RawMessage(after)
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetAuditLog", "err", err)
+		return nil, err
+	}
+	return records, nil
+}
+
+func (r *repository) querier(txn DBTransaction) querier {
+	if txn == nil {
+		return tracedQuerier{ctx: r.ctx, q: r.db}
+	}
+	return txn
+}
+
+// Subscribe returns subscription to balance changes and payments of wallets of holder.
+func (r *repository) Subscribe(holderID string) *activity.Subscription {
+	return r.broker.Subscribe(holderID)
+}
+
+// AppendOutbox writes event of account to outbox within txn, ID, Seq and CreatedAt
+// of event are filled in. Account is locked till the end of txn.
+func (r *repository) AppendOutbox(txn DBTransaction, event *OutboxEvent) (err error) {
+	err = txn.QueryRow(QueryAppendOutbox, event.Account, event.Type, string(event.Payload)).Scan(&event.ID,
+		&event.Seq, &event.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrAccountNotFound
+	}
+	event.CreatedAt = event.CreatedAt.UTC()
 	return
 }
+
+// GetOutbox returns up to limit events not published by relay yet in order of their writing.
+func (r *repository) GetOutbox(relay string, limit int) ([]*OutboxEvent, error) {
+	rows, err := r.querier(nil).Query(QueryOutbox, relay, limit)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetOutbox", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*OutboxEvent, 0)
+	for rows.Next() {
+		event := &OutboxEvent{}
+		var payload string
+		if err = rows.Scan(&event.ID, &event.Account, &event.Seq, &event.Type, &payload, &event.CreatedAt); err != nil {
+			_ = level.Error(r.logger).Log("method", "GetOutbox", "err", err)
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		event.CreatedAt = event.CreatedAt.UTC()
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetOutbox", "err", err)
+		return nil, err
+	}
+	return events, nil
+}
+
+// SaveOutboxOffsets marks events as published by relay, offset of account never goes back.
+func (r *repository) SaveOutboxOffsets(relay string, events []*OutboxEvent) (err error) {
+	txn, err := r.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+			_ = level.Error(r.logger).Log("method", "SaveOutboxOffsets", "err", err)
+		}
+	}()
+	for account, seq := range OutboxOffsets(events) {
+		if _, err = txn.Exec(QuerySaveOutboxOffset, relay, account, seq); err != nil {
+			return
+		}
+	}
+	return txn.Commit()
+}
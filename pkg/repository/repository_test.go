@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTransactionPageBoundaries(t *testing.T) {
+	// boundaries are compared with TIMESTAMPTZ dates, casting them to TIMESTAMP
+	// would drop their offset and shift range by it
+	for _, query := range []string{QueryTransactionPage, QueryLedgerDelta} {
+		if strings.Contains(strings.ToLower(query), "::timestamp ") {
+			t.Errorf("Boundaries should be cast to TIMESTAMPTZ: %s", query)
+		}
+	}
+
+	db := openFake(t, "history")
+	defer db.Close()
+	repo := New(db, nil, nil, log.NewNopLogger())
+	moscow := time.FixedZone("MSK", 3*60*60)
+	filter := &TransactionFilter{
+		From: time.Date(2020, 1, 1, 0, 0, 0, 0, moscow),
+		To:   time.Date(2020, 1, 2, 0, 0, 0, 0, moscow),
+	}
+	if _, err := repo.GetTransactionPage(filter, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	args := fakeDBs["history"].args
+	if len(args) != 5 {
+		t.Fatalf("Unexpected arguments %v", args)
+	}
+	from, ok := args[2].(time.Time)
+	if !ok || !from.Equal(time.Date(2019, 12, 31, 21, 0, 0, 0, time.UTC)) {
+		t.Errorf("Start of range should be 2019-12-31T21:00:00Z, got %v", args[2])
+	}
+	if _, offset := from.Zone(); offset != 3*60*60 {
+		t.Errorf("Start of range should keep its offset, got %v", from)
+	}
+	if to, ok := args[3].(time.Time); !ok || !to.Equal(filter.To) {
+		t.Errorf("End of range should be %v, got %v", filter.To, args[3])
+	}
+}
@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/lib/pq"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// States of saga
+const (
+	// SagaPending saga is written by its coordinator, other steps may be not applied yet
+	SagaPending = "pending"
+	// SagaCompleted all steps of saga are applied
+	SagaCompleted = "completed"
+	// SagaCompensated applied steps of saga are reverted, others are never applied
+	SagaCompensated = "compensated"
+)
+
+// Types of saga operations
+const (
+	// SagaOpBalance changes balance of account by Delta
+	SagaOpBalance = "balance"
+	// SagaOpAccount creates account with opening balance Delta
+	SagaOpAccount = "account"
+	// SagaOpEquity creates equity account unless it exists
+	SagaOpEquity = "equity"
+	// SagaOpPayment inserts history record
+	SagaOpPayment = "payment"
+	// SagaOpOutbox writes event of account to outbox
+	SagaOpOutbox = "outbox"
+	// SagaOpPayout writes payout of Payload
+	SagaOpPayout = "payout"
+	// SagaOpPayoutState moves payout of Payload from state From
+	SagaOpPayoutState = "payout_state"
+)
+
+// sagaUndo suffixes ID of saga in marker of reverted step.
+const sagaUndo = "/undo"
+
+var (
+	// QueryInsertSaga is a query for writing pending saga
+	QueryInsertSaga = "INSERT INTO saga(id, state, steps) VALUES ($1, $2, $3) RETURNING created_at"
+
+	// QueryInsertSagaStep is a query for marking step of saga applied, it fails if step is already marked
+	QueryInsertSagaStep = "INSERT INTO saga_step(id) VALUES ($1)"
+
+	// QueryPendingSagas is a query for fetching pending sagas created before time
+	QueryPendingSagas = "SELECT id, state, steps, error, created_at FROM saga WHERE state = 'pending' AND created_at < $1 " +
+		"ORDER BY created_at LIMIT $2"
+
+	// QueryUpdateSagaState is a query for setting state of saga
+	QueryUpdateSagaState = "UPDATE saga SET state = $2, error = $3, updated_at = now() WHERE id = $1"
+
+	// QueryFailSagaTransactions is a query for setting error of history records written by saga
+	QueryFailSagaTransactions = "UPDATE payment SET error = $2 WHERE saga_id = $1 AND error = ''"
+
+	// ErrSagaStepApplied error fired when step of saga is marked applied already
+	ErrSagaStepApplied = errs.New("saga_step_applied", "Saga step is already applied", http.StatusConflict)
+
+	// ErrCrossShard error fired when change which can not be replayed spans shards
+	ErrCrossShard = errs.New("cross_shard", "Change spans several shards", http.StatusInternalServerError)
+)
+
+// Saga is a change spanning several shards. Its coordinator shard commits its own
+// step along with saga, other shards commit their steps along with markers, so
+// every step is applied once. Pending saga is driven forward by recovery, or its
+// applied steps are reverted if one of steps can not be applied.
+type Saga struct {
+	ID    string      `json:"id"`
+	State string      `json:"state"`
+	Steps []*SagaStep `json:"steps"`
+	// Error is a reason of compensation
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SagaStep is a change of single shard, the first step of saga is its coordinator.
+type SagaStep struct {
+	Shard int       `json:"shard"`
+	Ops   []*SagaOp `json:"ops"`
+}
+
+// SagaOp is an operation of saga step, it is replayed by recovery if step is not applied.
+type SagaOp struct {
+	Type    string `json:"type"`
+	Account string `json:"account,omitempty"`
+	// Delta is a change of balance (or opening balance of created account)
+	Delta       float64 `json:"delta,omitempty"`
+	Holder      string  `json:"holder,omitempty"`
+	Currency    string  `json:"currency,omitempty"`
+	CreditLimit float64 `json:"credit_limit,omitempty"`
+	// Direction, Payer, Payee, Amount, Fee and Error describe history record
+	Direction string  `json:"direction,omitempty"`
+	Payer     string  `json:"payer,omitempty"`
+	Payee     string  `json:"payee,omitempty"`
+	Amount    float64 `json:"amount,omitempty"`
+	Fee       float64 `json:"fee,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// Event and Payload describe outbox event, Payload is a payout of payout operations
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// From is a state payout is moved from
+	From string `json:"from,omitempty"`
+}
+
+// SagaStore keeps sagas and markers of their applied steps, it is implemented by
+// shards of ShardedRepository.
+type SagaStore interface {
+	// InsertSaga writes pending saga within txn of its coordinator
+	InsertSaga(txn DBTransaction, saga *Saga) error
+	// InsertSagaStep marks step of saga applied within txn, ErrSagaStepApplied is
+	// returned if it is marked already
+	InsertSagaStep(txn DBTransaction, stepID string) error
+	// GetPendingSagas returns up to limit pending sagas created before time
+	GetPendingSagas(before time.Time, limit int) ([]*Saga, error)
+	// UpdateSagaState sets state of saga along with reason of compensation
+	UpdateSagaState(sagaID, state, reason string) error
+	// FailSagaTransactions sets error of history records written by saga within txn,
+	// pending payouts written by saga are compensated
+	FailSagaTransactions(txn DBTransaction, sagaID, reason string) error
+}
+
+// Shard is a database of ShardedRepository.
+type Shard interface {
+	Repository
+	SagaStore
+}
+
+// InsertSaga writes pending saga within txn, its CreatedAt is filled in.
+func (r *repository) InsertSaga(txn DBTransaction, saga *Saga) (err error) {
+	steps, err := json.Marshal(saga.Steps)
+	if err != nil {
+		return err
+	}
+	if err = txn.QueryRow(QueryInsertSaga, saga.ID, saga.State, string(steps)).Scan(&saga.CreatedAt); err != nil {
+		_ = level.Error(r.logger).Log("method", "InsertSaga", "saga", saga.ID, "err", err)
+		return err
+	}
+	saga.CreatedAt = saga.CreatedAt.UTC()
+	return nil
+}
+
+// InsertSagaStep marks step applied within txn, marker of step committed by
+// concurrent txn is waited for.
+func (r *repository) InsertSagaStep(txn DBTransaction, stepID string) (err error) {
+	_, err = txn.Exec(QueryInsertSagaStep, stepID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pgUniqueViolation {
+		return ErrSagaStepApplied
+	}
+	return
+}
+
+// GetPendingSagas returns up to limit pending sagas created before time, the oldest first.
+func (r *repository) GetPendingSagas(before time.Time, limit int) ([]*Saga, error) {
+	rows, err := r.querier(nil).Query(QueryPendingSagas, before, limit)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "GetPendingSagas", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sagas := make([]*Saga, 0)
+	for rows.Next() {
+		saga := &Saga{}
+		var steps string
+		if err = rows.Scan(&saga.ID, &saga.State, &steps, &saga.Error, &saga.CreatedAt); err != nil {
+			_ = level.Error(r.logger).Log("method", "GetPendingSagas", "err", err)
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(steps), &saga.Steps); err != nil {
+			_ = level.Error(r.logger).Log("method", "GetPendingSagas", "saga", saga.ID, "err", err)
+			return nil, err
+		}
+		saga.CreatedAt = saga.CreatedAt.UTC()
+		sagas = append(sagas, saga)
+	}
+	if err = rows.Err(); err != nil {
+		_ = level.Error(r.logger).Log("method", "GetPendingSagas", "err", err)
+		return nil, err
+	}
+	return sagas, nil
+}
+
+// UpdateSagaState sets state of saga.
+func (r *repository) UpdateSagaState(sagaID, state, reason string) error {
+	result, err := r.querier(nil).Exec(QueryUpdateSagaState, sagaID, state, reason)
+	if err != nil {
+		_ = level.Error(r.logger).Log("method", "UpdateSagaState", "saga", sagaID, "err", err)
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// FailSagaTransactions sets error of successful history records written by saga
+// within txn, its pending payouts are never sent then.
+func (r *repository) FailSagaTransactions(txn DBTransaction, sagaID, reason string) (err error) {
+	if _, err = txn.Exec(QueryFailSagaTransactions, sagaID, reason); err != nil {
+		return
+	}
+	_, err = txn.Exec(QueryCompensateSagaPayouts, sagaID, reason)
+	return
+}
@@ -0,0 +1,196 @@
+package repository_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+)
+
+// newShards returns sharded repository over two in-memory shards along with
+// payer kept by shard 0 and payee kept by shard 1, having 100 and 0 USD.
+func newShards(t *testing.T) (*repository.ShardedRepository, []*inmem.RepositoryInmem, string, string) {
+	stores := []*inmem.RepositoryInmem{inmem.NewInmem().(*inmem.RepositoryInmem), inmem.NewInmem().(*inmem.RepositoryInmem)}
+	repo := repository.NewSharded([]repository.Shard{stores[0], stores[1]}, log.NewNopLogger())
+	names := make([]string, 2)
+	for i := 0; names[0] == "" || names[1] == ""; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if shard := repo.ShardOf(name); names[shard] == "" {
+			names[shard] = name
+		}
+	}
+	stores[0].InsertAccount(&repository.Account{UserID: names[0], Balance: 100, Currency: "USD"})
+	stores[1].InsertAccount(&repository.Account{UserID: names[1], Currency: "USD"})
+	return repo, stores, names[0], names[1]
+}
+
+// transferSteps returns steps of saga moving amount from payer of shard 0 to payee of shard 1.
+func transferSteps(payer, payee string, amount float64) []*repository.SagaStep {
+	return []*repository.SagaStep{
+		{Shard: 0, Ops: []*repository.SagaOp{{Type: repository.SagaOpBalance, Account: payer, Delta: -amount}}},
+		{Shard: 1, Ops: []*repository.SagaOp{{Type: repository.SagaOpBalance, Account: payee, Delta: amount},
+			{Type: repository.SagaOpPayment, Direction: repository.DirectionIncoming, Payer: payer, Payee: payee,
+				Amount: amount, Currency: "USD"}}},
+	}
+}
+
+// commitCoordinator writes saga along with its coordinator step as Commit does,
+// as if instance crashed before other steps were committed.
+func commitCoordinator(t *testing.T, coordinator *inmem.RepositoryInmem, saga *repository.Saga) {
+	txn, _ := coordinator.Begin()
+	for _, op := range saga.Steps[0].Ops {
+		account, err := coordinator.GetAndLockAccount(txn, op.Account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = coordinator.UpdateBalance(txn, op.Account, account.Balance+op.Delta)
+	}
+	_ = coordinator.InsertTransaction(txn, &repository.Transaction{Direction: repository.DirectionOutgoing,
+		Payer: saga.Steps[0].Ops[0].Account, Payee: saga.Steps[1].Ops[0].Account, Amount: -saga.Steps[0].Ops[0].Delta,
+		Currency: "USD", SagaID: saga.ID})
+	_ = coordinator.InsertSaga(txn, saga)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func balance(t *testing.T, repo repository.Repository, name string) float64 {
+	account, err := repo.GetAccount(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account.Balance
+}
+
+func TestShardedCommit(t *testing.T) {
+	repo, stores, payer, payee := newShards(t)
+
+	// test change spanning shards is committed by saga of the debited shard
+	txn, err := repo.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, delta := range map[string]float64{payer: -10, payee: 10} {
+		account, err := repo.GetAndLockAccount(txn, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = repo.UpdateBalance(txn, name, account.Balance+delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, direction := range []string{repository.DirectionOutgoing, repository.DirectionIncoming} {
+		err = repo.InsertTransaction(txn, &repository.Transaction{Direction: direction, Payer: payer, Payee: payee,
+			Amount: 10, Currency: "USD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if balance(t, repo, payer) != 90 || balance(t, repo, payee) != 10 {
+		t.Errorf("Unexpected balances %v and %v", balance(t, repo, payer), balance(t, repo, payee))
+	}
+	if len(stores[0].Sagas) != 1 || stores[0].Sagas[0].State != repository.SagaCompleted || len(stores[1].Sagas) != 0 {
+		t.Fatalf("Saga should be completed by coordinator, got %+v %+v", stores[0].Sagas, stores[1].Sagas)
+	}
+	if saga := stores[0].Sagas[0]; len(saga.Steps) != 2 || saga.Steps[0].Shard != 0 || !stores[1].SagaSteps[saga.ID] {
+		t.Errorf("Step of payee should be marked applied, saga %+v, markers %v", saga, stores[1].SagaSteps)
+	}
+	if len(stores[0].Transactions) != 1 || len(stores[1].Transactions) != 1 {
+		t.Errorf("History records should be written by home shards, got %d and %d",
+			len(stores[0].Transactions), len(stores[1].Transactions))
+	}
+
+	// test raw statements are not routed to a shard
+	txn, _ = repo.Begin()
+	defer txn.Rollback()
+	if _, err = txn.Exec(repository.QueryUpdateCreditLimit, 10, payer); !errors.Is(err, repository.ErrCrossShard) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrCrossShard, err)
+	}
+	if _, err = txn.Query(repository.QueryTransaction); !errors.Is(err, repository.ErrCrossShard) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrCrossShard, err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != repository.ErrCrossShard {
+				t.Errorf("QueryRow should panic with %v, got %v", repository.ErrCrossShard, r)
+			}
+		}()
+		txn.QueryRow(repository.QueryTransaction)
+	}()
+}
+
+func TestRecoverSagas(t *testing.T) {
+	repo, stores, payer, payee := newShards(t)
+
+	// test step left by crash after coordinator commit is applied by recovery
+	commitCoordinator(t, stores[0], &repository.Saga{ID: "crashed", State: repository.SagaPending,
+		Steps: transferSteps(payer, payee, 10)})
+	if n, err := repo.RecoverSagas(time.Hour); n != 0 || err != nil {
+		t.Errorf("Recent saga should be left to its instance, recovered %d, %v", n, err)
+	}
+	if n, err := repo.RecoverSagas(-time.Second); n != 1 || err != nil {
+		t.Fatalf("Saga should be recovered, got %d, %v", n, err)
+	}
+	if balance(t, repo, payer) != 90 || balance(t, repo, payee) != 10 || stores[0].Sagas[0].State != repository.SagaCompleted {
+		t.Errorf("Saga should be completed, balances %v and %v, saga %+v", balance(t, repo, payer),
+			balance(t, repo, payee), stores[0].Sagas[0])
+	}
+	if len(stores[1].Transactions) != 1 || !stores[1].SagaSteps["crashed"] {
+		t.Errorf("Step of payee should be applied once, history %d, markers %v", len(stores[1].Transactions), stores[1].SagaSteps)
+	}
+
+	// test step committed before crash is not applied again
+	commitCoordinator(t, stores[0], &repository.Saga{ID: "applied", State: repository.SagaPending,
+		Steps: transferSteps(payer, payee, 5)})
+	stores[1].SagaSteps["applied"] = true
+	stores[1].Accounts[0].Balance += 5
+	if n, err := repo.RecoverSagas(-time.Second); n != 1 || err != nil {
+		t.Fatalf("Saga should be recovered, got %d, %v", n, err)
+	}
+	if balance(t, repo, payee) != 15 || stores[0].Sagas[1].State != repository.SagaCompleted {
+		t.Errorf("Saga should be completed without replay, balance %v, saga %+v", balance(t, repo, payee), stores[0].Sagas[1])
+	}
+	if n, err := repo.RecoverSagas(-time.Second); n != 0 || err != nil {
+		t.Errorf("Nothing should be recovered, got %d, %v", n, err)
+	}
+}
+
+func TestCompensateSaga(t *testing.T) {
+	repo, stores, payer, payee := newShards(t)
+
+	// test saga which step fails permanently is compensated
+	steps := transferSteps(payer, payee, 10)
+	steps[1].Ops[0].Account = "ghost"
+	steps[1].Shard = repo.ShardOf("ghost")
+	commitCoordinator(t, stores[0], &repository.Saga{ID: "doomed", State: repository.SagaPending, Steps: steps})
+	if balance(t, repo, payer) != 90 {
+		t.Fatalf("Coordinator step should be committed, balance %v", balance(t, repo, payer))
+	}
+	if n, err := repo.RecoverSagas(-time.Second); n != 1 || err != nil {
+		t.Fatalf("Saga should be recovered, got %d, %v", n, err)
+	}
+	saga := stores[0].Sagas[0]
+	if saga.State != repository.SagaCompensated || saga.Error != repository.ErrAccountNotFound.Error() {
+		t.Errorf("Saga should be compensated, got %+v", saga)
+	}
+	if balance(t, repo, payer) != 100 || balance(t, repo, payee) != 0 {
+		t.Errorf("Balances should be reverted, got %v and %v", balance(t, repo, payer), balance(t, repo, payee))
+	}
+	if record := stores[0].Transactions[0].(*repository.Transaction); record.Error != saga.Error {
+		t.Errorf("History record of saga should fail, got %+v", record)
+	}
+	if n := len(stores[0].Outbox); n != 1 || stores[0].Outbox[0].Type != repository.EventCompensation {
+		t.Errorf("Compensation should be written to outbox, got %+v", stores[0].Outbox)
+	}
+	if store := stores[steps[1].Shard]; !store.SagaSteps["doomed"] {
+		t.Errorf("Failed step should be fenced off, markers %v", store.SagaSteps)
+	}
+}
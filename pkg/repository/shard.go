@@ -0,0 +1,458 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/tracing"
+)
+
+// ringPoints is a number of points of every shard on hash ring.
+const ringPoints = 128
+
+// Ring maps keys to shards by consistent hashing: every shard owns points of hash
+// ring and key belongs to shard owning the first point following hash of key.
+// Shard appended to ring takes about 1/N of keys from others, the rest stay.
+type Ring struct {
+	points []uint32
+	shards map[uint32]int
+}
+
+// NewRing returns ring of shards numbered from 0.
+func NewRing(shards int) *Ring {
+	r := &Ring{shards: make(map[uint32]int)}
+	for i := 0; i < shards; i++ {
+		for j := 0; j < ringPoints; j++ {
+			point := ringHash(fmt.Sprintf("shard%d#%d", i, j))
+			if _, ok := r.shards[point]; ok { // collision, the former shard keeps point
+				continue
+			}
+			r.shards[point] = i
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Shard returns shard of key.
+func (r *Ring) Shard(key string) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i]]
+}
+
+func ringHash(key string) uint32 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// ShardedRepository is a Repository spreading accounts over shards by consistent
+// hash of account name. Account and its limits, freeze history, snapshots and
+// outbox are kept by its shard; fee schedules, currency settings and audit log
+// are kept by the first shard. History record is listed from shard of its payer
+// if it is outgoing, from shard of its payee otherwise; opening record is kept
+// by shard of its payer as well, so ledger of every shard is complete.
+//
+// IDs of history records and outbox events are local to shard, they are exposed
+// as local ID * number of shards + shard index, so they are unique and single
+// shard keeps its IDs as is.
+//
+// Changes spanning shards are committed by saga, see Commit of transaction.
+type ShardedRepository struct {
+	shards []Shard
+	ring   *Ring
+	logger log.Logger
+}
+
+// NewSharded returns repository over shards, their WithContext must return Shard.
+// The first shard keeps global settings.
+func NewSharded(shards []Shard, logger log.Logger) *ShardedRepository {
+	return &ShardedRepository{
+		shards: shards,
+		ring:   NewRing(len(shards)),
+		logger: log.With(logger, "repository", "sharded"),
+	}
+}
+
+// ShardOf returns index of shard keeping account.
+func (s *ShardedRepository) ShardOf(accountName string) int {
+	return s.ring.Shard(accountName)
+}
+
+// homeShard returns shard listing history record.
+func (s *ShardedRepository) homeShard(direction, payer, payee string) int {
+	if direction == DirectionOutgoing {
+		return s.ShardOf(payer)
+	}
+	return s.ShardOf(payee)
+}
+
+// globalID returns ID of record exposed by repository.
+func (s *ShardedRepository) globalID(localID int64, shard int) int64 {
+	return localID*int64(len(s.shards)) + int64(shard)
+}
+
+// localAfter returns local ID of shard following records up to global afterID.
+func (s *ShardedRepository) localAfter(afterID int, shard int) int {
+	if afterID < shard {
+		return 0
+	}
+	return (afterID - shard) / len(s.shards)
+}
+
+// WithContext returns repository which shards are bound to ctx.
+func (s *ShardedRepository) WithContext(ctx context.Context) Repository {
+	logger := s.logger
+	if requestID := tracing.RequestIDFromContext(ctx); requestID != "" {
+		logger = log.With(logger, "request_id", requestID)
+	}
+	shards := make([]Shard, len(s.shards))
+	for i, shard := range s.shards {
+		shards[i] = shard.WithContext(ctx).(Shard)
+	}
+	return &ShardedRepository{shards: shards, ring: s.ring, logger: logger}
+}
+
+// GetAccounts returns Accounts of all shards ordered by holder and currency.
+func (s *ShardedRepository) GetAccounts() ([]*Account, error) {
+	accounts := make([]*Account, 0)
+	for _, shard := range s.shards {
+		shardAccounts, err := shard.GetAccounts()
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, shardAccounts...)
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if accounts[i].Holder != accounts[j].Holder {
+			return accounts[i].Holder < accounts[j].Holder
+		}
+		return accounts[i].Currency < accounts[j].Currency
+	})
+	return accounts, nil
+}
+
+// GetAccount returns Account by its name.
+func (s *ShardedRepository) GetAccount(accountName string) (*Account, error) {
+	return s.shards[s.ShardOf(accountName)].GetAccount(accountName)
+}
+
+// GetWallet returns wallet of holder in currency, wallet itself is preferred.
+// Wallets of holder are spread over shards, so they are looked up on every shard.
+func (s *ShardedRepository) GetWallet(holderID, currency string) (*Account, error) {
+	if account, err := s.GetAccount(holderID); err == nil && account.Currency == currency {
+		return account, nil
+	} else if err != nil && err != ErrAccountNotFound {
+		return nil, err
+	}
+	for _, shard := range s.shards {
+		wallet, err := shard.GetWallet(holderID, currency)
+		if err == ErrAccountNotFound {
+			continue
+		}
+		return wallet, err
+	}
+	return nil, ErrAccountNotFound
+}
+
+// GetHolder returns holder with its wallets of all shards ordered by currency.
+func (s *ShardedRepository) GetHolder(holderID string) (*Holder, error) {
+	holder := &Holder{ID: holderID, Wallets: make([]*Account, 0)}
+	for _, shard := range s.shards {
+		shardHolder, err := shard.GetHolder(holderID)
+		if err == ErrAccountNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		holder.Wallets = append(holder.Wallets, shardHolder.Wallets...)
+	}
+	if len(holder.Wallets) == 0 {
+		return nil, ErrAccountNotFound
+	}
+	sort.SliceStable(holder.Wallets, func(i, j int) bool { return holder.Wallets[i].Currency < holder.Wallets[j].Currency })
+	return holder, nil
+}
+
+// GetTransactions returns Transaction history of all shards ordered by ID.
+func (s *ShardedRepository) GetTransactions() ([]interface{}, error) {
+	type entry struct {
+		id  int
+		txn interface{}
+	}
+	entries := make([]entry, 0)
+	for i, shard := range s.shards {
+		transactions, err := shard.GetTransactions()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range transactions {
+			switch t := t.(type) {
+			case *Transaction:
+				if s.homeShard(t.Direction, t.Payer, t.Payee) == i {
+					copied := *t
+					copied.TxnID = int(s.globalID(int64(t.TxnID), i))
+					entries = append(entries, entry{copied.TxnID, &copied})
+				}
+			case *TransactionIncoming:
+				if s.homeShard(t.Direction, t.Payer, t.Payee) == i {
+					copied := *t
+					copied.TxnID = int(s.globalID(int64(t.TxnID), i))
+					entries = append(entries, entry{copied.TxnID, &copied})
+				}
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	transactions := make([]interface{}, len(entries))
+	for i, e := range entries {
+		transactions[i] = e.txn
+	}
+	return transactions, nil
+}
+
+// GetTransactionPage returns up to limit transactions of all shards matching filter
+// following afterID. Every shard contributes up to limit records, records kept
+// for ledger of other shard only are skipped.
+func (s *ShardedRepository) GetTransactionPage(filter *TransactionFilter, afterID int, limit int) ([]*Transaction, error) {
+	transactions := make([]*Transaction, 0, limit)
+	for i, shard := range s.shards {
+		after, found := s.localAfter(afterID, i), 0
+		for found < limit {
+			page, err := shard.GetTransactionPage(filter, after, limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, txn := range page {
+				after = txn.TxnID
+				if s.homeShard(txn.Direction, txn.Payer, txn.Payee) != i {
+					continue
+				}
+				txn.TxnID = int(s.globalID(int64(txn.TxnID), i))
+				transactions = append(transactions, txn)
+				found++
+			}
+			if len(page) < limit {
+				break
+			}
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool { return transactions[i].TxnID < transactions[j].TxnID })
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+// GetFreezeHistory returns audit trail of freeze state changes of account.
+func (s *ShardedRepository) GetFreezeHistory(accountName string) ([]*FreezeRecord, error) {
+	return s.shards[s.ShardOf(accountName)].GetFreezeHistory(accountName)
+}
+
+// AppendAudit appends record to audit log of the first shard.
+func (s *ShardedRepository) AppendAudit(record *AuditRecord) error {
+	return s.shards[0].AppendAudit(record)
+}
+
+// GetAuditLog returns up to limit audit log records following record with afterID.
+func (s *ShardedRepository) GetAuditLog(afterID int64, limit int) ([]*AuditRecord, error) {
+	return s.shards[0].GetAuditLog(afterID, limit)
+}
+
+// GetLimits returns transfer limits of account merged with default limits of
+// currency, which are kept by the first shard.
+func (s *ShardedRepository) GetLimits(txn DBTransaction, accountName, currency string) (*Limits, error) {
+	i := s.ShardOf(accountName)
+	shardTxn, err := s.shardTxn(txn, i)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := s.shards[i].GetLimits(shardTxn, accountName, currency)
+	if err != nil || i == 0 {
+		return limits, err
+	}
+	defaults, err := s.shards[0].GetLimits(nil, "", currency)
+	if err != nil {
+		return nil, err
+	}
+	return limits.Merge(defaults), nil
+}
+
+// GetLimitUsage returns outgoing totals of account for current day, month and last hour.
+func (s *ShardedRepository) GetLimitUsage(txn DBTransaction, accountName string) (*LimitUsage, error) {
+	i := s.ShardOf(accountName)
+	shardTxn, err := s.shardTxn(txn, i)
+	if err != nil {
+		return nil, err
+	}
+	return s.shards[i].GetLimitUsage(shardTxn, accountName)
+}
+
+// SetLimits sets transfer limits of account, or default limits of currency if UserID is empty.
+func (s *ShardedRepository) SetLimits(limits *Limits) error {
+	if limits.UserID == "" {
+		return s.shards[0].SetLimits(limits)
+	}
+	return s.shards[s.ShardOf(limits.UserID)].SetLimits(limits)
+}
+
+// GetFeeSchedule returns fee schedule of currency kept by the first shard, it is
+// read outside of txn.
+func (s *ShardedRepository) GetFeeSchedule(txn DBTransaction, currency string) (*FeeSchedule, error) {
+	return s.shards[0].GetFeeSchedule(nil, currency)
+}
+
+// SetFeeSchedule replaces fee schedule of currency together with its tiers.
+func (s *ShardedRepository) SetFeeSchedule(schedule *FeeSchedule) error {
+	return s.shards[0].SetFeeSchedule(schedule)
+}
+
+// GetLedgerBalances returns stored and recomputed balances of accounts of all
+// shards. Shards are read one by one, so every balance carries time it is taken
+// at, snapshot is taken at time of the last shard.
+func (s *ShardedRepository) GetLedgerBalances() (*LedgerSnapshot, error) {
+	snapshot := &LedgerSnapshot{Balances: make([]*LedgerBalance, 0)}
+	for _, shard := range s.shards {
+		shardSnapshot, err := shard.GetLedgerBalances()
+		if err != nil {
+			return nil, err
+		}
+		for _, balance := range shardSnapshot.Balances {
+			balance.TakenAt = shardSnapshot.TakenAt
+		}
+		snapshot.TakenAt = shardSnapshot.TakenAt
+		snapshot.Balances = append(snapshot.Balances, shardSnapshot.Balances...)
+	}
+	sort.Slice(snapshot.Balances, func(i, j int) bool { return snapshot.Balances[i].UserID < snapshot.Balances[j].UserID })
+	return snapshot, nil
+}
+
+// SaveBalanceSnapshot saves balances of snapshot to shards of their accounts.
+func (s *ShardedRepository) SaveBalanceSnapshot(snapshot *LedgerSnapshot) error {
+	balances := make([][]*LedgerBalance, len(s.shards))
+	for _, balance := range snapshot.Balances {
+		i := s.ShardOf(balance.UserID)
+		balances[i] = append(balances[i], balance)
+	}
+	for i, shard := range s.shards {
+		if len(balances[i]) == 0 {
+			continue
+		}
+		if err := shard.SaveBalanceSnapshot(&LedgerSnapshot{TakenAt: snapshot.TakenAt, Balances: balances[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBalanceAt returns balance of account at time.
+func (s *ShardedRepository) GetBalanceAt(accountName string, at time.Time) (*BalanceAt, error) {
+	return s.shards[s.ShardOf(accountName)].GetBalanceAt(accountName, at)
+}
+
+// GetCurrencies returns overrides of ISO 4217 currencies kept by the first shard.
+func (s *ShardedRepository) GetCurrencies() ([]currency.Currency, error) {
+	return s.shards[0].GetCurrencies()
+}
+
+// Subscribe returns subscription to balance changes and payments of wallets of
+// holder, broker of the first shard must be fed by listeners of all shards.
+func (s *ShardedRepository) Subscribe(holderID string) *activity.Subscription {
+	return s.shards[0].Subscribe(holderID)
+}
+
+// GetOutbox returns up to limit events of all shards not published by relay yet.
+// Shards are taken in turn, so events of every account keep their order.
+func (s *ShardedRepository) GetOutbox(relay string, limit int) ([]*OutboxEvent, error) {
+	pending := make([][]*OutboxEvent, len(s.shards))
+	for i, shard := range s.shards {
+		events, err := shard.GetOutbox(relay, limit)
+		if err != nil {
+			return nil, err
+		}
+		pending[i] = events
+	}
+	events := make([]*OutboxEvent, 0, limit)
+	for len(events) < limit {
+		taken := false
+		for i := range pending {
+			if len(pending[i]) == 0 || len(events) == limit {
+				continue
+			}
+			event := *pending[i][0]
+			event.ID = s.globalID(event.ID, i)
+			events, pending[i], taken = append(events, &event), pending[i][1:], true
+		}
+		if !taken {
+			break
+		}
+	}
+	return events, nil
+}
+
+// SaveOutboxOffsets marks events as published by relay on shards of their accounts.
+func (s *ShardedRepository) SaveOutboxOffsets(relay string, events []*OutboxEvent) error {
+	published := make([][]*OutboxEvent, len(s.shards))
+	for _, event := range events {
+		i := s.ShardOf(event.Account)
+		published[i] = append(published[i], event)
+	}
+	for i, shard := range s.shards {
+		if len(published[i]) == 0 {
+			continue
+		}
+		if err := shard.SaveOutboxOffsets(relay, published[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPayout returns payout of the first shard by ID.
+func (s *ShardedRepository) GetPayout(id int64) (*Payout, error) {
+	return s.shards[0].GetPayout(id)
+}
+
+// GetDuePayouts returns up to limit unfinished payouts of the first shard which
+// next attempt is due. Payouts written by pending sagas are skipped, as they may
+// be compensated yet.
+func (s *ShardedRepository) GetDuePayouts(limit int) ([]*Payout, error) {
+	payouts, err := s.shards[0].GetDuePayouts(limit)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]bool)
+	for _, shard := range s.shards {
+		sagas, err := shard.GetPendingSagas(time.Now(), math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		for _, saga := range sagas {
+			pending[saga.ID] = true
+		}
+	}
+	due := payouts[:0]
+	for _, payout := range payouts {
+		if payout.SagaID == "" || !pending[payout.SagaID] {
+			due = append(due, payout)
+		}
+	}
+	return due, nil
+}
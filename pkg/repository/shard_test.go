@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring, grown := NewRing(3), NewRing(4)
+	counts := make([]int, 3)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user%d", i)
+		shard := ring.Shard(key)
+		counts[shard]++
+		if after := grown.Shard(key); after != shard {
+			if after != 3 {
+				t.Fatalf("Key %s should move to new shard only, moved from %d to %d", key, shard, after)
+			}
+			moved++
+		}
+	}
+	for shard, count := range counts {
+		if count < 2500 || count > 4200 {
+			t.Errorf("Shard %d has unbalanced number of keys %d", shard, count)
+		}
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("About quarter of keys should move to new shard, moved %d", moved)
+	}
+	if NewRing(1).Shard("alice456") != 0 || NewRing(0).Shard("alice456") != 0 {
+		t.Error("Single shard should keep all keys")
+	}
+
+	repo := &ShardedRepository{shards: make([]Shard, 3)}
+	for afterID := 0; afterID < 12; afterID++ {
+		for shard := 0; shard < 3; shard++ {
+			local := repo.localAfter(afterID, shard) // local IDs start from 1
+			if local > 0 && repo.globalID(int64(local), shard) > int64(afterID) ||
+				repo.globalID(int64(local+1), shard) <= int64(afterID) {
+				t.Errorf("Local ID %d of shard %d does not follow %d", local, shard, afterID)
+			}
+		}
+	}
+}
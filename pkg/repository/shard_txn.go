@@ -0,0 +1,602 @@
+package repository
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/lib/pq"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// pgCheckViolation is a postgresql error code of violated check constraint.
+const pgCheckViolation = "23514"
+
+// sagaBatch limits sagas recovered from shard at once.
+const sagaBatch = 100
+
+// EventCompensation is written to outbox for every account which balance is
+// reverted by compensation of saga.
+const EventCompensation = "compensation"
+
+// shardedTransaction is a transaction of ShardedRepository, transactions of shards
+// are begun once they are touched. Changes are recorded by shards as steps of
+// saga, which is written only if changes span several shards.
+type shardedTransaction struct {
+	repo     *ShardedRepository
+	sagaID   string
+	txns     map[int]DBTransaction
+	steps    map[int]*SagaStep
+	balances map[string]float64 // balances of accounts locked within txn
+	local    bool               // there are changes which are not replayed by saga
+}
+
+// Begin starts transaction spanning shards.
+func (s *ShardedRepository) Begin() (DBTransaction, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &shardedTransaction{
+		repo:     s,
+		sagaID:   hex.EncodeToString(id),
+		txns:     make(map[int]DBTransaction),
+		steps:    make(map[int]*SagaStep),
+		balances: make(map[string]float64),
+	}, nil
+}
+
+// shardTxn returns transaction of shard within txn, nil if txn is nil.
+func (s *ShardedRepository) shardTxn(txn DBTransaction, shard int) (DBTransaction, error) {
+	if txn == nil {
+		return nil, nil
+	}
+	return txn.(*shardedTransaction).begin(shard)
+}
+
+func (st *shardedTransaction) begin(shard int) (DBTransaction, error) {
+	if txn, ok := st.txns[shard]; ok {
+		return txn, nil
+	}
+	txn, err := st.repo.shards[shard].Begin()
+	if err != nil {
+		return nil, err
+	}
+	st.txns[shard] = txn
+	return txn, nil
+}
+
+// record appends op to step of shard, nil op marks shard changed only.
+func (st *shardedTransaction) record(shard int, op *SagaOp) {
+	step, ok := st.steps[shard]
+	if !ok {
+		step = &SagaStep{Shard: shard, Ops: make([]*SagaOp, 0)}
+		st.steps[shard] = step
+	}
+	if op != nil {
+		step.Ops = append(step.Ops, op)
+	}
+}
+
+// Rollback rolls back transactions of all shards.
+func (st *shardedTransaction) Rollback() (err error) {
+	for shard, txn := range st.txns {
+		if e := txn.Rollback(); e != nil {
+			err = e
+		}
+		delete(st.txns, shard)
+	}
+	return
+}
+
+// Commit commits transactions of shards. Change of single shard is committed by
+// its transaction. Change spanning shards is committed by saga: its coordinator
+// is the most debited shard, it commits its step along with pending saga, then
+// other shards commit their steps along with markers. Once coordinator is
+// committed the change is committed: step failed to commit is replayed at once
+// or later by recovery, see RecoverSagas.
+func (st *shardedTransaction) Commit() error {
+	defer st.Rollback() // shards which are read only
+	steps := make([]*SagaStep, 0, len(st.steps))
+	for _, step := range st.steps {
+		steps = append(steps, step)
+	}
+	switch len(steps) {
+	case 0:
+		return nil
+	case 1:
+		txn := st.txns[steps[0].Shard]
+		delete(st.txns, steps[0].Shard)
+		return txn.Commit()
+	}
+	if st.local {
+		return ErrCrossShard
+	}
+
+	sort.Slice(steps, func(i, j int) bool {
+		if di, dj := steps[i].debit(), steps[j].debit(); di != dj {
+			return di < dj
+		}
+		return steps[i].Shard < steps[j].Shard
+	})
+	repo, coordinator := st.repo, steps[0].Shard
+	saga := &Saga{ID: st.sagaID, State: SagaPending, Steps: steps}
+	txn := st.txns[coordinator]
+	if err := repo.shards[coordinator].InsertSaga(txn, saga); err != nil {
+		return err
+	}
+	delete(st.txns, coordinator)
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	completed := true
+	for _, step := range steps[1:] {
+		txn := st.txns[step.Shard]
+		delete(st.txns, step.Shard)
+		err := repo.shards[step.Shard].InsertSagaStep(txn, saga.ID)
+		if err == nil {
+			err = txn.Commit()
+		} else {
+			_ = txn.Rollback()
+		}
+		if err != nil && err != ErrSagaStepApplied {
+			// locks are released, so step is replayed on its own
+			err = repo.applyStep(saga.ID, step)
+		}
+		if err != nil {
+			completed = false
+			_ = level.Warn(repo.logger).Log("saga", saga.ID, "shard", step.Shard, "msg", "step is left to recovery", "err", err)
+		}
+	}
+	if completed {
+		if err := repo.shards[coordinator].UpdateSagaState(saga.ID, SagaCompleted, ""); err != nil {
+			_ = level.Warn(repo.logger).Log("saga", saga.ID, "msg", "saga is left to recovery", "err", err)
+		}
+	}
+	return nil
+}
+
+// debit returns total change of balances by step, it is negative for debited shard.
+func (step *SagaStep) debit() float64 {
+	var total float64
+	for _, op := range step.Ops {
+		if op.Type == SagaOpBalance || op.Type == SagaOpAccount {
+			total += op.Delta
+		}
+	}
+	return total
+}
+
+// QueryRow can't run raw statement, as it isn't known which shard it belongs to,
+// so it panics with ErrCrossShard. Statements run by methods of repository only.
+func (st *shardedTransaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	panic(ErrCrossShard)
+}
+
+// Query fails with ErrCrossShard, see QueryRow.
+func (st *shardedTransaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, ErrCrossShard
+}
+
+// Exec fails with ErrCrossShard, see QueryRow.
+func (st *shardedTransaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrCrossShard
+}
+
+// GetAndLockAccount locks account on its shard till the end of txn and returns it.
+func (s *ShardedRepository) GetAndLockAccount(txn DBTransaction, accountName string) (*Account, error) {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(accountName)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return nil, err
+	}
+	account, err := s.shards[i].GetAndLockAccount(shardTxn, accountName)
+	if err != nil {
+		return nil, err
+	}
+	st.balances[accountName] = account.Balance
+	return account, nil
+}
+
+// UpdateBalance sets balance of account, the change is recorded as delta from
+// balance it is locked with.
+func (s *ShardedRepository) UpdateBalance(txn DBTransaction, accountName string, balance float64) error {
+	st := txn.(*shardedTransaction)
+	locked, ok := st.balances[accountName]
+	if !ok {
+		account, err := s.GetAndLockAccount(txn, accountName)
+		if err != nil {
+			return err
+		}
+		locked = account.Balance
+	}
+	i := s.ShardOf(accountName)
+	if err := s.shards[i].UpdateBalance(st.txns[i], accountName, balance); err != nil {
+		return err
+	}
+	st.balances[accountName] = balance
+	st.record(i, &SagaOp{Type: SagaOpBalance, Account: accountName, Delta: balance - locked})
+	return nil
+}
+
+// CreateAccount creates account on its shard within txn.
+func (s *ShardedRepository) CreateAccount(txn DBTransaction, account *Account) error {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(account.UserID)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return err
+	}
+	if err = s.shards[i].CreateAccount(shardTxn, account); err != nil {
+		return err
+	}
+	st.balances[account.UserID] = account.Balance
+	st.record(i, &SagaOp{Type: SagaOpAccount, Account: account.UserID, Delta: account.Balance, Holder: account.Holder,
+		Currency: account.Currency, CreditLimit: account.CreditLimit})
+	return nil
+}
+
+// CreateEquityAccount creates equity account on its shard within txn unless it exists.
+func (s *ShardedRepository) CreateEquityAccount(txn DBTransaction, holderID, accountName, currency string) error {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(accountName)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return err
+	}
+	if err = s.shards[i].CreateEquityAccount(shardTxn, holderID, accountName, currency); err != nil {
+		return err
+	}
+	st.record(i, &SagaOp{Type: SagaOpEquity, Account: accountName, Holder: holderID, Currency: currency})
+	return nil
+}
+
+// UpdateCreditLimit sets credit limit of account, it may not be combined with
+// changes of other shards.
+func (s *ShardedRepository) UpdateCreditLimit(txn DBTransaction, accountName string, creditLimit float64) error {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(accountName)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return err
+	}
+	st.local = true
+	st.record(i, nil)
+	return s.shards[i].UpdateCreditLimit(shardTxn, accountName, creditLimit)
+}
+
+// UpdateFreeze sets freeze state of account, it may not be combined with changes
+// of other shards.
+func (s *ShardedRepository) UpdateFreeze(txn DBTransaction, record *FreezeRecord) error {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(record.UserID)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return err
+	}
+	st.local = true
+	st.record(i, nil)
+	return s.shards[i].UpdateFreeze(shardTxn, record)
+}
+
+// InsertTransaction inserts record into history of its shard within txn, or
+// directly if txn is nil. Opening record is inserted into history of shard of
+// its payer as well. TxnID of record is filled in with ID of record listed.
+func (s *ShardedRepository) InsertTransaction(txn DBTransaction, record *Transaction) error {
+	shards := []int{s.homeShard(record.Direction, record.Payer, record.Payee)}
+	if record.Direction == DirectionOpening {
+		if i := s.ShardOf(record.Payer); i != shards[0] {
+			shards = append(shards, i)
+		}
+	}
+	var id int64
+	for n, i := range shards {
+		written := *record
+		if txn == nil {
+			if err := s.shards[i].InsertTransaction(nil, &written); err != nil {
+				return err
+			}
+		} else {
+			st := txn.(*shardedTransaction)
+			shardTxn, err := st.begin(i)
+			if err != nil {
+				return err
+			}
+			written.SagaID = st.sagaID
+			if err = s.shards[i].InsertTransaction(shardTxn, &written); err != nil {
+				return err
+			}
+			st.record(i, &SagaOp{Type: SagaOpPayment, Direction: record.Direction,
+				Payer: record.Payer, Payee: record.Payee, Amount: record.Amount, Fee: record.Fee,
+				Currency: record.Currency, Error: record.Error})
+		}
+		if n == 0 {
+			id = s.globalID(int64(written.TxnID), i)
+		}
+	}
+	record.TxnID = int(id)
+	return nil
+}
+
+// AppendOutbox writes event of account to outbox of its shard within txn.
+func (s *ShardedRepository) AppendOutbox(txn DBTransaction, event *OutboxEvent) error {
+	st := txn.(*shardedTransaction)
+	i := s.ShardOf(event.Account)
+	shardTxn, err := st.begin(i)
+	if err != nil {
+		return err
+	}
+	if err = s.shards[i].AppendOutbox(shardTxn, event); err != nil {
+		return err
+	}
+	event.ID = s.globalID(event.ID, i)
+	st.record(i, &SagaOp{Type: SagaOpOutbox, Account: event.Account, Event: event.Type, Payload: event.Payload})
+	return nil
+}
+
+// InsertPayout writes payout to the first shard within txn.
+func (s *ShardedRepository) InsertPayout(txn DBTransaction, payout *Payout) error {
+	st := txn.(*shardedTransaction)
+	shardTxn, err := st.begin(0)
+	if err != nil {
+		return err
+	}
+	written := *payout
+	written.SagaID = st.sagaID
+	if err = s.shards[0].InsertPayout(shardTxn, &written); err != nil {
+		return err
+	}
+	payout.CreatedAt, payout.UpdatedAt, payout.NextAttemptAt = written.CreatedAt, written.UpdatedAt, written.NextAttemptAt
+	payload, err := json.Marshal(&written)
+	if err != nil {
+		return err
+	}
+	st.record(0, &SagaOp{Type: SagaOpPayout, Payload: payload})
+	return nil
+}
+
+// UpdatePayout moves payout of the first shard from state within txn, or directly
+// if txn is nil.
+func (s *ShardedRepository) UpdatePayout(txn DBTransaction, payout *Payout, from string) error {
+	if txn == nil {
+		return s.shards[0].UpdatePayout(nil, payout, from)
+	}
+	st := txn.(*shardedTransaction)
+	shardTxn, err := st.begin(0)
+	if err != nil {
+		return err
+	}
+	if err = s.shards[0].UpdatePayout(shardTxn, payout, from); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(payout)
+	if err != nil {
+		return err
+	}
+	st.record(0, &SagaOp{Type: SagaOpPayoutState, From: from, Payload: payload})
+	return nil
+}
+
+// applyStep replays step of saga within new transaction of its shard unless the
+// step is applied already.
+func (s *ShardedRepository) applyStep(sagaID string, step *SagaStep) (err error) {
+	shard := s.shards[step.Shard]
+	txn, err := shard.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	if err = shard.InsertSagaStep(txn, sagaID); err != nil {
+		if err == ErrSagaStepApplied {
+			_ = txn.Rollback()
+			return nil
+		}
+		return err
+	}
+	for _, op := range step.Ops {
+		if err = replaySagaOp(shard, txn, sagaID, op); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func replaySagaOp(shard Shard, txn DBTransaction, sagaID string, op *SagaOp) error {
+	switch op.Type {
+	case SagaOpBalance:
+		account, err := shard.GetAndLockAccount(txn, op.Account)
+		if err != nil {
+			return err
+		}
+		return shard.UpdateBalance(txn, op.Account, currency.Round(account.Balance+op.Delta, account.Currency))
+	case SagaOpAccount:
+		return shard.CreateAccount(txn, &Account{UserID: op.Account, Holder: op.Holder, Balance: op.Delta,
+			Currency: op.Currency, CreditLimit: op.CreditLimit})
+	case SagaOpEquity:
+		return shard.CreateEquityAccount(txn, op.Holder, op.Account, op.Currency)
+	case SagaOpPayment:
+		return shard.InsertTransaction(txn, &Transaction{Direction: op.Direction, Payer: op.Payer, Payee: op.Payee,
+			Amount: op.Amount, Fee: op.Fee, Currency: op.Currency, Error: op.Error, SagaID: sagaID})
+	case SagaOpOutbox:
+		return shard.AppendOutbox(txn, &OutboxEvent{Account: op.Account, Type: op.Event, Payload: op.Payload})
+	case SagaOpPayout, SagaOpPayoutState:
+		payout := &Payout{}
+		if err := json.Unmarshal(op.Payload, payout); err != nil {
+			return err
+		}
+		if op.Type == SagaOpPayoutState {
+			return shard.UpdatePayout(txn, payout, op.From)
+		}
+		payout.SagaID = sagaID
+		return shard.InsertPayout(txn, payout)
+	}
+	return fmt.Errorf("unknown saga operation %q", op.Type)
+}
+
+// RecoverSagas drives pending sagas created more than age ago forward. Saga which
+// step can not be applied (f.e. its account does not exist) is compensated: its
+// applied steps are reverted and the rest are fenced off. Sagas failed for other
+// reasons are retried by the next call. It returns number of finished sagas.
+func (s *ShardedRepository) RecoverSagas(age time.Duration) (int, error) {
+	finished := 0
+	for i, shard := range s.shards {
+		sagas, err := shard.GetPendingSagas(time.Now().Add(-age), sagaBatch)
+		if err != nil {
+			return finished, err
+		}
+		for _, saga := range sagas {
+			state, err := s.recoverSaga(shard, saga)
+			if err != nil {
+				_ = level.Warn(s.logger).Log("saga", saga.ID, "shard", i, "msg", "recovery failed", "err", err)
+				continue
+			}
+			_ = level.Info(s.logger).Log("saga", saga.ID, "shard", i, "state", state, "err", saga.Error)
+			finished++
+		}
+	}
+	return finished, nil
+}
+
+func (s *ShardedRepository) recoverSaga(coordinator Shard, saga *Saga) (string, error) {
+	for _, step := range saga.Steps[1:] {
+		err := s.applyStep(saga.ID, step)
+		if err == nil {
+			continue
+		}
+		if !permanentSagaError(err) {
+			return "", err
+		}
+		saga.Error = err.Error()
+		if err = s.compensate(saga); err != nil {
+			return "", err
+		}
+		return SagaCompensated, coordinator.UpdateSagaState(saga.ID, SagaCompensated, saga.Error)
+	}
+	return SagaCompleted, coordinator.UpdateSagaState(saga.ID, SagaCompleted, "")
+}
+
+// permanentSagaError reports whether replay of step fails with err again.
+func permanentSagaError(err error) bool {
+	if _, ok := err.(*errs.Error); ok || err == sql.ErrNoRows {
+		return true
+	}
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == pgCheckViolation || pqErr.Code == pgUniqueViolation || pqErr.Code == pgForeignKeyViolation)
+}
+
+// compensate reverts applied steps of saga in reverse order, step which is not
+// applied is marked so, so it is never applied afterwards.
+func (s *ShardedRepository) compensate(saga *Saga) error {
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := saga.Steps[i]
+		if i > 0 { // coordinator step is committed along with saga
+			err := s.fenceStep(saga.ID, step)
+			if err == nil {
+				continue
+			}
+			if err != ErrSagaStepApplied {
+				return err
+			}
+		}
+		if err := s.revertStep(saga, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fenceStep marks step of saga applied without applying it, ErrSagaStepApplied is
+// returned if it is applied already.
+func (s *ShardedRepository) fenceStep(sagaID string, step *SagaStep) error {
+	shard := s.shards[step.Shard]
+	txn, err := shard.Begin()
+	if err != nil {
+		return err
+	}
+	if err = shard.InsertSagaStep(txn, sagaID); err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// revertStep fails history records of applied step and reverts balances it has
+// changed, every reverted balance is written to outbox.
+func (s *ShardedRepository) revertStep(saga *Saga, step *SagaStep) (err error) {
+	shard := s.shards[step.Shard]
+	txn, err := shard.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	if err = shard.InsertSagaStep(txn, saga.ID+sagaUndo); err != nil {
+		if err == ErrSagaStepApplied { // reverted already
+			_ = txn.Rollback()
+			return nil
+		}
+		return err
+	}
+	if err = shard.FailSagaTransactions(txn, saga.ID, saga.Error); err != nil {
+		return err
+	}
+	for _, op := range step.Ops {
+		if op.Delta == 0 || op.Type != SagaOpBalance && op.Type != SagaOpAccount {
+			continue
+		}
+		account, err := shard.GetAndLockAccount(txn, op.Account)
+		if err != nil {
+			return err
+		}
+		balance := currency.Round(account.Balance-op.Delta, account.Currency)
+		if err = shard.UpdateBalance(txn, op.Account, balance); err != nil {
+			return err
+		}
+		event, err := NewOutboxEvent(op.Account, EventCompensation, &BalanceChange{
+			Direction: EventCompensation,
+			Payee:     op.Account,
+			Amount:    -op.Delta,
+			Currency:  account.Currency,
+			Balance:   balance,
+		})
+		if err != nil {
+			return err
+		}
+		if err = shard.AppendOutbox(txn, event); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// RunRecovery recovers sagas pending longer than age every interval until stop is closed.
+func (s *ShardedRepository) RunRecovery(interval, age time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.RecoverSagas(age); err != nil {
+				_ = level.Error(s.logger).Log("method", "RecoverSagas", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
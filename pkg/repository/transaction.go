@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"io"
 	"time"
 )
 
@@ -12,10 +13,15 @@ type Transaction struct {
 	Payer     string    `json:"account"`
 	Payee     string    `json:"to_account"`
 	Amount    float64   `json:"amount"`
+	Fee       float64   `json:"fee"`
 	Currency  string    `json:"-"`
 	Error     string    `json:"error"`
+	Breakdown *Fee      `json:"fee_breakdown,omitempty"`
+	// SagaID is an ID of saga which wrote record, if any
+	SagaID string `json:"-"`
 }
 
+// TransactionIncoming represents incoming transaction history record of payment system.
 type TransactionIncoming struct {
 	TxnID     int       `json:"-"`
 	Direction string    `json:"direction"`
@@ -23,6 +29,70 @@ type TransactionIncoming struct {
 	Payer     string    `json:"from_account"`
 	Payee     string    `json:"account"`
 	Amount    float64   `json:"amount"`
+	Fee       float64   `json:"fee"`
 	Currency  string    `json:"-"`
 	Error     string    `json:"error"`
+	SagaID    string    `json:"-"`
+}
+
+// TransactionFilter selects transactions of history, zero fields match any.
+type TransactionFilter struct {
+	// Account is a payer or payee of transaction
+	Account string
+	// From is an inclusive start of date range
+	From time.Time
+	// To is an exclusive end of date range
+	To time.Time
+}
+
+// TransactionCursor iterates over transaction history.
+type TransactionCursor interface {
+	// Next returns next transaction, io.EOF after the last one.
+	Next() (*Transaction, error)
+	// Close releases cursor.
+	Close() error
+}
+
+// NewTransactionCursor returns cursor over transactions of repository matching filter.
+// Transactions are fetched by pages of pageSize, so history of any size is iterated
+// with bounded memory.
+func NewTransactionCursor(repository Repository, filter *TransactionFilter, pageSize int) TransactionCursor {
+	if filter == nil {
+		filter = &TransactionFilter{}
+	}
+	return &pagedTransactionCursor{
+		repository: repository,
+		filter:     filter,
+		pageSize:   pageSize,
+	}
+}
+
+type pagedTransactionCursor struct {
+	repository Repository
+	filter     *TransactionFilter
+	pageSize   int
+	page       []*Transaction
+	lastID     int
+	done       bool
+}
+
+func (c *pagedTransactionCursor) Next() (*Transaction, error) {
+	if len(c.page) == 0 && !c.done {
+		page, err := c.repository.GetTransactionPage(c.filter, c.lastID, c.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		c.page, c.done = page, len(page) < c.pageSize
+	}
+	if len(c.page) == 0 {
+		return nil, io.EOF
+	}
+	txn := c.page[0]
+	c.page, c.lastID = c.page[1:], txn.TxnID
+	return txn, nil
+}
+
+func (c *pagedTransactionCursor) Close() error {
+	c.page, c.done = nil, true
+	return nil
 }
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+)
+
+// Activity implements Service. Principal of request is a holder whose
+// wallets are watched, current balances of wallets are delivered first.
+// Principal must be authenticated, claimed one may not watch others' wallets.
+func (ps paymentService) Activity(ctx context.Context) (*activity.Subscription, error) {
+	holderID := PrincipalFromContext(ctx)
+	if holderID == AnonymousPrincipal {
+		return nil, ErrPrincipalRequired
+	}
+	if !PrincipalAuthenticated(ctx) {
+		return nil, ErrPrincipalUnverified
+	}
+	ps = ps.withContext(ctx)
+	// subscribe before reading balances, so changes made meanwhile aren't missed
+	subscription := ps.repository.Subscribe(holderID)
+	holder, err := ps.repository.GetHolder(holderID)
+	if err != nil {
+		subscription.Close()
+		return nil, err
+	}
+	for _, wallet := range holder.Wallets {
+		subscription.Snapshot = append(subscription.Snapshot, &activity.Event{
+			Type:    activity.TypeBalance,
+			Holders: []string{holder.ID},
+			Balance: &activity.Balance{Account: wallet.UserID, Holder: holder.ID, Currency: wallet.Currency, Balance: wallet.Balance},
+		})
+	}
+	return subscription, nil
+}
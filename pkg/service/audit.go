@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	kitexpvar "github.com/go-kit/kit/metrics/expvar"
+
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/tracing"
+)
+
+// Audit log actions
+const (
+	AuditTransfer       = "transfer"
+	AuditSetLimits      = "set_limits"
+	AuditSetFeeSchedule = "set_fee_schedule"
+	AuditSetCreditLimit = "set_credit_limit"
+	AuditFreeze         = "freeze"
+	AuditImportAccounts = "import_accounts"
+	AuditPayout         = "payout"
+)
+
+// auditFailures counts operations, which are done but not recorded in audit log.
+var auditFailures = kitexpvar.NewCounter("audit_failures")
+
+// AuditMiddleware takes a repository as a dependency and returns a service Middleware,
+// which appends record with before/after snapshots to audit log for every mutating
+// operation, both successful and failed. Snapshots are taken outside of operation's
+// DB transaction, so they show state as it was seen right before and after it.
+func AuditMiddleware(repository repository.Repository, logger log.Logger) Middleware {
+	return func(next Service) Service {
+		return auditMiddleware{
+			Service:    next,
+			repository: repository,
+			logger:     logger,
+		}
+	}
+}
+
+// auditMiddleware passes read-only methods to the embedded Service as is.
+// Every new mutating method of Service must be overridden here.
+type auditMiddleware struct {
+	Service
+	repository repository.Repository
+	logger     log.Logger
+}
+
+func (mw auditMiddleware) Transfer(ctx context.Context, from, to string, amount float64, currency string) (txnOut *repository.Transaction, err error) {
+	before := snapshot(mw.accounts(ctx, from, to))
+	defer func() {
+		after := snapshot(map[string]interface{}{
+			"accounts":    mw.accounts(ctx, from, to),
+			"transaction": txnOut,
+		})
+		mw.record(ctx, AuditTransfer, from, before, after, &err)
+	}()
+	return mw.Service.Transfer(ctx, from, to, amount, currency)
+}
+
+func (mw auditMiddleware) SetLimits(ctx context.Context, limits *repository.Limits) (err error) {
+	if limits == nil {
+		return mw.Service.SetLimits(ctx, limits)
+	}
+	target := limits.UserID
+	if target == "" {
+		target = limits.Currency
+	}
+	before := snapshot(mw.limits(ctx, limits))
+	defer func() {
+		mw.record(ctx, AuditSetLimits, target, before, snapshot(mw.limits(ctx, limits)), &err)
+	}()
+	return mw.Service.SetLimits(ctx, limits)
+}
+
+func (mw auditMiddleware) SetFeeSchedule(ctx context.Context, schedule *repository.FeeSchedule) (err error) {
+	if schedule == nil {
+		return mw.Service.SetFeeSchedule(ctx, schedule)
+	}
+	before := snapshot(mw.feeSchedule(ctx, schedule.Currency))
+	defer func() {
+		mw.record(ctx, AuditSetFeeSchedule, schedule.Currency, before, snapshot(mw.feeSchedule(ctx, schedule.Currency)), &err)
+	}()
+	return mw.Service.SetFeeSchedule(ctx, schedule)
+}
+
+func (mw auditMiddleware) SetCreditLimit(ctx context.Context, userID string, creditLimit float64) (err error) {
+	before := snapshot(mw.accounts(ctx, userID))
+	defer func() {
+		mw.record(ctx, AuditSetCreditLimit, userID, before, snapshot(mw.accounts(ctx, userID)), &err)
+	}()
+	return mw.Service.SetCreditLimit(ctx, userID, creditLimit)
+}
+
+func (mw auditMiddleware) Freeze(ctx context.Context, userID, state, reason, comment string) (err error) {
+	before := snapshot(mw.accounts(ctx, userID))
+	defer func() {
+		mw.record(ctx, AuditFreeze, userID, before, snapshot(mw.accounts(ctx, userID)), &err)
+	}()
+	return mw.Service.Freeze(ctx, userID, state, reason, comment)
+}
+
+// ImportAccounts is recorded once per import, report shows outcome of every row.
+func (mw auditMiddleware) ImportAccounts(ctx context.Context, rows []*repository.AccountImport, options *repository.ImportOptions) (report *repository.ImportReport, err error) {
+	defer func() {
+		mw.record(ctx, AuditImportAccounts, "accounts", nil, snapshot(report), &err)
+	}()
+	return mw.Service.ImportAccounts(ctx, rows, options)
+}
+
+func (mw auditMiddleware) Payout(ctx context.Context, from, bankAccount string, amount float64, currency string) (payout *repository.Payout, err error) {
+	before := snapshot(mw.accounts(ctx, from))
+	defer func() {
+		after := snapshot(map[string]interface{}{
+			"accounts": mw.accounts(ctx, from),
+			"payout":   payout,
+		})
+		mw.record(ctx, AuditPayout, from, before, after, &err)
+	}()
+	return mw.Service.Payout(ctx, from, bankAccount, amount, currency)
+}
+
+// accounts returns existing accounts by name.
+func (mw auditMiddleware) accounts(ctx context.Context, names ...string) map[string]*repository.Account {
+	repo := mw.repository.WithContext(ctx)
+	accounts := make(map[string]*repository.Account)
+	for _, name := range names {
+		if account, err := repo.GetAccount(name); err == nil {
+			accounts[name] = account
+		}
+	}
+	return accounts
+}
+
+// limits returns current account limits or currency defaults.
+func (mw auditMiddleware) limits(ctx context.Context, limits *repository.Limits) *repository.Limits {
+	current, err := mw.repository.WithContext(ctx).GetLimits(nil, limits.UserID, limits.Currency)
+	if err != nil {
+		return nil
+	}
+	return current
+}
+
+// feeSchedule returns current fee schedule of currency.
+func (mw auditMiddleware) feeSchedule(ctx context.Context, currency string) *repository.FeeSchedule {
+	schedule, err := mw.repository.WithContext(ctx).GetFeeSchedule(nil, currency)
+	if err != nil {
+		return nil
+	}
+	return schedule
+}
+
+// snapshot serializes state right away, as repository may return shared objects,
+// which are changed later by the operation.
+func snapshot(state interface{}) json.RawMessage {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// record appends operation to audit log. Operation is already committed, so
+// if it can't be recorded, its outcome is still returned, as reporting failure
+// of committed transfer would make caller repeat it. Failure is logged and
+// counted by auditFailures instead, monitoring should alert on it.
+func (mw auditMiddleware) record(ctx context.Context, action, target string, before, after json.RawMessage, err *error) {
+	record := &repository.AuditRecord{
+		Actor:     PrincipalFromContext(ctx),
+		Action:    action,
+		Target:    target,
+		RequestID: tracing.RequestIDFromContext(ctx),
+		ClientIP:  ClientIPFromContext(ctx),
+		Before:    before,
+		After:     after,
+	}
+	if *err != nil {
+		record.Error = (*err).Error()
+	}
+	if auditErr := mw.repository.WithContext(ctx).AppendAudit(record); auditErr != nil {
+		auditFailures.Add(1)
+		_ = level.Error(mw.logger).Log("middleware", "audit", "alert", "unaudited operation", "action", action,
+			"target", target, "actor", record.Actor, "request_id", record.RequestID, "err", auditErr)
+	}
+}
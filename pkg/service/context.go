@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+)
+
+// AnonymousPrincipal is a principal of requests which are not identified.
+const AnonymousPrincipal = "anonymous"
+
+type contextKey int
+
+const (
+	principalContextKey contextKey = iota
+	clientIPContextKey
+	authenticatedContextKey
+)
+
+// ContextWithPrincipal returns context carrying principal (API client or operator)
+// on behalf of which request is made.
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalContextKey, principal)
+}
+
+// ContextWithAuthenticatedPrincipal returns context carrying principal whose
+// identity is verified by transport, f.e. by client certificate.
+func ContextWithAuthenticatedPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ContextWithPrincipal(ctx, principal), authenticatedContextKey, principal)
+}
+
+// PrincipalAuthenticated reports whether principal carried by context is authenticated.
+func PrincipalAuthenticated(ctx context.Context) bool {
+	principal, _ := ctx.Value(authenticatedContextKey).(string)
+	return principal != "" && principal == PrincipalFromContext(ctx)
+}
+
+// PrincipalFromContext returns principal carried by context, AnonymousPrincipal if there is none.
+func PrincipalFromContext(ctx context.Context) string {
+	if principal, ok := ctx.Value(principalContextKey).(string); ok && principal != "" {
+		return principal
+	}
+	return AnonymousPrincipal
+}
+
+// ContextWithClientIP returns context carrying IP address of client.
+func ContextWithClientIP(ctx context.Context, clientIP string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey, clientIP)
+}
+
+// ClientIPFromContext returns IP address of client carried by context, empty string if there is none.
+func ClientIPFromContext(ctx context.Context) string {
+	clientIP, _ := ctx.Value(clientIPContextKey).(string)
+	return clientIP
+}
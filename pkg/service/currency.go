@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// LoadCurrencies replaces default currency registry with ISO 4217 currencies
+// overridden by ones of repository. Default registry is kept if it fails.
+func LoadCurrencies(repo repository.Repository) (*currency.Registry, error) {
+	overrides, err := repo.GetCurrencies()
+	if err != nil {
+		return nil, err
+	}
+	registry := currency.NewRegistry(overrides...)
+	currency.SetDefault(registry)
+	return registry, nil
+}
+
+// Currencies implements Service.
+func (ps paymentService) Currencies(_ context.Context) ([]currency.Currency, error) {
+	return currency.Default().Currencies(), nil
+}
+
+// checkCurrency checks that accounts and transfers in currency are accepted.
+func checkCurrency(code string) error {
+	c, ok := currency.Lookup(code)
+	if !ok {
+		return ErrUnknownCurrency
+	}
+	if !c.Enabled {
+		return ErrCurrencyDisabled
+	}
+	return nil
+}
+
+// checkAmount checks that amount is accepted in currency.
+func checkAmount(amount float64, code string) error {
+	if err := checkCurrency(code); err != nil {
+		return err
+	}
+	if !currency.Fits(amount, code) {
+		return ErrInvalidAmount
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+)
+
+// ErrShuttingDown error fired by health check when instance drains requests before exit
+var ErrShuttingDown = errs.NewRetryable("shutting_down", "Shutting down", http.StatusServiceUnavailable)
+
+// Readiness tells load balancer whether instance accepts new requests.
+// Zero value is ready.
+type Readiness struct {
+	draining int32
+}
+
+// Drain makes instance unhealthy, so load balancer stops sending requests to it.
+func (r *Readiness) Drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+// Ready reports whether instance is not draining.
+func (r *Readiness) Ready() bool {
+	return atomic.LoadInt32(&r.draining) == 0
+}
+
+// ReadinessMiddleware returns a service middleware, which fails HealthCheck
+// with ErrShuttingDown once readiness is drained.
+func ReadinessMiddleware(readiness *Readiness) Middleware {
+	return func(next Service) Service {
+		return readinessMiddleware{
+			Service:   next,
+			readiness: readiness,
+		}
+	}
+}
+
+type readinessMiddleware struct {
+	Service
+	readiness *Readiness
+}
+
+func (mw readinessMiddleware) HealthCheck(ctx context.Context) (bool, error) {
+	if !mw.readiness.Ready() {
+		return false, ErrShuttingDown
+	}
+	return mw.Service.HealthCheck(ctx)
+}
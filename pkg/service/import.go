@@ -0,0 +1,376 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+var (
+	// ErrImportFailed error fired when some rows of bulk import are not imported, it carries import report
+	ErrImportFailed = errs.New("import_failed", "Import failed, see report", http.StatusUnprocessableEntity)
+
+	// ErrInvalidImportRow error fired when row of bulk import can't be parsed
+	ErrInvalidImportRow = errs.New("invalid_import_row", "Invalid import row", http.StatusBadRequest)
+
+	// ErrInvalidAccountID error fired when account ID is empty, too long or contains spaces or colons
+	ErrInvalidAccountID = errs.New("invalid_account_id", "Account ID must be 1 to 40 characters without spaces and colons", http.StatusBadRequest)
+
+	// ErrUnknownCurrency error fired when currency is not in currency registry
+	ErrUnknownCurrency = errs.New("unknown_currency", "Unknown currency", http.StatusBadRequest)
+
+	// ErrInvalidOpeningBalance error fired when opening balance exceeds credit limit or credit limit is negative
+	ErrInvalidOpeningBalance = errs.New("invalid_opening_balance", "Opening balance exceeds credit limit", http.StatusBadRequest)
+
+	// ErrDuplicateAccountID error fired when wallet of account holder is repeated in bulk import
+	ErrDuplicateAccountID = errs.New("duplicate_account_id", "Account ID is repeated in import", http.StatusBadRequest)
+
+	// ErrInvalidResumeToken error fired when resume token of bulk import is malformed
+	ErrInvalidResumeToken = errs.New("invalid_resume_token", "Invalid resume token", http.StatusBadRequest)
+
+	// ErrEquityMisconfigured error fired when equity account has different currency
+	ErrEquityMisconfigured = errs.New("equity_misconfigured", "Equity account misconfigured", http.StatusInternalServerError)
+)
+
+// AccountIDMaxLength is a maximum number of characters of account ID
+const AccountIDMaxLength = 40
+
+// WalletSeparator separates holder and currency in name of wallet, f.e. "alice456:EUR".
+// The first wallet of holder is named after holder, so its name has no separator.
+const WalletSeparator = ":"
+
+// EquityHolder is a holder of equity accounts, which opening balances are booked
+// against. Imported accounts can't be named after it.
+const EquityHolder = "equity"
+
+// EquityAccountPrefix is a prefix of equity account of currency, f.e. "equity:USD".
+const EquityAccountPrefix = EquityHolder + WalletSeparator
+
+// WalletAccount returns name of wallet of holder in currency, unless it is the
+// first wallet of holder.
+func WalletAccount(holder, currency string) string {
+	return holder + WalletSeparator + currency
+}
+
+// EquityAccount returns name of equity account of currency.
+func EquityAccount(currency string) string {
+	return WalletAccount(EquityHolder, currency)
+}
+
+// ImportReportFromError returns report carried by ErrImportFailed, nil if err is not one.
+func ImportReportFromError(err error) *repository.ImportReport {
+	var e *errs.Error
+	if !errors.As(err, &e) || !errors.Is(e, ErrImportFailed) {
+		return nil
+	}
+	switch details := e.Details.(type) {
+	case *repository.ImportReport:
+		return details
+	case json.RawMessage:
+		report := &repository.ImportReport{}
+		if json.Unmarshal(details, report) == nil {
+			return report
+		}
+	}
+	return nil
+}
+
+// ImportAccounts implements Service. ID of row is ID of account holder, holder
+// gets a wallet per currency of its rows. All rows are validated first and nothing is
+// imported unless every row is valid. Then rows are imported within single DB
+// transaction, or by chunks of options.ChunkSize rows each committed separately.
+// If a chunk fails, import stops and report carries resume token of that chunk.
+func (ps paymentService) ImportAccounts(ctx context.Context, rows []*repository.AccountImport, options *repository.ImportOptions) (*repository.ImportReport, error) {
+	ps = ps.withContext(ctx)
+	if options == nil {
+		options = &repository.ImportOptions{}
+	}
+	if len(rows) == 0 || options.ChunkSize < 0 {
+		return nil, ErrRequiredArgumentMissing
+	}
+	resume := 0
+	if options.Resume != "" {
+		var err error
+		if resume, err = strconv.Atoi(options.Resume); err != nil || resume <= 0 {
+			return nil, ErrInvalidResumeToken
+		}
+	}
+
+	rows = append([]*repository.AccountImport(nil), rows...) // rows are numbered and named in copy
+	report := &repository.ImportReport{
+		Total: len(rows),
+		Rows:  make([]*repository.ImportRowResult, len(rows)),
+	}
+	seen := make(map[string]bool) // holders and their wallets
+	for i := range rows {
+		imported := *rows[i]
+		if imported.Line == 0 {
+			imported.Line = i + 1
+		}
+		row := &imported
+		rows[i] = row
+		result := &repository.ImportRowResult{Line: row.Line, UserID: row.UserID, Status: repository.ImportPending}
+		report.Rows[i] = result
+		if row.Line < resume {
+			result.Status = repository.ImportSkipped
+			report.Skipped++
+			continue
+		}
+		if err := ps.validateImportRow(row, seen); err != nil {
+			failImportRow(report, result, err)
+		} else {
+			result.UserID = row.Wallet
+		}
+		seen[row.UserID] = true
+		seen[WalletAccount(row.UserID, row.Currency)] = true
+	}
+	if report.Failed > 0 {
+		return report, ErrImportFailed.WithDetails(report)
+	}
+
+	chunkSize := options.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = len(rows)
+	}
+	for start := report.Skipped; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if !ps.importChunk(report, rows[start:end], report.Rows[start:end]) {
+			if options.ChunkSize > 0 {
+				report.Resume = strconv.Itoa(rows[start].Line)
+			}
+			return report, ErrImportFailed.WithDetails(report)
+		}
+	}
+	return report, nil
+}
+
+// validateImportRow checks row of bulk import before anything is imported and
+// names wallet of row.
+func (ps paymentService) validateImportRow(row *repository.AccountImport, seen map[string]bool) error {
+	if row.Error != "" {
+		err := ErrInvalidImportRow.WithDetails(nil)
+		err.Message = row.Error
+		return err
+	}
+	if !validAccountID(row.UserID) || row.UserID == EquityHolder || row.UserID == ClearingHolder {
+		return ErrInvalidAccountID
+	}
+	if err := checkCurrency(row.Currency); err != nil {
+		return err
+	}
+	if row.CreditLimit < 0 || row.Balance < -row.CreditLimit {
+		return ErrInvalidOpeningBalance
+	}
+	if !currency.Fits(row.Balance, row.Currency) || !currency.Fits(row.CreditLimit, row.Currency) {
+		return ErrInvalidAmount
+	}
+	row.Wallet = WalletAccount(row.UserID, row.Currency)
+	if seen[row.Wallet] {
+		return ErrDuplicateAccountID
+	}
+	holder, err := ps.repository.GetHolder(row.UserID)
+	if err != nil && err != repository.ErrAccountNotFound {
+		return err
+	}
+	if holder != nil {
+		for _, wallet := range holder.Wallets {
+			if wallet.Currency == row.Currency {
+				return repository.ErrAccountExists
+			}
+		}
+	} else if !seen[row.UserID] { // the first wallet is named after holder
+		_, err = ps.repository.GetAccount(row.UserID)
+		if err == nil {
+			return repository.ErrAccountExists
+		}
+		if err != repository.ErrAccountNotFound {
+			return err
+		}
+		row.Wallet = row.UserID
+	}
+	if utf8.RuneCountInString(row.Wallet) > AccountIDMaxLength {
+		return ErrInvalidAccountID
+	}
+	return nil
+}
+
+// validAccountID reports whether id fits into account table and has no spaces
+// and wallet separators.
+func validAccountID(id string) bool {
+	if id == "" || utf8.RuneCountInString(id) > AccountIDMaxLength || strings.Contains(id, WalletSeparator) {
+		return false
+	}
+	for _, r := range id {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// importChunk imports rows within DB transaction booking their opening balances
+// against equity accounts of their currencies. It updates results of rows and
+// reports whether chunk is committed.
+func (ps paymentService) importChunk(report *repository.ImportReport, rows []*repository.AccountImport, results []*repository.ImportRowResult) (ok bool) {
+	failed := -1 // row which failed the chunk
+	txn, err := ps.repository.Begin()
+	if err != nil { // failed to start txn
+		err = ErrTransactionFailed
+	}
+	defer func() {
+		if ok {
+			for _, result := range results {
+				result.Status = repository.ImportCreated
+			}
+			report.Created += len(results)
+			return
+		}
+		if txn != nil {
+			_ = txn.Rollback()
+		}
+		for i, result := range results {
+			if i == failed {
+				failImportRow(report, result, err)
+				continue
+			}
+			result.Status = repository.ImportRolledBack
+			result.Code, result.Error = toCode(err), err.Error()
+		}
+	}()
+	if err != nil {
+		return false
+	}
+
+	equity, err := ps.lockEquityAccounts(txn, rows)
+	if err != nil {
+		return false
+	}
+	for i, row := range rows {
+		err = ps.repository.CreateAccount(txn, &repository.Account{
+			UserID:      row.Wallet,
+			Holder:      row.UserID,
+			Balance:     row.Balance,
+			Currency:    row.Currency,
+			CreditLimit: row.CreditLimit,
+		})
+		if err != nil {
+			if err != repository.ErrAccountExists {
+				err = ErrTransactionFailed
+			}
+			failed = i
+			return false
+		}
+		change := &repository.BalanceChange{
+			Direction: repository.DirectionOpening,
+			Payer:     EquityAccount(row.Currency),
+			Payee:     row.Wallet,
+			Amount:    row.Balance,
+			Currency:  row.Currency,
+			Balance:   row.Balance,
+		}
+		if row.Balance < 0 { // overdraft is owed to equity
+			change.Payer, change.Payee, change.Amount = row.Wallet, EquityAccount(row.Currency), -row.Balance
+		}
+		if err = ps.writeOutbox(txn, repository.EventOpening, row.Wallet, change); err != nil {
+			err = ErrTransactionFailed
+			failed = i
+			return false
+		}
+		if row.Balance == 0 {
+			continue
+		}
+		account := equity[row.Currency]
+		account.Balance -= row.Balance
+		record := &repository.Transaction{
+			Direction: repository.DirectionOpening,
+			Payer:     change.Payer,
+			Payee:     change.Payee,
+			Amount:    change.Amount,
+			Currency:  row.Currency,
+		}
+		if err = ps.repository.InsertTransaction(txn, record); err != nil {
+			err = ErrTransactionFailed
+			failed = i
+			return false
+		}
+		change.Balance = account.Balance
+		if err = ps.writeOutbox(txn, repository.EventOpening, account.UserID, change); err != nil {
+			err = ErrTransactionFailed
+			failed = i
+			return false
+		}
+	}
+	for _, account := range equity {
+		if err = ps.repository.UpdateBalance(txn, account.UserID, account.Balance); err != nil {
+			err = ErrTransactionFailed
+			return false
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		txn = nil
+		err = commitError(err)
+		return false
+	}
+	return true
+}
+
+// lockEquityAccounts creates missing equity accounts of currencies of rows and locks
+// them in alphabet order to avoid deadlock with concurrent imports and transfers.
+func (ps paymentService) lockEquityAccounts(txn repository.DBTransaction, rows []*repository.AccountImport) (map[string]*repository.Account, error) {
+	currencies := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if row.Balance != 0 && !seen[row.Currency] {
+			seen[row.Currency] = true
+			currencies = append(currencies, row.Currency)
+		}
+	}
+	sort.Strings(currencies) // names of equity accounts share prefix
+
+	equity := make(map[string]*repository.Account)
+	for _, code := range currencies {
+		name := EquityAccount(code)
+		if err := ps.repository.CreateEquityAccount(txn, EquityHolder, name, code); err != nil {
+			return nil, ErrTransactionFailed
+		}
+		account, err := ps.repository.GetAndLockAccount(txn, name)
+		if err != nil {
+			return nil, ErrTransactionFailed
+		}
+		if account.Currency != code {
+			return nil, ErrEquityMisconfigured
+		}
+		locked := *account // repository may return shared object
+		equity[code] = &locked
+	}
+	return equity, nil
+}
+
+// failImportRow marks row of report as failed with err.
+func failImportRow(report *repository.ImportReport, result *repository.ImportRowResult, err error) {
+	result.Status = repository.ImportFailed
+	result.Code, result.Error = toCode(err), err.Error()
+	report.Failed++
+}
+
+// toCode returns code of domain error, code of internal error for others.
+func toCode(err error) string {
+	var e *errs.Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return errs.ErrInternal.Code
+}
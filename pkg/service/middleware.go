@@ -2,11 +2,15 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
 	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/tracing"
 )
 
 // Middleware describes a service (as opposed to endpoint) middleware.
@@ -27,28 +31,155 @@ type loggingMiddleware struct {
 
 func (mw loggingMiddleware) HealthCheck(ctx context.Context) (success bool, err error) {
 	defer func() {
-		_ = level.Info(mw.logger).Log("method", "HealthCheck", "success", success, "err", err)
+		_ = level.Info(mw.logger).Log("method", "HealthCheck", "request_id", tracing.RequestIDFromContext(ctx), "success", success, "err", err)
 	}()
 	return mw.next.HealthCheck(ctx)
 }
 
-func (mw loggingMiddleware) Account(ctx context.Context) (_ []*repository.Account, err error) {
+func (mw loggingMiddleware) Account(ctx context.Context) (_ []*repository.Holder, err error) {
 	defer func() {
-		_ = level.Info(mw.logger).Log("method", "Account", "err", err)
+		_ = level.Info(mw.logger).Log("method", "Account", "request_id", tracing.RequestIDFromContext(ctx), "err", err)
 	}()
 	return mw.next.Account(ctx)
 }
 
 func (mw loggingMiddleware) TransactionHistory(ctx context.Context) (_ []interface{}, err error) {
 	defer func() {
-		_ = level.Info(mw.logger).Log("method", "TransactionHistory", "err", err)
+		_ = level.Info(mw.logger).Log("method", "TransactionHistory", "request_id", tracing.RequestIDFromContext(ctx), "err", err)
 	}()
 	return mw.next.TransactionHistory(ctx)
 }
 
 func (mw loggingMiddleware) Transfer(ctx context.Context, from, to string, amount float64, currency string) (_ *repository.Transaction, err error) {
 	defer func() {
-		_ = level.Info(mw.logger).Log("method", "Transfer", "from", from, "to", to, "amount", amount, "currency", currency, "err", err)
+		_ = level.Info(mw.logger).Log("method", "Transfer", "request_id", tracing.RequestIDFromContext(ctx), "from", from, "to", to, "amount", amount, "currency", currency, "err", err)
 	}()
 	return mw.next.Transfer(ctx, from, to, amount, currency)
 }
+
+func (mw loggingMiddleware) Limits(ctx context.Context, userID string) (_ *repository.Limits, _ *repository.LimitUsage, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Limits", "request_id", tracing.RequestIDFromContext(ctx), "id", userID, "err", err)
+	}()
+	return mw.next.Limits(ctx, userID)
+}
+
+func (mw loggingMiddleware) SetLimits(ctx context.Context, limits *repository.Limits) (err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "SetLimits", "request_id", tracing.RequestIDFromContext(ctx), "limits", limits, "err", err)
+	}()
+	return mw.next.SetLimits(ctx, limits)
+}
+
+func (mw loggingMiddleware) Quote(ctx context.Context, from, to string, amount float64, currency string) (_ *repository.Quote, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Quote", "request_id", tracing.RequestIDFromContext(ctx), "from", from, "to", to, "amount", amount, "currency", currency, "err", err)
+	}()
+	return mw.next.Quote(ctx, from, to, amount, currency)
+}
+
+func (mw loggingMiddleware) FeeSchedule(ctx context.Context, currency string) (_ *repository.FeeSchedule, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "FeeSchedule", "request_id", tracing.RequestIDFromContext(ctx), "currency", currency, "err", err)
+	}()
+	return mw.next.FeeSchedule(ctx, currency)
+}
+
+func (mw loggingMiddleware) SetFeeSchedule(ctx context.Context, schedule *repository.FeeSchedule) (err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "SetFeeSchedule", "request_id", tracing.RequestIDFromContext(ctx), "schedule", schedule, "err", err)
+	}()
+	return mw.next.SetFeeSchedule(ctx, schedule)
+}
+
+func (mw loggingMiddleware) SetCreditLimit(ctx context.Context, userID string, creditLimit float64) (err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "SetCreditLimit", "request_id", tracing.RequestIDFromContext(ctx), "id", userID, "credit_limit", creditLimit, "err", err)
+	}()
+	return mw.next.SetCreditLimit(ctx, userID, creditLimit)
+}
+
+func (mw loggingMiddleware) Freeze(ctx context.Context, userID, state, reason, comment string) (err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Freeze", "request_id", tracing.RequestIDFromContext(ctx), "id", userID, "state", state, "reason", reason,
+			"principal", PrincipalFromContext(ctx), "err", err)
+	}()
+	return mw.next.Freeze(ctx, userID, state, reason, comment)
+}
+
+func (mw loggingMiddleware) FreezeHistory(ctx context.Context, userID string) (_ []*repository.FreezeRecord, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "FreezeHistory", "request_id", tracing.RequestIDFromContext(ctx), "id", userID, "err", err)
+	}()
+	return mw.next.FreezeHistory(ctx, userID)
+}
+
+func (mw loggingMiddleware) AuditLog(ctx context.Context, after int64, limit int) (_ []*repository.AuditRecord, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "AuditLog", "request_id", tracing.RequestIDFromContext(ctx), "after", after, "limit", limit, "err", err)
+	}()
+	return mw.next.AuditLog(ctx, after, limit)
+}
+
+func (mw loggingMiddleware) ExportTransactions(ctx context.Context, filter *repository.TransactionFilter) (_ repository.TransactionCursor, err error) {
+	if filter == nil {
+		filter = &repository.TransactionFilter{}
+	}
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "ExportTransactions", "request_id", tracing.RequestIDFromContext(ctx), "account", filter.Account, "from", filter.From, "to", filter.To, "err", err)
+	}()
+	return mw.next.ExportTransactions(ctx, filter)
+}
+
+func (mw loggingMiddleware) ImportAccounts(ctx context.Context, rows []*repository.AccountImport, options *repository.ImportOptions) (report *repository.ImportReport, err error) {
+	defer func() {
+		keyvals := []interface{}{"method", "ImportAccounts", "request_id", tracing.RequestIDFromContext(ctx), "rows", len(rows),
+			"principal", PrincipalFromContext(ctx)}
+		if report != nil {
+			keyvals = append(keyvals, "created", report.Created, "failed", report.Failed, "resume", report.Resume)
+		}
+		_ = level.Info(mw.logger).Log(append(keyvals, "err", err)...)
+	}()
+	return mw.next.ImportAccounts(ctx, rows, options)
+}
+
+func (mw loggingMiddleware) BalanceAt(ctx context.Context, userID string, at time.Time) (_ *repository.BalanceAt, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "BalanceAt", "request_id", tracing.RequestIDFromContext(ctx), "id", userID, "at", at, "err", err)
+	}()
+	return mw.next.BalanceAt(ctx, userID, at)
+}
+
+func (mw loggingMiddleware) Currencies(ctx context.Context) (_ []currency.Currency, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Currencies", "request_id", tracing.RequestIDFromContext(ctx), "err", err)
+	}()
+	return mw.next.Currencies(ctx)
+}
+
+func (mw loggingMiddleware) Activity(ctx context.Context) (_ *activity.Subscription, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Activity", "request_id", tracing.RequestIDFromContext(ctx),
+			"principal", PrincipalFromContext(ctx), "err", err)
+	}()
+	return mw.next.Activity(ctx)
+}
+
+func (mw loggingMiddleware) Payout(ctx context.Context, from, bankAccount string, amount float64, currency string) (payout *repository.Payout, err error) {
+	defer func() {
+		keyvals := []interface{}{"method", "Payout", "request_id", tracing.RequestIDFromContext(ctx), "from", from,
+			"amount", amount, "currency", currency}
+		if payout != nil {
+			keyvals = append(keyvals, "payout", payout.ID)
+		}
+		_ = level.Info(mw.logger).Log(append(keyvals, "err", err)...)
+	}()
+	return mw.next.Payout(ctx, from, bankAccount, amount, currency)
+}
+
+func (mw loggingMiddleware) Payment(ctx context.Context, id int64) (_ *repository.PaymentStatus, err error) {
+	defer func() {
+		_ = level.Info(mw.logger).Log("method", "Payment", "request_id", tracing.RequestIDFromContext(ctx), "id", id, "err", err)
+	}()
+	return mw.next.Payment(ctx, id)
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// ErrInvalidBankAccount error fired when account of external bank is empty or too long
+var ErrInvalidBankAccount = errs.New("invalid_bank_account", "Bank account must be 1 to 64 characters", http.StatusBadRequest)
+
+// BankAccountMaxLength is a maximum number of characters of account of external bank
+const BankAccountMaxLength = 64
+
+// ClearingHolder is a holder of clearing accounts, which payouts are booked to
+// until bank settles them. Imported accounts can't be named after it.
+const ClearingHolder = "clearing"
+
+// ClearingAccount returns name of clearing account of currency, f.e. "clearing:USD".
+func ClearingAccount(currency string) string {
+	return WalletAccount(ClearingHolder, currency)
+}
+
+// Payout implements Service. Amount is booked from wallet of holder (or wallet)
+// from to clearing account like a transfer, the payout is sent to bank later by
+// payout.Processor. Payout shares ID with outgoing history record.
+func (ps paymentService) Payout(ctx context.Context, from, bankAccount string, amount float64, currency string) (payout *repository.Payout, err error) {
+	ps = ps.withContext(ctx)
+	if from == "" || bankAccount == "" || amount <= 0 {
+		return nil, ErrRequiredArgumentMissing
+	}
+	if len(bankAccount) > BankAccountMaxLength {
+		return nil, ErrInvalidBankAccount
+	}
+	if currency != "" {
+		if err = checkCurrency(currency); err != nil {
+			return nil, err
+		}
+	}
+	if from, err = ps.pickWallet(from, currency); err != nil {
+		return nil, err
+	}
+	payer, err := ps.repository.GetAccount(from)
+	if err != nil {
+		if err == repository.ErrAccountNotFound {
+			return nil, repository.ErrPayerNotFound
+		}
+		return nil, err
+	}
+	clearing := ClearingAccount(payer.Currency)
+
+	txn, err := ps.repository.Begin()
+	if err != nil { // failed to start txn
+		return nil, err
+	}
+	var record *repository.Transaction
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+		// failed payouts are recorded like failed transfers
+		if record != nil && err != nil {
+			record.Error = err.Error()
+			failed := *record
+			failed.Fee = 0
+			_ = ps.repository.InsertTransaction(nil, &failed)
+		}
+	}()
+
+	if err = ps.repository.CreateEquityAccount(txn, ClearingHolder, clearing, payer.Currency); err != nil {
+		return nil, ErrTransactionFailed
+	}
+
+	plan, err := ps.prepareTransfer(txn, from, clearing, amount, currency)
+	if plan != nil {
+		record = plan.record
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ps.book(txn, plan); err != nil {
+		return nil, err
+	}
+
+	payout = &repository.Payout{
+		ID:          int64(record.TxnID),
+		Account:     record.Payer,
+		BankAccount: bankAccount,
+		Amount:      amount,
+		Currency:    record.Currency,
+		State:       repository.PayoutPending,
+	}
+	if err = ps.repository.InsertPayout(txn, payout); err != nil {
+		return nil, ErrTransactionFailed
+	}
+
+	if err = txn.Commit(); err != nil {
+		return nil, commitError(err)
+	}
+	return payout, nil
+}
+
+// Payment implements Service. Status of payout is its state, other records are
+// either completed or failed. It is read from primary database, so payout is
+// found right after it is booked.
+func (ps paymentService) Payment(ctx context.Context, id int64) (*repository.PaymentStatus, error) {
+	ps = ps.withContext(repository.ContextWithReadYourWrites(ctx))
+	if id <= 0 {
+		return nil, repository.ErrPaymentNotFound
+	}
+	records, err := ps.repository.GetTransactionPage(&repository.TransactionFilter{}, int(id-1), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || int64(records[0].TxnID) != id {
+		return nil, repository.ErrPaymentNotFound
+	}
+	record := records[0]
+	status := &repository.PaymentStatus{
+		ID:        record.TxnID,
+		Direction: record.Direction,
+		Date:      record.Date,
+		Payer:     record.Payer,
+		Payee:     record.Payee,
+		Amount:    record.Amount,
+		Fee:       record.Fee,
+		Currency:  record.Currency,
+		Error:     record.Error,
+		Status:    repository.PaymentCompleted,
+	}
+	if record.Error != "" {
+		status.Status = repository.PaymentFailed
+	}
+	if record.Direction != repository.DirectionOutgoing {
+		return status, nil
+	}
+	payout, err := ps.repository.GetPayout(id)
+	if err == repository.ErrPayoutNotFound {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Status, status.Payout = payout.State, payout
+	return status, nil
+}
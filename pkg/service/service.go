@@ -3,38 +3,139 @@ package service
 import (
 	"context"
 	"errors"
+	"net/http"
+	"sort"
+	"time"
 
 	"github.com/go-kit/kit/log"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/errs"
 	"github.com/khaliullov/payment-system/pkg/repository"
 )
 
 var (
 	// ErrRequiredArgumentMissing - not enough parameters or they empty
-	ErrRequiredArgumentMissing = errors.New("Required argument missing or it is incorrect")
+	ErrRequiredArgumentMissing = errs.New("required_argument_missing", "Required argument missing or it is incorrect", http.StatusBadRequest)
 
 	// ErrSelfTransfer error fired when payee equals payer
-	ErrSelfTransfer = errors.New("Transfer to self")
+	ErrSelfTransfer = errs.New("self_transfer", "Transfer to self", http.StatusBadRequest)
 
 	// ErrInsufficientFunds error fired when not enough money for transfer
-	ErrInsufficientFunds = errors.New("Insufficient funds")
+	ErrInsufficientFunds = errs.New("insufficient_funds", "Insufficient funds", http.StatusBadRequest)
 
 	// ErrDifferentCurrency error fired when account have different currencies
-	ErrDifferentCurrency = errors.New("Different currency")
+	ErrDifferentCurrency = errs.New("different_currency", "Different currency", http.StatusBadRequest)
 
 	// ErrWrongCurrency error fired when trying to make transfer with different currency from account's currency
-	ErrWrongCurrency = errors.New("Wrong currency")
+	ErrWrongCurrency = errs.New("wrong_currency", "Wrong currency", http.StatusBadRequest)
 
 	// ErrTransactionFailed error fired when DB failes to make transaction
-	ErrTransactionFailed = errors.New("Transaction failed")
+	ErrTransactionFailed = errs.NewRetryable("transaction_failed", "Transaction failed", http.StatusInternalServerError)
+
+	// ErrFeeMisconfigured error fired when revenue account of fee schedule not found or has different currency
+	ErrFeeMisconfigured = errs.New("fee_misconfigured", "Fee schedule misconfigured", http.StatusInternalServerError)
+
+	// ErrCreditLimitTooLow error fired when credit limit is less than already used overdraft
+	ErrCreditLimitTooLow = errs.New("credit_limit_too_low", "Credit limit is less than used overdraft", http.StatusConflict)
+
+	// ErrPayerFrozen error fired when outgoing transfers of payer are blocked by compliance
+	ErrPayerFrozen = errs.New("payer_frozen", "Payer account is frozen", http.StatusLocked)
+
+	// ErrPayeeFrozen error fired when incoming transfers of payee are blocked by compliance
+	ErrPayeeFrozen = errs.New("payee_frozen", "Payee account is frozen", http.StatusLocked)
+
+	// ErrUnknownFreezeState error fired when freeze state is not one of repository.Freeze* values
+	ErrUnknownFreezeState = errs.New("unknown_freeze_state", "Unknown freeze state", http.StatusBadRequest)
+
+	// ErrUnknownFreezeReason error fired when account is frozen without known reason code
+	ErrUnknownFreezeReason = errs.New("unknown_freeze_reason", "Unknown freeze reason", http.StatusBadRequest)
+
+	// ErrLimitExceeded error fired when transfer exceeds one of account limits
+	ErrLimitExceeded = errs.New("limit_exceeded", "Limit exceeded", http.StatusForbidden)
+
+	// ErrInvalidDateRange error fired when end of date range precedes its start
+	ErrInvalidDateRange = errs.New("invalid_date_range", "Invalid date range", http.StatusBadRequest)
+
+	// ErrCurrencyDisabled error fired when accounts and transfers in currency are not accepted
+	ErrCurrencyDisabled = errs.New("currency_disabled", "Currency is disabled", http.StatusBadRequest)
+
+	// ErrInvalidAmount error fired when amount has more decimals than minor unit of currency
+	ErrInvalidAmount = errs.New("invalid_amount", "Amount is not a whole number of minor units of currency", http.StatusBadRequest)
+
+	// ErrPrincipalRequired error fired when anonymous request asks for data of its principal
+	ErrPrincipalRequired = errs.New("principal_required", "Principal required", http.StatusUnauthorized)
+
+	// ErrPrincipalUnverified error fired when principal of request asking for its data is not authenticated
+	ErrPrincipalUnverified = errs.New("principal_unverified", "Principal is not authenticated", http.StatusForbidden)
+)
+
+// FreezeReasons are reason codes which account may be frozen with.
+var FreezeReasons = map[string]bool{
+	"AML_REVIEW":       true,
+	"FRAUD_SUSPECTED":  true,
+	"SANCTIONS":        true,
+	"COURT_ORDER":      true,
+	"CUSTOMER_REQUEST": true,
+	"OTHER":            true,
+}
+
+// Page size of audit log
+const (
+	AuditLogDefaultLimit = 100
+	AuditLogMaxLimit     = 1000
 )
 
+// ExportPageSize is a number of transactions fetched at once by export cursor
+const ExportPageSize = 1000
+
+// Limit rules reported by LimitError
+const (
+	LimitMaxAmount     = "max_amount"
+	LimitDailyAmount   = "daily_amount"
+	LimitMonthlyAmount = "monthly_amount"
+	LimitHourlyCount   = "hourly_count"
+)
+
+// LimitError is an ErrLimitExceeded with details about exceeded limit.
+type LimitError struct {
+	Rule  string  `json:"rule"`
+	Limit float64 `json:"limit"`
+	Used  float64 `json:"used"`
+}
+
+func (le *LimitError) Error() string {
+	return ErrLimitExceeded.Error() + ": " + le.Rule
+}
+
+// Unwrap makes errors.Is(err, ErrLimitExceeded) work.
+func (le *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
 // Service describes a service that adds things together.
 type Service interface {
 	HealthCheck(context.Context) (bool, error)
-	Account(context.Context) ([]*repository.Account, error)
+	Account(context.Context) ([]*repository.Holder, error)
 	TransactionHistory(context.Context) ([]interface{}, error)
 	Transfer(context.Context, string, string, float64, string) (*repository.Transaction, error)
+	Limits(context.Context, string) (*repository.Limits, *repository.LimitUsage, error)
+	SetLimits(context.Context, *repository.Limits) error
+	Quote(context.Context, string, string, float64, string) (*repository.Quote, error)
+	FeeSchedule(context.Context, string) (*repository.FeeSchedule, error)
+	SetFeeSchedule(context.Context, *repository.FeeSchedule) error
+	SetCreditLimit(context.Context, string, float64) error
+	Freeze(context.Context, string, string, string, string) error
+	FreezeHistory(context.Context, string) ([]*repository.FreezeRecord, error)
+	AuditLog(context.Context, int64, int) ([]*repository.AuditRecord, error)
+	ExportTransactions(context.Context, *repository.TransactionFilter) (repository.TransactionCursor, error)
+	ImportAccounts(context.Context, []*repository.AccountImport, *repository.ImportOptions) (*repository.ImportReport, error)
+	BalanceAt(context.Context, string, time.Time) (*repository.BalanceAt, error)
+	Currencies(context.Context) ([]currency.Currency, error)
+	Activity(context.Context) (*activity.Subscription, error)
+	Payout(context.Context, string, string, float64, string) (*repository.Payout, error)
+	Payment(context.Context, int64) (*repository.PaymentStatus, error)
 }
 
 // New returns a payment Service with all of the expected middlewares wired in.
@@ -42,6 +143,8 @@ func New(repository repository.Repository, logger log.Logger) Service {
 	var svc Service
 	{
 		svc = NewPaymentService(repository)
+		svc = AuditMiddleware(repository, logger)(svc)
+		svc = TracingMiddleware()(svc)
 		svc = LoggingMiddleware(logger)(svc)
 	}
 	return svc
@@ -58,25 +161,49 @@ type paymentService struct {
 	repository repository.Repository
 }
 
+// withContext returns service using repository bound to ctx of request.
+func (ps paymentService) withContext(ctx context.Context) paymentService {
+	ps.repository = ps.repository.WithContext(ctx)
+	return ps
+}
+
 // HealthCheck implements Service.
 func (ps paymentService) HealthCheck(_ context.Context) (bool, error) {
 	return true, nil
 }
 
-// Account implements Service.
-func (ps paymentService) Account(ctx context.Context) (accounts []*repository.Account, err error) {
-	accounts, err = ps.repository.GetAccounts()
-	return
+// Account implements Service. Accounts are grouped by their holders.
+func (ps paymentService) Account(ctx context.Context) ([]*repository.Holder, error) {
+	ps = ps.withContext(ctx)
+	accounts, err := ps.repository.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]*repository.Holder, 0)
+	byID := make(map[string]*repository.Holder)
+	for _, account := range accounts {
+		account.AvailableCredit = account.UnusedCredit()
+		holder, ok := byID[account.Holder]
+		if !ok {
+			holder = &repository.Holder{ID: account.Holder}
+			byID[account.Holder] = holder
+			holders = append(holders, holder)
+		}
+		holder.Wallets = append(holder.Wallets, account)
+	}
+	return holders, nil
 }
 
 // TransactionHistory implements Service.
 func (ps paymentService) TransactionHistory(ctx context.Context) (transactions []interface{}, err error) {
+	ps = ps.withContext(ctx)
 	transactions, err = ps.repository.GetTransactions()
 	return
 }
 
 // Transfer implements Service.
 func (ps paymentService) Transfer(ctx context.Context, from, to string, amount float64, currency string) (txnOut *repository.Transaction, err error) {
+	ps = ps.withContext(ctx)
 	if from == "" || to == "" || amount <= 0 {
 		return nil, ErrRequiredArgumentMissing
 	}
@@ -93,65 +220,555 @@ func (ps paymentService) Transfer(ctx context.Context, from, to string, amount f
 		if err != nil {
 			_ = txn.Rollback()
 		}
-		if txnOut != nil {
-			if err == nil {
-				_ = ps.repository.InsertTransaction(repository.DirectionIncoming, from, to, amount, txnOut.Currency, "")
-				_ = ps.repository.InsertTransaction(repository.DirectionOutgoing, from, to, amount, txnOut.Currency, "")
-			} else {
-				_ = ps.repository.InsertTransaction(repository.DirectionOutgoing, from, to, amount, txnOut.Currency, err.Error())
+		// successful transfers are recorded within txn, so limits usage is always accurate
+		if txnOut != nil && err != nil {
+			txnOut.Error = err.Error()
+			failed := *txnOut
+			failed.Fee = 0 // fee is charged for successful transfers only
+			_ = ps.repository.InsertTransaction(nil, &failed)
+		}
+	}()
+
+	plan, err := ps.prepareTransfer(txn, from, to, amount, currency)
+	if plan != nil {
+		txnOut = plan.record
+	}
+	if err != nil {
+		return
+	}
+
+	if err = ps.book(txn, plan); err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return txnOut, commitError(err)
+	}
+
+	return
+}
+
+// book applies prepared transfer within txn: sets balances of locked accounts,
+// writes history records and events of accounts to outbox. TxnID of outgoing
+// record of plan is filled in.
+func (ps paymentService) book(txn repository.DBTransaction, plan *transferPlan) error {
+	record := plan.record
+	for _, name := range plan.names {
+		if err := ps.repository.UpdateBalance(txn, name, plan.balances[name]); err != nil {
+			return ErrTransactionFailed
+		}
+	}
+
+	err := ps.repository.InsertTransaction(txn, &repository.Transaction{
+		Direction: repository.DirectionIncoming,
+		Payer:     record.Payer,
+		Payee:     record.Payee,
+		Amount:    record.Amount,
+		Currency:  record.Currency,
+	})
+	if err != nil {
+		return ErrTransactionFailed
+	}
+
+	err = ps.repository.InsertTransaction(txn, record)
+	if err != nil {
+		return ErrTransactionFailed
+	}
+
+	if record.Fee > 0 {
+		err = ps.repository.InsertTransaction(txn, &repository.Transaction{
+			Direction: repository.DirectionFee,
+			Payer:     record.Payer,
+			Payee:     plan.fee.Account,
+			Amount:    record.Fee,
+			Currency:  record.Currency,
+		})
+		if err != nil {
+			return ErrTransactionFailed
+		}
+	}
+
+	// events are committed along with balances, relay publishes them afterwards
+	for _, name := range plan.names {
+		change := &repository.BalanceChange{
+			Direction: repository.DirectionIncoming,
+			Payer:     record.Payer,
+			Payee:     record.Payee,
+			Amount:    record.Amount,
+			Currency:  record.Currency,
+			Balance:   plan.balances[name],
+		}
+		switch name {
+		case record.Payer:
+			change.Direction, change.Fee = repository.DirectionOutgoing, record.Fee
+		case record.Payee:
+		default: // revenue account
+			if record.Fee == 0 {
+				continue
 			}
+			change.Direction, change.Payee, change.Amount = repository.DirectionFee, name, record.Fee
 		}
+		if err := ps.writeOutbox(txn, repository.EventPayment, name, change); err != nil {
+			return ErrTransactionFailed
+		}
+	}
+
+	return nil
+}
+
+// commitError returns domain error of failed commit: concurrent change of
+// event-sourced account is reported as is, so it may be retried.
+func commitError(err error) error {
+	if errors.Is(err, repository.ErrVersionConflict) {
+		return repository.ErrVersionConflict
+	}
+	return ErrTransactionFailed
+}
+
+// writeOutbox writes event of account with change to outbox within txn.
+func (ps paymentService) writeOutbox(txn repository.DBTransaction, eventType, account string, change *repository.BalanceChange) error {
+	event, err := repository.NewOutboxEvent(account, eventType, change)
+	if err != nil {
+		return err
+	}
+	return ps.repository.AppendOutbox(txn, event)
+}
+
+// Quote implements Service.
+func (ps paymentService) Quote(ctx context.Context, from, to string, amount float64, currency string) (*repository.Quote, error) {
+	ps = ps.withContext(ctx)
+	if from == "" || to == "" || amount <= 0 {
+		return nil, ErrRequiredArgumentMissing
+	}
+
+	if from == to {
+		return nil, ErrSelfTransfer
+	}
+
+	txn, err := ps.repository.Begin()
+	if err != nil { // failed to start txn
+		return nil, err
+	}
+	defer func() {
+		_ = txn.Rollback()
 	}()
 
-	// to avoid deadlock: lock rows in alphabet order
-	// https://www.citusdata.com/blog/2018/02/22/seven-tips-for-dealing-with-postgres-locks/
-	// with NO KEY UPDATE flag
-	// https://habr.com/ru/company/wargaming/blog/323354/
-	var toAccount, fromAccount *repository.Account
-	if from > to {
-		toAccount, fromAccount, err = ps.repository.GetAndLockTwoAccounts(txn, repository.LockToFrom, to, from)
-	} else {
-		fromAccount, toAccount, err = ps.repository.GetAndLockTwoAccounts(txn, repository.LockFromTo, from, to)
+	plan, err := ps.prepareTransfer(txn, from, to, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	fee := plan.fee
+	if fee == nil {
+		fee = &repository.Fee{}
+	}
+	from, to = plan.record.Payer, plan.record.Payee
+	return &repository.Quote{
+		From:         from,
+		To:           to,
+		Amount:       amount,
+		Currency:     plan.record.Currency,
+		Fee:          fee,
+		Total:        amount + fee.Amount,
+		PayerBalance: plan.balances[from],
+		PayeeBalance: plan.balances[to],
+	}, nil
+}
+
+// transferPlan collects outcome of checked, but not yet applied transfer.
+type transferPlan struct {
+	record   *repository.Transaction // outgoing history record
+	fee      *repository.Fee         // nil if transfer is free of charge
+	names    []string                // locked accounts in locking order
+	balances map[string]float64      // resulting balances of locked accounts
+}
+
+// prepareTransfer locks accounts involved into transfer, calculates fee and checks
+// that transfer is possible. Payer and payee may be given as holders, currency
+// picks wallet of payer and payee gets wallet in currency of payer. Returned
+// plan is not nil once payer and payee are locked.
+func (ps paymentService) prepareTransfer(txn repository.DBTransaction, from, to string, amount float64, currency string) (plan *transferPlan, err error) {
+	if currency != "" {
+		if err = checkCurrency(currency); err != nil {
+			return nil, err
+		}
+	}
+	// currency of account never changes, so it is safe to pick wallets and find fee schedule before locking
+	if from, err = ps.pickWallet(from, currency); err != nil {
+		return nil, err
+	}
+	payer, err := ps.repository.GetAccount(from)
+	if err != nil {
+		if err == repository.ErrAccountNotFound {
+			return nil, repository.ErrPayerNotFound
+		}
+		return nil, err
+	}
+	if err = checkAmount(amount, payer.Currency); err != nil {
+		return nil, err
+	}
+	if to, err = ps.pickWallet(to, payer.Currency); err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, ErrSelfTransfer
+	}
+	schedule, err := ps.repository.GetFeeSchedule(txn, payer.Currency)
+	if err != nil {
+		return nil, ErrTransactionFailed
 	}
 
+	roles := make(map[string]error)
+	if schedule != nil && schedule.RevenueAccount != from {
+		roles[schedule.RevenueAccount] = ErrFeeMisconfigured
+	}
+	roles[from] = repository.ErrPayerNotFound
+	roles[to] = repository.ErrPayeeNotFound
+	names, accounts, err := ps.lockAccounts(txn, roles)
 	if err != nil { // record not found or failed to lock
 		return nil, err
 	}
+	fromAccount, toAccount := accounts[from], accounts[to]
 
-	txnOut = &repository.Transaction{
-		Payee:    to,
-		Payer:    from,
-		Amount:   amount,
-		Currency: fromAccount.Currency,
+	plan = &transferPlan{
+		record: &repository.Transaction{
+			Direction: repository.DirectionOutgoing,
+			Payee:     to,
+			Payer:     from,
+			Amount:    amount,
+			Currency:  fromAccount.Currency,
+		},
+		names:    names,
+		balances: make(map[string]float64),
+	}
+	for name, account := range accounts {
+		plan.balances[name] = account.Balance
 	}
 
 	if currency != "" && fromAccount.Currency != currency { // check if requested currency fits to users currency (if was specifed)
-		txnOut.Currency = currency
-		return txnOut, ErrWrongCurrency
+		plan.record.Currency = currency
+		return plan, ErrWrongCurrency
 	}
 
 	if fromAccount.Currency != toAccount.Currency { // compare dest and source currencies
-		return txnOut, ErrDifferentCurrency
+		return plan, ErrDifferentCurrency
+	}
+
+	if fromAccount.DebitBlocked() { // compliance holds are checked after locking
+		return plan, ErrPayerFrozen
+	}
+
+	if toAccount.CreditBlocked() {
+		return plan, ErrPayeeFrozen
+	}
+
+	if schedule != nil && schedule.RevenueAccount != from {
+		if accounts[schedule.RevenueAccount].Currency != fromAccount.Currency {
+			return plan, ErrFeeMisconfigured
+		}
+		plan.fee = schedule.Calculate(amount)
+		plan.record.Fee = plan.fee.Amount
+		plan.record.Breakdown = plan.fee
+	}
+
+	if err = ps.checkLimits(txn, fromAccount, amount); err != nil {
+		return plan, err
+	}
+
+	if fromAccount.Available() < amount+plan.record.Fee { // check enough money (including credit) for transfer
+		return plan, ErrInsufficientFunds
 	}
 
-	if fromAccount.Balance < amount { // check enough money for transfer
-		return txnOut, ErrInsufficientFunds
+	plan.balances[from] -= amount + plan.record.Fee
+	plan.balances[to] += amount
+	if plan.fee != nil {
+		plan.balances[plan.fee.Account] += plan.fee.Amount
 	}
 
-	err = ps.repository.UpdateBalance(txn, from, fromAccount.Balance-amount)
+	return plan, nil
+}
+
+// pickWallet returns wallet of holder (or wallet) id in currency. The id is returned
+// as is if there is no such wallet, so mismatch of currencies is reported once
+// accounts are locked.
+func (ps paymentService) pickWallet(id, currency string) (string, error) {
+	if currency == "" {
+		return id, nil
+	}
+	wallet, err := ps.repository.GetWallet(id, currency)
+	if err == repository.ErrAccountNotFound {
+		return id, nil
+	}
 	if err != nil {
-		return txnOut, ErrTransactionFailed
+		return "", err
 	}
+	return wallet.UserID, nil
+}
 
-	err = ps.repository.UpdateBalance(txn, to, toAccount.Balance+amount)
+// lockAccounts locks accounts for update and returns them with their names in
+// locking order. roles maps account name to error returned if it is not found.
+func (ps paymentService) lockAccounts(txn repository.DBTransaction, roles map[string]error) ([]string, map[string]*repository.Account, error) {
+	// to avoid deadlock: lock rows in alphabet order
+	// https://www.citusdata.com/blog/2018/02/22/seven-tips-for-dealing-with-postgres-locks/
+	// with NO KEY UPDATE flag
+	// https://habr.com/ru/company/wargaming/blog/323354/
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	accounts := make(map[string]*repository.Account)
+	for _, name := range names {
+		account, err := ps.repository.GetAndLockAccount(txn, name)
+		if err != nil {
+			if err == repository.ErrAccountNotFound {
+				return nil, nil, roles[name]
+			}
+			return nil, nil, err
+		}
+		accounts[name] = account
+	}
+	return names, accounts, nil
+}
+
+// checkLimits checks that transfer of amount from locked account fits into its limits.
+func (ps paymentService) checkLimits(txn repository.DBTransaction, account *repository.Account, amount float64) error {
+	limits, err := ps.repository.GetLimits(txn, account.UserID, account.Currency)
 	if err != nil {
-		return txnOut, ErrTransactionFailed
+		return ErrTransactionFailed
+	}
+	if limits.MaxAmount > 0 && amount > limits.MaxAmount {
+		return &LimitError{Rule: LimitMaxAmount, Limit: limits.MaxAmount}
+	}
+	if limits.DailyAmount == 0 && limits.MonthlyAmount == 0 && limits.HourlyCount == 0 {
+		return nil
+	}
+	usage, err := ps.repository.GetLimitUsage(txn, account.UserID)
+	if err != nil {
+		return ErrTransactionFailed
+	}
+	if limits.DailyAmount > 0 && usage.DailyAmount+amount > limits.DailyAmount {
+		return &LimitError{Rule: LimitDailyAmount, Limit: limits.DailyAmount, Used: usage.DailyAmount}
+	}
+	if limits.MonthlyAmount > 0 && usage.MonthlyAmount+amount > limits.MonthlyAmount {
+		return &LimitError{Rule: LimitMonthlyAmount, Limit: limits.MonthlyAmount, Used: usage.MonthlyAmount}
 	}
+	if limits.HourlyCount > 0 && usage.HourlyCount >= limits.HourlyCount {
+		return &LimitError{Rule: LimitHourlyCount, Limit: float64(limits.HourlyCount), Used: float64(usage.HourlyCount)}
+	}
+	return nil
+}
 
-	err = txn.Commit()
+// Limits implements Service.
+func (ps paymentService) Limits(ctx context.Context, userID string) (*repository.Limits, *repository.LimitUsage, error) {
+	ps = ps.withContext(ctx)
+	if userID == "" {
+		return nil, nil, ErrRequiredArgumentMissing
+	}
+	account, err := ps.repository.GetAccount(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits, err := ps.repository.GetLimits(nil, account.UserID, account.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	usage, err := ps.repository.GetLimitUsage(nil, account.UserID)
 	if err != nil {
-		return txnOut, ErrTransactionFailed
+		return nil, nil, err
 	}
+	return limits, usage, nil
+}
 
-	return
+// SetLimits implements Service.
+func (ps paymentService) SetLimits(ctx context.Context, limits *repository.Limits) error {
+	ps = ps.withContext(ctx)
+	if limits == nil || (limits.UserID == "") == (limits.Currency == "") {
+		return ErrRequiredArgumentMissing
+	}
+	if limits.MaxAmount < 0 || limits.DailyAmount < 0 || limits.MonthlyAmount < 0 || limits.HourlyCount < 0 {
+		return ErrRequiredArgumentMissing
+	}
+	if _, ok := currency.Lookup(limits.Currency); limits.Currency != "" && !ok {
+		return ErrUnknownCurrency
+	}
+	return ps.repository.SetLimits(limits)
+}
+
+// FeeSchedule implements Service.
+func (ps paymentService) FeeSchedule(ctx context.Context, currency string) (*repository.FeeSchedule, error) {
+	ps = ps.withContext(ctx)
+	if currency == "" {
+		return nil, ErrRequiredArgumentMissing
+	}
+	schedule, err := ps.repository.GetFeeSchedule(nil, currency)
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil { // transfers are free of charge
+		schedule = &repository.FeeSchedule{Currency: currency}
+	}
+	return schedule, nil
+}
+
+// SetFeeSchedule implements Service.
+func (ps paymentService) SetFeeSchedule(ctx context.Context, schedule *repository.FeeSchedule) error {
+	ps = ps.withContext(ctx)
+	if schedule == nil || schedule.Currency == "" || schedule.RevenueAccount == "" {
+		return ErrRequiredArgumentMissing
+	}
+	if schedule.Fixed < 0 || schedule.Percent < 0 || schedule.MinFee < 0 || schedule.MaxFee < 0 ||
+		(schedule.MaxFee > 0 && schedule.MaxFee < schedule.MinFee) {
+		return ErrRequiredArgumentMissing
+	}
+	for _, tier := range schedule.Tiers {
+		if tier.MinAmount < 0 || tier.Fixed < 0 || tier.Percent < 0 {
+			return ErrRequiredArgumentMissing
+		}
+	}
+	account, err := ps.repository.GetAccount(schedule.RevenueAccount)
+	if err != nil {
+		return err
+	}
+	if account.Currency != schedule.Currency {
+		return ErrWrongCurrency
+	}
+	return ps.repository.SetFeeSchedule(schedule)
+}
+
+// SetCreditLimit implements Service.
+func (ps paymentService) SetCreditLimit(ctx context.Context, userID string, creditLimit float64) (err error) {
+	ps = ps.withContext(ctx)
+	if userID == "" || creditLimit < 0 {
+		return ErrRequiredArgumentMissing
+	}
+
+	txn, err := ps.repository.Begin()
+	if err != nil { // failed to start txn
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	account, err := ps.repository.GetAndLockAccount(txn, userID)
+	if err != nil {
+		return err
+	}
+	if account.Balance+creditLimit < 0 {
+		return ErrCreditLimitTooLow
+	}
+	if err = ps.repository.UpdateCreditLimit(txn, userID, creditLimit); err != nil {
+		return ErrTransactionFailed
+	}
+	if err = txn.Commit(); err != nil {
+		return commitError(err)
+	}
+	return nil
+}
+
+// Freeze implements Service.
+func (ps paymentService) Freeze(ctx context.Context, userID, state, reason, comment string) (err error) {
+	ps = ps.withContext(ctx)
+	if userID == "" {
+		return ErrRequiredArgumentMissing
+	}
+	switch state {
+	case repository.FreezeNone:
+	case repository.FreezeDebit, repository.FreezeCredit, repository.FreezeBoth:
+		if !FreezeReasons[reason] {
+			return ErrUnknownFreezeReason
+		}
+	default:
+		return ErrUnknownFreezeState
+	}
+
+	txn, err := ps.repository.Begin()
+	if err != nil { // failed to start txn
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	// lock account, so freeze is applied between transfers, not in the middle of one
+	if _, err = ps.repository.GetAndLockAccount(txn, userID); err != nil {
+		return err
+	}
+	err = ps.repository.UpdateFreeze(txn, &repository.FreezeRecord{
+		UserID:  userID,
+		State:   state,
+		Reason:  reason,
+		Comment: comment,
+		Actor:   PrincipalFromContext(ctx),
+	})
+	if err != nil {
+		return ErrTransactionFailed
+	}
+	if err = txn.Commit(); err != nil {
+		return commitError(err)
+	}
+	return nil
+}
+
+// FreezeHistory implements Service.
+func (ps paymentService) FreezeHistory(ctx context.Context, userID string) ([]*repository.FreezeRecord, error) {
+	ps = ps.withContext(ctx)
+	if userID == "" {
+		return nil, ErrRequiredArgumentMissing
+	}
+	if _, err := ps.repository.GetAccount(userID); err != nil {
+		return nil, err
+	}
+	return ps.repository.GetFreezeHistory(userID)
+}
+
+// BalanceAt implements Service. Balance is computed at the current time if at is zero.
+func (ps paymentService) BalanceAt(ctx context.Context, userID string, at time.Time) (*repository.BalanceAt, error) {
+	ps = ps.withContext(ctx)
+	if userID == "" {
+		return nil, ErrRequiredArgumentMissing
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return ps.repository.GetBalanceAt(userID, at.UTC())
+}
+
+// AuditLog implements Service.
+func (ps paymentService) AuditLog(ctx context.Context, after int64, limit int) ([]*repository.AuditRecord, error) {
+	ps = ps.withContext(ctx)
+	if after < 0 || limit < 0 {
+		return nil, ErrRequiredArgumentMissing
+	}
+	if limit == 0 {
+		limit = AuditLogDefaultLimit
+	}
+	if limit > AuditLogMaxLimit {
+		limit = AuditLogMaxLimit
+	}
+	return ps.repository.GetAuditLog(after, limit)
+}
+
+// ExportTransactions implements Service. Transactions are fetched by cursor while
+// they are read, so caller must close it.
+func (ps paymentService) ExportTransactions(ctx context.Context, filter *repository.TransactionFilter) (repository.TransactionCursor, error) {
+	ps = ps.withContext(ctx)
+	if filter == nil {
+		filter = &repository.TransactionFilter{}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return nil, ErrInvalidDateRange
+	}
+	if filter.Account != "" {
+		if _, err := ps.repository.GetAccount(filter.Account); err != nil {
+			return nil, err
+		}
+	}
+	return repository.NewTransactionCursor(ps.repository, filter, ExportPageSize), nil
 }
@@ -2,10 +2,22 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
 	"github.com/khaliullov/payment-system/pkg/repository"
 	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/tracing"
 )
 
 func TestService(t *testing.T) {
@@ -63,7 +75,8 @@ func TestService(t *testing.T) {
 		t.Errorf("Error should be: %v, got %v", ErrWrongCurrency, err)
 	}
 
-	accounts, _ := svc.Account(context.Background())
+	holders, _ := svc.Account(context.Background())
+	accounts := holders[0].Wallets
 	accounts[0].Currency = "RUB"
 
 	// test wrong currency
@@ -86,3 +99,932 @@ func TestService(t *testing.T) {
 		t.Errorf("Transaction history should be filled")
 	}
 }
+
+func TestTransferLimits(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 1000, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 1000, Currency: "USD"})
+
+	// test limits validation
+	err := svc.SetLimits(context.Background(), &repository.Limits{UserID: "alice456", Currency: "USD"})
+	if err != ErrRequiredArgumentMissing {
+		t.Errorf("Error should be: %v, got %v", ErrRequiredArgumentMissing, err)
+	}
+	err = svc.SetLimits(context.Background(), &repository.Limits{UserID: "vasya", MaxAmount: 10})
+	if err != repository.ErrAccountNotFound {
+		t.Errorf("Error should be: %v, got %v", repository.ErrAccountNotFound, err)
+	}
+
+	// test currency default
+	_ = svc.SetLimits(context.Background(), &repository.Limits{Currency: "USD", MaxAmount: 100, HourlyCount: 3})
+	_, err = svc.Transfer(context.Background(), "alice456", "bob123", 100.01, "")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Rule != LimitMaxAmount {
+		t.Errorf("Error should be: %v, got %v", LimitMaxAmount, err)
+	}
+
+	// test account limit overrides currency default
+	_ = svc.SetLimits(context.Background(), &repository.Limits{UserID: "alice456", MaxAmount: 200, DailyAmount: 250})
+	_, err = svc.Transfer(context.Background(), "alice456", "bob123", 150, "")
+	if err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+	_, err = svc.Transfer(context.Background(), "alice456", "bob123", 150, "")
+	if !errors.As(err, &limitErr) || limitErr.Rule != LimitDailyAmount || limitErr.Used != 150 {
+		t.Errorf("Error should be: %v, got %v", LimitDailyAmount, err)
+	}
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Error should be: %v, got %v", ErrLimitExceeded, err)
+	}
+
+	// test hourly count is inherited from currency default
+	_, _ = svc.Transfer(context.Background(), "alice456", "bob123", 50, "")
+	_, _ = svc.Transfer(context.Background(), "alice456", "bob123", 10, "")
+	_, err = svc.Transfer(context.Background(), "alice456", "bob123", 10, "")
+	if !errors.As(err, &limitErr) || limitErr.Rule != LimitHourlyCount {
+		t.Errorf("Error should be: %v, got %v", LimitHourlyCount, err)
+	}
+
+	// test usage report
+	limits, usage, err := svc.Limits(context.Background(), "alice456")
+	if err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+	if limits.HourlyCount != 3 || usage.HourlyCount != 3 || usage.DailyAmount != 210 {
+		t.Errorf("Unexpected limits %+v and usage %+v", limits, usage)
+	}
+}
+
+func TestTransferFees(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 0, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 1000, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "revenue", Balance: 0, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "rub", Balance: 0, Currency: "RUB"})
+
+	// test revenue account validation
+	schedule := &repository.FeeSchedule{Currency: "USD", RevenueAccount: "rub", Fixed: 0.5, Percent: 1, MaxFee: 5,
+		Tiers: []repository.FeeTier{{MinAmount: 100, Fixed: 0, Percent: 0.5}}}
+	err := svc.SetFeeSchedule(context.Background(), schedule)
+	if err != ErrWrongCurrency {
+		t.Errorf("Error should be: %v, got %v", ErrWrongCurrency, err)
+	}
+	schedule.RevenueAccount = "revenue"
+	if err = svc.SetFeeSchedule(context.Background(), schedule); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+
+	// test fee breakdown
+	fees := []struct{ amount, fee float64 }{{10, 0.6}, {100, 0.5}, {2000, 5}}
+	for _, tc := range fees {
+		fee := schedule.Calculate(tc.amount)
+		if fee.Amount != tc.fee {
+			t.Errorf("Fee of %v should be: %v, got %v", tc.amount, tc.fee, fee.Amount)
+		}
+	}
+
+	// test capped fee breakdown adds up to fee
+	capped := &repository.FeeSchedule{Currency: "USD", Fixed: 0.5, Percent: 1, MinFee: 1, MaxFee: 5}
+	breakdowns := []repository.Fee{
+		{Fixed: 0.5, Percentage: 0.1, Adjustment: 0.4, Amount: 1},
+		{Fixed: 0.5, Percentage: 2, Amount: 2.5},
+		{Fixed: 0.5, Percentage: 20, Adjustment: -15.5, Amount: 5},
+	}
+	for i, amount := range []float64{10, 200, 2000} {
+		if fee := capped.Calculate(amount); *fee != breakdowns[i] {
+			t.Errorf("Fee of %v should be: %+v, got %+v", amount, breakdowns[i], *fee)
+		}
+	}
+
+	// test quote does not move money
+	quote, err := svc.Quote(context.Background(), "bob123", "alice456", 10, "")
+	if err != nil || quote.Fee.Amount != 0.6 || quote.Total != 10.6 || quote.PayerBalance != 989.4 || quote.PayeeBalance != 10 {
+		t.Errorf("Unexpected quote %+v, err %v", quote, err)
+	}
+	if account, _ := repo.GetAccount("bob123"); account.Balance != 1000 {
+		t.Errorf("Balance should be: %v, got %v", 1000, account.Balance)
+	}
+
+	// test fee is taken into account when checking funds
+	_, err = svc.Transfer(context.Background(), "bob123", "alice456", 996, "")
+	if err != ErrInsufficientFunds {
+		t.Errorf("Error should be: %v, got %v", ErrInsufficientFunds, err)
+	}
+
+	// test fee is booked to revenue account
+	txn, err := svc.Transfer(context.Background(), "bob123", "alice456", 10, "")
+	if err != nil || txn.Fee != 0.6 || txn.Breakdown.Fixed != 0.5 || txn.Breakdown.Percentage != 0.1 {
+		t.Errorf("Unexpected transaction %+v, err %v", txn, err)
+	}
+	balances := map[string]float64{"alice456": 10, "bob123": 989.4, "revenue": 0.6}
+	for name, balance := range balances {
+		if account, _ := repo.GetAccount(name); account.Balance != balance {
+			t.Errorf("Balance of %s should be: %v, got %v", name, balance, account.Balance)
+		}
+	}
+
+	// test fee is shown in history
+	transactions, _ := svc.TransactionHistory(context.Background())
+	var feeRecords int
+	for _, record := range transactions {
+		if txn, ok := record.(*repository.Transaction); ok && txn.Direction == repository.DirectionFee {
+			feeRecords++
+			if txn.Payee != "revenue" || txn.Amount != 0.6 {
+				t.Errorf("Unexpected fee record %+v", txn)
+			}
+		}
+	}
+	if feeRecords != 1 {
+		t.Errorf("History should contain %d fee records, got %d", 1, feeRecords)
+	}
+}
+
+func TestTransferOverdraft(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 10, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 0, Currency: "USD"})
+
+	if err := svc.SetCreditLimit(context.Background(), "alice456", 50); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+
+	// test transfer within credit limit
+	if _, err := svc.Transfer(context.Background(), "alice456", "bob123", 40, ""); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+
+	// test transfer over credit limit
+	_, err := svc.Transfer(context.Background(), "alice456", "bob123", 20.01, "")
+	if err != ErrInsufficientFunds {
+		t.Errorf("Error should be: %v, got %v", ErrInsufficientFunds, err)
+	}
+
+	// test credit limit can't be less than used overdraft
+	err = svc.SetCreditLimit(context.Background(), "alice456", 29.99)
+	if err != ErrCreditLimitTooLow {
+		t.Errorf("Error should be: %v, got %v", ErrCreditLimitTooLow, err)
+	}
+
+	// test available credit is reported
+	holders, _ := svc.Account(context.Background())
+	alice, bob := holders[0].Wallets[0], holders[1].Wallets[0]
+	if alice.Balance != -30 || alice.AvailableCredit != 20 || bob.AvailableCredit != 0 {
+		t.Errorf("Unexpected accounts %+v, %+v", alice, bob)
+	}
+}
+
+func TestTransferFrozen(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+	ctx := ContextWithPrincipal(context.Background(), "compliance")
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+
+	// test freeze validation
+	if err := svc.Freeze(ctx, "alice456", "partial", "OTHER", ""); err != ErrUnknownFreezeState {
+		t.Errorf("Error should be: %v, got %v", ErrUnknownFreezeState, err)
+	}
+	if err := svc.Freeze(ctx, "alice456", repository.FreezeDebit, "", ""); err != ErrUnknownFreezeReason {
+		t.Errorf("Error should be: %v, got %v", ErrUnknownFreezeReason, err)
+	}
+
+	// test debit freeze blocks outgoing transfers only
+	_ = svc.Freeze(ctx, "alice456", repository.FreezeDebit, "AML_REVIEW", "case 42")
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 1, ""); err != ErrPayerFrozen {
+		t.Errorf("Error should be: %v, got %v", ErrPayerFrozen, err)
+	}
+	if _, err := svc.Transfer(ctx, "bob123", "alice456", 1, ""); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+
+	// test credit freeze blocks incoming transfers
+	_ = svc.Freeze(ctx, "alice456", repository.FreezeCredit, "COURT_ORDER", "")
+	if _, err := svc.Transfer(ctx, "bob123", "alice456", 1, ""); err != ErrPayeeFrozen {
+		t.Errorf("Error should be: %v, got %v", ErrPayeeFrozen, err)
+	}
+
+	// test unfreeze and audit trail
+	_ = svc.Freeze(ctx, "alice456", repository.FreezeNone, "", "cleared")
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 1, ""); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+	history, err := svc.FreezeHistory(ctx, "alice456")
+	if err != nil || len(history) != 3 || history[0].Actor != "compliance" || history[2].State != repository.FreezeNone {
+		t.Errorf("Unexpected freeze history %v, err %v", history, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := AuditMiddleware(repo, log.NewNopLogger())(NewPaymentService(repo))
+	ctx := ContextWithPrincipal(context.Background(), "operator")
+	ctx = tracing.ContextWithRequestID(ctx, "req-1")
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+
+	// test successful and failed mutations are recorded, reads are not
+	_, _ = svc.Transfer(ctx, "alice456", "bob123", 10, "USD")
+	_, _ = svc.Transfer(ctx, "alice456", "bob123", 1000, "USD")
+	_, _ = svc.Account(ctx)
+	_ = svc.SetCreditLimit(ctx, "bob123", 50)
+	records, err := svc.AuditLog(ctx, 0, 0)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Audit log should have 3 records, got %d, %v", len(records), err)
+	}
+	if records[0].Actor != "operator" || records[0].RequestID != "req-1" || records[0].Action != AuditTransfer {
+		t.Errorf("Unexpected audit record: %+v", records[0])
+	}
+	if records[1].Error != ErrInsufficientFunds.Error() {
+		t.Errorf("Error should be: %v, got %v", ErrInsufficientFunds, records[1].Error)
+	}
+	if !strings.Contains(string(records[2].Before), `"credit_limit":0`) ||
+		!strings.Contains(string(records[2].After), `"credit_limit":50`) {
+		t.Errorf("Unexpected snapshots: %s -> %s", records[2].Before, records[2].After)
+	}
+
+	// test paging
+	if page, _ := svc.AuditLog(ctx, 1, 1); len(page) != 1 || page[0].ID != 2 {
+		t.Errorf("Page should contain record 2, got %+v", page)
+	}
+
+	// test chain is valid and detects tampering
+	prevHash := ""
+	for _, record := range records {
+		if !record.Valid(prevHash) {
+			t.Errorf("Record %d should be valid", record.ID)
+		}
+		prevHash = record.Hash
+	}
+	records[1].After = json.RawMessage(`{}`)
+	if records[1].Valid(records[0].Hash) {
+		t.Errorf("Tampered record should be invalid")
+	}
+	if records[2].Valid(records[0].Hash) {
+		t.Errorf("Record should not follow record 1")
+	}
+
+	// test values longer than columns are truncated before hashing
+	long := ContextWithClientIP(ContextWithPrincipal(ctx, strings.Repeat("é", 150)), strings.Repeat("1", 60))
+	_ = svc.SetCreditLimit(long, "bob123", 60)
+	records, _ = svc.AuditLog(ctx, 3, 1)
+	if len(records) != 1 || len([]rune(records[0].Actor)) != repository.MaxAuditActor ||
+		len(records[0].ClientIP) != repository.MaxAuditClientIP || !records[0].Valid(prevHash) {
+		t.Errorf("Unexpected truncated record: %+v", records)
+	}
+}
+
+// failingAuditRepository fails to append audit log records.
+type failingAuditRepository struct {
+	repository.Repository
+}
+
+func (r failingAuditRepository) WithContext(ctx context.Context) repository.Repository {
+	return failingAuditRepository{r.Repository.WithContext(ctx)}
+}
+
+func (r failingAuditRepository) AppendAudit(*repository.AuditRecord) error {
+	return errors.New("audit log is unavailable")
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+	svc := AuditMiddleware(failingAuditRepository{repo}, log.NewNopLogger())(NewPaymentService(repo))
+	ctx := context.Background()
+	failures := expvar.Get("audit_failures").(*expvar.Float).Value()
+
+	// test committed operations are not reported as failed, but counted
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 10, "USD"); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+	if err := svc.SetCreditLimit(ctx, "bob123", 50); err != nil {
+		t.Errorf("Error should be: %v, got %v", nil, err)
+	}
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 1000, "USD"); err != ErrInsufficientFunds {
+		t.Errorf("Error should be: %v, got %v", ErrInsufficientFunds, err)
+	}
+	if account, _ := repo.GetAccount("bob123"); account.Balance != 110 {
+		t.Errorf("Balance should be: %v, got %v", 110, account.Balance)
+	}
+	if n := expvar.Get("audit_failures").(*expvar.Float).Value() - failures; n != 3 {
+		t.Errorf("Audit failures should be counted: %v, got %v", 3, n)
+	}
+}
+
+type recordingExporter struct {
+	spans []*tracing.Span
+}
+
+func (re *recordingExporter) Export(span *tracing.Span) {
+	re.spans = append(re.spans, span)
+}
+
+func (re *recordingExporter) Close() error {
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := TracingMiddleware()(NewPaymentService(repo))
+	exporter := &recordingExporter{}
+
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+
+	// test nothing is traced without tracer
+	_, _ = svc.Account(context.Background())
+	if len(exporter.spans) != 0 {
+		t.Errorf("Nothing should be traced, got %d spans", len(exporter.spans))
+	}
+
+	// test spans continue trace of the caller and carry request ID
+	ctx := tracing.ContextWithTracer(context.Background(), tracing.NewTracer("test", exporter))
+	ctx = tracing.ContextWithRequestID(ctx, "req-1")
+	ctx, parent := tracing.StartSpan(ctx, "parent", tracing.KindServer)
+	traceID, spanID, ok := tracing.ParseTraceParent(tracing.TraceParent(ctx))
+	if !ok || traceID != parent.TraceID || spanID != parent.SpanID {
+		t.Errorf("Trace parent should be parsed back, got %s %s %v", traceID, spanID, ok)
+	}
+	_, _ = svc.Transfer(ctx, "alice456", "bob123", 1000, "USD")
+	if len(exporter.spans) != 1 {
+		t.Fatalf("There should be 1 span, got %d", len(exporter.spans))
+	}
+	span := exporter.spans[0]
+	if span.Name != "service.Transfer" || span.TraceID != parent.TraceID || span.ParentID != parent.SpanID {
+		t.Errorf("Unexpected span: %+v", span)
+	}
+	if span.Attributes["request_id"] != "req-1" || span.Error != ErrInsufficientFunds.Error() {
+		t.Errorf("Unexpected span attributes: %+v, error: %s", span.Attributes, span.Error)
+	}
+}
+
+func TestExportTransactions(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "carol", Balance: 100, Currency: "USD"})
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+	for i := 0; i < ExportPageSize; i++ {
+		_, _ = svc.Transfer(ctx, "alice456", "bob123", 0.01, "")
+	}
+	_, _ = svc.Transfer(ctx, "bob123", "carol", 1, "")
+
+	// test cursor walks through pages
+	count := func(filter *repository.TransactionFilter) (n int) {
+		cursor, err := svc.ExportTransactions(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cursor.Close()
+		for {
+			if _, err = cursor.Next(); err != nil {
+				return
+			}
+			n++
+		}
+	}
+	if n := count(nil); n != 2*ExportPageSize+2 {
+		t.Errorf("Export should have %d transactions, got %d", 2*ExportPageSize+2, n)
+	}
+	if n := count(&repository.TransactionFilter{Account: "carol"}); n != 2 {
+		t.Errorf("Export of carol should have 2 transactions, got %d", n)
+	}
+	if n := count(&repository.TransactionFilter{To: time.Now().Add(-time.Hour)}); n != 0 {
+		t.Errorf("Export of past should be empty, got %d", n)
+	}
+
+	// test wrong date range
+	now := time.Now()
+	if _, err := svc.ExportTransactions(ctx, &repository.TransactionFilter{From: now, To: now.Add(-time.Hour)}); err != ErrInvalidDateRange {
+		t.Errorf("Error should be: %v, got %v", ErrInvalidDateRange, err)
+	}
+}
+
+func TestImportAccounts(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	svc := New(repo, log.NewNopLogger())
+	ctx := context.Background()
+
+	// test invalid rows fail whole import
+	report, err := svc.ImportAccounts(ctx, []*repository.AccountImport{
+		{UserID: "bob123", Currency: "USD", Balance: 10},
+		{UserID: "alice456", Currency: "USD"},
+		{UserID: strings.Repeat("x", AccountIDMaxLength+1), Currency: "USD"},
+		{UserID: "equity:USD", Currency: "USD"},
+		{UserID: "vasya", Currency: "XYZ"},
+		{UserID: "petya", Currency: "USD", Balance: -10, CreditLimit: 5},
+		{UserID: "bob123", Currency: "USD"},
+		{UserID: "ivan", Error: `invalid balance "ten"`},
+	}, nil)
+	if !errors.Is(err, ErrImportFailed) || report == nil || ImportReportFromError(err) != report {
+		t.Fatalf("Error should be: %v with report, got %v", ErrImportFailed, err)
+	}
+	codes := []string{"", repository.ErrAccountExists.Code, ErrInvalidAccountID.Code, ErrInvalidAccountID.Code,
+		ErrUnknownCurrency.Code, ErrInvalidOpeningBalance.Code, ErrDuplicateAccountID.Code, ErrInvalidImportRow.Code}
+	for i, row := range report.Rows {
+		if row.Line != i+1 || row.Code != codes[i] {
+			t.Errorf("Row %d should fail with %q, got %+v", i+1, codes[i], row)
+		}
+	}
+	if report.Failed != 7 || report.Created != 0 || report.Rows[0].Status != repository.ImportPending ||
+		report.Rows[7].Error != `invalid balance "ten"` {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if _, err = repo.GetAccount("bob123"); err != repository.ErrAccountNotFound {
+		t.Errorf("Nothing should be imported, got %v", err)
+	}
+
+	// test opening balances are booked against equity account
+	rows := []*repository.AccountImport{
+		{Line: 2, UserID: "bob123", Currency: "USD", Balance: 10},
+		{Line: 3, UserID: "petya", Currency: "USD", Balance: -5, CreditLimit: 5},
+		{Line: 4, UserID: "hans", Currency: "EUR", Balance: 20},
+		{Line: 5, UserID: "ivan", Currency: "EUR"},
+	}
+	report, err = svc.ImportAccounts(ctx, rows, &repository.ImportOptions{ChunkSize: 3})
+	if err != nil || report.Created != 4 || report.Resume != "" {
+		t.Fatalf("Unexpected import: %+v %v", report, err)
+	}
+	balances := map[string]float64{"bob123": 10, "petya": -5, "hans": 20, "ivan": 0, "equity:USD": -5, "equity:EUR": -20}
+	for name, balance := range balances {
+		if account, err := repo.GetAccount(name); err != nil || account.Balance != balance {
+			t.Errorf("Balance of %s should be %v, got %+v %v", name, balance, account, err)
+		}
+	}
+	transactions, _ := repo.GetTransactions()
+	if len(transactions) != 3 {
+		t.Fatalf("3 opening transactions should be booked, got %d", len(transactions))
+	}
+	if txn := transactions[1].(*repository.Transaction); txn.Direction != repository.DirectionOpening ||
+		txn.Payer != "petya" || txn.Payee != "equity:USD" || txn.Amount != 5 {
+		t.Errorf("Unexpected opening transaction: %+v", txn)
+	}
+
+	// test import is resumed after rows preceding token
+	report, err = svc.ImportAccounts(ctx, append(rows[:2:2], &repository.AccountImport{Line: 6, UserID: "olga", Currency: "USD"}),
+		&repository.ImportOptions{Resume: "6"})
+	if err != nil || report.Skipped != 2 || report.Created != 1 || report.Rows[2].Status != repository.ImportCreated {
+		t.Errorf("Unexpected import: %+v %v", report, err)
+	}
+	if _, err = svc.ImportAccounts(ctx, rows, &repository.ImportOptions{Resume: "x"}); err != ErrInvalidResumeToken {
+		t.Errorf("Error should be: %v, got %v", ErrInvalidResumeToken, err)
+	}
+
+	// test import is audited
+	records, _ := repo.GetAuditLog(0, 10)
+	if len(records) != 4 || records[1].Action != AuditImportAccounts || records[1].Target != "accounts" {
+		t.Errorf("Unexpected audit log: %v", records)
+	}
+}
+
+func TestBalanceAt(t *testing.T) {
+	repo := inmem.NewInmem()
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+	_, err := svc.ImportAccounts(ctx, []*repository.AccountImport{
+		{UserID: "alice456", Currency: "USD", Balance: 100},
+		{UserID: "bob123", Currency: "USD"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := time.Now()
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 10, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := repo.GetLedgerBalances()
+	_ = repo.SaveBalanceSnapshot(snapshot)
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 20, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 1000, "USD"); err == nil {
+		t.Fatal("Transfer should fail")
+	}
+
+	// test balance before and after snapshot
+	for _, test := range []struct {
+		at       time.Time
+		balance  float64
+		snapshot bool
+	}{
+		{opened.Add(-time.Hour), 0, false},
+		{opened, 100, false},
+		{snapshot.TakenAt, 90, true},
+		{time.Time{}, 70, true},
+	} {
+		balance, err := svc.BalanceAt(ctx, "alice456", test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Balance != test.balance || (balance.SnapshotAt != nil) != test.snapshot || balance.Currency != "USD" {
+			t.Errorf("Balance at %v should be: %v, got %+v", test.at, test.balance, balance)
+		}
+	}
+
+	if _, err = svc.BalanceAt(ctx, "vasya", time.Time{}); err != repository.ErrAccountNotFound {
+		t.Errorf("Error should be: %v, got %v", repository.ErrAccountNotFound, err)
+	}
+}
+
+func TestWallets(t *testing.T) {
+	repo := inmem.NewInmem()
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+	report, err := svc.ImportAccounts(ctx, []*repository.AccountImport{
+		{UserID: "alice456", Currency: "USD", Balance: 100},
+		{UserID: "alice456", Currency: "EUR", Balance: 50},
+		{UserID: "bob123", Currency: "EUR"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows[0].UserID != "alice456" || report.Rows[1].UserID != "alice456:EUR" {
+		t.Errorf("Unexpected wallets: %+v, %+v", report.Rows[0], report.Rows[1])
+	}
+
+	// test wallet is added to existing holder unless holder has one in currency
+	rows := []*repository.AccountImport{{UserID: "bob123", Currency: "USD"}, {UserID: "alice456", Currency: "EUR"}}
+	report, err = svc.ImportAccounts(ctx, rows, nil)
+	if !errors.Is(err, ErrImportFailed) || report.Rows[0].UserID != "bob123:USD" ||
+		report.Rows[1].Code != repository.ErrAccountExists.Code {
+		t.Fatalf("Unexpected import: %+v %v", report, err)
+	}
+	if _, err = svc.ImportAccounts(ctx, rows[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// test currency picks wallets of payer and payee
+	for _, test := range []struct {
+		currency, payer, payee string
+	}{
+		{"EUR", "alice456:EUR", "bob123"},
+		{"USD", "alice456", "bob123:USD"},
+		{"", "alice456", "bob123:USD"},
+	} {
+		txn, err := svc.Transfer(ctx, "alice456", "bob123", 10, test.currency)
+		if err != nil || txn.Payer != test.payer || txn.Payee != test.payee {
+			t.Errorf("Transfer in %q should be from %s to %s, got %+v %v", test.currency, test.payer, test.payee, txn, err)
+		}
+	}
+	if _, err = svc.Transfer(ctx, "bob123", "alice456", 1, "RUB"); err != ErrWrongCurrency {
+		t.Errorf("Error should be: %v, got %v", ErrWrongCurrency, err)
+	}
+	quote, err := svc.Quote(ctx, "bob123", "alice456", 10, "EUR")
+	if err != nil || quote.From != "bob123" || quote.To != "alice456:EUR" || quote.PayeeBalance != 50 {
+		t.Errorf("Unexpected quote %+v, err %v", quote, err)
+	}
+
+	// test balances are grouped per holder
+	holders, err := svc.Account(ctx)
+	if err != nil || len(holders) != 3 || holders[0].ID != "alice456" || holders[2].ID != EquityHolder {
+		t.Fatalf("Unexpected holders %+v, err %v", holders, err)
+	}
+	if wallets := holders[0].Wallets; len(wallets) != 2 || wallets[0].Currency != "EUR" || wallets[0].Balance != 40 ||
+		wallets[1].UserID != "alice456" || wallets[1].Balance != 80 {
+		t.Errorf("Unexpected wallets %+v, %+v", wallets[0], wallets[1])
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 1000, Currency: "JPY"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "JPY"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "carol789", Balance: 100, Currency: "RUB"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "dave000", Currency: "RUB"})
+
+	// test amounts must be whole number of minor units
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 10.5, ""); err != ErrInvalidAmount {
+		t.Errorf("Error should be: %v, got %v", ErrInvalidAmount, err)
+	}
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 10, "XYZ"); err != ErrUnknownCurrency {
+		t.Errorf("Error should be: %v, got %v", ErrUnknownCurrency, err)
+	}
+	if _, err := svc.Transfer(ctx, "alice456", "bob123", 10, "JPY"); err != nil {
+		t.Error(err)
+	}
+
+	// test overrides of repository disable currency
+	inmemRepo.Currencies = []currency.Currency{{Code: "RUB", Exponent: -1}}
+	if _, err := LoadCurrencies(repo); err != nil {
+		t.Fatal(err)
+	}
+	defer currency.SetDefault(currency.NewRegistry())
+	if _, err := svc.Transfer(ctx, "carol789", "dave000", 10, ""); err != ErrCurrencyDisabled {
+		t.Errorf("Error should be: %v, got %v", ErrCurrencyDisabled, err)
+	}
+	report, err := svc.ImportAccounts(ctx, []*repository.AccountImport{{UserID: "eve", Currency: "RUB"}}, nil)
+	if !errors.Is(err, ErrImportFailed) || report.Rows[0].Code != ErrCurrencyDisabled.Code {
+		t.Errorf("Unexpected import: %+v %v", report, err)
+	}
+	currencies, err := svc.Currencies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range currencies {
+		if c.Code == "RUB" && c.Enabled || c.Code == "JPY" && (!c.Enabled || c.Exponent != 0) {
+			t.Errorf("Unexpected currency %+v", c)
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	svc := NewPaymentService(repo)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+
+	// test principal is required and must be a holder
+	if _, err := svc.Activity(context.Background()); err != ErrPrincipalRequired {
+		t.Errorf("Error should be: %v, got %v", ErrPrincipalRequired, err)
+	}
+	if _, err := svc.Activity(ContextWithPrincipal(context.Background(), "bob123")); err != ErrPrincipalUnverified {
+		t.Errorf("Error should be: %v, got %v", ErrPrincipalUnverified, err)
+	}
+	ctx := ContextWithAuthenticatedPrincipal(context.Background(), "alice456")
+	if _, err := svc.Activity(ContextWithPrincipal(ctx, "bob123")); err != ErrPrincipalUnverified {
+		t.Errorf("Error should be: %v for principal overriding authenticated one, got %v", ErrPrincipalUnverified, err)
+	}
+	if _, err := svc.Activity(ContextWithAuthenticatedPrincipal(context.Background(), "vasya")); err != repository.ErrAccountNotFound {
+		t.Errorf("Error should be: %v, got %v", repository.ErrAccountNotFound, err)
+	}
+
+	// test current balances come first, then changes of transfer
+	subscription, err := svc.Activity(ContextWithAuthenticatedPrincipal(context.Background(), "bob123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+	if len(subscription.Snapshot) != 1 || subscription.Snapshot[0].Balance.Account != "bob123" ||
+		subscription.Snapshot[0].Balance.Balance != 0 {
+		t.Fatalf("Unexpected snapshot %+v", subscription.Snapshot)
+	}
+	if _, err = svc.Transfer(context.Background(), "alice456", "bob123", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	var balance float64
+	var directions []string
+	for len(subscription.Events()) > 0 {
+		e := <-subscription.Events()
+		switch e.Type {
+		case activity.TypeBalance:
+			if e.Balance.Account == "alice456" {
+				t.Errorf("Unexpected balance of other holder %+v", e.Balance)
+			}
+			balance = e.Balance.Balance
+		case activity.TypePayment:
+			directions = append(directions, e.Payment.Direction)
+		}
+	}
+	sort.Strings(directions)
+	if balance != 10 || strings.Join(directions, ",") != "incoming,outgoing" {
+		t.Errorf("Unexpected events: balance %v, payments %v", balance, directions)
+	}
+}
+
+// shardNames returns one account name kept by every shard of repo, names of the
+// first shard are taken after skip ones.
+func shardNames(repo *repository.ShardedRepository, shards, skip int) []string {
+	names := make([]string, shards)
+	for i, found := 0, 0; found < shards; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if shard := repo.ShardOf(name); names[shard] == "" {
+			if shard == 0 && skip > 0 {
+				skip--
+				continue
+			}
+			names[shard], found = name, found+1
+		}
+	}
+	return names
+}
+
+func TestSharding(t *testing.T) {
+	var stores []*inmem.RepositoryInmem
+	var shards []repository.Shard
+	for i := 0; i < 3; i++ {
+		store := inmem.NewInmem().(*inmem.RepositoryInmem)
+		stores, shards = append(stores, store), append(shards, store)
+	}
+	repo := repository.NewSharded(shards, log.NewNopLogger())
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+	names := shardNames(repo, 3, 0)
+	payer, payee, revenue, neighbour := names[0], names[1], shardNames(repo, 3, 1)[0], shardNames(repo, 3, 2)[0]
+	stores[0].InsertAccount(&repository.Account{UserID: payer, Balance: 100, Currency: "USD"})
+	stores[0].InsertAccount(&repository.Account{UserID: revenue, Currency: "USD"})
+	stores[0].InsertAccount(&repository.Account{UserID: neighbour, Currency: "USD"})
+	stores[1].InsertAccount(&repository.Account{UserID: payee, Currency: "USD"})
+	if err := svc.SetFeeSchedule(ctx, &repository.FeeSchedule{Currency: "USD", RevenueAccount: revenue, Fixed: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// test transfer spanning shards is committed by saga of the debited shard
+	if _, err := svc.Transfer(ctx, payer, payee, 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	for name, balance := range map[string]float64{payer: 89, payee: 10, revenue: 1} {
+		if account, err := repo.GetAccount(name); err != nil || account.Balance != balance {
+			t.Errorf("Balance of %s should be %v, got %+v %v", name, balance, account, err)
+		}
+	}
+	if len(stores[0].Sagas) != 1 || stores[0].Sagas[0].State != repository.SagaCompleted || len(stores[0].Sagas[0].Steps) != 2 {
+		t.Fatalf("Unexpected sagas %+v", stores[0].Sagas)
+	}
+
+	// test transfer within shard is committed by its transaction
+	if _, err := svc.Transfer(ctx, payer, neighbour, 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(stores[0].Sagas) != 1 {
+		t.Errorf("Transfer within shard should not write saga")
+	}
+
+	// test history of shards is paged in order of IDs
+	var ids []int
+	cursor := repository.NewTransactionCursor(repo, &repository.TransactionFilter{Account: payer}, 1)
+	for txn, err := cursor.Next(); err == nil; txn, err = cursor.Next() {
+		ids = append(ids, txn.TxnID)
+	}
+	if len(ids) != 6 || !sort.IntsAreSorted(ids) {
+		t.Errorf("Unexpected history of payer %v", ids)
+	}
+	if transactions, err := repo.GetTransactions(); err != nil || len(transactions) != 6 {
+		t.Errorf("Unexpected history %d, err %v", len(transactions), err)
+	}
+
+	// test pending saga is driven forward by recovery
+	steps := []*repository.SagaStep{
+		{Shard: 0, Ops: []*repository.SagaOp{{Type: repository.SagaOpBalance, Account: payer, Delta: -5}}},
+		{Shard: 1, Ops: []*repository.SagaOp{{Type: repository.SagaOpBalance, Account: payee, Delta: 5},
+			{Type: repository.SagaOpPayment, Direction: repository.DirectionIncoming, Payer: payer, Payee: payee, Amount: 5, Currency: "USD"}}},
+	}
+	if err := recoverSaga(stores[0], &repository.Saga{ID: "forward", State: repository.SagaPending, Steps: steps}, repo); err != nil {
+		t.Fatal(err)
+	}
+	if account, _ := repo.GetAccount(payee); account.Balance != 15 || stores[0].Sagas[1].State != repository.SagaCompleted {
+		t.Errorf("Saga should be completed, balance of payee %v, saga %+v", account.Balance, stores[0].Sagas[1])
+	}
+
+	// test saga which step can not be applied is compensated
+	steps[1].Ops[0].Account = "ghost" + payee
+	steps[1].Shard = repo.ShardOf(steps[1].Ops[0].Account)
+	_ = stores[0].InsertTransaction(nil, &repository.Transaction{Direction: repository.DirectionOutgoing, Payer: payer,
+		Payee: payee, Amount: 5, Currency: "USD", SagaID: "backward"})
+	if err := recoverSaga(stores[0], &repository.Saga{ID: "backward", State: repository.SagaPending, Steps: steps}, repo); err != nil {
+		t.Fatal(err)
+	}
+	if account, _ := repo.GetAccount(payer); account.Balance != 73 || stores[0].Sagas[2].State != repository.SagaCompensated {
+		t.Errorf("Saga should be compensated, balance of payer %v, saga %+v", account.Balance, stores[0].Sagas[2])
+	}
+	if last := stores[0].Transactions[len(stores[0].Transactions)-1].(*repository.Transaction); last.Error == "" {
+		t.Errorf("Record of compensated saga should fail %+v", last)
+	}
+	if n, err := repo.RecoverSagas(-time.Second); n != 0 || err != nil {
+		t.Errorf("Nothing should be recovered %d, %v", n, err)
+	}
+
+	// test ledger of every shard stays consistent
+	snapshot, err := repo.GetLedgerBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, balance := range snapshot.Balances {
+		if balance.UserID != payer && balance.Difference != 0 {
+			t.Errorf("Unexpected ledger balance %+v", balance)
+		}
+	}
+}
+
+// recoverSaga writes saga as if its coordinator step is committed and recovers it.
+func recoverSaga(coordinator *inmem.RepositoryInmem, saga *repository.Saga, repo *repository.ShardedRepository) error {
+	txn, _ := coordinator.Begin()
+	for _, op := range saga.Steps[0].Ops {
+		account, _ := coordinator.GetAndLockAccount(txn, op.Account)
+		_ = coordinator.UpdateBalance(txn, op.Account, account.Balance+op.Delta)
+	}
+	_ = coordinator.InsertSaga(txn, saga)
+	_ = txn.Commit()
+	_, err := repo.RecoverSagas(-time.Second)
+	return err
+}
+
+func TestPayout(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	svc := NewPaymentService(repo)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		from, bankAccount string
+		amount            float64
+		err               error
+	}{
+		{"alice456", "", 10, ErrRequiredArgumentMissing},
+		{"alice456", strings.Repeat("1", BankAccountMaxLength+1), 10, ErrInvalidBankAccount},
+		{"carol789", "DE89370400440532013000", 10, repository.ErrPayerNotFound},
+		{"alice456", "DE89370400440532013000", 1000, ErrInsufficientFunds},
+	} {
+		if _, err := svc.Payout(ctx, tc.from, tc.bankAccount, tc.amount, ""); err != tc.err {
+			t.Errorf("Payout of %+v should fail with %v, got %v", tc, tc.err, err)
+		}
+	}
+
+	// test payout is booked to clearing account along with its history record
+	payout, err := svc.Payout(ctx, "alice456", "DE89370400440532013000", 30, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payout.State != repository.PayoutPending || payout.Account != "alice456" || payout.Currency != "USD" {
+		t.Errorf("Unexpected payout %+v", payout)
+	}
+	if account, _ := repo.GetAccount(ClearingAccount("USD")); account == nil || account.Balance != 30 || account.Holder != ClearingHolder {
+		t.Errorf("Unexpected clearing account %+v", account)
+	}
+	status, err := svc.Payment(ctx, payout.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Direction != repository.DirectionOutgoing || status.Payee != ClearingAccount("USD") || status.Amount != 30 ||
+		status.Status != repository.PayoutPending || status.Payout == nil || status.Payout.BankAccount != "DE89370400440532013000" {
+		t.Errorf("Unexpected status of payout %+v", status)
+	}
+
+	// test status of history records which are not payouts
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.Transfer(ctx, "bob123", "alice456", 1000, ""); err == nil {
+		t.Fatal("Transfer should fail")
+	}
+	transactions, _ := repo.GetTransactionPage(&repository.TransactionFilter{}, int(payout.ID), 10)
+	statuses := make(map[string]string)
+	for _, txn := range transactions {
+		status, err := svc.Payment(ctx, int64(txn.TxnID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses[txn.Direction+" "+txn.Payer] = status.Status
+	}
+	expected := map[string]string{
+		"incoming alice456": repository.PaymentCompleted,
+		"outgoing alice456": repository.PaymentCompleted,
+		"outgoing bob123":   repository.PaymentFailed,
+	}
+	for k, v := range expected {
+		if statuses[k] != v {
+			t.Errorf("Status of %s should be %s, got %v", k, v, statuses)
+		}
+	}
+	if _, err = svc.Payment(ctx, 1000); err != repository.ErrPaymentNotFound {
+		t.Errorf("Unknown payment should not be found, got %v", err)
+	}
+
+	// test status of fresh payout is not read from lagging replica
+	svc = NewPaymentService(laggingReplicaRepository{Repository: repo})
+	if status, err = svc.Payment(ctx, payout.ID); err != nil || status.Payout == nil {
+		t.Errorf("Payout should be found, got %+v, %v", status, err)
+	}
+}
+
+// laggingReplicaRepository serves history from replica missing all records,
+// unless read-your-writes consistency is requested.
+type laggingReplicaRepository struct {
+	repository.Repository
+	ctx context.Context
+}
+
+func (r laggingReplicaRepository) WithContext(ctx context.Context) repository.Repository {
+	return laggingReplicaRepository{r.Repository.WithContext(ctx), ctx}
+}
+
+func (r laggingReplicaRepository) GetTransactionPage(filter *repository.TransactionFilter, afterID int, limit int) ([]*repository.Transaction, error) {
+	if r.ctx == nil || !repository.ReadYourWritesFromContext(r.ctx) {
+		return []*repository.Transaction{}, nil
+	}
+	return r.Repository.GetTransactionPage(filter, afterID, limit)
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/currency"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/tracing"
+)
+
+// TracingMiddleware returns a service Middleware, which wraps every method call
+// into a span. Tracer is taken from context, so without it nothing is traced.
+func TracingMiddleware() Middleware {
+	return func(next Service) Service {
+		return tracingMiddleware{next}
+	}
+}
+
+type tracingMiddleware struct {
+	next Service
+}
+
+func startSpan(ctx context.Context, method string) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, "service."+method, tracing.KindInternal)
+}
+
+func (mw tracingMiddleware) HealthCheck(ctx context.Context) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "HealthCheck")
+	defer func() { span.Finish(err) }()
+	return mw.next.HealthCheck(ctx)
+}
+
+func (mw tracingMiddleware) Account(ctx context.Context) (_ []*repository.Holder, err error) {
+	ctx, span := startSpan(ctx, "Account")
+	defer func() { span.Finish(err) }()
+	return mw.next.Account(ctx)
+}
+
+func (mw tracingMiddleware) TransactionHistory(ctx context.Context) (_ []interface{}, err error) {
+	ctx, span := startSpan(ctx, "TransactionHistory")
+	defer func() { span.Finish(err) }()
+	return mw.next.TransactionHistory(ctx)
+}
+
+func (mw tracingMiddleware) Transfer(ctx context.Context, from, to string, amount float64, currency string) (_ *repository.Transaction, err error) {
+	ctx, span := startSpan(ctx, "Transfer")
+	span.SetAttribute("from", from)
+	span.SetAttribute("to", to)
+	defer func() { span.Finish(err) }()
+	return mw.next.Transfer(ctx, from, to, amount, currency)
+}
+
+func (mw tracingMiddleware) Limits(ctx context.Context, userID string) (_ *repository.Limits, _ *repository.LimitUsage, err error) {
+	ctx, span := startSpan(ctx, "Limits")
+	defer func() { span.Finish(err) }()
+	return mw.next.Limits(ctx, userID)
+}
+
+func (mw tracingMiddleware) SetLimits(ctx context.Context, limits *repository.Limits) (err error) {
+	ctx, span := startSpan(ctx, "SetLimits")
+	defer func() { span.Finish(err) }()
+	return mw.next.SetLimits(ctx, limits)
+}
+
+func (mw tracingMiddleware) Quote(ctx context.Context, from, to string, amount float64, currency string) (_ *repository.Quote, err error) {
+	ctx, span := startSpan(ctx, "Quote")
+	defer func() { span.Finish(err) }()
+	return mw.next.Quote(ctx, from, to, amount, currency)
+}
+
+func (mw tracingMiddleware) FeeSchedule(ctx context.Context, currency string) (_ *repository.FeeSchedule, err error) {
+	ctx, span := startSpan(ctx, "FeeSchedule")
+	defer func() { span.Finish(err) }()
+	return mw.next.FeeSchedule(ctx, currency)
+}
+
+func (mw tracingMiddleware) SetFeeSchedule(ctx context.Context, schedule *repository.FeeSchedule) (err error) {
+	ctx, span := startSpan(ctx, "SetFeeSchedule")
+	defer func() { span.Finish(err) }()
+	return mw.next.SetFeeSchedule(ctx, schedule)
+}
+
+func (mw tracingMiddleware) SetCreditLimit(ctx context.Context, userID string, creditLimit float64) (err error) {
+	ctx, span := startSpan(ctx, "SetCreditLimit")
+	defer func() { span.Finish(err) }()
+	return mw.next.SetCreditLimit(ctx, userID, creditLimit)
+}
+
+func (mw tracingMiddleware) Freeze(ctx context.Context, userID, state, reason, comment string) (err error) {
+	ctx, span := startSpan(ctx, "Freeze")
+	defer func() { span.Finish(err) }()
+	return mw.next.Freeze(ctx, userID, state, reason, comment)
+}
+
+func (mw tracingMiddleware) FreezeHistory(ctx context.Context, userID string) (_ []*repository.FreezeRecord, err error) {
+	ctx, span := startSpan(ctx, "FreezeHistory")
+	defer func() { span.Finish(err) }()
+	return mw.next.FreezeHistory(ctx, userID)
+}
+
+func (mw tracingMiddleware) AuditLog(ctx context.Context, after int64, limit int) (_ []*repository.AuditRecord, err error) {
+	ctx, span := startSpan(ctx, "AuditLog")
+	defer func() { span.Finish(err) }()
+	return mw.next.AuditLog(ctx, after, limit)
+}
+
+func (mw tracingMiddleware) ExportTransactions(ctx context.Context, filter *repository.TransactionFilter) (_ repository.TransactionCursor, err error) {
+	ctx, span := startSpan(ctx, "ExportTransactions")
+	defer func() { span.Finish(err) }()
+	return mw.next.ExportTransactions(ctx, filter)
+}
+
+func (mw tracingMiddleware) ImportAccounts(ctx context.Context, rows []*repository.AccountImport, options *repository.ImportOptions) (_ *repository.ImportReport, err error) {
+	ctx, span := startSpan(ctx, "ImportAccounts")
+	defer func() { span.Finish(err) }()
+	return mw.next.ImportAccounts(ctx, rows, options)
+}
+
+func (mw tracingMiddleware) BalanceAt(ctx context.Context, userID string, at time.Time) (_ *repository.BalanceAt, err error) {
+	ctx, span := startSpan(ctx, "BalanceAt")
+	defer func() { span.Finish(err) }()
+	return mw.next.BalanceAt(ctx, userID, at)
+}
+
+func (mw tracingMiddleware) Currencies(ctx context.Context) (_ []currency.Currency, err error) {
+	ctx, span := startSpan(ctx, "Currencies")
+	defer func() { span.Finish(err) }()
+	return mw.next.Currencies(ctx)
+}
+
+func (mw tracingMiddleware) Activity(ctx context.Context) (_ *activity.Subscription, err error) {
+	ctx, span := startSpan(ctx, "Activity")
+	defer func() { span.Finish(err) }()
+	return mw.next.Activity(ctx)
+}
+
+func (mw tracingMiddleware) Payout(ctx context.Context, from, bankAccount string, amount float64, currency string) (_ *repository.Payout, err error) {
+	ctx, span := startSpan(ctx, "Payout")
+	span.SetAttribute("from", from)
+	defer func() { span.Finish(err) }()
+	return mw.next.Payout(ctx, from, bankAccount, amount, currency)
+}
+
+func (mw tracingMiddleware) Payment(ctx context.Context, id int64) (_ *repository.PaymentStatus, err error) {
+	ctx, span := startSpan(ctx, "Payment")
+	defer func() { span.Finish(err) }()
+	return mw.next.Payment(ctx, id)
+}
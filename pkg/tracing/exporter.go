@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// NewExporter returns exporter by its name: "stdout" writes spans to w, URL of
+// Zipkin-compatible collector (f.e. http://localhost:9411/api/v2/spans) sends
+// them to local collector.
+func NewExporter(name string, w io.Writer, serviceName string, logger log.Logger) (Exporter, error) {
+	switch {
+	case name == "stdout":
+		return NewWriterExporter(w), nil
+	case strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://"):
+		return NewZipkinExporter(name, serviceName, logger), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", name)
+}
+
+// NewWriterExporter returns Exporter writing spans to w as JSON lines.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{encoder: json.NewEncoder(w)}
+}
+
+type writerExporter struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func (we *writerExporter) Export(span *Span) {
+	we.mutex.Lock()
+	defer we.mutex.Unlock()
+	_ = we.encoder.Encode(span)
+}
+
+func (we *writerExporter) Close() error {
+	return nil
+}
+
+// Zipkin exporter batching parameters
+const (
+	zipkinQueueSize     = 10000
+	zipkinBatchSize     = 100
+	zipkinFlushInterval = time.Second
+)
+
+// NewZipkinExporter returns Exporter sending spans in batches to collector accepting
+// Zipkin v2 JSON (Zipkin, Jaeger or OpenTelemetry collector). Spans are dropped if
+// collector doesn't keep up, so tracing never slows down requests.
+func NewZipkinExporter(url, serviceName string, logger log.Logger) Exporter {
+	ze := &zipkinExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		logger:      log.With(logger, "exporter", "zipkin"),
+		queue:       make(chan *Span, zipkinQueueSize),
+		done:        make(chan struct{}),
+	}
+	go ze.run()
+	return ze
+}
+
+type zipkinExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	logger      log.Logger
+	queue       chan *Span
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func (ze *zipkinExporter) Export(span *Span) {
+	select {
+	case ze.queue <- span:
+	default:
+		_ = level.Warn(ze.logger).Log("msg", "span dropped", "name", span.Name)
+	}
+}
+
+// Close sends queued spans and stops exporter.
+func (ze *zipkinExporter) Close() error {
+	ze.closeOnce.Do(func() {
+		close(ze.queue)
+		<-ze.done
+	})
+	return nil
+}
+
+func (ze *zipkinExporter) run() {
+	defer close(ze.done)
+	ticker := time.NewTicker(zipkinFlushInterval)
+	defer ticker.Stop()
+	batch := make([]zipkinSpan, 0, zipkinBatchSize)
+	for {
+		select {
+		case span, ok := <-ze.queue:
+			if !ok {
+				ze.send(batch)
+				return
+			}
+			batch = append(batch, ze.convert(span))
+			if len(batch) >= zipkinBatchSize {
+				ze.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			ze.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (ze *zipkinExporter) convert(span *Span) zipkinSpan {
+	zs := zipkinSpan{
+		TraceID:       span.TraceID,
+		ID:            span.SpanID,
+		ParentID:      span.ParentID,
+		Name:          span.Name,
+		Timestamp:     span.Start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(span.Duration / time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: ze.serviceName},
+		Tags:          span.Attributes,
+	}
+	if span.Kind != KindInternal {
+		zs.Kind = span.Kind
+	}
+	if span.Error != "" {
+		zs.Tags = make(map[string]string, len(span.Attributes)+1)
+		for k, v := range span.Attributes {
+			zs.Tags[k] = v
+		}
+		zs.Tags["error"] = span.Error
+	}
+	return zs
+}
+
+func (ze *zipkinExporter) send(batch []zipkinSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		_ = level.Error(ze.logger).Log("during", "Marshal", "err", err)
+		return
+	}
+	resp, err := ze.client.Post(ze.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		_ = level.Error(ze.logger).Log("during", "Post", "err", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		_ = level.Error(ze.logger).Log("during", "Post", "status", resp.Status)
+	}
+}
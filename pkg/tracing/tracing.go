@@ -0,0 +1,193 @@
+// Package tracing implements lightweight OpenTelemetry-style tracing: spans
+// of a trace are linked by parent span ID and carried through context from
+// HTTP transport down to SQL statements, finished spans are sent to Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Span kinds
+const (
+	KindServer   = "SERVER"
+	KindInternal = "INTERNAL"
+	KindClient   = "CLIENT"
+)
+
+// Span represents single timed operation of a trace.
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	Start      time.Time         `json:"start"`
+	Duration   time.Duration     `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	tracer *Tracer
+	mutex  sync.Mutex
+}
+
+// SetAttribute sets attribute of span. It is safe to call on nil span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends span with err (if any) and exports it. It is safe to call on nil span.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Duration = time.Since(s.Start)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.mutex.Unlock()
+	s.tracer.exporter.Export(s)
+}
+
+// Exporter sends finished spans to their destination.
+type Exporter interface {
+	Export(span *Span)
+	Close() error
+}
+
+// Tracer starts spans and passes finished ones to exporter.
+type Tracer struct {
+	ServiceName string
+	exporter    Exporter
+}
+
+// NewTracer returns Tracer of service exporting spans to exporter.
+func NewTracer(serviceName string, exporter Exporter) *Tracer {
+	return &Tracer{
+		ServiceName: serviceName,
+		exporter:    exporter,
+	}
+}
+
+// Close flushes and closes exporter of tracer.
+func (t *Tracer) Close() error {
+	return t.exporter.Close()
+}
+
+type contextKey int
+
+const (
+	tracerContextKey contextKey = iota
+	spanContextKey
+	remoteContextKey
+	requestIDContextKey
+)
+
+// remoteParent is a parent span received from another service.
+type remoteParent struct {
+	traceID, spanID string
+}
+
+// ContextWithTracer returns context carrying tracer, spans are only started within such context.
+func ContextWithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerContextKey, tracer)
+}
+
+// ContextWithRemoteParent returns context carrying parent span received from another service,
+// see ParseTraceParent.
+func ContextWithRemoteParent(ctx context.Context, traceID, spanID string) context.Context {
+	return context.WithValue(ctx, remoteContextKey, remoteParent{traceID, spanID})
+}
+
+// SpanFromContext returns current span carried by context, nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// StartSpan starts span as a child of current span of context (if any) and returns
+// context carrying it. Without tracer in context nil span is returned.
+func StartSpan(ctx context.Context, name, kind string) (context.Context, *Span) {
+	tracer, _ := ctx.Value(tracerContextKey).(*Tracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		SpanID: newID(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: tracer,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	} else if remote, ok := ctx.Value(remoteContextKey).(remoteParent); ok {
+		span.TraceID, span.ParentID = remote.traceID, remote.spanID
+	} else {
+		span.TraceID = newID(16)
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		span.SetAttribute("request_id", requestID)
+	}
+	return context.WithValue(ctx, spanContextKey, span), span
+}
+
+// ContextWithRequestID returns context carrying ID of request.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// RequestIDFromContext returns ID of request carried by context, empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// NewRequestID returns random request ID.
+func NewRequestID() string {
+	return newID(16)
+}
+
+// TraceParent returns W3C traceparent header value of current span of context,
+// empty string if there is none.
+func TraceParent(ctx context.Context) string {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// ParseTraceParent parses W3C traceparent header value into trace and parent span IDs.
+func ParseTraceParent(header string) (traceID, spanID string, ok bool) {
+	if len(header) != 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return "", "", false
+	}
+	traceID, spanID = header[3:35], header[36:52]
+	if _, err := hex.DecodeString(traceID); err != nil {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(spanID); err != nil {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// newID returns random hex ID of size bytes.
+func newID(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,13 +1,20 @@
 package transport
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	ep "github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
@@ -15,27 +22,75 @@ import (
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 
+	"github.com/khaliullov/payment-system/pkg/activity"
 	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/export"
+	"github.com/khaliullov/payment-system/pkg/importer"
 	"github.com/khaliullov/payment-system/pkg/repository"
 	"github.com/khaliullov/payment-system/pkg/service"
+	"github.com/khaliullov/payment-system/pkg/tracing"
 )
 
 var (
-	HealthCheckPath = "/v1/healthcheck" // for smoke test
-	AccountPath     = "/v1/accounts"
-	TransactionPath = "/v1/payments"
-	TransferPath    = "/v1/transfer"
+	HealthCheckPath    = "/v1/healthcheck" // for smoke test
+	AccountPath        = "/v1/accounts"
+	TransactionPath    = "/v1/payments"
+	TransferPath       = "/v1/transfer"
+	AccountLimitsPath  = "/v1/accounts/{id}/limits"
+	CurrencyLimitsPath = "/v1/limits/{currency}"
+	QuotePath          = "/v1/transfer/quote"
+	FeeSchedulePath    = "/v1/fees/{currency}"
+	CreditLimitPath    = "/v1/accounts/{id}/credit-limit"
+	FreezePath         = "/v1/accounts/{id}/freeze"
+	AuditPath          = "/v1/audit"
+	ExportPath         = "/v1/payments/export"
+	ImportPath         = "/v1/accounts/import"
+	BalancePath        = "/v1/accounts/{id}/balance"
+	CurrenciesPath     = "/v1/currencies"
+	ActivityPath       = "/v1/activity"
+	PayoutsPath        = "/v1/payouts"
+	PaymentPath        = "/v1/payments/{id}"
+	OpenAPIPath        = "/v1/openapi.json" // OpenAPI document of HTTP API
+	DocsPath           = "/v1/docs"         // Swagger UI of OpenAPI document
+	MetricsPath        = "/debug/vars"      // expvar metrics
+)
+
+// MaxImportSize is a maximum size of body of import request
+const MaxImportSize = 32 << 20
+
+const (
+	// PrincipalHeader is an HTTP header carrying principal on behalf of which request is made.
+	PrincipalHeader = "X-Principal"
+	// RequestIDHeader is an HTTP header carrying ID of request for correlation.
+	RequestIDHeader = "X-Request-ID"
+	// TraceParentHeader is a W3C Trace Context header carrying parent span.
+	TraceParentHeader = "traceparent"
+	// ConsistencyHeader is an HTTP header requesting consistency of reads: with
+	// ConsistencyStrong they are served by primary database and see writes
+	// committed before, otherwise they may be served by lagging replica.
+	ConsistencyHeader = "X-Consistency"
+	// ConsistencyStrong is a value of ConsistencyHeader requesting read-your-writes consistency.
+	ConsistencyStrong = "strong"
 )
 
 // NewHTTPHandler returns an HTTP handler that makes a set of endpoints
-// available on predefined paths.
-func NewHTTPHandler(endpoints endpoint.Set, logger log.Logger) http.Handler {
+// available on predefined paths. Every request gets ID (taken from X-Request-ID
+// header or generated) and, unless tracer is nil, a server span.
+func NewHTTPHandler(endpoints endpoint.Set, tracer *tracing.Tracer, logger log.Logger, opts ...HandlerOption) http.Handler {
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorEncoder(errorEncoder),
 		httptransport.ServerErrorHandler(trans.NewLogErrorHandler(logger)),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, cfg.principalToContext, cfg.clientIPToContext,
+			consistencyToContext),
 	}
 
-	m := mux.NewRouter()
+	m := mux.NewRouter().UseEncodedPath()
+	m.Use(requestMiddleware(tracer))
 	m.Methods("GET").Path(HealthCheckPath).Handler(httptransport.NewServer(
 		endpoints.HealthCheckEndpoint,
 		decodeHTTPHealthCheckRequest,
@@ -60,17 +115,185 @@ func NewHTTPHandler(endpoints endpoint.Set, logger log.Logger) http.Handler {
 		encodeHTTPGenericResponse,
 		options...,
 	))
+	m.Methods("GET").Path(AccountLimitsPath).Handler(httptransport.NewServer(
+		endpoints.LimitsEndpoint,
+		decodeHTTPLimitsRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("PUT").Path(AccountLimitsPath).Handler(httptransport.NewServer(
+		endpoints.SetLimitsEndpoint,
+		decodeHTTPSetLimitsRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("PUT").Path(CurrencyLimitsPath).Handler(httptransport.NewServer(
+		endpoints.SetLimitsEndpoint,
+		decodeHTTPSetLimitsRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("POST").Path(QuotePath).Handler(httptransport.NewServer(
+		endpoints.QuoteEndpoint,
+		decodeHTTPTransferRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(FeeSchedulePath).Handler(httptransport.NewServer(
+		endpoints.FeeScheduleEndpoint,
+		decodeHTTPFeeScheduleRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("PUT").Path(FeeSchedulePath).Handler(httptransport.NewServer(
+		endpoints.SetFeeScheduleEndpoint,
+		decodeHTTPSetFeeScheduleRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("PUT").Path(CreditLimitPath).Handler(httptransport.NewServer(
+		endpoints.SetCreditLimitEndpoint,
+		decodeHTTPSetCreditLimitRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("PUT").Path(FreezePath).Handler(httptransport.NewServer(
+		endpoints.FreezeEndpoint,
+		decodeHTTPFreezeRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(FreezePath).Handler(httptransport.NewServer(
+		endpoints.FreezeHistoryEndpoint,
+		decodeHTTPFreezeHistoryRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(AuditPath).Handler(httptransport.NewServer(
+		endpoints.AuditLogEndpoint,
+		decodeHTTPAuditLogRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(ExportPath).Handler(httptransport.NewServer(
+		endpoints.ExportTransactionsEndpoint,
+		decodeHTTPExportTransactionsRequest,
+		encodeHTTPExportTransactionsResponse,
+		options...,
+	))
+	m.Methods("POST").Path(ImportPath).Handler(httptransport.NewServer(
+		endpoints.ImportAccountsEndpoint,
+		decodeHTTPImportAccountsRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(BalancePath).Handler(httptransport.NewServer(
+		endpoints.BalanceAtEndpoint,
+		decodeHTTPBalanceAtRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(CurrenciesPath).Handler(httptransport.NewServer(
+		endpoints.CurrenciesEndpoint,
+		decodeHTTPCurrenciesRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(ActivityPath).Handler(httptransport.NewServer(
+		endpoints.ActivityEndpoint,
+		decodeHTTPActivityRequest,
+		encodeHTTPActivityResponse,
+		append(options, httptransport.ServerBefore(webSocketKeyToContext))...,
+	))
+	m.Methods("POST").Path(PayoutsPath).Handler(httptransport.NewServer(
+		endpoints.PayoutEndpoint,
+		decodeHTTPPayoutRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	// registered after ExportPath, which it would match otherwise
+	m.Methods("GET").Path(PaymentPath).Handler(httptransport.NewServer(
+		endpoints.PaymentEndpoint,
+		decodeHTTPPaymentRequest,
+		encodeHTTPGenericResponse,
+		options...,
+	))
+	m.Methods("GET").Path(OpenAPIPath).HandlerFunc(openAPIHandler)
+	m.Methods("GET").Path(DocsPath).HandlerFunc(swaggerUIHandler)
+	return m
+}
+
+// NewMetricsHandler returns an HTTP handler serving expvar metrics at MetricsPath.
+// They include command line and memory statistics, so the handler is served
+// by separate internal listener, not along with API.
+func NewMetricsHandler() http.Handler {
+	m := http.NewServeMux()
+	m.Handle(MetricsPath, expvar.Handler())
 	return m
 }
 
+// HandlerOption configures handler returned by NewHTTPHandler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	trustedProxies []*net.IPNet
+	clientAuth     bool
+}
+
+// WithTrustedProxies makes handler take principal from PrincipalHeader and
+// address of client from X-Real-IP or X-Forwarded-For headers of requests
+// coming from networks of trusted proxies, which authenticate clients and
+// overwrite the headers. The headers of other peers are ignored.
+func WithTrustedProxies(nets []*net.IPNet) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.trustedProxies = nets
+	}
+}
+
+// WithClientAuth makes handler take principal from verified client certificate
+// only, PrincipalHeader is ignored even if set by trusted proxy. Request without
+// certificate is anonymous. It is meant for servers of mutual TLS.
+func WithClientAuth() HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.clientAuth = true
+	}
+}
+
+// trustedPeer reports whether request comes directly from a trusted proxy.
+func (cfg handlerConfig) trustedPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range cfg.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // NewHTTPClient returns an Service backed by an HTTP server living at the
 // remote instance. We expect instance to come from a service discovery system,
 // so likely of the form "host:port". We bake-in certain middlewares,
 // implementing the client library pattern.
-func NewHTTPClient(instance string, logger log.Logger) (service.Service, error) {
+func NewHTTPClient(instance string, logger log.Logger, opts ...ClientOption) (service.Service, error) {
+	cfg := clientConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	// Quickly sanitize the instance string.
 	if !strings.HasPrefix(instance, "http") {
-		instance = "http://" + instance
+		if cfg.tls != nil {
+			instance = "https://" + instance
+		} else {
+			instance = "http://" + instance
+		}
 	}
 	u, err := url.Parse(instance)
 	if err != nil {
@@ -78,7 +301,17 @@ func NewHTTPClient(instance string, logger log.Logger) (service.Service, error)
 	}
 
 	// global client middlewares
-	options := []httptransport.ClientOption{}
+	options := []httptransport.ClientOption{
+		httptransport.ClientBefore(principalToHTTP, requestToHTTP, consistencyToHTTP),
+	}
+	if cfg.tls != nil {
+		options = append(options, httptransport.SetClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: cfg.tls,
+			},
+		}))
+	}
 
 	// Each individual endpoint is an http/transport.Client (which implements
 	// endpoint.Endpoint) that gets wrapped with various middlewares. If you
@@ -88,7 +321,7 @@ func NewHTTPClient(instance string, logger log.Logger) (service.Service, error)
 	{
 		healthCheckEndpoint = httptransport.NewClient(
 			"GET",
-			copyURL(u, AccountPath),
+			copyURL(u, HealthCheckPath),
 			encodeHTTPGenericRequest,
 			decodeHTTPHealthCheckResponse,
 			options...,
@@ -125,6 +358,191 @@ func NewHTTPClient(instance string, logger log.Logger) (service.Service, error)
 		).Endpoint()
 	}
 
+	var limitsEndpoint ep.Endpoint
+	{
+		limitsEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ""),
+			encodeHTTPLimitsRequest,
+			decodeHTTPLimitsResponse,
+			options...,
+		).Endpoint()
+	}
+	var setLimitsEndpoint ep.Endpoint
+	{
+		setLimitsEndpoint = httptransport.NewClient(
+			"PUT",
+			copyURL(u, ""),
+			encodeHTTPSetLimitsRequest,
+			decodeHTTPSetLimitsResponse,
+			options...,
+		).Endpoint()
+	}
+	var quoteEndpoint ep.Endpoint
+	{
+		quoteEndpoint = httptransport.NewClient(
+			"POST",
+			copyURL(u, QuotePath),
+			encodeHTTPGenericRequest,
+			decodeHTTPQuoteResponse,
+			options...,
+		).Endpoint()
+	}
+	var feeScheduleEndpoint ep.Endpoint
+	{
+		feeScheduleEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ""),
+			encodeHTTPFeeScheduleRequest,
+			decodeHTTPFeeScheduleResponse,
+			options...,
+		).Endpoint()
+	}
+	var setFeeScheduleEndpoint ep.Endpoint
+	{
+		setFeeScheduleEndpoint = httptransport.NewClient(
+			"PUT",
+			copyURL(u, ""),
+			encodeHTTPSetFeeScheduleRequest,
+			decodeHTTPSetFeeScheduleResponse,
+			options...,
+		).Endpoint()
+	}
+	var setCreditLimitEndpoint ep.Endpoint
+	{
+		setCreditLimitEndpoint = httptransport.NewClient(
+			"PUT",
+			copyURL(u, ""),
+			encodeHTTPSetCreditLimitRequest,
+			decodeHTTPSetCreditLimitResponse,
+			options...,
+		).Endpoint()
+	}
+	var freezeEndpoint ep.Endpoint
+	{
+		freezeEndpoint = httptransport.NewClient(
+			"PUT",
+			copyURL(u, ""),
+			encodeHTTPFreezeRequest,
+			decodeHTTPFreezeResponse,
+			options...,
+		).Endpoint()
+	}
+	var freezeHistoryEndpoint ep.Endpoint
+	{
+		freezeHistoryEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ""),
+			encodeHTTPFreezeHistoryRequest,
+			decodeHTTPFreezeHistoryResponse,
+			options...,
+		).Endpoint()
+	}
+	var auditLogEndpoint ep.Endpoint
+	{
+		auditLogEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, AuditPath),
+			encodeHTTPAuditLogRequest,
+			decodeHTTPAuditLogResponse,
+			options...,
+		).Endpoint()
+	}
+	var exportTransactionsEndpoint ep.Endpoint
+	{
+		// body is left open, as it is read by returned cursor
+		exportTransactionsEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ExportPath),
+			encodeHTTPExportTransactionsRequest,
+			decodeHTTPExportTransactionsResponse,
+			append([]httptransport.ClientOption{httptransport.BufferedStream(true)}, options...)...,
+		).Endpoint()
+	}
+	var importAccountsEndpoint ep.Endpoint
+	{
+		importAccountsEndpoint = httptransport.NewClient(
+			"POST",
+			copyURL(u, ImportPath),
+			encodeHTTPImportAccountsRequest,
+			decodeHTTPImportAccountsResponse,
+			options...,
+		).Endpoint()
+	}
+	var balanceAtEndpoint ep.Endpoint
+	{
+		balanceAtEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ""),
+			encodeHTTPBalanceAtRequest,
+			decodeHTTPBalanceAtResponse,
+			options...,
+		).Endpoint()
+	}
+	var currenciesEndpoint ep.Endpoint
+	{
+		currenciesEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, CurrenciesPath),
+			encodeHTTPGenericRequest,
+			decodeHTTPCurrenciesResponse,
+			options...,
+		).Endpoint()
+	}
+	var activityEndpoint ep.Endpoint
+	{
+		// body is left open, as it is read by returned subscription
+		activityEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ActivityPath),
+			encodeHTTPActivityRequest,
+			decodeHTTPActivityResponse,
+			append([]httptransport.ClientOption{httptransport.BufferedStream(true)}, options...)...,
+		).Endpoint()
+	}
+	var payoutEndpoint ep.Endpoint
+	{
+		payoutEndpoint = httptransport.NewClient(
+			"POST",
+			copyURL(u, PayoutsPath),
+			encodeHTTPGenericRequest,
+			decodeHTTPPayoutResponse,
+			options...,
+		).Endpoint()
+	}
+	var paymentEndpoint ep.Endpoint
+	{
+		paymentEndpoint = httptransport.NewClient(
+			"GET",
+			copyURL(u, ""),
+			encodeHTTPPaymentRequest,
+			decodeHTTPPaymentResponse,
+			options...,
+		).Endpoint()
+	}
+
+	// resilience middlewares: every attempt of retry passes circuit breaker
+	healthCheckEndpoint = cfg.wrap(healthCheckEndpoint, true)
+	accountEndpoint = cfg.wrap(accountEndpoint, true)
+	transactionHistoryEndpoint = cfg.wrap(transactionHistoryEndpoint, true)
+	transferEndpoint = cfg.wrap(transferEndpoint, false)
+	limitsEndpoint = cfg.wrap(limitsEndpoint, true)
+	setLimitsEndpoint = cfg.wrap(setLimitsEndpoint, true)
+	quoteEndpoint = cfg.wrap(quoteEndpoint, true)
+	feeScheduleEndpoint = cfg.wrap(feeScheduleEndpoint, true)
+	setFeeScheduleEndpoint = cfg.wrap(setFeeScheduleEndpoint, true)
+	setCreditLimitEndpoint = cfg.wrap(setCreditLimitEndpoint, true)
+	freezeEndpoint = cfg.wrap(freezeEndpoint, false)
+	freezeHistoryEndpoint = cfg.wrap(freezeHistoryEndpoint, true)
+	auditLogEndpoint = cfg.wrap(auditLogEndpoint, true)
+	exportTransactionsEndpoint = cfg.wrap(exportTransactionsEndpoint, true)
+	importAccountsEndpoint = cfg.wrap(importAccountsEndpoint, false)
+	balanceAtEndpoint = cfg.wrap(balanceAtEndpoint, true)
+	currenciesEndpoint = cfg.wrap(currenciesEndpoint, true)
+	activityEndpoint = cfg.wrap(activityEndpoint, true)
+	payoutEndpoint = cfg.wrap(payoutEndpoint, false)
+	paymentEndpoint = cfg.wrap(paymentEndpoint, true)
+
 	// Returning the endpoint.Set as a service.Service relies on the
 	// endpoint.Set implementing the Service methods. That's just a simple bit
 	// of glue code.
@@ -133,35 +551,350 @@ func NewHTTPClient(instance string, logger log.Logger) (service.Service, error)
 		AccountEndpoint:            accountEndpoint,
 		TransactionHistoryEndpoint: transactionHistoryEndpoint,
 		TransferEndpoint:           transferEndpoint,
+		LimitsEndpoint:             limitsEndpoint,
+		SetLimitsEndpoint:          setLimitsEndpoint,
+		QuoteEndpoint:              quoteEndpoint,
+		FeeScheduleEndpoint:        feeScheduleEndpoint,
+		SetFeeScheduleEndpoint:     setFeeScheduleEndpoint,
+		SetCreditLimitEndpoint:     setCreditLimitEndpoint,
+		FreezeEndpoint:             freezeEndpoint,
+		FreezeHistoryEndpoint:      freezeHistoryEndpoint,
+		AuditLogEndpoint:           auditLogEndpoint,
+		ExportTransactionsEndpoint: exportTransactionsEndpoint,
+		ImportAccountsEndpoint:     importAccountsEndpoint,
+		BalanceAtEndpoint:          balanceAtEndpoint,
+		CurrenciesEndpoint:         currenciesEndpoint,
+		ActivityEndpoint:           activityEndpoint,
+		PayoutEndpoint:             payoutEndpoint,
+		PaymentEndpoint:            paymentEndpoint,
 	}, nil
 }
 
+// ClientOption configures client returned by NewHTTPClient.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	retries int
+	backoff time.Duration
+	breaker *endpoint.CircuitBreaker
+	tls     *tls.Config
+}
+
+// WithTLS makes client connect to server over TLS with config, f.e. returned by
+// ClientTLSConfig. Instance without scheme is connected with https then.
+func WithTLS(config *tls.Config) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.tls = config
+	}
+}
+
+// WithRetry makes client repeat failed calls up to retries times, waiting backoff
+// before first retry and doubling it after. Transfers and freezes are repeated only
+// if rejected by server without processing, so they are never applied twice.
+func WithRetry(retries int, backoff time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.retries, cfg.backoff = retries, backoff
+	}
+}
+
+// WithCircuitBreaker makes client fail fast with endpoint.ErrCircuitOpen for cooldown
+// after failures consecutive failed calls (transport, retryable or
+// internal errors; errors of requests like insufficient funds are not failures).
+func WithCircuitBreaker(failures int, cooldown time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.breaker = endpoint.NewCircuitBreaker(failures, cooldown)
+	}
+}
+
+func (cfg clientConfig) wrap(e ep.Endpoint, idempotent bool) ep.Endpoint {
+	if cfg.breaker != nil {
+		e = cfg.breaker.Middleware()(e)
+	}
+	if cfg.retries > 0 {
+		e = endpoint.RetryMiddleware(cfg.retries, cfg.backoff, idempotent)(e)
+	}
+	return e
+}
+
 func copyURL(base *url.URL, path string) *url.URL {
 	next := *base
 	next.Path = path
 	return &next
 }
 
-func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
-	w.WriteHeader(err2code(err))
-	_ = json.NewEncoder(w).Encode(errorWrapper{Success: false, Error: err.Error()})
+// pathURL sets path of u to route path with {name} placeholders substituted
+// with vars, each escaped as a path segment, so values may contain slashes.
+func pathURL(u *url.URL, path string, vars map[string]string) {
+	raw := path
+	for k, v := range vars {
+		path = strings.Replace(path, "{"+k+"}", v, 1)
+		raw = strings.Replace(raw, "{"+k+"}", url.PathEscape(v), 1)
+	}
+	u.Path, u.RawPath = path, raw
+}
+
+// pathVar returns unescaped value of route variable of r, routes are matched
+// against escaped path.
+func pathVar(r *http.Request, name string) string {
+	raw := mux.Vars(r)[name]
+	v, err := url.PathUnescape(raw)
+	if err != nil {
+		return raw
+	}
+	return v
+}
+
+// principalToContext is a transport/http.RequestFunc that puts principal
+// into context: common name of verified client certificate if there is one,
+// value of the HTTP request header set by a trusted proxy otherwise, unless
+// client certificates are used. Requests of other peers are anonymous.
+// Primarily useful in a server.
+func (cfg handlerConfig) principalToContext(ctx context.Context, r *http.Request) context.Context {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if principal := r.TLS.VerifiedChains[0][0].Subject.CommonName; principal != "" {
+			return service.ContextWithAuthenticatedPrincipal(ctx, principal)
+		}
+	}
+	if cfg.clientAuth {
+		return ctx
+	}
+	if principal := r.Header.Get(PrincipalHeader); principal != "" && cfg.trustedPeer(r) {
+		return service.ContextWithAuthenticatedPrincipal(ctx, principal)
+	}
+	return ctx
+}
+
+// principalToHTTP is a transport/http.RequestFunc that puts principal
+// from context into the HTTP request header. Primarily useful in a client.
+func principalToHTTP(ctx context.Context, r *http.Request) context.Context {
+	if principal := service.PrincipalFromContext(ctx); principal != service.AnonymousPrincipal {
+		r.Header.Set(PrincipalHeader, principal)
+	}
+	return ctx
+}
+
+// requestMiddleware returns mux middleware, which puts request ID into context
+// and response header, and wraps request into a server span continuing trace
+// of the caller (if any).
+func requestMiddleware(tracer *tracing.Tracer) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(RequestIDHeader)
+			if requestID == "" {
+				requestID = tracing.NewRequestID()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+			ctx := tracing.ContextWithRequestID(r.Context(), requestID)
+			if tracer == nil {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			ctx = tracing.ContextWithTracer(ctx, tracer)
+			if traceID, spanID, ok := tracing.ParseTraceParent(r.Header.Get(TraceParentHeader)); ok {
+				ctx = tracing.ContextWithRemoteParent(ctx, traceID, spanID)
+			}
+			name := r.Method
+			if path, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				name += " " + path
+			}
+			ctx, span := tracing.StartSpan(ctx, name, tracing.KindServer)
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.target", r.URL.RequestURI())
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r.WithContext(ctx))
+			span.SetAttribute("http.status_code", strconv.Itoa(sw.status))
+			var err error
+			if sw.status >= http.StatusInternalServerError {
+				err = errors.New(http.StatusText(sw.status))
+			}
+			span.Finish(err)
+		})
+	}
+}
+
+// statusWriter remembers status code of response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, so streamed response is written at once.
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so connection may be taken over by stream.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errCannotHijack
+	}
+	return hijacker.Hijack()
+}
+
+// clientIPToContext is a transport/http.RequestFunc that puts address of
+// client into context: address of peer, or the one trusted proxy took it from
+// (X-Real-IP, or the last address of X-Forwarded-For appended by the proxy).
+// Forwarding headers of other peers are ignored. Primarily useful in a server.
+func (cfg handlerConfig) clientIPToContext(ctx context.Context, r *http.Request) context.Context {
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if cfg.trustedPeer(r) {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+			clientIP = realIP.String()
+		} else if lastIP := net.ParseIP(strings.TrimSpace(forwarded[len(forwarded)-1])); lastIP != nil {
+			clientIP = lastIP.String()
+		}
+	}
+	return service.ContextWithClientIP(ctx, clientIP)
+}
+
+// requestToHTTP is a transport/http.RequestFunc that puts request ID and
+// current span from context into the HTTP request headers. Primarily useful
+// in a client.
+func requestToHTTP(ctx context.Context, r *http.Request) context.Context {
+	if requestID := tracing.RequestIDFromContext(ctx); requestID != "" {
+		r.Header.Set(RequestIDHeader, requestID)
+	}
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		r.Header.Set(TraceParentHeader, traceParent)
+	}
+	return ctx
+}
+
+// consistencyToContext is a transport/http.RequestFunc that requests
+// read-your-writes consistency of context if the HTTP request header asks
+// for it. Primarily useful in a server.
+func consistencyToContext(ctx context.Context, r *http.Request) context.Context {
+	if strings.EqualFold(r.Header.Get(ConsistencyHeader), ConsistencyStrong) {
+		return repository.ContextWithReadYourWrites(ctx)
+	}
+	return ctx
+}
+
+// consistencyToHTTP is a transport/http.RequestFunc that puts read-your-writes
+// consistency requested by context into the HTTP request header. Primarily
+// useful in a client.
+func consistencyToHTTP(ctx context.Context, r *http.Request) context.Context {
+	if repository.ReadYourWritesFromContext(ctx) {
+		r.Header.Set(ConsistencyHeader, ConsistencyStrong)
+	}
+	return ctx
+}
+
+// errorEncoder writes error as {code, message, details} JSON, or as RFC 7807
+// problem if client accepts application/problem+json. Message is also kept
+// in "error" field for older clients.
+func errorEncoder(ctx context.Context, err error, w http.ResponseWriter) {
+	e := toDomainError(err)
+	if accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string); strings.Contains(accept, problemContentType) {
+		w.Header().Set("Content-Type", problemContentType)
+		w.WriteHeader(e.Status)
+		_ = json.NewEncoder(w).Encode(problem{
+			Type:      "urn:payment-system:error:" + e.Code,
+			Title:     e.Message,
+			Status:    e.Status,
+			Code:      e.Code,
+			Retryable: e.Retryable,
+			Details:   e.Details,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(e.Status)
+	_ = json.NewEncoder(w).Encode(errorWrapper{
+		Success:   false,
+		Error:     e.Message,
+		Code:      e.Code,
+		Message:   e.Message,
+		Retryable: e.Retryable,
+		Details:   e.Details,
+	})
+}
+
+// toDomainError returns domain error err is or wraps, errors of other kinds are internal ones.
+func toDomainError(err error) *errs.Error {
+	var e *errs.Error
+	if !errors.As(err, &e) {
+		return errs.FromCode(errs.ErrInternal.Code, err.Error(), nil)
+	}
+	if error(e) != err {
+		// keep message and details of the wrapping error
+		e = e.WithDetails(e.Details)
+		e.Message = err.Error()
+	}
+	var limitErr *service.LimitError
+	if e.Details == nil && errors.As(err, &limitErr) {
+		e = e.WithDetails(limitErr)
+	}
+	return e
 }
 
-func err2code(err error) int {
-	switch err {
-	case service.ErrInsufficientFunds, repository.ErrPayerNotFound, repository.ErrPayeeNotFound:
-		return http.StatusBadRequest
-	case service.ErrSelfTransfer, service.ErrRequiredArgumentMissing, service.ErrWrongCurrency:
-		return http.StatusBadRequest
-	case service.ErrDifferentCurrency:
-		return http.StatusBadRequest
+// errorDecoder restores domain error from the body of unsuccessful response.
+func errorDecoder(r *http.Response) error {
+	var wrapper struct {
+		Error   string          `json:"error"`
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Title   string          `json:"title"`
+		Details json.RawMessage `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&wrapper); err != nil || wrapper.Code == "" && wrapper.Error == "" {
+		e := errs.FromCode(errs.ErrInternal.Code, http.StatusText(r.StatusCode), nil)
+		e.Status = r.StatusCode
+		return e
+	}
+	message := wrapper.Message
+	if message == "" {
+		message = wrapper.Title
+	}
+	if message == "" {
+		message = wrapper.Error
 	}
-	return http.StatusInternalServerError
+	var details interface{}
+	if len(wrapper.Details) > 0 {
+		details = wrapper.Details
+	}
+	e := errs.FromCode(wrapper.Code, message, details)
+	e.Status = r.StatusCode
+	if errors.Is(e, service.ErrLimitExceeded) && details != nil {
+		limitErr := &service.LimitError{}
+		if err := json.Unmarshal(wrapper.Details, limitErr); err == nil {
+			return limitErr
+		}
+	}
+	return e
 }
 
+const problemContentType = "application/problem+json"
+
 type errorWrapper struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error"`
+	Success   bool        `json:"success"`
+	Error     string      `json:"error"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// problem is RFC 7807 problem details of error
+type problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Code      string      `json:"code"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
 }
 
 // decodeHTTPHealthCheckRequest is a transport/http.DecodeRequestFunc that decodes a
@@ -178,6 +911,22 @@ func decodeHTTPAccountRequest(_ context.Context, _ *http.Request) (interface{},
 	return nil, nil
 }
 
+// decodeHTTPCurrenciesRequest is a transport/http.DecodeRequestFunc for
+// Currencies request, which has no parameters. Primarily useful in a server.
+func decodeHTTPCurrenciesRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return endpoint.CurrenciesRequest{}, nil
+}
+
+// decodeHTTPActivityRequest is a transport/http.DecodeRequestFunc for
+// Activity request, which has no parameters, but WebSocket upgrade request
+// must be valid. Primarily useful in a server.
+func decodeHTTPActivityRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if isWebSocketUpgrade(r) && !validWebSocketUpgrade(r) {
+		return nil, service.ErrRequiredArgumentMissing
+	}
+	return endpoint.ActivityRequest{}, nil
+}
+
 // decodeHTTPTransactionRequest is a transport/http.DecodeRequestFunc that decodes a
 // JSON-encoded TransactionHistory request from the HTTP request body. Primarily useful in a
 // server.
@@ -194,10 +943,186 @@ func decodeHTTPTransferRequest(_ context.Context, r *http.Request) (interface{},
 	return req, err
 }
 
+// decodeHTTPPayoutRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded Payout request from the HTTP request body. Primarily useful in a
+// server.
+func decodeHTTPPayoutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req endpoint.PayoutRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	return req, err
+}
+
+// decodeHTTPPaymentRequest is a transport/http.DecodeRequestFunc that decodes a
+// Payment request from the HTTP request path. Primarily useful in a server.
+func decodeHTTPPaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := strconv.ParseInt(pathVar(r, "id"), 10, 64)
+	if err != nil {
+		return nil, service.ErrRequiredArgumentMissing
+	}
+	return endpoint.PaymentRequest{ID: id}, nil
+}
+
+// decodeHTTPLimitsRequest is a transport/http.DecodeRequestFunc that decodes a
+// Limits request from the HTTP request path. Primarily useful in a server.
+func decodeHTTPLimitsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return endpoint.LimitsRequest{UserID: pathVar(r, "id")}, nil
+}
+
+// decodeHTTPSetLimitsRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded SetLimits request from the HTTP request body, account or currency
+// is taken from the HTTP request path. Primarily useful in a server.
+func decodeHTTPSetLimitsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var limits repository.Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		return nil, err
+	}
+	limits.UserID = pathVar(r, "id")
+	limits.Currency = pathVar(r, "currency")
+	return endpoint.SetLimitsRequest{Limits: &limits}, nil
+}
+
+// decodeHTTPFeeScheduleRequest is a transport/http.DecodeRequestFunc that decodes a
+// FeeSchedule request from the HTTP request path. Primarily useful in a server.
+func decodeHTTPFeeScheduleRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return endpoint.FeeScheduleRequest{Currency: pathVar(r, "currency")}, nil
+}
+
+// decodeHTTPSetFeeScheduleRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded SetFeeSchedule request from the HTTP request body, currency is taken
+// from the HTTP request path. Primarily useful in a server.
+func decodeHTTPSetFeeScheduleRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var schedule repository.FeeSchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		return nil, err
+	}
+	schedule.Currency = pathVar(r, "currency")
+	return endpoint.SetFeeScheduleRequest{Schedule: &schedule}, nil
+}
+
+// decodeHTTPSetCreditLimitRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded SetCreditLimit request from the HTTP request body, account is taken
+// from the HTTP request path. Primarily useful in a server.
+func decodeHTTPSetCreditLimitRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req endpoint.SetCreditLimitRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.UserID = pathVar(r, "id")
+	return req, err
+}
+
+// decodeHTTPFreezeRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded Freeze request from the HTTP request body, account is taken
+// from the HTTP request path. Primarily useful in a server.
+func decodeHTTPFreezeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req endpoint.FreezeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.UserID = pathVar(r, "id")
+	return req, err
+}
+
+// decodeHTTPFreezeHistoryRequest is a transport/http.DecodeRequestFunc that decodes a
+// FreezeHistory request from the HTTP request path. Primarily useful in a server.
+func decodeHTTPFreezeHistoryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return endpoint.FreezeHistoryRequest{UserID: pathVar(r, "id")}, nil
+}
+
+// decodeHTTPBalanceAtRequest is a transport/http.DecodeRequestFunc that decodes a
+// BalanceAt request from the HTTP request path and RFC 3339 time of "at" query
+// parameter. Primarily useful in a server.
+func decodeHTTPBalanceAtRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.BalanceAtRequest{UserID: pathVar(r, "id")}
+	if at := r.URL.Query().Get("at"); at != "" {
+		v, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return nil, service.ErrRequiredArgumentMissing
+		}
+		req.At = v
+	}
+	return req, nil
+}
+
+// decodeHTTPAuditLogRequest is a transport/http.DecodeRequestFunc that decodes a
+// AuditLog request from the HTTP request query. Primarily useful in a server.
+func decodeHTTPAuditLogRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req endpoint.AuditLogRequest
+	query := r.URL.Query()
+	if after := query.Get("after"); after != "" {
+		v, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return nil, service.ErrRequiredArgumentMissing
+		}
+		req.After = v
+	}
+	if limit := query.Get("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, service.ErrRequiredArgumentMissing
+		}
+		req.Limit = v
+	}
+	return req, nil
+}
+
+// decodeHTTPExportTransactionsRequest is a transport/http.DecodeRequestFunc that decodes a
+// ExportTransactions request from the HTTP request query. Primarily useful in a server.
+func decodeHTTPExportTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	req := endpoint.ExportTransactionsRequest{
+		Filter: &repository.TransactionFilter{Account: query.Get("account")},
+		Format: query.Get("format"),
+	}
+	if req.Format == "" {
+		req.Format = export.FormatCSV
+	}
+	var err error
+	if req.Filter.From, err = export.ParseDate(query.Get("from")); err != nil {
+		return nil, service.ErrRequiredArgumentMissing
+	}
+	if req.Filter.To, err = export.ParseDate(query.Get("to")); err != nil {
+		return nil, service.ErrRequiredArgumentMissing
+	}
+	if err = export.Validate(req.Format, req.Filter); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeHTTPImportAccountsRequest is a transport/http.DecodeRequestFunc that decodes
+// rows of ImportAccounts request from CSV or JSON Lines file in the HTTP request body,
+// format and options are taken from the request query. Primarily useful in a server.
+func decodeHTTPImportAccountsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = importer.FormatCSV
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+			format = importer.FormatJSONL
+		}
+	}
+	req := endpoint.ImportAccountsRequest{
+		Options: &repository.ImportOptions{Resume: query.Get("resume")},
+	}
+	if chunk := query.Get("chunk"); chunk != "" {
+		v, err := strconv.Atoi(chunk)
+		if err != nil {
+			return nil, service.ErrRequiredArgumentMissing
+		}
+		req.Options.ChunkSize = v
+	}
+	rows, err := importer.Read(format, http.MaxBytesReader(nil, r.Body, MaxImportSize))
+	if err != nil {
+		return nil, err
+	}
+	req.Rows = rows
+	return req, nil
+}
+
 // decodeHTTPHealthCheckResponse is a transport/http.DecodeResponseFunc that decodes a
 // JSON-encoded HealthCheck response from the HTTP response body. Primarily useful in a
 // client.
 func decodeHTTPHealthCheckResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.HealthCheckResponse{Error: errorDecoder(r)}, nil
+	}
 	var resp endpoint.HealthCheckResponse
 	err := json.NewDecoder(r.Body).Decode(&resp)
 	return resp, err
@@ -207,6 +1132,9 @@ func decodeHTTPHealthCheckResponse(_ context.Context, r *http.Response) (interfa
 // JSON-encoded Account response from the HTTP response body. Primarily useful in a
 // client.
 func decodeHTTPAccountResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.AccountResponse{Error: errorDecoder(r)}, nil
+	}
 	var resp endpoint.AccountResponse
 	err := json.NewDecoder(r.Body).Decode(&resp)
 	return resp, err
@@ -216,6 +1144,9 @@ func decodeHTTPAccountResponse(_ context.Context, r *http.Response) (interface{}
 // JSON-encoded Transaction response from the HTTP response body. Primarily useful in a
 // client.
 func decodeHTTPTransactionResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.TransactionHistoryResponse{Error: errorDecoder(r)}, nil
+	}
 	var resp endpoint.TransactionHistoryResponse
 	err := json.NewDecoder(r.Body).Decode(&resp)
 	return resp, err
@@ -225,11 +1156,365 @@ func decodeHTTPTransactionResponse(_ context.Context, r *http.Response) (interfa
 // JSON-encoded Transfer response from the HTTP response body. Primarily useful in a
 // client.
 func decodeHTTPTransferResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.TransferResponse{Error: errorDecoder(r)}, nil
+	}
 	var resp endpoint.TransferResponse
 	err := json.NewDecoder(r.Body).Decode(&resp)
 	return resp, err
 }
 
+// decodeHTTPLimitsResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Limits response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPLimitsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.LimitsResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.LimitsResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPSetLimitsResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded SetLimits response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPSetLimitsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.SetLimitsResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.SetLimitsResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPQuoteResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Quote response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPQuoteResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.QuoteResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.QuoteResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPFeeScheduleResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded FeeSchedule response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPFeeScheduleResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.FeeScheduleResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.FeeScheduleResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPSetFeeScheduleResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded SetFeeSchedule response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPSetFeeScheduleResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.SetFeeScheduleResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.SetFeeScheduleResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// encodeHTTPFeeScheduleRequest is a transport/http.EncodeRequestFunc that puts
+// currency of FeeSchedule request into the request path. Primarily useful in a client.
+func encodeHTTPFeeScheduleRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.FeeScheduleRequest)
+	pathURL(r.URL, FeeSchedulePath, map[string]string{"currency": req.Currency})
+	return nil
+}
+
+// encodeHTTPSetFeeScheduleRequest is a transport/http.EncodeRequestFunc that puts
+// currency of SetFeeSchedule request into the request path and JSON-encodes
+// schedule to the request body. Primarily useful in a client.
+func encodeHTTPSetFeeScheduleRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.SetFeeScheduleRequest)
+	pathURL(r.URL, FeeSchedulePath, map[string]string{"currency": req.Schedule.Currency})
+	return encodeHTTPGenericRequest(ctx, r, req.Schedule)
+}
+
+// decodeHTTPSetCreditLimitResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded SetCreditLimit response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPSetCreditLimitResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.SetCreditLimitResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.SetCreditLimitResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// encodeHTTPSetCreditLimitRequest is a transport/http.EncodeRequestFunc that puts
+// account of SetCreditLimit request into the request path and JSON-encodes credit
+// limit to the request body. Primarily useful in a client.
+func encodeHTTPSetCreditLimitRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.SetCreditLimitRequest)
+	pathURL(r.URL, CreditLimitPath, map[string]string{"id": req.UserID})
+	return encodeHTTPGenericRequest(ctx, r, req)
+}
+
+// decodeHTTPFreezeResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Freeze response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPFreezeResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.FreezeResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.FreezeResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPFreezeHistoryResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded FreezeHistory response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPFreezeHistoryResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.FreezeHistoryResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.FreezeHistoryResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPBalanceAtResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded BalanceAt response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPBalanceAtResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.BalanceAtResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.BalanceAtResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPCurrenciesResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Currencies response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPCurrenciesResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.CurrenciesResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.CurrenciesResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPPayoutResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Payout response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPPayoutResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.PayoutResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.PayoutResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPPaymentResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded Payment response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPPaymentResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.PaymentResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.PaymentResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// encodeHTTPPaymentRequest is a transport/http.EncodeRequestFunc that puts
+// ID of Payment request into the request path. Primarily useful in a client.
+func encodeHTTPPaymentRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.PaymentRequest)
+	pathURL(r.URL, PaymentPath, map[string]string{"id": strconv.FormatInt(req.ID, 10)})
+	return nil
+}
+
+// encodeHTTPActivityRequest is a transport/http.EncodeRequestFunc that asks
+// for Server-Sent Events. Primarily useful in a client.
+func encodeHTTPActivityRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.Header.Set("Accept", eventStreamContentType)
+	return nil
+}
+
+// decodeHTTPActivityResponse is a transport/http.DecodeResponseFunc that
+// returns subscription reading Server-Sent Events from the HTTP response body
+// until it is closed. Current balances come as the first events. Primarily
+// useful in a client.
+func decodeHTTPActivityResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		return endpoint.ActivityResponse{Error: errorDecoder(r)}, nil
+	}
+	events := make(chan *activity.Event, activity.Buffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		_ = readEventStream(r.Body, events, done)
+	}()
+	return endpoint.ActivityResponse{Subscription: activity.NewSubscription(events, func() {
+		close(done)
+		r.Body.Close()
+	})}, nil
+}
+
+// encodeHTTPBalanceAtRequest is a transport/http.EncodeRequestFunc that puts
+// account of BalanceAt request into the request path and its time into the
+// request query. Primarily useful in a client.
+func encodeHTTPBalanceAtRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.BalanceAtRequest)
+	pathURL(r.URL, BalancePath, map[string]string{"id": req.UserID})
+	if !req.At.IsZero() {
+		r.URL.RawQuery = url.Values{"at": {req.At.Format(time.RFC3339Nano)}}.Encode()
+	}
+	return nil
+}
+
+// encodeHTTPFreezeRequest is a transport/http.EncodeRequestFunc that puts
+// account of Freeze request into the request path and JSON-encodes freeze
+// state to the request body. Primarily useful in a client.
+func encodeHTTPFreezeRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.FreezeRequest)
+	pathURL(r.URL, FreezePath, map[string]string{"id": req.UserID})
+	return encodeHTTPGenericRequest(ctx, r, req)
+}
+
+// encodeHTTPFreezeHistoryRequest is a transport/http.EncodeRequestFunc that puts
+// account of FreezeHistory request into the request path. Primarily useful in a client.
+func encodeHTTPFreezeHistoryRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.FreezeHistoryRequest)
+	pathURL(r.URL, FreezePath, map[string]string{"id": req.UserID})
+	return nil
+}
+
+// decodeHTTPAuditLogResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded AuditLog response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPAuditLogResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.AuditLogResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.AuditLogResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// decodeHTTPExportTransactionsResponse is a transport/http.DecodeResponseFunc that
+// returns cursor over JSON Lines export in the HTTP response body. Primarily useful
+// in a client.
+func decodeHTTPExportTransactionsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		return endpoint.ExportTransactionsResponse{Error: errorDecoder(r)}, nil
+	}
+	return endpoint.ExportTransactionsResponse{Format: export.FormatJSONL, Cursor: export.NewJSONLReader(r.Body)}, nil
+}
+
+// decodeHTTPImportAccountsResponse is a transport/http.DecodeResponseFunc that decodes a
+// JSON-encoded ImportAccounts response from the HTTP response body. Primarily useful in a
+// client.
+func decodeHTTPImportAccountsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return endpoint.ImportAccountsResponse{Error: errorDecoder(r)}, nil
+	}
+	var resp endpoint.ImportAccountsResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	return resp, err
+}
+
+// encodeHTTPImportAccountsRequest is a transport/http.EncodeRequestFunc that puts
+// options of ImportAccounts request into the request query and rows as JSON Lines
+// file to the request body. Primarily useful in a client.
+func encodeHTTPImportAccountsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.ImportAccountsRequest)
+	query := url.Values{}
+	query.Set("format", importer.FormatJSONL)
+	if req.Options != nil {
+		if req.Options.ChunkSize > 0 {
+			query.Set("chunk", strconv.Itoa(req.Options.ChunkSize))
+		}
+		if req.Options.Resume != "" {
+			query.Set("resume", req.Options.Resume)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+	var buf bytes.Buffer
+	if err := importer.WriteJSONL(&buf, req.Rows); err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	r.Body = ioutil.NopCloser(&buf)
+	return nil
+}
+
+// encodeHTTPExportTransactionsRequest is a transport/http.EncodeRequestFunc that puts
+// format and filter of ExportTransactions request into the request query. Primarily
+// useful in a client.
+func encodeHTTPExportTransactionsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.ExportTransactionsRequest)
+	query := url.Values{}
+	query.Set("format", req.Format)
+	if req.Filter != nil {
+		if req.Filter.Account != "" {
+			query.Set("account", req.Filter.Account)
+		}
+		if !req.Filter.From.IsZero() {
+			query.Set("from", req.Filter.From.Format(time.RFC3339))
+		}
+		if !req.Filter.To.IsZero() {
+			query.Set("to", req.Filter.To.Format(time.RFC3339))
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// encodeHTTPAuditLogRequest is a transport/http.EncodeRequestFunc that puts
+// paging of AuditLog request into the request query. Primarily useful in a client.
+func encodeHTTPAuditLogRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.AuditLogRequest)
+	query := url.Values{}
+	query.Set("after", strconv.FormatInt(req.After, 10))
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	r.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// encodeHTTPLimitsRequest is a transport/http.EncodeRequestFunc that puts
+// account of Limits request into the request path. Primarily useful in a client.
+func encodeHTTPLimitsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.LimitsRequest)
+	pathURL(r.URL, AccountLimitsPath, map[string]string{"id": req.UserID})
+	return nil
+}
+
+// encodeHTTPSetLimitsRequest is a transport/http.EncodeRequestFunc that puts
+// account or currency of SetLimits request into the request path and JSON-encodes
+// limits to the request body. Primarily useful in a client.
+func encodeHTTPSetLimitsRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(endpoint.SetLimitsRequest)
+	if req.Limits.UserID != "" {
+		pathURL(r.URL, AccountLimitsPath, map[string]string{"id": req.Limits.UserID})
+	} else {
+		pathURL(r.URL, CurrencyLimitsPath, map[string]string{"currency": req.Limits.Currency})
+	}
+	return encodeHTTPGenericRequest(ctx, r, req.Limits)
+}
+
 // encodeHTTPGenericRequest is a transport/http.EncodeRequestFunc that
 // JSON-encodes any request to the request body. Primarily useful in a client.
 func encodeHTTPGenericRequest(_ context.Context, r *http.Request, request interface{}) error {
@@ -241,6 +1526,26 @@ func encodeHTTPGenericRequest(_ context.Context, r *http.Request, request interf
 	return nil
 }
 
+// encodeHTTPExportTransactionsResponse is a transport/http.EncodeResponseFunc that
+// streams transactions of cursor to the response writer in requested format.
+// Primarily useful in a server.
+func encodeHTTPExportTransactionsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(endpoint.ExportTransactionsResponse)
+	if resp.Error != nil {
+		errorEncoder(ctx, resp.Error, w)
+		return nil
+	}
+	defer resp.Cursor.Close()
+	writer, err := export.NewWriter(resp.Format, w, resp.Filter)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", export.ContentType(resp.Format))
+	w.Header().Set("Content-Disposition", `attachment; filename="payments.`+resp.Format+`"`)
+	_, err = export.Copy(writer, resp.Cursor)
+	return err
+}
+
 // encodeHTTPGenericResponse is a transport/http.EncodeResponseFunc that encodes
 // the response as JSON to the response writer. Primarily useful in a server.
 func encodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
@@ -0,0 +1,599 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/errs"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestErrorsOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// test typed errors are restored by client
+	_, err = client.Transfer(ctx, "alice456", "bob123", 1000, "")
+	if !errors.Is(err, service.ErrInsufficientFunds) || err.Error() != service.ErrInsufficientFunds.Error() {
+		t.Errorf("Error should be: %v, got %v", service.ErrInsufficientFunds, err)
+	}
+	_, err = client.Transfer(ctx, "vasya", "bob123", 1, "")
+	if !errors.Is(err, repository.ErrPayerNotFound) || errors.Is(err, repository.ErrPayeeNotFound) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrPayerNotFound, err)
+	}
+	var e *errs.Error
+	if _, _, err = client.Limits(ctx, "vasya"); !errors.As(err, &e) || e.Status != http.StatusNotFound {
+		t.Errorf("Error should be: %v with status 404, got %v", repository.ErrAccountNotFound, err)
+	}
+
+	// test details of limit error are restored
+	_ = svc.SetLimits(ctx, &repository.Limits{UserID: "alice456", MaxAmount: 10})
+	_, err = client.Transfer(ctx, "alice456", "bob123", 20, "")
+	var limitErr *service.LimitError
+	if !errors.Is(err, service.ErrLimitExceeded) || !errors.As(err, &limitErr) || limitErr.Rule != service.LimitMaxAmount ||
+		err.Error() != "Limit exceeded: max_amount" {
+		t.Errorf("Error should be: %v, got %v", service.ErrLimitExceeded, err)
+	}
+
+	// test problem+json is returned if accepted
+	req, _ := http.NewRequest("POST", server.URL+TransferPath, strings.NewReader(`{"from":"alice456","to":"alice456","amount":1}`))
+	req.Header.Set("Accept", problemContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var p problem
+	_ = json.NewDecoder(resp.Body).Decode(&p)
+	if resp.Header.Get("Content-Type") != problemContentType || p.Status != http.StatusBadRequest ||
+		p.Code != "self_transfer" || p.Title != service.ErrSelfTransfer.Error() {
+		t.Errorf("Unexpected problem: %s %+v", resp.Header.Get("Content-Type"), p)
+	}
+}
+
+// trustLoopback makes handler trust principal header of local test clients.
+func trustLoopback() HandlerOption {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	return WithTrustedProxies([]*net.IPNet{loopback})
+}
+
+func TestPrincipalOverHTTP(t *testing.T) {
+	logger := log.NewNopLogger()
+	for _, tc := range []struct {
+		name  string
+		opts  []HandlerOption
+		actor string
+	}{
+		{"trusted proxy", []HandlerOption{trustLoopback()}, "admin"},
+		{"untrusted peer", nil, service.AnonymousPrincipal},
+	} {
+		repo := inmem.NewInmem()
+		repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+		repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+		svc := service.New(repo, logger)
+		server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger, tc.opts...))
+		client, err := NewHTTPClient(server.URL, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := service.ContextWithPrincipal(context.Background(), "admin")
+		if _, err = client.Transfer(ctx, "alice456", "bob123", 10, ""); err != nil {
+			t.Fatal(err)
+		}
+		records, err := svc.AuditLog(context.Background(), 0, 0)
+		if err != nil || len(records) != 1 || records[0].Actor != tc.actor {
+			t.Errorf("%s: actor should be: %s, got %v %v", tc.name, tc.actor, records, err)
+		}
+		server.Close()
+	}
+}
+
+func TestAdminEndpointsOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger, "admin"), nil, logger,
+		trustLoopback()))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := map[string]func(ctx context.Context) error{
+		"SetCreditLimit": func(ctx context.Context) error { return client.SetCreditLimit(ctx, "alice456", 1000) },
+		"SetLimits": func(ctx context.Context) error {
+			return client.SetLimits(ctx, &repository.Limits{UserID: "alice456", MaxAmount: 1000})
+		},
+		"SetCurrencyLimits": func(ctx context.Context) error {
+			return client.SetLimits(ctx, &repository.Limits{Currency: "USD", MaxAmount: 1000})
+		},
+		"SetFeeSchedule": func(ctx context.Context) error {
+			return client.SetFeeSchedule(ctx, &repository.FeeSchedule{Currency: "USD", RevenueAccount: "alice456", Fixed: 1})
+		},
+		"Freeze": func(ctx context.Context) error {
+			return client.Freeze(ctx, "alice456", repository.FreezeDebit, "AML_REVIEW", "")
+		},
+		"FreezeHistory": func(ctx context.Context) error {
+			_, err := client.FreezeHistory(ctx, "alice456")
+			return err
+		},
+		"AuditLog": func(ctx context.Context) error {
+			_, err := client.AuditLog(ctx, 0, 0)
+			return err
+		},
+	}
+	for name, call := range calls {
+		// test anonymous and non-admin principals are rejected
+		for _, principal := range []string{"", "alice456"} {
+			ctx := service.ContextWithPrincipal(context.Background(), principal)
+			if err = call(ctx); !errors.Is(err, endpoint.ErrAdminRequired) {
+				t.Errorf("%s of %q should fail with: %v, got %v", name, principal, endpoint.ErrAdminRequired, err)
+			}
+		}
+		if err = call(service.ContextWithPrincipal(context.Background(), "admin")); err != nil {
+			t.Errorf("%s of admin should succeed, got %v", name, err)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		clientIP   string
+	}{
+		{"direct", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"spoofed by client", "192.0.2.1:1234", "198.51.100.1", "198.51.100.2", "192.0.2.1"},
+		{"real IP of proxy", "127.0.0.1:1234", "198.51.100.1", "203.0.113.1, 198.51.100.2", "198.51.100.1"},
+		{"appended by proxy", "127.0.0.1:1234", "", "203.0.113.1, 198.51.100.2", "198.51.100.2"},
+		{"invalid from proxy", "127.0.0.1:1234", "unknown", "", "127.0.0.1"},
+	} {
+		var cfg handlerConfig
+		trustLoopback()(&cfg)
+		r := httptest.NewRequest("GET", AccountPath, nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if clientIP := service.ClientIPFromContext(cfg.clientIPToContext(context.Background(), r)); clientIP != tc.clientIP {
+			t.Errorf("%s: client IP should be: %s, got %s", tc.name, tc.clientIP, clientIP)
+		}
+	}
+}
+
+func TestRateLimitOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	limits := endpoint.Limits{PrincipalRate: 0.001, Burst: 2}
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, limits, logger), nil, logger, trustLoopback()))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := service.ContextWithPrincipal(context.Background(), "alice456")
+
+	// test burst is allowed, then principal is rate limited
+	for i := 0; i < 2; i++ {
+		if _, err = client.Account(ctx); err != nil {
+			t.Fatalf("Request %d should pass, got %v", i, err)
+		}
+	}
+	var e *errs.Error
+	if _, err = client.Account(ctx); !errors.Is(err, endpoint.ErrRateLimited) || !errors.As(err, &e) ||
+		e.Status != http.StatusTooManyRequests || !e.Retryable {
+		t.Errorf("Error should be: %v, got %v", endpoint.ErrRateLimited, err)
+	}
+
+	// test other principal has own bucket
+	if _, err = client.Account(service.ContextWithPrincipal(ctx, "bob123")); err != nil {
+		t.Errorf("Other principal should not be limited, got %v", err)
+	}
+
+	// test untrusted peer can't escape its bucket by claimed principal or forwarding headers
+	limits = endpoint.Limits{PrincipalRate: 0.001, IPRate: 0.001, Burst: 2}
+	untrusted := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, limits, logger), nil, logger))
+	defer untrusted.Close()
+	for i, principal := range []string{"alice456", "bob123", "carol789"} {
+		req, _ := http.NewRequest("GET", untrusted.URL+AccountPath, nil)
+		req.Header.Set(PrincipalHeader, principal)
+		req.Header.Set("X-Forwarded-For", "198.51.100."+principal[len(principal)-1:])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if limited := resp.StatusCode == http.StatusTooManyRequests; limited != (i == 2) {
+			t.Errorf("Request %d should be limited: %v, got status %d", i, i == 2, resp.StatusCode)
+		}
+	}
+}
+
+func TestClientResilience(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"success":false,"error":"Too many concurrent requests","code":"overloaded","retryable":true}`))
+	}))
+	defer server.Close()
+	logger := log.NewNopLogger()
+	ctx := context.Background()
+
+	// test rejected requests are retried, even if not idempotent
+	client, err := NewHTTPClient(server.URL, logger, WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Transfer(ctx, "alice456", "bob123", 1, ""); !errors.Is(err, endpoint.ErrOverloaded) || calls != 3 {
+		t.Errorf("Error should be: %v after 3 calls, got %v after %d", endpoint.ErrOverloaded, err, calls)
+	}
+
+	// test breaker opens after failures and stops calling server
+	calls = 0
+	client, err = NewHTTPClient(server.URL, logger, WithCircuitBreaker(2, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _ = client.Account(ctx)
+	}
+	if _, err = client.Account(ctx); !errors.Is(err, endpoint.ErrCircuitOpen) || calls != 2 {
+		t.Errorf("Error should be: %v after 2 calls, got %v after %d", endpoint.ErrCircuitOpen, err, calls)
+	}
+}
+
+func TestHealthCheckDraining(t *testing.T) {
+	logger := log.NewNopLogger()
+	readiness := &service.Readiness{}
+	svc := service.ReadinessMiddleware(readiness)(service.New(inmem.NewInmem(), logger))
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + HealthCheckPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status should be: %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// test instance reports unhealthy while draining
+	readiness.Drain()
+	resp, err = http.Get(server.URL + HealthCheckPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Status should be: %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	logger := log.NewNopLogger()
+	svc := service.New(inmem.NewInmem(), logger)
+
+	// test metrics are served by metrics handler only
+	for handler, status := range map[http.Handler]int{
+		NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger): http.StatusNotFound,
+		NewMetricsHandler(): http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+		if rec.Code != status || (status == http.StatusOK && !strings.Contains(rec.Body.String(), "memstats")) {
+			t.Errorf("Status should be: %d, got %d", status, rec.Code)
+		}
+	}
+}
+
+func TestExportOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := svc.Transfer(ctx, "alice456", "bob123", 10.5, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// test CSV is streamed as attachment
+	resp, err := http.Get(server.URL + ExportPath + "?format=csv&account=alice456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != `attachment; filename="payments.csv"` ||
+		len(lines) != 7 || !strings.HasSuffix(lines[2], ",outgoing,alice456,bob123,10.50,0.00,USD,") {
+		t.Errorf("Unexpected export: %d %v %q", resp.StatusCode, resp.Header, lines)
+	}
+
+	// test client reads export by cursor
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := client.ExportTransactions(ctx, &repository.TransactionFilter{Account: "alice456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close()
+	var n int
+	for ; ; n++ {
+		txn, err := cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || txn.Amount != 10.5 {
+			t.Fatalf("Unexpected transaction: %+v %v", txn, err)
+		}
+	}
+	if n != 6 {
+		t.Errorf("Export should have 6 transactions, got %d", n)
+	}
+
+	// test wrong requests are rejected
+	if _, err = client.ExportTransactions(ctx, &repository.TransactionFilter{Account: "vasya"}); !errors.Is(err, repository.ErrAccountNotFound) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrAccountNotFound, err)
+	}
+	if resp, err = http.Get(server.URL + ExportPath + "?format=ofx"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status should be: %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestImportOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger, "admin"), nil, logger,
+		trustLoopback()))
+	defer server.Close()
+	post := func(principal, query, body string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", server.URL+ImportPath+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		if principal != "" {
+			req.Header.Set(PrincipalHeader, principal)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	// test only authenticated admin may import
+	for _, principal := range []string{"", "bob123"} {
+		resp, err := post(principal, "?format=csv", "id,currency,balance\nmallory,USD,1000000\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Status of %q should be: %d, got %d", principal, http.StatusForbidden, resp.StatusCode)
+		}
+	}
+	if _, err := repo.GetAccount("mallory"); !errors.Is(err, repository.ErrAccountNotFound) {
+		t.Errorf("Account should not be imported, got %v", err)
+	}
+
+	// test CSV is imported and reported
+	resp, err := post("admin", "?format=csv&chunk=10", "id,currency,balance\nbob123,USD,10\npetya,EUR,0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Success bool                    `json:"success"`
+		Report  repository.ImportReport `json:"report"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !body.Success || body.Report.Created != 2 ||
+		body.Report.Rows[1].Line != 3 || body.Report.Rows[1].Status != repository.ImportCreated {
+		t.Errorf("Unexpected import: %d %+v %v", resp.StatusCode, body, err)
+	}
+
+	// test client gets report of failed import
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.ImportAccounts(service.ContextWithPrincipal(context.Background(), "admin"), []*repository.AccountImport{
+		{Line: 2, UserID: "vasya", Currency: "USD", Balance: 1},
+		{Line: 3, UserID: "bob123", Currency: "USD"},
+	}, nil)
+	if !errors.Is(err, service.ErrImportFailed) || report == nil || report.Failed != 1 ||
+		report.Rows[1].Line != 3 || report.Rows[1].Code != repository.ErrAccountExists.Code {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+
+	// test malformed file is rejected
+	if resp, err = post("admin", "", "id\nvasya\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status should be: %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestBalanceAtOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before := time.Now()
+	if _, err = client.Transfer(ctx, "alice456", "bob123", 10, "USD"); err != nil {
+		t.Fatal(err)
+	}
+
+	// test time is passed with sub-second precision
+	balance, err := client.BalanceAt(ctx, "bob123", before)
+	if err != nil || balance.Balance != 0 || !balance.At.Equal(before) {
+		t.Errorf("Unexpected balance: %+v %v", balance, err)
+	}
+	if balance, err = client.BalanceAt(ctx, "bob123", time.Time{}); err != nil || balance.Balance != 10 {
+		t.Errorf("Unexpected balance: %+v %v", balance, err)
+	}
+	if _, err = client.BalanceAt(ctx, "vasya", time.Time{}); !errors.Is(err, repository.ErrAccountNotFound) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrAccountNotFound, err)
+	}
+
+	// test malformed time is rejected
+	resp, err := http.Get(server.URL + "/v1/accounts/bob123/balance?at=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status should be: %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestCurrenciesOverHTTP(t *testing.T) {
+	logger := log.NewNopLogger()
+	svc := service.New(inmem.NewInmem(), logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currencies, err := client.Currencies(context.Background())
+	if err != nil || len(currencies) == 0 {
+		t.Fatalf("Unexpected currencies: %+v %v", currencies, err)
+	}
+	for _, c := range currencies {
+		if c.Code == "KWD" && (c.Numeric != 414 || c.Exponent != 3 || !c.Enabled) {
+			t.Errorf("Unexpected currency %+v", c)
+		}
+	}
+}
+
+func TestPathEscapingOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "a/b?c#d%e f", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "a", Balance: 100, Currency: "USD"})
+
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger, "admin"), nil, logger,
+		trustLoopback()))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := service.ContextWithPrincipal(context.Background(), "admin")
+
+	// test account with reserved characters is addressed as a single path segment
+	r, _ := http.NewRequest("GET", server.URL, nil)
+	pathURL(r.URL, AccountLimitsPath, map[string]string{"id": "a/b?c#d%e f"})
+	if path := r.URL.EscapedPath(); path != "/v1/accounts/a%2Fb%3Fc%23d%25e%20f/limits" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	if err = client.SetLimits(ctx, &repository.Limits{UserID: "a/b?c#d%e f", MaxAmount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	limits, _, err := client.Limits(ctx, "a/b?c#d%e f")
+	if err != nil || limits.UserID != "a/b?c#d%e f" || limits.MaxAmount != 10 {
+		t.Errorf("Unexpected limits %+v, err %v", limits, err)
+	}
+	if limits, _, err = client.Limits(ctx, "a"); err != nil || limits.MaxAmount != 0 {
+		t.Errorf("Limits of other account should not be set, got %+v, err %v", limits, err)
+	}
+}
+
+func TestPayoutOverHTTP(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	payout, err := client.Payout(ctx, "alice456", "DE89370400440532013000", 30, "USD")
+	if err != nil || payout.State != repository.PayoutPending || payout.ID == 0 {
+		t.Fatalf("Unexpected payout: %+v %v", payout, err)
+	}
+	if _, err = client.Payout(ctx, "alice456", "", 30, "USD"); !errors.Is(err, service.ErrRequiredArgumentMissing) {
+		t.Errorf("Error should be: %v, got %v", service.ErrRequiredArgumentMissing, err)
+	}
+
+	// test status of payout is served next to export of payments
+	status, err := client.Payment(ctx, payout.ID)
+	if err != nil || status.Status != repository.PayoutPending || status.Payout == nil || status.Payout.Amount != 30 {
+		t.Errorf("Unexpected status: %+v %v", status, err)
+	}
+	if _, err = client.Payment(ctx, payout.ID+100); !errors.Is(err, repository.ErrPaymentNotFound) {
+		t.Errorf("Error should be: %v, got %v", repository.ErrPaymentNotFound, err)
+	}
+	resp, err := http.Get(server.URL + ExportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Export should be served, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,317 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/export"
+	"github.com/khaliullov/payment-system/pkg/importer"
+	"github.com/khaliullov/payment-system/pkg/openapi"
+	"github.com/khaliullov/payment-system/pkg/repository"
+)
+
+// APIVersion is a version of HTTP API in OpenAPI document.
+const APIVersion = "1.1.0"
+
+// media is a set of body types by media types of operation, which body is not
+// just JSON. String type stands for body which is not JSON at all.
+type media map[string]interface{}
+
+// apiOperation describes operation registered by NewHTTPHandler for OpenAPI
+// document, request and response are types of JSON bodies or media.
+type apiOperation struct {
+	method, path string
+	id, tag      string
+	summary      string
+	// params are query parameters and path ones which are not strings
+	params   []*openapi.Parameter
+	request  interface{}
+	response interface{}
+}
+
+func queryParam(name, description string, schema *openapi.Schema) *openapi.Parameter {
+	return &openapi.Parameter{Name: name, In: openapi.InQuery, Description: description, Schema: schema}
+}
+
+var (
+	stringSchema  = &openapi.Schema{Type: "string"}
+	integerSchema = &openapi.Schema{Type: "integer", Format: "int64"}
+)
+
+// apiOperations are operations of HTTP API in order of their registration by NewHTTPHandler.
+var apiOperations = []apiOperation{
+	{
+		method: "GET", path: HealthCheckPath, id: "healthCheck", tag: "system",
+		summary:  "Check health of instance, it fails while instance is draining",
+		response: endpoint.HealthCheckResponse{},
+	},
+	{
+		method: "GET", path: AccountPath, id: "listAccounts", tag: "account",
+		summary:  "Get list of existing accounts grouped per holder",
+		response: endpoint.AccountResponse{},
+	},
+	{
+		method: "GET", path: TransactionPath, id: "listTransactions", tag: "payment",
+		summary:  "Get list of processed transfers",
+		response: endpoint.TransactionHistoryResponse{},
+	},
+	{
+		method: "POST", path: TransferPath, id: "makeTransfer", tag: "transfer",
+		summary:  "Transfer money from account to account",
+		request:  endpoint.TransferRequest{},
+		response: endpoint.TransferResponse{},
+	},
+	{
+		method: "GET", path: AccountLimitsPath, id: "getAccountLimits", tag: "limit",
+		summary:  "Get effective transfer limits of account and their usage",
+		response: endpoint.LimitsResponse{},
+	},
+	{
+		method: "PUT", path: AccountLimitsPath, id: "setAccountLimits", tag: "limit",
+		summary:  "Set transfer limits of account",
+		request:  repository.Limits{},
+		response: endpoint.SetLimitsResponse{},
+	},
+	{
+		method: "PUT", path: CurrencyLimitsPath, id: "setCurrencyLimits", tag: "limit",
+		summary:  "Set default transfer limits of currency",
+		request:  repository.Limits{},
+		response: endpoint.SetLimitsResponse{},
+	},
+	{
+		method: "POST", path: QuotePath, id: "quoteTransfer", tag: "transfer",
+		summary:  "Calculate fee and resulting balances of transfer without moving money",
+		request:  endpoint.TransferRequest{},
+		response: endpoint.QuoteResponse{},
+	},
+	{
+		method: "GET", path: FeeSchedulePath, id: "getFeeSchedule", tag: "fee",
+		summary:  "Get fee schedule of currency",
+		response: endpoint.FeeScheduleResponse{},
+	},
+	{
+		method: "PUT", path: FeeSchedulePath, id: "setFeeSchedule", tag: "fee",
+		summary:  "Set fee schedule of currency",
+		request:  repository.FeeSchedule{},
+		response: endpoint.SetFeeScheduleResponse{},
+	},
+	{
+		method: "PUT", path: CreditLimitPath, id: "setCreditLimit", tag: "account",
+		summary:  "Set credit limit (approved overdraft) of account",
+		request:  endpoint.SetCreditLimitRequest{},
+		response: endpoint.SetCreditLimitResponse{},
+	},
+	{
+		method: "PUT", path: FreezePath, id: "freezeAccount", tag: "account",
+		summary:  "Freeze or unfreeze account",
+		request:  endpoint.FreezeRequest{},
+		response: endpoint.FreezeResponse{},
+	},
+	{
+		method: "GET", path: FreezePath, id: "getFreezeHistory", tag: "account",
+		summary:  "Get audit trail of freeze state changes of account",
+		response: endpoint.FreezeHistoryResponse{},
+	},
+	{
+		method: "GET", path: AuditPath, id: "getAuditLog", tag: "audit",
+		summary: "Get page of hash-chained audit log of mutating actions",
+		params: []*openapi.Parameter{
+			queryParam("after", "sequence number of the last record of previous page", integerSchema),
+			queryParam("limit", "maximum number of records", integerSchema),
+		},
+		response: endpoint.AuditLogResponse{},
+	},
+	{
+		method: "GET", path: ExportPath, id: "exportPayments", tag: "payment",
+		summary: "Download payment history as CSV, JSON Lines or OFX statement",
+		params: []*openapi.Parameter{
+			queryParam("format", "export format, OFX requires account",
+				&openapi.Schema{Type: "string", Enum: []string{export.FormatCSV, export.FormatJSONL, export.FormatOFX}}),
+			queryParam("account", "payer or payee of transactions", stringSchema),
+			queryParam("from", "start of date range (inclusive), date or RFC 3339 timestamp", stringSchema),
+			queryParam("to", "end of date range (exclusive), date or RFC 3339 timestamp", stringSchema),
+		},
+		response: media{
+			"text/csv":             "",
+			"application/x-ndjson": export.Record{},
+			"application/x-ofx":    "",
+		},
+	},
+	{
+		method: "POST", path: ImportPath, id: "importAccounts", tag: "account",
+		summary: "Import accounts with opening balances from CSV or JSON Lines file",
+		params: []*openapi.Parameter{
+			queryParam("format", "import format, taken from Content-Type if absent",
+				&openapi.Schema{Type: "string", Enum: []string{importer.FormatCSV, importer.FormatJSONL}}),
+			queryParam("chunk", "number of rows committed at once, all rows are committed together if absent",
+				integerSchema),
+			queryParam("resume", "resume token of report of interrupted import", stringSchema),
+		},
+		request: media{
+			"text/csv":             "",
+			"application/x-ndjson": repository.AccountImport{},
+		},
+		response: endpoint.ImportAccountsResponse{},
+	},
+	{
+		method: "GET", path: BalancePath, id: "getBalanceAt", tag: "account",
+		summary: "Get balance of account at point in time",
+		params: []*openapi.Parameter{
+			queryParam("at", "RFC 3339 timestamp, current time if omitted", &openapi.Schema{Type: "string", Format: "date-time"}),
+		},
+		response: endpoint.BalanceAtResponse{},
+	},
+	{
+		method: "GET", path: CurrenciesPath, id: "getCurrencies", tag: "account",
+		summary:  "List currencies of currency registry",
+		response: endpoint.CurrenciesResponse{},
+	},
+	{
+		method: "GET", path: ActivityPath, id: "streamActivity", tag: "account",
+		summary: "Stream balance changes and payments of wallets of principal as Server-Sent Events " +
+			"or WebSocket messages",
+		response: media{"text/event-stream": activity.Event{}},
+	},
+	{
+		method: "POST", path: PayoutsPath, id: "makePayout", tag: "payout",
+		summary:  "Book payout from account to account of external bank",
+		request:  endpoint.PayoutRequest{},
+		response: endpoint.PayoutResponse{},
+	},
+	{
+		method: "GET", path: PaymentPath, id: "getPayment", tag: "payment",
+		summary: "Get payment history record with its status, and state of payout if it is one",
+		params: []*openapi.Parameter{
+			{Name: "id", In: openapi.InPath, Required: true, Schema: integerSchema},
+		},
+		response: endpoint.PaymentResponse{},
+	},
+}
+
+// pathParamRegexp matches parameters of path templates
+var pathParamRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+// NewOpenAPI returns OpenAPI document of HTTP API. Schemas of bodies are
+// generated from request and response types of endpoints, errors are
+// described by Error response.
+func NewOpenAPI() *openapi.Document {
+	d := openapi.New(openapi.Info{
+		Title:       "Payment System",
+		Description: "Demo payment system, error codes are listed in docs/api.md",
+		Version:     APIVersion,
+	})
+	d.Components.Parameters["Principal"] = &openapi.Parameter{
+		Name: PrincipalHeader, In: openapi.InHeader, Schema: stringSchema,
+		Description: "principal on behalf of which request is made, unless client certificate identifies it",
+	}
+	d.Components.Parameters["RequestID"] = &openapi.Parameter{
+		Name: RequestIDHeader, In: openapi.InHeader, Schema: stringSchema,
+		Description: "ID of request for correlation, generated if absent",
+	}
+	d.Components.Parameters["Consistency"] = &openapi.Parameter{
+		Name: ConsistencyHeader, In: openapi.InHeader,
+		Schema:      &openapi.Schema{Type: "string", Enum: []string{ConsistencyStrong}},
+		Description: "strong to read from primary database (read-your-writes), replica may be used otherwise",
+	}
+	d.Components.Responses["Error"] = &openapi.Response{
+		Description: "error with stable machine code",
+		Content: map[string]*openapi.MediaType{
+			"application/json": {Schema: d.NamedSchema("Error", errorWrapper{})},
+			problemContentType: {Schema: d.NamedSchema("Problem", problem{})},
+		},
+	}
+
+	for _, op := range apiOperations {
+		operation := &openapi.Operation{
+			OperationID: op.id,
+			Summary:     op.summary,
+			Tags:        []string{op.tag},
+			Parameters:  []*openapi.Parameter{openapi.ParameterRef("Principal"), openapi.ParameterRef("RequestID")},
+			Responses: map[string]*openapi.Response{
+				"200":     {Description: "successful operation", Content: content(d, op.response)},
+				"default": openapi.ResponseRef("Error"),
+			},
+		}
+		if op.method == "GET" {
+			operation.Parameters = append(operation.Parameters, openapi.ParameterRef("Consistency"))
+		}
+		for _, match := range pathParamRegexp.FindAllStringSubmatch(op.path, -1) {
+			if param(op.params, match[1]) == nil {
+				operation.Parameters = append(operation.Parameters,
+					&openapi.Parameter{Name: match[1], In: openapi.InPath, Required: true, Schema: stringSchema})
+			}
+		}
+		operation.Parameters = append(operation.Parameters, op.params...)
+		if op.request != nil {
+			operation.RequestBody = &openapi.RequestBody{Required: true, Content: content(d, op.request)}
+		}
+		d.Add(op.method, op.path, operation)
+	}
+	return d
+}
+
+func param(params []*openapi.Parameter, name string) *openapi.Parameter {
+	for _, p := range params {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// content returns content of body of type, which is JSON unless it is media.
+func content(d *openapi.Document, body interface{}) map[string]*openapi.MediaType {
+	m, ok := body.(media)
+	if !ok {
+		return openapi.JSON(d.Schema(body))
+	}
+	c := make(map[string]*openapi.MediaType, len(m))
+	for mediaType, v := range m {
+		c[mediaType] = &openapi.MediaType{Schema: d.Schema(v)}
+	}
+	return c
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// openAPIHandler serves OpenAPI document of HTTP API as JSON.
+func openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(NewOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(openAPIJSON)
+}
+
+// swaggerUIPage is a page of Swagger UI rendering OpenAPI document of the same instance.
+var swaggerUIPage = strings.TrimSpace(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Payment System API</title>
+    <link rel="stylesheet" type="text/css" href="//unpkg.com/swagger-ui-dist@3/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="//unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+<script>
+    SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"})
+</script>
+</body>
+</html>
+`)
+
+// swaggerUIHandler serves Swagger UI of OpenAPI document.
+func swaggerUIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUIPage))
+}
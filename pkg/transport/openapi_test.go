@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	logger := log.NewNopLogger()
+	svc := service.New(inmem.NewInmem(), logger)
+	router := NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger).(*mux.Router)
+
+	// test every route of handler is in document and vice versa
+	undocumented := map[string]bool{"GET " + OpenAPIPath: true, "GET " + DocsPath: true}
+	routes := make([]string, 0)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			if !undocumented[method+" "+path] {
+				routes = append(routes, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := NewOpenAPI().Operations()
+	sort.Strings(routes)
+	sort.Strings(operations)
+	if strings.Join(routes, "\n") != strings.Join(operations, "\n") {
+		t.Errorf("Operations of OpenAPI document:\n%s\nshould match routes:\n%s",
+			strings.Join(operations, "\n"), strings.Join(routes, "\n"))
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	logger := log.NewNopLogger()
+	svc := service.New(inmem.NewInmem(), logger)
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+
+	// test document is served and its references resolve
+	resp, err := http.Get(server.URL + OpenAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components map[string]map[string]json.RawMessage `json:"components"`
+	}
+	if err = json.Unmarshal(body, &doc); err != nil || resp.StatusCode != http.StatusOK || doc.OpenAPI == "" {
+		t.Fatalf("OpenAPI document should be served, got %d %s %v", resp.StatusCode, body, err)
+	}
+	for _, ref := range regexp.MustCompile(`"#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(string(body), -1) {
+		if _, ok := doc.Components[ref[1]][ref[2]]; !ok {
+			t.Errorf("Reference %s should resolve", ref[0])
+		}
+	}
+	var transfer struct {
+		RequestBody struct {
+			Content map[string]struct {
+				Schema struct {
+					Ref string `json:"$ref"`
+				} `json:"schema"`
+			} `json:"content"`
+		} `json:"requestBody"`
+	}
+	_ = json.Unmarshal(doc.Paths[TransferPath]["post"], &transfer)
+	if ref := transfer.RequestBody.Content["application/json"].Schema.Ref; ref != "#/components/schemas/TransferRequest" {
+		t.Errorf("Transfer request should refer TransferRequest schema, got %q", ref)
+	}
+
+	// test Swagger UI is served
+	resp, err = http.Get(server.URL + DocsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "SwaggerUIBundle") {
+		t.Errorf("Swagger UI should be served, got %d %s", resp.StatusCode, body)
+	}
+}
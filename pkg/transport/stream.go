@@ -0,0 +1,247 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+)
+
+// StreamHeartbeat is an interval of keep-alive messages of activity stream,
+// so proxies don't close idle stream.
+var StreamHeartbeat = 15 * time.Second
+
+// streamWriteTimeout limits writing of single message of activity stream.
+const streamWriteTimeout = 10 * time.Second
+
+// eventStreamContentType is a media type of Server-Sent Events.
+const eventStreamContentType = "text/event-stream"
+
+// errCannotHijack is returned by hijack if connection is shared (HTTP/2).
+var errCannotHijack = errors.New("connection can't be taken over")
+
+// activityStream is a connection activity events are pushed to.
+type activityStream interface {
+	// Send writes event to peer.
+	Send(event *activity.Event) error
+	// Ping writes keep-alive message to peer.
+	Ping() error
+	// Done returns channel which is closed when peer goes away.
+	Done() <-chan struct{}
+	// Close ends stream and closes connection.
+	Close() error
+}
+
+// webSocketKeyToContext is a transport/http.RequestFunc that puts
+// Sec-WebSocket-Key of WebSocket upgrade request into context, so response
+// is streamed over WebSocket instead of Server-Sent Events. Primarily useful
+// in a server.
+func webSocketKeyToContext(ctx context.Context, r *http.Request) context.Context {
+	if !isWebSocketUpgrade(r) {
+		return ctx
+	}
+	return context.WithValue(ctx, webSocketKeyContextKey, r.Header.Get("Sec-WebSocket-Key"))
+}
+
+type transportContextKey int
+
+const webSocketKeyContextKey transportContextKey = iota
+
+// encodeHTTPActivityResponse is a transport/http.EncodeResponseFunc that
+// streams events of subscription until it is closed or client goes away.
+// Connection is taken over from HTTP server, so stream is not limited by
+// server timeouts and doesn't delay its shutdown. Primarily useful in a server.
+func encodeHTTPActivityResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(endpoint.ActivityResponse)
+	if resp.Error != nil {
+		errorEncoder(ctx, resp.Error, w)
+		return nil
+	}
+	subscription := resp.Subscription
+	defer subscription.Close()
+	var (
+		stream activityStream
+		err    error
+	)
+	if key, ok := ctx.Value(webSocketKeyContextKey).(string); ok {
+		stream, err = acceptWebSocket(w, key)
+	} else {
+		stream, err = acceptEventStream(ctx, w)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// errors of writing mean that client went away, stream just ends
+	for _, event := range subscription.Snapshot {
+		if stream.Send(event) != nil {
+			return nil
+		}
+	}
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok || stream.Send(event) != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if stream.Ping() != nil {
+				return nil
+			}
+		case <-stream.Done():
+			return nil
+		}
+	}
+}
+
+// hijack takes over connection of HTTP response and writes response header
+// with status into it.
+func hijack(w http.ResponseWriter, status int) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errCannotHijack
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// deadlines set by HTTP server are replaced by ones of every write
+	_ = conn.SetDeadline(time.Time{})
+	_, _ = fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	_ = w.Header().Write(rw)
+	_, _ = rw.WriteString("\r\n")
+	if err = flushConn(conn, rw.Writer); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// flushConn flushes buffered data of connection within streamWriteTimeout.
+func flushConn(conn net.Conn, w *bufio.Writer) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return w.Flush()
+}
+
+// eventStream pushes events as Server-Sent Events: every event is sent as
+// "event: <type>" and "data: <JSON>" lines, keep-alive messages are comments.
+type eventStream struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	flush func() error
+	close func() error
+	done  <-chan struct{}
+}
+
+func acceptEventStream(ctx context.Context, w http.ResponseWriter) (*eventStream, error) {
+	header := w.Header()
+	header.Set("Content-Type", eventStreamContentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	header.Set("Connection", "close")
+	conn, rw, err := hijack(w, http.StatusOK)
+	if err == errCannotHijack {
+		// HTTP/2 connection is shared, so stream is written by HTTP server
+		header.Del("Connection")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, err
+		}
+		w.WriteHeader(http.StatusOK)
+		bw := bufio.NewWriter(w)
+		stream := &eventStream{
+			w:     bw,
+			flush: func() error { err := bw.Flush(); flusher.Flush(); return err },
+			close: func() error { return nil },
+			done:  ctx.Done(),
+		}
+		return stream, stream.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		// client sends nothing, so reading ends once it closes connection
+		_, _ = io.Copy(ioutil.Discard, rw.Reader)
+		close(done)
+	}()
+	return &eventStream{
+		w:     rw.Writer,
+		flush: func() error { return flushConn(conn, rw.Writer) },
+		close: conn.Close,
+		done:  done,
+	}, nil
+}
+
+func (es *eventStream) Send(event *activity.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	_, _ = es.w.WriteString("event: " + event.Type + "\ndata: ")
+	_, _ = es.w.Write(data)
+	_, _ = es.w.WriteString("\n\n")
+	return es.flush()
+}
+
+func (es *eventStream) Ping() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	_, _ = es.w.WriteString(": keep-alive\n\n")
+	return es.flush()
+}
+
+func (es *eventStream) Done() <-chan struct{} {
+	return es.done
+}
+
+func (es *eventStream) Close() error {
+	return es.close()
+}
+
+// readEventStream reads Server-Sent Events of activity stream from r into
+// events until r ends or done is closed. Primarily useful in a client.
+func readEventStream(r io.Reader, events chan<- *activity.Event, done <-chan struct{}) error {
+	scanner := bufio.NewScanner(r)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			event := &activity.Event{}
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), event); err != nil {
+				return err
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return nil
+			}
+			data = data[:0]
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// event type is carried by data, comments and other fields are skipped
+	}
+	return scanner.Err()
+}
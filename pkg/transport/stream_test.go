@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+// newActivityServer returns server of repository with accounts of alice456 and bob123.
+func newActivityServer() (*httptest.Server, service.Service) {
+	repo := inmem.NewInmem()
+	inmemRepo := repo.(*inmem.RepositoryInmem)
+	inmemRepo.InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	inmemRepo.InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	server := httptest.NewUnstartedServer(NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger), nil, logger, trustLoopback()))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	return server, svc
+}
+
+func TestActivityOverHTTP(t *testing.T) {
+	server, svc := newActivityServer()
+	defer server.Close()
+	client, err := NewHTTPClient(server.URL, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = client.Activity(ctx); !errors.Is(err, service.ErrPrincipalRequired) {
+		t.Errorf("Error should be: %v, got %v", service.ErrPrincipalRequired, err)
+	}
+	subscription, err := client.Activity(service.ContextWithPrincipal(ctx, "bob123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+	next := func() *activity.Event {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				t.Fatal("Stream should not be closed")
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event should be streamed")
+		}
+		return nil
+	}
+
+	// test current balance comes first, then changes of transfer
+	if event := next(); event.Type != activity.TypeBalance || event.Balance.Account != "bob123" || event.Balance.Balance != 0 {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	// stream outlives write timeout of server
+	time.Sleep(200 * time.Millisecond)
+	if _, err = svc.Transfer(ctx, "alice456", "bob123", 10, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	var payment *activity.Payment
+	var balance *activity.Balance
+	for payment == nil || balance == nil {
+		switch event := next(); event.Type {
+		case activity.TypePayment:
+			payment = event.Payment
+		case activity.TypeBalance:
+			balance = event.Balance
+		}
+	}
+	if payment.Amount != 10 || payment.Payee != "bob123" || balance.Balance != 10 {
+		t.Errorf("Unexpected payment %+v and balance %+v", payment, balance)
+	}
+}
+
+func TestActivityRequiresAuthenticatedPrincipal(t *testing.T) {
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	logger := log.NewNopLogger()
+	server := httptest.NewServer(NewHTTPHandler(endpoint.New(service.New(repo, logger), endpoint.Limits{}, logger), nil, logger))
+	defer server.Close()
+
+	// test principal header of peer which is not a trusted proxy opens no stream
+	req, _ := http.NewRequest("GET", server.URL+ActivityPath, nil)
+	req.Header.Set(PrincipalHeader, "bob123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Content-Type") == eventStreamContentType {
+		t.Errorf("Status should be: %d, got %d %v", http.StatusUnauthorized, resp.StatusCode, resp.Header)
+	}
+	client, err := NewHTTPClient(server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Activity(service.ContextWithPrincipal(context.Background(), "bob123")); !errors.Is(err, service.ErrPrincipalRequired) {
+		t.Errorf("Error should be: %v, got %v", service.ErrPrincipalRequired, err)
+	}
+}
+
+func TestActivityStreamFallsBack(t *testing.T) {
+	// response which can't be taken over is streamed by HTTP server
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	logger := log.NewNopLogger()
+	handler := NewHTTPHandler(endpoint.New(service.New(repo, logger), endpoint.Limits{}, logger), nil, logger, trustLoopback())
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", ActivityPath, nil).WithContext(ctx)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(PrincipalHeader, "bob123")
+	w := httptest.NewRecorder()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != eventStreamContentType ||
+		w.Body.String() != "event: balance\ndata: {\"type\":\"balance\",\"holders\":[\"bob123\"],"+
+			"\"balance\":{\"account\":\"bob123\",\"holder\":\"bob123\",\"currency\":\"USD\",\"balance\":0}}\n\n" {
+		t.Errorf("Unexpected response %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
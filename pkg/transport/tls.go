@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// ServerTLS keeps TLS configuration of server, which may be reloaded from
+// files at runtime (f.e. on SIGHUP), so certificates are rotated without restart.
+type ServerTLS struct {
+	certFile          string
+	keyFile           string
+	clientCAFile      string
+	requireClientCert bool
+
+	config *tls.Config
+	mutex  sync.RWMutex
+}
+
+// NewServerTLS loads server certificate and key. If clientCAFile is set, client
+// certificates are verified against its bundle: they are required if
+// requireClientCert is true, and verified only if given otherwise.
+func NewServerTLS(certFile, keyFile, clientCAFile string, requireClientCert bool) (*ServerTLS, error) {
+	st := &ServerTLS{
+		certFile:          certFile,
+		keyFile:           keyFile,
+		clientCAFile:      clientCAFile,
+		requireClientCert: requireClientCert,
+	}
+	if err := st.Reload(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Reload reads certificate, key and client CA bundle again. New handshakes use
+// them, established connections are not affected. On error the current
+// configuration is kept.
+func (st *ServerTLS) Reload() error {
+	cert, err := tls.LoadX509KeyPair(st.certFile, st.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if st.clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(st.clientCAFile); err != nil {
+			return err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if st.requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.config = config
+	return nil
+}
+
+// Config returns TLS configuration for listener, which uses the latest loaded files.
+func (st *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			st.mutex.RLock()
+			defer st.mutex.RUnlock()
+			return st.config, nil
+		},
+	}
+}
+
+// ClientTLSConfig returns TLS configuration of client trusting servers signed by
+// CA bundle of caFile (system roots if empty) and presenting certificate for
+// mutual TLS if certFile and keyFile are set.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: %v", file, errNoCertificates)
+	}
+	return pool, nil
+}
+
+var errNoCertificates = errors.New("no certificates found")
@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/khaliullov/payment-system/pkg/endpoint"
+	"github.com/khaliullov/payment-system/pkg/repository"
+	"github.com/khaliullov/payment-system/pkg/repository/inmem"
+	"github.com/khaliullov/payment-system/pkg/service"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payment-system-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeCert(t, dir, "ca", "Test CA", nil, nil)
+	writeCert(t, dir, "server", "127.0.0.1", caCert, caKey)
+	writeCert(t, dir, "client", "operator1", caCert, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	serverTLS, err := NewServerTLS(file("server.crt"), file("server.key"), file("ca.crt"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:  NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger, "operator1"), nil, logger),
+		ErrorLog: stdlog.New(ioutil.Discard, "", 0),
+	}
+	go func() { _ = server.Serve(tls.NewListener(listener, serverTLS.Config())) }()
+	defer server.Close()
+	ctx := context.Background()
+
+	// test principal is taken from client certificate, not from header, and may be admin
+	clientTLS, err := ClientTLSConfig(file("client.crt"), file("client.key"), file("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewHTTPClient(listener.Addr().String(), logger, WithTLS(clientTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetLimits(service.ContextWithPrincipal(ctx, "admin"), &repository.Limits{UserID: "alice456", MaxAmount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := client.AuditLog(ctx, 0, 0)
+	if err != nil || len(records) != 1 || records[0].Actor != "operator1" {
+		t.Errorf("Actor should be: operator1, got %v %v", records, err)
+	}
+
+	// test client without certificate is rejected
+	anonTLS, _ := ClientTLSConfig("", "", file("ca.crt"))
+	client, _ = NewHTTPClient(listener.Addr().String(), logger, WithTLS(anonTLS))
+	if _, err = client.Account(ctx); err == nil {
+		t.Error("Client without certificate should be rejected")
+	}
+
+	// test certificates are reloaded
+	if err = ioutil.WriteFile(file("server.key"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = serverTLS.Reload(); err == nil {
+		t.Error("Broken key should not be loaded")
+	}
+	writeCert(t, dir, "server", "127.0.0.1", caCert, caKey)
+	if err = serverTLS.Reload(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptionalClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payment-system-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeCert(t, dir, "ca", "Test CA", nil, nil)
+	writeCert(t, dir, "server", "127.0.0.1", caCert, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	repo := inmem.NewInmem()
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "alice456", Balance: 100, Currency: "USD"})
+	repo.(*inmem.RepositoryInmem).InsertAccount(&repository.Account{UserID: "bob123", Currency: "USD"})
+	logger := log.NewNopLogger()
+	svc := service.New(repo, logger)
+	serverTLS, err := NewServerTLS(file("server.crt"), file("server.key"), file("ca.crt"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: NewHTTPHandler(endpoint.New(svc, endpoint.Limits{}, logger, "admin"), nil, logger, trustLoopback(),
+			WithClientAuth()),
+		ErrorLog: stdlog.New(ioutil.Discard, "", 0),
+	}
+	go func() { _ = server.Serve(tls.NewListener(listener, serverTLS.Config())) }()
+	defer server.Close()
+
+	// test client without certificate is anonymous, even from trusted proxy
+	anonTLS, _ := ClientTLSConfig("", "", file("ca.crt"))
+	client, err := NewHTTPClient(listener.Addr().String(), logger, WithTLS(anonTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := service.ContextWithPrincipal(context.Background(), "admin")
+	err = client.SetLimits(ctx, &repository.Limits{UserID: "alice456", MaxAmount: 10})
+	if !errors.Is(err, endpoint.ErrAdminRequired) {
+		t.Errorf("Error should be: %v, got %v", endpoint.ErrAdminRequired, err)
+	}
+	if _, err = client.Transfer(ctx, "alice456", "bob123", 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	records, err := svc.AuditLog(context.Background(), 0, 0)
+	if err != nil || len(records) != 1 || records[0].Actor != service.AnonymousPrincipal {
+		t.Errorf("Actor should be: %s, got %v %v", service.AnonymousPrincipal, records, err)
+	}
+}
+
+// writeCert writes certificate and key of name to dir, it is self-signed CA if parent is nil.
+func writeCert(t *testing.T, dir, name, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+)
+
+// Minimal server side of WebSocket protocol (RFC 6455): activity stream only
+// pushes events, so messages of client are read and dropped, except control
+// frames.
+
+// webSocketGUID is appended to key of client to compute accept key of server.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of WebSocket frames.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// Status codes of WebSocket close frames.
+const (
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// wsMaxFrameSize limits size of frame read from client.
+const wsMaxFrameSize = 4096
+
+var (
+	errWebSocketProtocol = errors.New("websocket: protocol error")
+	errFrameTooBig       = errors.New("websocket: frame is too big")
+	errWebSocketClosed   = errors.New("websocket: close frame is sent")
+)
+
+// isWebSocketUpgrade tells whether request asks to switch to WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// validWebSocketUpgrade tells whether WebSocket upgrade request may be accepted.
+func validWebSocketUpgrade(r *http.Request) bool {
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key"))
+	return err == nil && len(key) == 16 && r.Header.Get("Sec-WebSocket-Version") == "13"
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept returns Sec-WebSocket-Accept of key of client.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	_, _ = h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// webSocketStream pushes every event as text message with JSON of event,
+// keep-alive messages are pings.
+type webSocketStream struct {
+	mu     sync.Mutex // serializes writes of frames
+	conn   net.Conn
+	w      *bufio.Writer
+	closed bool // close frame is sent, nothing may follow it
+	done   chan struct{}
+}
+
+func acceptWebSocket(w http.ResponseWriter, key string) (*webSocketStream, error) {
+	header := w.Header()
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", webSocketAccept(key))
+	conn, rw, err := hijack(w, http.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+	ws := &webSocketStream{conn: conn, w: rw.Writer, done: make(chan struct{})}
+	go ws.read(rw.Reader)
+	return ws, nil
+}
+
+func (ws *webSocketStream) Send(event *activity.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, data)
+}
+
+func (ws *webSocketStream) Ping() error {
+	return ws.writeFrame(wsPing, nil)
+}
+
+func (ws *webSocketStream) Done() <-chan struct{} {
+	return ws.done
+}
+
+// Close sends close frame, client should reconnect.
+func (ws *webSocketStream) Close() error {
+	_ = ws.writeFrame(wsClose, closePayload(wsCloseGoingAway))
+	return ws.conn.Close()
+}
+
+// read handles frames of client until it closes connection or violates protocol.
+func (ws *webSocketStream) read(r *bufio.Reader) {
+	defer close(ws.done)
+	for {
+		opcode, payload, err := readFrame(r)
+		switch {
+		case err == errWebSocketProtocol:
+			_ = ws.writeFrame(wsClose, closePayload(wsCloseProtocolError))
+			return
+		case err == errFrameTooBig:
+			_ = ws.writeFrame(wsClose, closePayload(wsCloseTooBig))
+			return
+		case err != nil:
+			return
+		case opcode == wsClose:
+			// echo status code of client
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			_ = ws.writeFrame(wsClose, payload)
+			return
+		case opcode == wsPing:
+			_ = ws.writeFrame(wsPong, payload)
+		}
+	}
+}
+
+// writeFrame writes single unmasked frame with FIN bit set.
+func (ws *webSocketStream) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return errWebSocketClosed
+	}
+	ws.closed = opcode == wsClose
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	_, _ = ws.w.Write(header)
+	_, _ = ws.w.Write(payload)
+	return flushConn(ws.conn, ws.w)
+}
+
+// readFrame reads single frame of client and unmasks its payload, frames
+// bigger than wsMaxFrameSize are rejected.
+func readFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7F)
+	if !masked || opcode >= wsClose && (size > 125 || header[0]&0x80 == 0) {
+		// frames of client are masked, control frames are short and not fragmented
+		return 0, nil, errWebSocketProtocol
+	}
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxFrameSize {
+		return 0, nil, errFrameTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func closePayload(code uint16) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	return payload
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/khaliullov/payment-system/pkg/activity"
+)
+
+func TestActivityOverWebSocket(t *testing.T) {
+	server, _ := newActivityServer()
+	defer server.Close()
+
+	// test malformed upgrade request is rejected
+	req, _ := http.NewRequest("GET", server.URL+ActivityPath, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set(PrincipalHeader, "bob123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status should be: %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// test handshake with sample key of RFC 6455
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET "+ActivityPath+" HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\n"+
+		"Upgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+		PrincipalHeader+": bob123\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// test events are text messages
+	opcode, payload := readServerFrame(t, r)
+	event := &activity.Event{}
+	if err = json.Unmarshal(payload, event); opcode != wsText || err != nil || event.Balance.Account != "bob123" {
+		t.Errorf("Unexpected message %d %s %v", opcode, payload, err)
+	}
+
+	// test ping is answered and close is echoed
+	writeClientFrame(conn, wsPing, []byte("ping"))
+	if opcode, payload = readServerFrame(t, r); opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("Unexpected pong %d %q", opcode, payload)
+	}
+	writeClientFrame(conn, wsClose, closePayload(1000))
+	if opcode, payload = readServerFrame(t, r); opcode != wsClose || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("Unexpected close %d %v", opcode, payload)
+	}
+}
+
+// readServerFrame reads unmasked frame of server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	size := int(header[1] & 0x7F)
+	if size == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			t.Fatal(err)
+		}
+		size = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// writeClientFrame writes short masked frame of client.
+func writeClientFrame(w io.Writer, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, _ = w.Write(frame)
+}
@@ -134,11 +134,14 @@ func (af *apiFeature) theFollowingListExist(tableName string, recordList *gherki
 func (af *apiFeature) iSendRequestTo(_, requestPath string) error {
 	switch requestPath {
 	case transport.AccountPath:
-		var err error
-		af.accounts, err = af.client.Account(context.Background())
+		holders, err := af.client.Account(context.Background())
 		if err != nil {
 			return err
 		}
+		af.accounts = make([]*repository.Account, 0)
+		for _, holder := range holders {
+			af.accounts = append(af.accounts, holder.Wallets...)
+		}
 	case transport.TransactionPath:
 		var err error
 		af.transactions, err = af.client.TransactionHistory(context.Background())
@@ -205,6 +208,10 @@ func (af *apiFeature) outputJSONShouldHaveFieldWithFollowingData(fieldName strin
 				if cell.Value != af.accounts[i-1].UserID {
 					return fmt.Errorf("User Ids are different: %s != %s", cell.Value, af.accounts[i-1].UserID)
 				}
+			case "holder":
+				if cell.Value != af.accounts[i-1].Holder {
+					return fmt.Errorf("Holders are different: %s != %s", cell.Value, af.accounts[i-1].Holder)
+				}
 			case "balance", "amount":
 				value, err := strconv.ParseFloat(cell.Value, 64)
 				if err != nil {
@@ -18,3 +18,16 @@ Feature: accounts
     When I send "GET" request to "/v1/accounts"
     Then output json should have "accounts" field with following data:
       | id       | balance | currency |
+
+  Scenario: list accounts grouped per holder
+    Given the following "account" list exist:
+      | user_id      | holder_id | balance | currency |
+      | bob123       | bob123    | 100.00  | USD      |
+      | alice456     | alice456  | 0.01    | USD      |
+      | alice456:EUR | alice456  | 5.00    | EUR      |
+    When I send "GET" request to "/v1/accounts"
+    Then output json should have "accounts" field with following data:
+      | id           | holder   | balance | currency |
+      | alice456:EUR | alice456 | 5.00    | EUR      |
+      | alice456     | alice456 | 0.01    | USD      |
+      | bob123       | bob123   | 100.00  | USD      |